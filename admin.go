@@ -0,0 +1,409 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// /admin is a dashboard for admins, backed by:
+//
+//	GET   /api/v1/admin/stats             storage usage and counts
+//	GET   /api/v1/admin/uploads?limit=    the latest uploads of everyone,
+//	                                      ?flagged=1 those a scan flagged
+//	GET   /api/v1/admin/users             users with what they store
+//	PATCH /api/v1/admin/users/{id}        {"role": "...", "banned": true, "trash": true}
+//	POST  /api/v1/admin/maintenance       {"task": "gc"|"thumbs"|"places", "regenerate": false}
+//	GET   /api/v1/admin/retention         retention rules and log, see retention.go
+//	GET   /api/v1/admin/review            uploads awaiting review, see moderation.go
+//
+// Banned users can no longer log in and lose their sessions; with "trash"
+// their images go to the trash as well. Content is deleted through the
+// usual image endpoints, which admins may use on any image. Maintenance
+// tasks are the gc, thumbs and places commands, queued as jobs.
+
+const (
+	defaultRecentUploads = 20
+	maxRecentUploads     = 200
+)
+
+var maintenanceTasks = map[string]bool{"gc": true, "thumbs": true, "places": true}
+
+type adminStats struct {
+	Images     usage          `json:"images"`
+	Trash      usage          `json:"trash"`
+	Thumbs     usage          `json:"thumbs"`
+	Processing int            `json:"processing"`
+	Pending    int            `json:"pending"` // awaiting review
+	Flagged    int            `json:"flagged"` // by the content scan
+	Albums     int            `json:"albums"`
+	Users      int            `json:"users"`
+	Banned     int            `json:"banned"`
+	Jobs       map[string]int `json:"jobs"`
+	DiskFree   *uint64        `json:"disk_free,omitempty"` // local storage only
+	Uptime     float64        `json:"uptime_seconds"`
+	Started    time.Time      `json:"started"`
+}
+
+type usage struct {
+	Count int   `json:"count"`
+	Bytes int64 `json:"bytes"`
+}
+
+type adminUser struct {
+	User
+	Images usage `json:"images"`
+}
+
+var startedAt = time.Now()
+
+// isAdmin reports whether the caller may use the dashboard. A gallery
+// without API keys and accounts is open to everyone anyway.
+func isAdmin(r *http.Request) bool {
+	if p, _ := requestPrincipal(r); p.Admin {
+		return true
+	}
+	return len(cfg.APIKeys) == 0 && !cfg.Accounts
+}
+
+// handleAdminPage serves the dashboard. It is only the page; its data
+// comes from the admin API, which checks the caller.
+func handleAdminPage(w http.ResponseWriter, r *http.Request) {
+	tmpl, err := template.ParseFS(templateFS(), "admin.html")
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Admin template", "err", err)
+		http.Error(w, "Template error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	tmpl.Execute(w, struct {
+		Accounts  bool
+		CSRFToken string
+		Base      string
+	}{cfg.Accounts, csrfToken(w, r), cfg.BasePath})
+}
+
+func handleAdmin(w http.ResponseWriter, r *http.Request) {
+	if apiPreamble(w, r) {
+		return
+	}
+	if !isAdmin(r) {
+		writeJSONError(w, "Admins only", http.StatusForbidden)
+		return
+	}
+
+	switch rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/admin"), "/"); {
+	case rest == "stats" && r.Method == "GET":
+		handleAdminStats(w)
+	case rest == "uploads" && r.Method == "GET":
+		handleRecentUploads(w, r)
+	case rest == "users" && r.Method == "GET":
+		handleAdminUsers(w)
+	case strings.HasPrefix(rest, "users/") && r.Method == "PATCH":
+		handleUpdateUser(w, r, strings.TrimPrefix(rest, "users/"))
+	case rest == "maintenance" && r.Method == "POST":
+		handleMaintenance(w, r)
+	case rest == "retention":
+		handleRetention(w, r)
+	case rest == "review" || strings.HasPrefix(rest, "review/"):
+		handleReview(w, r, strings.TrimPrefix(strings.TrimPrefix(rest, "review"), "/"))
+	case rest == "stats" || rest == "uploads" || rest == "users" || rest == "maintenance" || strings.HasPrefix(rest, "users/"):
+		writeJSONError(w, "Unsupported method", http.StatusMethodNotAllowed)
+	default:
+		writeJSONError(w, "Not found", http.StatusNotFound)
+	}
+}
+
+func handleAdminStats(w http.ResponseWriter) {
+	s, err := gatherStats()
+	if err != nil {
+		slog.Error("Could not gather stats", "err", err)
+		writeJSONError(w, "Could not gather stats", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(s)
+}
+
+func gatherStats() (adminStats, error) {
+	s := adminStats{Jobs: map[string]int{}, Started: startedAt.UTC(), Uptime: time.Since(startedAt).Seconds()}
+	counts := []struct {
+		query string
+		dest  []any
+	}{
+		{`SELECT COUNT(*), COALESCE(SUM(size), 0) FROM images WHERE deleted_at = 0`, []any{&s.Images.Count, &s.Images.Bytes}},
+		{`SELECT COUNT(*), COALESCE(SUM(size), 0) FROM images WHERE deleted_at > 0`, []any{&s.Trash.Count, &s.Trash.Bytes}},
+		{`SELECT COUNT(*) FROM images WHERE processing = 1`, []any{&s.Processing}},
+		{`SELECT COUNT(*) FROM images WHERE pending = 1 AND deleted_at = 0`, []any{&s.Pending}},
+		{`SELECT COUNT(*) FROM images WHERE flagged = 1 AND deleted_at = 0`, []any{&s.Flagged}},
+		{`SELECT COUNT(*) FROM albums`, []any{&s.Albums}},
+		{`SELECT COUNT(*), COUNT(NULLIF(banned_at, 0)) FROM users`, []any{&s.Users, &s.Banned}},
+	}
+	for _, c := range counts {
+		if err := db.QueryRow(c.query).Scan(c.dest...); err != nil {
+			return s, err
+		}
+	}
+
+	rows, err := db.Query(`SELECT status, COUNT(*) FROM jobs GROUP BY status`)
+	if err != nil {
+		return s, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var status string
+		var n int
+		if err := rows.Scan(&status, &n); err != nil {
+			return s, err
+		}
+		s.Jobs[status] = n
+	}
+
+	// the cache is only on disk, so it has to be measured there
+	filepath.WalkDir(cfg.ThumbDir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				s.Thumbs.Count++
+				s.Thumbs.Bytes += info.Size()
+			}
+		}
+		return nil
+	})
+	if sr, ok := baseStorage().(spaceReporter); ok {
+		if free, err := sr.FreeSpace(); err == nil {
+			s.DiskFree = &free
+		}
+	}
+	return s, rows.Err()
+}
+
+func handleRecentUploads(w http.ResponseWriter, r *http.Request) {
+	limit := defaultRecentUploads
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxRecentUploads {
+			writeJSONError(w, "limit must be 1-"+strconv.Itoa(maxRecentUploads), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	flagged := r.URL.Query().Get("flagged") == "1"
+	list, err := listImages(listQuery{Limit: limit, Sort: "uploaded", Desc: true, Flagged: flagged})
+	if err != nil {
+		writeJSONError(w, "Could not list images", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]any{"images": list.Images})
+}
+
+func handleAdminUsers(w http.ResponseWriter) {
+	owned := map[string]usage{}
+	rows, err := db.Query(`SELECT owner_id, COUNT(*), COALESCE(SUM(size), 0) FROM images WHERE deleted_at = 0 GROUP BY owner_id`)
+	if err != nil {
+		writeJSONError(w, "Could not list users", http.StatusInternalServerError)
+		return
+	}
+	for rows.Next() {
+		var owner string
+		var u usage
+		if err := rows.Scan(&owner, &u.Count, &u.Bytes); err != nil {
+			rows.Close()
+			writeJSONError(w, "Could not list users", http.StatusInternalServerError)
+			return
+		}
+		owned[owner] = u
+	}
+	rows.Close()
+
+	rows, err = db.Query(`SELECT ` + userColumns + ` FROM users ORDER BY username`)
+	if err != nil {
+		writeJSONError(w, "Could not list users", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	users := []adminUser{}
+	for rows.Next() {
+		u, err := scanUserRow(rows)
+		if err != nil {
+			writeJSONError(w, "Could not list users", http.StatusInternalServerError)
+			return
+		}
+		users = append(users, adminUser{User: u, Images: owned[u.ID]})
+	}
+	json.NewEncoder(w).Encode(map[string]any{"users": users})
+}
+
+type userUpdate struct {
+	Role   *string `json:"role"`
+	Banned *bool   `json:"banned"`
+	Trash  bool    `json:"trash"` // with banned, trash the user's images
+}
+
+func handleUpdateUser(w http.ResponseWriter, r *http.Request, id string) {
+	var req userUpdate
+	if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&req); err != nil {
+		writeJSONError(w, "Expected JSON body with role or banned", http.StatusBadRequest)
+		return
+	}
+	u, err := getUser(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeJSONError(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeJSONError(w, "Could not load user", http.StatusInternalServerError)
+		return
+	}
+	if req.Role != nil && *req.Role != roleAdmin && *req.Role != roleUser {
+		writeJSONError(w, "Role must be admin or user", http.StatusBadRequest)
+		return
+	}
+	demoted := req.Role != nil && *req.Role != roleAdmin
+	banned := req.Banned != nil && *req.Banned
+	if p, _ := requestPrincipal(r); p.UserID == id && (demoted || banned) {
+		writeJSONError(w, "You cannot ban or demote yourself", http.StatusBadRequest)
+		return
+	}
+
+	if req.Role != nil {
+		if _, err := db.Exec(`UPDATE users SET role = ? WHERE id = ?`, *req.Role, id); err != nil {
+			writeJSONError(w, "Could not update user", http.StatusInternalServerError)
+			return
+		}
+	}
+	if req.Banned != nil {
+		var since int64
+		if banned {
+			since = time.Now().UnixNano()
+			if u.Banned != nil {
+				since = u.Banned.UnixNano()
+			}
+		}
+		if _, err := db.Exec(`UPDATE users SET banned_at = ? WHERE id = ?`, since, id); err != nil {
+			writeJSONError(w, "Could not update user", http.StatusInternalServerError)
+			return
+		}
+		if banned {
+			db.Exec(`DELETE FROM user_sessions WHERE user_id = ?`, id)
+			slog.InfoContext(r.Context(), "User banned", "user", u.Username)
+		}
+	}
+	if banned && req.Trash {
+		if err := trashOwnedImages(id); err != nil {
+			slog.ErrorContext(r.Context(), "Could not trash images of banned user", "user", u.Username, "err", err)
+			writeJSONError(w, "User banned, but could not trash their images", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if u, err = getUser(id); err != nil {
+		writeJSONError(w, "Could not load user", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(u)
+}
+
+// trashOwnedImages moves all images of owner into the trash, those
+// awaiting review as well.
+func trashOwnedImages(owner string) error {
+	list, err := listImages(listQuery{Owner: owner})
+	if err != nil {
+		return err
+	}
+	pending, err := listImages(listQuery{Owner: owner, Pending: true})
+	if err != nil {
+		return err
+	}
+	now := time.Now().UnixNano()
+	for _, meta := range append(list.Images, pending.Images...) {
+		if _, err := db.Exec(`UPDATE images SET deleted_at = ? WHERE id = ?`, now, meta.ID); err != nil {
+			return err
+		}
+		notify(webhookEvent{Event: "image.deleted", Image: meta})
+	}
+	return nil
+}
+
+type maintenanceRequest struct {
+	Task       string `json:"task"`
+	Regenerate bool   `json:"regenerate,omitempty"` // thumbs: render all anew
+}
+
+func handleMaintenance(w http.ResponseWriter, r *http.Request) {
+	var req maintenanceRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&req); err != nil || !maintenanceTasks[req.Task] {
+		writeJSONError(w, "Expected JSON body with task gc, thumbs or places", http.StatusBadRequest)
+		return
+	}
+	var pending int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM jobs WHERE kind = ? AND status IN (?, ?)`,
+		req.Task, jobQueued, jobRunning).Scan(&pending); err != nil {
+		writeJSONError(w, "Could not queue task", http.StatusInternalServerError)
+		return
+	}
+	if pending > 0 {
+		writeJSONError(w, "Task is already queued", http.StatusConflict)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeJSONError(w, "Could not queue task", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	id, err := queueJob(tx, req.Task, "", "", req)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		writeJSONError(w, "Could not queue task", http.StatusInternalServerError)
+		return
+	}
+	wakeJobs()
+	j, err := scanJobRow(db.QueryRow(`SELECT `+jobColumns+` FROM jobs WHERE id = ?`, id))
+	if err != nil {
+		writeJSONError(w, "Could not load job", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(j)
+}
+
+// runMaintenance runs a maintenance job queued from the dashboard.
+func runMaintenance(ctx context.Context, j Job) error {
+	var req maintenanceRequest
+	if err := json.Unmarshal([]byte(j.payload), &req); err != nil {
+		return err
+	}
+	switch j.Kind {
+	case "gc":
+		report, err := collectGarbage()
+		if err != nil {
+			return err
+		}
+		slog.Info("Maintenance done", "job", j.ID, "task", j.Kind, "report", report)
+	case "thumbs":
+		rendered, failed, err := renderThumbs(req.Regenerate)
+		if err != nil {
+			return err
+		}
+		slog.Info("Maintenance done", "job", j.ID, "task", j.Kind, "rendered", rendered, "failed", failed)
+	case "places":
+		done, failed, err := geocodePending(ctx)
+		if err != nil {
+			return err
+		}
+		slog.Info("Maintenance done", "job", j.ID, "task", j.Kind, "geocoded", done, "failed", failed)
+	}
+	return nil
+}
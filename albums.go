@@ -0,0 +1,288 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Album groups images; an image can be in any number of albums.
+type Album struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	Count   int       `json:"count"`
+	Owner   string    `json:"owner,omitempty"`
+	Created time.Time `json:"created"`
+
+	Protected bool `json:"protected,omitempty"` // has a password, see gate.go
+	Watermark bool `json:"watermark,omitempty"` // images are watermarked, see watermark.go
+	Source    bool `json:"source,omitempty"`    // mirrors a source folder, see sources.go
+}
+
+// handleAlbums routes the album API:
+//
+//	GET    /api/v1/albums                      list albums
+//	POST   /api/v1/albums                      {"name": "..."} create
+//	GET    /api/v1/albums/{id}                 album with a page of its images
+//	PATCH  /api/v1/albums/{id}                 {"name": "..."} rename
+//	DELETE /api/v1/albums/{id}                 delete (images are kept)
+//	POST   /api/v1/albums/{id}/images          {"ids": [...]} add images
+//	DELETE /api/v1/albums/{id}/images/{image}  remove one image
+//	GET    /api/v1/albums/{id}/archive         download as ZIP, see archive.go
+//	POST   /api/v1/albums/{id}/password        {"password": "..."} protect
+//	DELETE /api/v1/albums/{id}/password        remove the password
+//	POST   /api/v1/albums/{id}/watermark       watermark the images
+//	DELETE /api/v1/albums/{id}/watermark       stop watermarking
+//	GET    /api/v1/albums/{id}/upload-links    guest upload links, see guest.go
+func handleAlbums(w http.ResponseWriter, r *http.Request) {
+	if apiPreamble(w, r) {
+		return
+	}
+
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/albums"), "/")
+	if rest == "" {
+		switch r.Method {
+		case "GET":
+			albums, err := listAlbums(requestViewer(r).ownerFilter())
+			if err != nil {
+				writeJSONError(w, "Could not list albums", http.StatusInternalServerError)
+				return
+			}
+			json.NewEncoder(w).Encode(albums)
+		case "POST":
+			handleCreateAlbum(w, r)
+		default:
+			writeJSONError(w, "Unsupported method", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	parts := strings.SplitN(rest, "/", 3)
+	album, err := getAlbum(parts[0])
+	// visitors let in by the album password may read it, and only that
+	reading := r.Method == "GET" && (len(parts) == 1 || parts[1] == "archive")
+	if err == nil && !requestViewer(r).sees(album.Owner) && !(reading && hasAlbumAccess(r, album.ID)) {
+		err = sql.ErrNoRows
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		writeJSONError(w, "Album not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeJSONError(w, "Could not load album", http.StatusInternalServerError)
+		return
+	}
+	if r.Method == "GET" && !canOpenAlbum(r, album) {
+		writeJSONError(w, "Album is password protected", http.StatusForbidden)
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && r.Method == "GET":
+		handleGetAlbum(w, r, album)
+	case len(parts) == 1 && r.Method == "PATCH":
+		name, ok := readAlbumName(w, r)
+		if !ok {
+			return
+		}
+		if _, err := db.Exec(`UPDATE albums SET name = ? WHERE id = ?`, name, album.ID); err != nil {
+			writeJSONError(w, "Could not rename album", http.StatusInternalServerError)
+			return
+		}
+		album.Name = name
+		json.NewEncoder(w).Encode(album)
+	case len(parts) == 1 && r.Method == "DELETE":
+		if _, err := db.Exec(`DELETE FROM albums WHERE id = ?`, album.ID); err != nil {
+			writeJSONError(w, "Could not delete album", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"success": true, "id": album.ID})
+	case len(parts) == 2 && parts[1] == "images" && r.Method == "POST":
+		handleAddAlbumImages(w, r, album)
+	case len(parts) == 2 && parts[1] == "archive" && r.Method == "GET":
+		handleAlbumArchive(w, r, album)
+	case len(parts) == 2 && parts[1] == "password" && r.Method == "POST":
+		handleSetAlbumPassword(w, r, album)
+	case len(parts) == 2 && parts[1] == "password" && r.Method == "DELETE":
+		if _, err := db.Exec(`UPDATE albums SET password_hash = '' WHERE id = ?`, album.ID); err != nil {
+			writeJSONError(w, "Could not update album", http.StatusInternalServerError)
+			return
+		}
+		db.Exec(`DELETE FROM album_access WHERE album_id = ?`, album.ID)
+		album.Protected = false
+		json.NewEncoder(w).Encode(album)
+	case len(parts) == 2 && parts[1] == "watermark" && (r.Method == "POST" || r.Method == "DELETE"):
+		on := r.Method == "POST"
+		if _, err := db.Exec(`UPDATE albums SET watermark = ? WHERE id = ?`, on, album.ID); err != nil {
+			writeJSONError(w, "Could not update album", http.StatusInternalServerError)
+			return
+		}
+		album.Watermark = on
+		json.NewEncoder(w).Encode(album)
+	case len(parts) >= 2 && parts[1] == "upload-links":
+		id := ""
+		if len(parts) == 3 {
+			id = parts[2]
+		}
+		handleUploadLinks(w, r, album, id)
+	case len(parts) == 3 && parts[1] == "images" && r.Method == "DELETE":
+		if _, err := db.Exec(`DELETE FROM album_images WHERE album_id = ? AND image_id = ?`, album.ID, parts[2]); err != nil {
+			writeJSONError(w, "Could not update album", http.StatusInternalServerError)
+			return
+		}
+		album, _ = getAlbum(album.ID)
+		json.NewEncoder(w).Encode(album)
+	default:
+		writeJSONError(w, "Unsupported method", http.StatusMethodNotAllowed)
+	}
+}
+
+func readAlbumName(w http.ResponseWriter, r *http.Request) (string, bool) {
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&req); err != nil {
+		writeJSONError(w, "Expected JSON body with name", http.StatusBadRequest)
+		return "", false
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		writeJSONError(w, "Album name must not be empty", http.StatusBadRequest)
+		return "", false
+	}
+	return req.Name, true
+}
+
+func handleCreateAlbum(w http.ResponseWriter, r *http.Request) {
+	name, ok := readAlbumName(w, r)
+	if !ok {
+		return
+	}
+	album := Album{ID: randomString(12), Name: name, Owner: requestViewer(r).UserID, Created: time.Now().UTC()}
+	if _, err := db.Exec(`INSERT INTO albums (id, name, owner_id, created_at) VALUES (?, ?, ?, ?)`,
+		album.ID, album.Name, album.Owner, album.Created.UnixNano()); err != nil {
+		writeJSONError(w, "Could not create album", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(album)
+}
+
+func handleGetAlbum(w http.ResponseWriter, r *http.Request, album Album) {
+	q, page, err := parseListQuery(r)
+	if err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	q.Album = album.ID
+	if !hasAlbumAccess(r, album.ID) {
+		// visitors let in by the album password see all of it
+		q.Owner = requestViewer(r).ownerFilter()
+	}
+	list, err := listImages(q)
+	if errors.Is(err, errBadCursor) {
+		writeProblem(w, http.StatusBadRequest, "invalid_cursor", "Invalid cursor", nil)
+		return
+	}
+	if err != nil {
+		writeJSONError(w, "Could not list images", http.StatusInternalServerError)
+		return
+	}
+	list.Page = page
+
+	json.NewEncoder(w).Encode(struct {
+		Album Album `json:"album"`
+		ImageList
+	}{album, list})
+}
+
+func handleAddAlbumImages(w http.ResponseWriter, r *http.Request, album Album) {
+	var req struct {
+		IDs []string `json:"ids"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req); err != nil || len(req.IDs) == 0 {
+		writeJSONError(w, "Expected JSON body with ids", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeJSONError(w, "Could not update album", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	now := time.Now().UnixNano()
+	owner := requestViewer(r).ownerFilter()
+	for _, id := range req.IDs {
+		res, err := tx.Exec(`INSERT OR IGNORE INTO album_images (album_id, image_id, added_at)
+			SELECT ?, id, ? FROM images WHERE id = ? AND (? = '' OR owner_id = ?)`, album.ID, now, id, owner, owner)
+		if err != nil {
+			writeJSONError(w, "Could not update album", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			if _, err := visibleImage(r, id); errors.Is(err, sql.ErrNoRows) {
+				writeJSONError(w, "Image not found: "+id, http.StatusNotFound)
+				return
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		writeJSONError(w, "Could not update album", http.StatusInternalServerError)
+		return
+	}
+
+	album, _ = getAlbum(album.ID)
+	json.NewEncoder(w).Encode(album)
+}
+
+const albumColumns = `a.id, a.name, a.owner_id, a.created_at, a.password_hash != '', a.watermark, a.source != '', (SELECT COUNT(*) FROM album_images ai JOIN images i ON i.id = ai.image_id
+	WHERE ai.album_id = a.id AND i.deleted_at = 0)`
+
+func scanAlbumRow(row rowScanner) (Album, error) {
+	var a Album
+	var created int64
+	if err := row.Scan(&a.ID, &a.Name, &a.Owner, &created, &a.Protected, &a.Watermark, &a.Source, &a.Count); err != nil {
+		return a, err
+	}
+	a.Created = time.Unix(0, created).UTC()
+	return a, nil
+}
+
+func getAlbum(id string) (Album, error) {
+	return scanAlbumRow(db.QueryRow(`SELECT `+albumColumns+` FROM albums a WHERE a.id = ?`, id))
+}
+
+// imageAlbums lists the albums containing an image, restricted to owner
+// unless it is empty.
+func imageAlbums(imageID, owner string) ([]Album, error) {
+	return queryAlbums(`SELECT `+albumColumns+` FROM albums a JOIN album_images ai ON ai.album_id = a.id
+		WHERE ai.image_id = ? AND (? = '' OR a.owner_id = ?) ORDER BY a.name, a.id`, imageID, owner, owner)
+}
+
+// listAlbums lists all albums, or only those of owner if it is not empty.
+func listAlbums(owner string) ([]Album, error) {
+	return queryAlbums(`SELECT `+albumColumns+` FROM albums a WHERE ? = '' OR a.owner_id = ? ORDER BY a.name, a.id`, owner, owner)
+}
+
+func queryAlbums(query string, args ...any) ([]Album, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	albums := []Album{}
+	for rows.Next() {
+		a, err := scanAlbumRow(rows)
+		if err != nil {
+			return nil, err
+		}
+		albums = append(albums, a)
+	}
+	return albums, rows.Err()
+}
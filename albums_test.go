@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestAlbumRoutes(t *testing.T) {
+	testGallery(t)
+	alice, aliceSession := testUser(t, "alice", false)
+	_, bobSession := testUser(t, "bob", false)
+	testAlbum(t, "open", alice, false)
+	testAlbum(t, "locked", alice, true)
+	pass := testAlbumCookie(t, "locked")
+	api := newAPIRouter()
+
+	tests := []struct {
+		name    string
+		method  string
+		target  string
+		cookies []*http.Cookie
+		want    int
+	}{
+		{"owner reads", "GET", "/api/v1/albums/open", []*http.Cookie{aliceSession}, http.StatusOK},
+		{"owner posts to the album", "POST", "/api/v1/albums/open", []*http.Cookie{aliceSession}, http.StatusMethodNotAllowed},
+		{"owner puts to the album", "PUT", "/api/v1/albums/open", []*http.Cookie{aliceSession}, http.StatusMethodNotAllowed},
+		{"owner lists upload links", "GET", "/api/v1/albums/open/upload-links", []*http.Cookie{aliceSession}, http.StatusOK},
+		{"unknown sub-resource", "GET", "/api/v1/albums/open/nothing", []*http.Cookie{aliceSession}, http.StatusMethodNotAllowed},
+		{"unknown album", "GET", "/api/v1/albums/none", []*http.Cookie{aliceSession}, http.StatusNotFound},
+		{"stranger reads", "GET", "/api/v1/albums/open", []*http.Cookie{bobSession}, http.StatusNotFound},
+		{"stranger reads locked", "GET", "/api/v1/albums/locked", []*http.Cookie{bobSession}, http.StatusNotFound},
+		{"album visitor reads", "GET", "/api/v1/albums/locked", []*http.Cookie{bobSession, pass}, http.StatusOK},
+		{"album visitor renames", "PATCH", "/api/v1/albums/locked", []*http.Cookie{bobSession, pass}, http.StatusNotFound},
+		{"album visitor deletes", "DELETE", "/api/v1/albums/locked", []*http.Cookie{bobSession, pass}, http.StatusNotFound},
+		{"album visitor lists upload links", "GET", "/api/v1/albums/locked/upload-links", []*http.Cookie{bobSession, pass}, http.StatusNotFound},
+		{"anonymous", "GET", "/api/v1/albums/open", nil, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serveTest(api, tt.method, tt.target, "", tt.cookies...)
+			if w.Code != tt.want {
+				t.Errorf("%s %s: got %d, want %d: %s", tt.method, tt.target, w.Code, tt.want, w.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// The JSON API lives under /api/v1. The unversioned paths it started out
+// with keep working as a deprecated alias: /api itself is the image list
+// and upload endpoint, now /api/v1/images, and every /api/{rest} is
+// /api/v1/{rest}. Responses through the alias carry a Deprecation header
+// and a Link to the new location.
+const apiV1 = "/api/v1"
+
+// newAPIRouter returns the handler for everything under /api/v1.
+func newAPIRouter() http.Handler {
+	mux := http.NewServeMux()
+	guarded := func(path string, h http.HandlerFunc) { mux.Handle(apiV1+path, requireAuth(h)) }
+	limited := func(path string, h http.HandlerFunc) { mux.Handle(apiV1+path, requireAuth(rateLimit(h))) }
+	uploading := func(path string, h http.HandlerFunc) {
+		mux.Handle(apiV1+path, requireAuth(rateLimit(idempotent(backpressure(trackProgress(h))))))
+	}
+	sending := func(path string, h http.HandlerFunc) {
+		mux.Handle(apiV1+path, requireUploader(rateLimit(backpressure(h))))
+	}
+
+	uploading("/images", handleAPI)
+	image := http.HandlerFunc(handleImage)
+	mux.Handle(apiV1+"/images/", anonymousComments(requireAuth(image), image))
+	guarded("/albums", handleAlbums)
+	guarded("/albums/", handleAlbums)
+	uploading("/upload/", handleRawUpload)
+	uploading("/sharex", handleShareX)
+	sending("/uploads", handleUploadSessions)
+	mux.Handle(apiV1+"/uploads/", requireUploader(backpressure(http.HandlerFunc(handleUploadSessions))))
+	sending("/tus/", handleTus)
+	limited("/trash", handleTrash)
+	guarded("/archive", handleArchive)
+	guarded("/batch", handleBatch)
+	uploading("/import", handleImport)
+	guarded("/events", handleEvents)
+	guarded("/jobs", handleJobs)
+	guarded("/jobs/", handleJobs)
+	guarded("/geo", handleGeo)
+	guarded("/timeline", handleTimeline)
+	guarded("/stats", handleStats)
+	guarded("/duplicates", handleDuplicates)
+	guarded("/search", handleSearch)
+	mux.Handle(apiV1+"/share/", rateLimit(http.HandlerFunc(handleShareQR)))
+	mux.Handle(apiV1+"/captcha", rateLimit(http.HandlerFunc(handleCaptcha)))
+	guarded("/usage", handleUsage)
+	guarded("/users", handleUsers)
+	guarded("/admin/", handleAdmin)
+	mux.Handle(apiV1+"/auth/", rateLimit(http.HandlerFunc(handleAuth)))
+	mux.HandleFunc(apiV1+"/openapi.json", handleOpenAPI)
+	mux.HandleFunc(apiV1+"/docs", handleAPIDocs)
+	mux.HandleFunc(apiV1+"/", func(w http.ResponseWriter, r *http.Request) {
+		apiPreamble(w, r)
+		writeJSONError(w, "Not found", http.StatusNotFound)
+	})
+	return mux
+}
+
+// legacyAPI serves the unversioned /api paths through the v1 router.
+func legacyAPI(v1 http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := apiV1 + strings.TrimPrefix(r.URL.Path, "/api")
+		if r.URL.Path == "/api" {
+			path = apiV1 + "/images"
+		}
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", "<"+sitePath(path)+`>; rel="successor-version"`)
+
+		r2 := r.Clone(r.Context())
+		r2.URL.Path = path
+		r2.URL.RawPath = ""
+		v1.ServeHTTP(w, r2)
+	})
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"archive/zip"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ZIP downloads of several images at once:
+//
+//	GET  /api/v1/albums/{id}/archive  the whole album
+//	POST /api/v1/archive              {"ids": [...]} a selection
+//
+// The archive is written straight to the response, one file at a time, so
+// it never has to fit in memory. Images are stored uncompressed since they
+// are compressed already. Last comes metadata.json with what the gallery
+// knows about each file beyond its bytes: title, description, alt text,
+// tags and custom fields.
+
+const maxArchiveImages = 1000
+
+func handleArchive(w http.ResponseWriter, r *http.Request) {
+	if apiPreamble(w, r) {
+		return
+	}
+	if r.Method != "POST" {
+		writeJSONError(w, "Unsupported method", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		IDs []string `json:"ids"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req); err != nil || len(req.IDs) == 0 {
+		writeJSONError(w, "Expected JSON body with ids", http.StatusBadRequest)
+		return
+	}
+	if len(req.IDs) > maxArchiveImages {
+		writeJSONError(w, fmt.Sprintf("At most %d images per archive", maxArchiveImages), http.StatusBadRequest)
+		return
+	}
+
+	images := make([]ImageMeta, 0, len(req.IDs))
+	seen := map[string]bool{}
+	for _, id := range req.IDs {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		meta, err := visibleImage(r, id)
+		if errors.Is(err, sql.ErrNoRows) || (err == nil && meta.Deleted != nil) {
+			writeJSONError(w, "Image not found: "+id, http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			writeJSONError(w, "Could not load image", http.StatusInternalServerError)
+			return
+		}
+		images = append(images, meta)
+	}
+	writeArchive(w, r, "images.zip", images)
+}
+
+func handleAlbumArchive(w http.ResponseWriter, r *http.Request, album Album) {
+	q := listQuery{Album: album.ID}
+	if !hasAlbumAccess(r, album.ID) {
+		q.Owner = requestViewer(r).ownerFilter()
+	}
+	list, err := listImages(q)
+	if err != nil {
+		writeJSONError(w, "Could not list images", http.StatusInternalServerError)
+		return
+	}
+	writeArchive(w, r, album.Name+".zip", list.Images)
+}
+
+// writeArchive streams images as a ZIP file. Once the first byte is out
+// errors can no longer be reported, so they are logged and the archive is
+// cut short.
+func writeArchive(w http.ResponseWriter, r *http.Request, filename string, images []ImageMeta) {
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+
+	zw := zip.NewWriter(w)
+	names := map[string]int{}
+	entries := make([]archiveEntry, 0, len(images))
+	for _, meta := range images {
+		name := archiveName(names, meta.Name)
+		if err := addToArchive(r, zw, name, meta); err != nil {
+			slog.WarnContext(r.Context(), "Could not write archive", "image", meta.ID, "err", err)
+			return
+		}
+		countView(meta.ID, true)
+		entries = append(entries, archiveEntry{File: name, ID: meta.ID, Title: meta.Title, Description: meta.Description,
+			Alt: meta.Alt, Tags: meta.Tags, Fields: meta.Fields, Taken: meta.Taken, Uploaded: meta.Uploaded})
+	}
+	dst, err := zw.CreateHeader(&zip.FileHeader{Name: archiveName(names, "metadata.json"), Method: zip.Deflate, Modified: time.Now()})
+	if err == nil {
+		enc := json.NewEncoder(dst)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(map[string]any{"images": entries})
+	}
+	if err != nil {
+		slog.WarnContext(r.Context(), "Could not write archive", "err", err)
+		return
+	}
+	if err := zw.Close(); err != nil {
+		slog.WarnContext(r.Context(), "Could not write archive", "err", err)
+	}
+}
+
+// archiveEntry describes a file of an archive in its metadata.json.
+type archiveEntry struct {
+	File        string            `json:"file"`
+	ID          string            `json:"id"`
+	Title       string            `json:"title,omitempty"`
+	Description string            `json:"description,omitempty"`
+	Alt         string            `json:"alt,omitempty"`
+	Tags        []string          `json:"tags"`
+	Fields      map[string]string `json:"fields,omitempty"`
+	Taken       *time.Time        `json:"taken,omitempty"`
+	Uploaded    time.Time         `json:"uploaded"`
+}
+
+func addToArchive(r *http.Request, zw *zip.Writer, name string, meta ImageMeta) error {
+	f, _, err := storage.Open(r.Context(), meta.ID)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	hdr := &zip.FileHeader{Name: name, Method: zip.Store, Modified: meta.Uploaded}
+	if meta.Taken != nil {
+		hdr.Modified = *meta.Taken
+	}
+	dst, err := zw.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, f)
+	return err
+}
+
+// archiveName keeps file names unique within an archive by numbering
+// repeats as "name (2).jpg".
+func archiveName(used map[string]int, name string) string {
+	name = strings.ReplaceAll(name, "/", "_")
+	used[name]++
+	if used[name] == 1 {
+		return name
+	}
+	ext := filepath.Ext(name)
+	for {
+		candidate := fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(name, ext), used[name], ext)
+		if used[candidate] == 0 {
+			used[candidate] = 1
+			return candidate
+		}
+		used[name]++
+	}
+}
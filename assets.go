@@ -0,0 +1,46 @@
+package main
+
+import (
+	"embed"
+	"errors"
+	"io/fs"
+	"os"
+)
+
+// The web UI (templates/ and static/) is built into the binary,
+// so it runs on its own. Files in cfg.TemplateDir and cfg.StaticDir take
+// precedence over the built in ones of the same name, which allows
+// customizing single files without rebuilding.
+
+//go:embed templates/index.html templates/admin.html templates/map.html static
+var embeddedAssets embed.FS
+
+// overlayFS serves files from dir, falling back to base for those it does
+// not have.
+type overlayFS struct {
+	dir  string
+	base fs.FS
+}
+
+func (o overlayFS) Open(name string) (fs.File, error) {
+	if o.dir != "" {
+		f, err := os.DirFS(o.dir).Open(name)
+		if err == nil || !errors.Is(err, fs.ErrNotExist) {
+			return f, err
+		}
+	}
+	return o.base.Open(name)
+}
+
+func assetFS(dir, embedded string) fs.FS {
+	sub, err := fs.Sub(embeddedAssets, embedded)
+	if err != nil {
+		// the embedded directories are fixed at build time
+		panic(err)
+	}
+	return overlayFS{dir: dir, base: sub}
+}
+
+func templateFS() fs.FS { return assetFS(cfg.TemplateDir, "templates") }
+
+func staticFS() fs.FS { return assetFS(cfg.StaticDir, "static") }
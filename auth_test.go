@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestProtectReadsPages(t *testing.T) {
+	testGallery(t)
+	cfg.Accounts = false
+	cfg.ProtectReads = true
+	cfg.APIKeys = apiKeys{"phone": "secret"}
+	testImage(t, "a.png", "")
+	if err := os.WriteFile(filepath.Join(cfg.UploadDir, "a.png"), []byte("png"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for path, h := range map[string]http.HandlerFunc{"/": handleIndex, "/uploads/a.png": handleOriginal} {
+		w := serveTest(h, "GET", path, "")
+		if w.Code == http.StatusOK {
+			t.Errorf("anonymous GET %s: got 200", path)
+		}
+	}
+	r := httptest.NewRequest("GET", "/uploads/a.png", nil)
+	r.Header.Set("X-API-Key", "secret")
+	w := httptest.NewRecorder()
+	handleOriginal(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("GET /uploads/a.png with a key: got %d, want 200", w.Code)
+	}
+}
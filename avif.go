@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Go has no AVIF or JPEG XL encoder, so the gallery can hand renditions to
+// libavif's avifenc (cfg.AVIFEnc) and libjxl's cjxl (cfg.CJXL). With one
+// configured, /img/ takes format=avif or format=jxl, and renditions that
+// do not ask for a format are negotiated from the Accept header: JPEG XL
+// first, then AVIF, else the usual JPEG or PNG. Those responses carry
+// Vary: Accept.
+
+const encodeTimeout = time.Minute
+
+// negotiable are the formats offered by Accept, best first.
+var negotiable = []struct{ format, mime string }{
+	{"jxl", "image/jxl"},
+	{"avif", "image/avif"},
+}
+
+// setupEncoders registers the encoders whose commands are there.
+func setupEncoders(c Config) {
+	for _, e := range []struct{ format, command, ext, mime string }{
+		{"avif", c.AVIFEnc, ".avif", "image/avif"},
+		{"jxl", c.CJXL, ".jxl", "image/jxl"},
+	} {
+		delete(encoders, e.format)
+		if e.command == "" {
+			continue
+		}
+		path, err := exec.LookPath(e.command)
+		if err != nil {
+			slog.Warn("Encoder not available", "format", e.format, "err", err)
+			continue
+		}
+		encoders[e.format] = imageEncoder{ext: e.ext, mime: e.mime, lossy: true, encode: commandEncoder(e.format, path)}
+	}
+}
+
+// commandEncoder encodes through avifenc or cjxl, which work on files: the
+// image goes in as PNG and comes back in the target format.
+func commandEncoder(format, command string) func(io.Writer, image.Image, int) error {
+	return func(w io.Writer, img image.Image, quality int) error {
+		dir, err := os.MkdirTemp(cfg.sessionDir(), ".encode-*")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		in, out := filepath.Join(dir, "in.png"), filepath.Join(dir, "out."+format)
+		f, err := os.Create(in)
+		if err != nil {
+			return err
+		}
+		err = png.Encode(f, img)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), encodeTimeout)
+		defer cancel()
+		q := strconv.Itoa(quality)
+		var cmd *exec.Cmd
+		if format == "jxl" {
+			cmd = exec.CommandContext(ctx, command, "-q", q, in, out)
+		} else {
+			cmd = exec.CommandContext(ctx, command, "-q", q, "-s", "6", in, out)
+		}
+		if output, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("%s: %w: %s", command, err, strings.TrimSpace(string(output)))
+		}
+		res, err := os.Open(out)
+		if err != nil {
+			return err
+		}
+		defer res.Close()
+		_, err = io.Copy(w, res)
+		return err
+	}
+}
+
+// negotiateFormat returns the best format r accepts in place of format,
+// for renditions that did not ask for one.
+func negotiateFormat(w http.ResponseWriter, r *http.Request, format string) string {
+	chosen, offered := format, false
+	for _, n := range negotiable {
+		if _, ok := encoders[n.format]; !ok {
+			continue
+		}
+		offered = true
+		if chosen == format && acceptsType(r.Header.Get("Accept"), n.mime) {
+			chosen = n.format
+		}
+	}
+	if offered {
+		w.Header().Add("Vary", "Accept")
+	}
+	return chosen
+}
+
+// acceptsType reports whether the Accept header lists mime with a quality
+// above zero. Wildcards do not count: browsers send */* for images they
+// could not show.
+func acceptsType(accept, mime string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		typ, params, _ := strings.Cut(part, ";")
+		if !strings.EqualFold(strings.TrimSpace(typ), mime) {
+			continue
+		}
+		for _, p := range strings.Split(params, ";") {
+			if k, v, ok := strings.Cut(strings.TrimSpace(p), "="); ok && k == "q" {
+				if q, err := strconv.ParseFloat(v, 64); err == nil && q == 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
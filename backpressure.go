@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// Bursts of uploads are turned away before they pile up: at most
+// cfg.UploadConcurrency requests may send files at once, each holding a
+// connection, a staging file and buffers, and while cfg.MaxQueuedJobs
+// uploads wait for the background workers new ones are refused too.
+// Either answers 503 with Retry-After, which clients retry like 429.
+
+const (
+	uploadSlotRetry = 5  // seconds
+	jobQueueRetry   = 30 // seconds
+)
+
+var uploadSlots chan struct{}
+
+// setupBackpressure sizes the upload slots from cfg.
+func setupBackpressure() {
+	if cfg.UploadConcurrency > 0 {
+		uploadSlots = make(chan struct{}, cfg.UploadConcurrency)
+	}
+}
+
+// backpressure holds the requests of h that send files to the limits.
+func backpressure(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" && r.Method != "PUT" && r.Method != "PATCH" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if cfg.MaxQueuedJobs > 0 && queuedJobs() >= cfg.MaxQueuedJobs {
+			busy(w, r, jobQueueRetry, "Too many uploads waiting to be processed, try again later")
+			return
+		}
+		if uploadSlots != nil {
+			select {
+			case uploadSlots <- struct{}{}:
+				defer func() { <-uploadSlots }()
+			default:
+				busy(w, r, uploadSlotRetry, "Too many uploads at once, try again later")
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func busy(w http.ResponseWriter, r *http.Request, retry int, msg string) {
+	w.Header().Set("Retry-After", strconv.Itoa(retry))
+	apiPreamble(w, r)
+	writeJSONError(w, msg, http.StatusServiceUnavailable)
+}
+
+// queuedJobs counts the upload processing jobs not yet run.
+func queuedJobs() int {
+	var n int
+	db.QueryRow(`SELECT COUNT(*) FROM jobs WHERE status = ? AND kind = 'process'`, jobQueued).Scan(&n)
+	return n
+}
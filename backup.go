@@ -0,0 +1,337 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// A backup is a gzipped tarball of
+//
+//	manifest.json   what is in it, see backupManifest
+//	gallery.db      a snapshot of the index: images, albums, users, shares...
+//	originals/...   every file in storage, HEIC originals included
+//
+// Cached thumbnails are left out; the server renders them again. Backups
+// are written to a file, to stdout ("-") or to s3://bucket/key on the
+// configured S3 endpoint, and restore reads them from the same places:
+//
+//	backup [-o gallery.tar.gz]
+//	restore [-force] <backup>
+//
+// restore rebuilds an empty instance; -force restores over an existing
+// one, replacing its index.
+
+const backupFormat = 1
+
+type backupManifest struct {
+	Format   int       `json:"format"`
+	Schema   int       `json:"schema"` // migrations applied to gallery.db
+	Created  time.Time `json:"created"`
+	Images   int       `json:"images"`
+	Files    int       `json:"files"`
+	Bytes    int64     `json:"bytes"`
+	Storage  string    `json:"storage"`
+	Accounts bool      `json:"accounts"`
+}
+
+func runBackup(name string, args []string) error {
+	out := "gallery-" + time.Now().Format("20060102-150405") + ".tar.gz"
+	if _, err := openGallery(name, args, func(fs *flag.FlagSet) {
+		fs.StringVar(&out, "o", out, "backup file, - for stdout or s3://bucket/key")
+	}); err != nil {
+		return err
+	}
+	defer db.Close()
+	maintenance()
+
+	report := os.Stdout
+	if out == "-" {
+		report = os.Stderr
+	}
+	var m backupManifest
+	err := withBackupWriter(out, func(w io.Writer) error {
+		var err error
+		m, err = writeBackup(context.Background(), w)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(report, "backed up %d images, %d files (%s) to %s\n", m.Images, m.Files, formatMB(m.Bytes), out)
+	return nil
+}
+
+// withBackupWriter runs write with a writer going to out.
+func withBackupWriter(out string, write func(io.Writer) error) error {
+	if out == "-" {
+		return write(os.Stdout)
+	}
+	if bucket, key, ok := s3Location(out); ok {
+		client, err := newS3Client(cfg)
+		if err != nil {
+			return err
+		}
+		pr, pw := io.Pipe()
+		go func() { pw.CloseWithError(write(pw)) }()
+		// the size is not known up front, so it goes up in parts
+		_, err = client.PutObject(context.Background(), bucket, key, pr, -1, minio.PutObjectOptions{ContentType: "application/gzip"})
+		pr.CloseWithError(err)
+		return err
+	}
+	f, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		os.Remove(out)
+		return err
+	}
+	return f.Close()
+}
+
+// openBackup opens a backup for reading from a file, stdin or S3.
+func openBackup(src string) (io.ReadCloser, error) {
+	if src == "-" {
+		return io.NopCloser(os.Stdin), nil
+	}
+	if bucket, key, ok := s3Location(src); ok {
+		client, err := newS3Client(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return client.GetObject(context.Background(), bucket, key, minio.GetObjectOptions{})
+	}
+	return os.Open(src)
+}
+
+// s3Location splits s3://bucket/key.
+func s3Location(s string) (string, string, bool) {
+	rest, ok := strings.CutPrefix(s, "s3://")
+	if !ok {
+		return "", "", false
+	}
+	bucket, key, _ := strings.Cut(rest, "/")
+	return bucket, key, bucket != "" && key != ""
+}
+
+// backupObjects lists what storage holds of the gallery, leaving out the
+// index and scratch files that share the upload directory, and the source
+// directories, which are not the gallery's.
+func backupObjects(ctx context.Context) ([]ObjectInfo, error) {
+	objects, err := storage.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var kept []ObjectInfo
+	for _, obj := range objects {
+		if !strings.HasPrefix(obj.Name, ".") && !isSourceFile(obj.Name) {
+			kept = append(kept, obj)
+		}
+	}
+	return kept, nil
+}
+
+func writeBackup(ctx context.Context, w io.Writer) (backupManifest, error) {
+	m := backupManifest{Format: backupFormat, Created: time.Now().UTC(), Storage: cfg.Storage, Accounts: cfg.Accounts}
+	if err := db.QueryRow(`PRAGMA user_version`).Scan(&m.Schema); err != nil {
+		return m, err
+	}
+	if err := db.QueryRow(`SELECT COUNT(*) FROM images`).Scan(&m.Images); err != nil {
+		return m, err
+	}
+	objects, err := backupObjects(ctx)
+	if err != nil {
+		return m, err
+	}
+	m.Files = len(objects)
+	for _, obj := range objects {
+		m.Bytes += obj.Size
+	}
+
+	// VACUUM INTO makes a consistent copy without stopping anyone
+	snapshot := filepath.Join(cfg.sessionDir(), ".backup-"+randomString(8)+".db")
+	if _, err := db.Exec(`VACUUM INTO ?`, snapshot); err != nil {
+		return m, fmt.Errorf("snapshot index: %w", err)
+	}
+	defer os.Remove(snapshot)
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	manifest, _ := json.MarshalIndent(m, "", "  ")
+	if err := writeTarEntry(tw, "manifest.json", int64(len(manifest)), m.Created, strings.NewReader(string(manifest))); err != nil {
+		return m, err
+	}
+	f, err := os.Open(snapshot)
+	if err != nil {
+		return m, err
+	}
+	info, err := f.Stat()
+	if err == nil {
+		err = writeTarEntry(tw, "gallery.db", info.Size(), m.Created, f)
+	}
+	f.Close()
+	if err != nil {
+		return m, err
+	}
+	for _, obj := range objects {
+		r, info, err := storage.Open(ctx, obj.Name)
+		if err != nil {
+			return m, fmt.Errorf("%s: %w", obj.Name, err)
+		}
+		err = writeTarEntry(tw, "originals/"+obj.Name, info.Size, info.ModTime, r)
+		r.Close()
+		if err != nil {
+			return m, fmt.Errorf("%s: %w", obj.Name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return m, err
+	}
+	return m, gz.Close()
+}
+
+func writeTarEntry(tw *tar.Writer, name string, size int64, mod time.Time, r io.Reader) error {
+	// PAX keeps the modification times exact; the index compares them
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: size, ModTime: mod, Format: tar.FormatPAX}); err != nil {
+		return err
+	}
+	_, err := io.CopyN(tw, r, size)
+	return err
+}
+
+func runRestore(name string, args []string) error {
+	var force bool
+	rest, err := openUnsynced(name, args, func(fs *flag.FlagSet) {
+		fs.BoolVar(&force, "force", false, "restore over a gallery that is not empty")
+	})
+	if err != nil {
+		return err
+	}
+	defer func() { db.Close() }()
+	maintenance()
+	if len(rest) != 1 {
+		return errors.New("expected the backup to restore")
+	}
+
+	ctx := context.Background()
+	if !force {
+		var images int
+		if err := db.QueryRow(`SELECT COUNT(*) FROM images`).Scan(&images); err != nil {
+			return err
+		}
+		objects, err := backupObjects(ctx)
+		if err != nil {
+			return err
+		}
+		if images > 0 || len(objects) > 0 {
+			return errors.New("the gallery is not empty; restore into a fresh instance or use -force")
+		}
+	}
+
+	src, err := openBackup(rest[0])
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	m, err := readBackup(ctx, src)
+	if err != nil {
+		return err
+	}
+	// the restored index may predate migrations; reopening applies them
+	if err := openStore(cfg.DBPath); err != nil {
+		return fmt.Errorf("open restored index: %w", err)
+	}
+	if err := syncStore(); err != nil {
+		return fmt.Errorf("sync restored index: %w", err)
+	}
+	fmt.Printf("restored %d images, %d files (%s) from a backup of %s\n",
+		m.Images, m.Files, formatMB(m.Bytes), m.Created.Local().Format(time.DateTime))
+	return nil
+}
+
+// readBackup unpacks a backup: the index replaces cfg.DBPath, the
+// originals go to storage. The index is closed while that happens.
+func readBackup(ctx context.Context, src io.Reader) (backupManifest, error) {
+	var m backupManifest
+	gz, err := gzip.NewReader(src)
+	if err != nil {
+		return m, fmt.Errorf("not a backup: %w", err)
+	}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return m, err
+		}
+		switch dir, file := path.Split(hdr.Name); {
+		case hdr.Name == "manifest.json":
+			if err := json.NewDecoder(tr).Decode(&m); err != nil {
+				return m, fmt.Errorf("manifest: %w", err)
+			}
+			if m.Format != backupFormat {
+				return m, fmt.Errorf("unsupported backup format %d", m.Format)
+			}
+			if m.Schema > len(migrations) {
+				return m, errors.New("the backup is from a newer version of the gallery")
+			}
+		case m.Format == 0:
+			return m, errors.New("not a backup: manifest.json must come first")
+		case hdr.Name == "gallery.db":
+			if err := restoreIndex(tr); err != nil {
+				return m, fmt.Errorf("restore index: %w", err)
+			}
+		case dir == "originals/" && file != "" && !strings.HasPrefix(file, "."):
+			if err := storage.Put(ctx, file, tr, hdr.Size, mime.TypeByExtension(filepath.Ext(file))); err != nil {
+				return m, fmt.Errorf("%s: %w", file, err)
+			}
+			if l, ok := baseStorage().(localStorage); ok {
+				// unchanged times spare the sync from reading every file
+				os.Chtimes(l.path(file), hdr.ModTime, hdr.ModTime)
+			}
+		}
+	}
+	if m.Format == 0 {
+		return m, errors.New("not a backup: no manifest.json")
+	}
+	return m, nil
+}
+
+// restoreIndex replaces the index with the snapshot read from r.
+func restoreIndex(r io.Reader) error {
+	db.Close()
+	tmp := cfg.DBPath + ".restore"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	// the journal of the old index must not be applied to the new one
+	os.Remove(cfg.DBPath + "-wal")
+	os.Remove(cfg.DBPath + "-shm")
+	return os.Rename(tmp, cfg.DBPath)
+}
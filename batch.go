@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// POST /api/v1/batch runs one operation on many images at once:
+//
+//	{"op": "delete", "ids": [...], "permanent": false}
+//	{"op": "tag", "ids": [...], "tags": [...]}
+//	{"op": "move-to-album", "ids": [...], "album": "...", "from": "..."}
+//	{"op": "strip-exif", "ids": [...]}
+//
+// It is all or nothing: every image is checked first, and if any of them
+// cannot take the operation, nothing is changed and the per-item report
+// says why. Otherwise the database changes are made in one transaction and
+// files (purged or stripped originals) are only touched once it has been
+// committed. "from" is optional; without it images are added to the album
+// and stay in the others.
+
+const maxBatchImages = 1000
+
+type batchRequest struct {
+	Op        string   `json:"op"`
+	IDs       []string `json:"ids"`
+	Tags      []string `json:"tags,omitempty"`
+	Album     string   `json:"album,omitempty"`
+	From      string   `json:"from,omitempty"`
+	Permanent bool     `json:"permanent,omitempty"`
+}
+
+type batchResult struct {
+	ID      string `json:"id"`
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+}
+
+type batchResponse struct {
+	Success bool          `json:"success"`
+	Op      string        `json:"op"`
+	Results []batchResult `json:"results"`
+}
+
+// batchItem is an image the operation applies to, with what it needs to
+// finish after the commit.
+type batchItem struct {
+	meta      ImageMeta
+	permanent bool   // delete: purge instead of trashing
+	stripped  string // strip-exif: scratch copy without metadata
+}
+
+func handleBatch(w http.ResponseWriter, r *http.Request) {
+	if apiPreamble(w, r) {
+		return
+	}
+	if r.Method != "POST" {
+		writeJSONError(w, "Unsupported method", http.StatusMethodNotAllowed)
+		return
+	}
+	var req batchRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req); err != nil || len(req.IDs) == 0 {
+		writeJSONError(w, "Expected JSON body with op and ids", http.StatusBadRequest)
+		return
+	}
+	if len(req.IDs) > maxBatchImages {
+		writeJSONError(w, fmt.Sprintf("At most %d images per batch", maxBatchImages), http.StatusBadRequest)
+		return
+	}
+
+	var tags []string
+	var album, from Album
+	switch req.Op {
+	case "delete", "strip-exif":
+	case "tag":
+		if len(req.Tags) == 0 {
+			writeJSONError(w, "Expected tags", http.StatusBadRequest)
+			return
+		}
+		for _, t := range req.Tags {
+			tag := normalizeTag(t)
+			if tag == "" {
+				writeJSONError(w, "Invalid tag: "+t, http.StatusBadRequest)
+				return
+			}
+			tags = append(tags, tag)
+		}
+	case "move-to-album":
+		var ok bool
+		if album, ok = batchAlbum(w, r, req.Album); !ok {
+			return
+		}
+		if req.From != "" {
+			if from, ok = batchAlbum(w, r, req.From); !ok {
+				return
+			}
+		}
+	default:
+		writeJSONError(w, "Unknown op: "+req.Op, http.StatusBadRequest)
+		return
+	}
+
+	// check every image first
+	items := make([]batchItem, 0, len(req.IDs))
+	results := make([]batchResult, 0, len(req.IDs))
+	seen := map[string]bool{}
+	failed := false
+	for _, id := range req.IDs {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		item, msg := prepareBatchItem(r, req, id)
+		if msg != "" {
+			failed = true
+			results = append(results, batchResult{ID: id, Error: msg})
+			continue
+		}
+		items = append(items, item)
+		results = append(results, batchResult{ID: id, Success: true})
+	}
+	defer func() {
+		for _, it := range items {
+			if it.stripped != "" {
+				os.Remove(it.stripped)
+			}
+		}
+	}()
+	if failed {
+		// nothing has been done, so nothing has succeeded
+		for i := range results {
+			if results[i].Success {
+				results[i] = batchResult{ID: results[i].ID, Error: "Not applied"}
+			}
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(batchResponse{Op: req.Op, Results: results})
+		return
+	}
+
+	if err := commitBatch(req, items, tags, album, from); err != nil {
+		slog.ErrorContext(r.Context(), "Batch failed", "op", req.Op, "err", err)
+		writeJSONError(w, "Could not apply batch", http.StatusInternalServerError)
+		return
+	}
+	finishBatch(r.Context(), req, items, results)
+
+	resp := batchResponse{Success: true, Op: req.Op, Results: results}
+	for _, res := range results {
+		resp.Success = resp.Success && res.Success
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// batchAlbum loads an album the caller may change, writing the error if
+// there is none.
+func batchAlbum(w http.ResponseWriter, r *http.Request, id string) (Album, bool) {
+	if id == "" {
+		writeJSONError(w, "Expected album", http.StatusBadRequest)
+		return Album{}, false
+	}
+	album, err := getAlbum(id)
+	if err == nil && !requestViewer(r).sees(album.Owner) {
+		err = sql.ErrNoRows
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		writeJSONError(w, "Album not found: "+id, http.StatusNotFound)
+		return album, false
+	}
+	if err != nil {
+		writeJSONError(w, "Could not load album", http.StatusInternalServerError)
+		return album, false
+	}
+	return album, true
+}
+
+// prepareBatchItem checks that the operation can be applied to image id.
+// If not, it returns the message for the report.
+func prepareBatchItem(r *http.Request, req batchRequest, id string) (batchItem, string) {
+	meta, err := visibleImage(r, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return batchItem{}, "Image not found"
+	}
+	if err != nil {
+		return batchItem{}, "Could not load image"
+	}
+	item := batchItem{meta: meta}
+	if req.Op == "delete" {
+		// deleting from the trash empties it for this image
+		item.permanent = req.Permanent || meta.Deleted != nil || cfg.TrashRetention <= 0
+		return item, ""
+	}
+	if meta.Deleted != nil {
+		return item, "Image is in the trash"
+	}
+	if req.Op == "strip-exif" {
+		if item.stripped, err = strippedCopy(r.Context(), meta); err != nil {
+			slog.WarnContext(r.Context(), "Could not strip metadata", "image", id, "err", err)
+			return item, "Could not strip metadata"
+		}
+	}
+	return item, ""
+}
+
+// strippedCopy writes the original of meta without metadata to a scratch
+// file and returns its path.
+func strippedCopy(ctx context.Context, meta ImageMeta) (string, error) {
+	src, _, err := storage.Open(ctx, meta.ID)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	tmp, err := os.CreateTemp(cfg.sessionDir(), ".strip-*")
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(tmp, src)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = stripFileMetadata(tmp.Name(), meta.Mime)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
+
+// commitBatch makes the database changes of a batch in one transaction.
+func commitBatch(req batchRequest, items []batchItem, tags []string, album, from Album) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	now := time.Now().UnixNano()
+	for _, it := range items {
+		id := it.meta.ID
+		switch req.Op {
+		case "delete":
+			// purged images lose their row along with the file afterwards
+			if !it.permanent {
+				_, err = tx.Exec(`UPDATE images SET deleted_at = ? WHERE id = ?`, now, id)
+			}
+		case "tag":
+			for _, tag := range tags {
+				if _, err = tx.Exec(`INSERT OR IGNORE INTO image_tags (image_id, tag) VALUES (?, ?)`, id, tag); err != nil {
+					break
+				}
+			}
+		case "move-to-album":
+			_, err = tx.Exec(`INSERT OR IGNORE INTO album_images (album_id, image_id, added_at) VALUES (?, ?, ?)`, album.ID, id, now)
+			if err == nil && from.ID != "" && from.ID != album.ID {
+				_, err = tx.Exec(`DELETE FROM album_images WHERE album_id = ? AND image_id = ?`, from.ID, id)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// finishBatch does the file work of a committed batch and sends the
+// events. Failures here can no longer be rolled back; they are reported
+// per item.
+func finishBatch(ctx context.Context, req batchRequest, items []batchItem, results []batchResult) {
+	fail := func(id, msg string) {
+		for i := range results {
+			if results[i].ID == id {
+				results[i] = batchResult{ID: id, Error: msg}
+			}
+		}
+	}
+	for _, it := range items {
+		id := it.meta.ID
+		switch req.Op {
+		case "delete":
+			if it.permanent {
+				if err := purgeImage(ctx, id); err != nil {
+					slog.WarnContext(ctx, "Could not purge image", "image", id, "err", err)
+					fail(id, "Could not delete image")
+					continue
+				}
+			}
+			notify(webhookEvent{Event: "image.deleted", Image: it.meta, Permanent: it.permanent})
+		case "tag":
+			notifyImage("image.tagged", id)
+		case "strip-exif":
+			if err := storeLocalFile(ctx, it.stripped, id, it.meta.Mime); err != nil {
+				slog.WarnContext(ctx, "Could not store stripped image", "image", id, "err", err)
+				fail(id, "Could not strip metadata")
+				continue
+			}
+			// the HEIC original has all the metadata still
+			storage.Delete(ctx, heicOriginalName(id))
+			os.RemoveAll(filepath.Join(cfg.ThumbDir, id))
+			if _, err := indexImage(ctx, id, it.meta.Uploaded, ""); err != nil {
+				slog.WarnContext(ctx, "Could not reindex image", "image", id, "err", err)
+			}
+		}
+	}
+}
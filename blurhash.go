@@ -0,0 +1,136 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"log/slog"
+	"math"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+// Every image gets a BlurHash (https://blurha.sh), a short string that
+// front-ends decode into a blurred color preview to show while the real
+// image loads. It is computed from a tiny copy of the image when it is
+// indexed, videos from their poster frame.
+
+// tinySize is the longer side of the copy placeholders and colors are
+// computed from; neither needs any detail.
+const tinySize = 32
+
+const base83 = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// indexColors fills in the BlurHash, palette, focus point and perceptual
+// hash of meta from the stored file. They are left empty when it cannot be
+// decoded.
+func indexColors(meta *ImageMeta) {
+	img, err := decodeStored(meta.ID)
+	if err != nil {
+		slog.Debug("No placeholder", "image", meta.ID, "err", err)
+		return
+	}
+	b := img.Bounds()
+	w, h := fitSize(b.Dx(), b.Dy(), tinySize, tinySize)
+	small := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(small, small.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.ApproxBiLinear.Scale(small, small.Bounds(), img, b, draw.Over, nil)
+
+	// four components along the longer side, three along the other
+	xc, yc := 4, 3
+	if h > w {
+		xc, yc = 3, 4
+	}
+	meta.Blurhash = blurhash(small, xc, yc)
+	meta.Palette = palette(small, paletteSize)
+	meta.Color = meta.Palette[0]
+	fx, fy := focusPoint(img)
+	meta.Focus = []float64{fx, fy}
+	meta.PHash = formatPHash(phash(img))
+}
+
+// blurhash encodes img with xc by yc components (1 to 9 each).
+func blurhash(img *image.RGBA, xc, yc int) string {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	linear := make([][3]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			p := img.Pix[img.PixOffset(x, y):]
+			linear[y*w+x] = [3]float64{srgbToLinear(p[0]), srgbToLinear(p[1]), srgbToLinear(p[2])}
+		}
+	}
+
+	factors := make([][3]float64, 0, xc*yc)
+	for j := 0; j < yc; j++ {
+		for i := 0; i < xc; i++ {
+			norm := 2.0
+			if i == 0 && j == 0 {
+				norm = 1
+			}
+			var f [3]float64
+			for y := 0; y < h; y++ {
+				for x := 0; x < w; x++ {
+					basis := math.Cos(math.Pi*float64(i*x)/float64(w)) * math.Cos(math.Pi*float64(j*y)/float64(h))
+					for c := range f {
+						f[c] += basis * linear[y*w+x][c]
+					}
+				}
+			}
+			scale := norm / float64(w*h)
+			factors = append(factors, [3]float64{f[0] * scale, f[1] * scale, f[2] * scale})
+		}
+	}
+
+	var sb strings.Builder
+	writeBase83(&sb, (xc-1)+(yc-1)*9, 1)
+
+	maxValue := 1.0
+	if ac := factors[1:]; len(ac) > 0 {
+		var actualMax float64
+		for _, f := range ac {
+			actualMax = math.Max(actualMax, math.Max(math.Abs(f[0]), math.Max(math.Abs(f[1]), math.Abs(f[2]))))
+		}
+		quantised := int(math.Max(0, math.Min(82, math.Floor(actualMax*166-0.5))))
+		maxValue = float64(quantised+1) / 166
+		writeBase83(&sb, quantised, 1)
+	} else {
+		writeBase83(&sb, 0, 1)
+	}
+
+	dc := factors[0]
+	writeBase83(&sb, linearToSRGB(dc[0])<<16|linearToSRGB(dc[1])<<8|linearToSRGB(dc[2]), 4)
+	for _, f := range factors[1:] {
+		q := func(v float64) int {
+			return int(math.Max(0, math.Min(18, math.Floor(signPow(v/maxValue, 0.5)*9+9.5))))
+		}
+		writeBase83(&sb, q(f[0])*19*19+q(f[1])*19+q(f[2]), 2)
+	}
+	return sb.String()
+}
+
+func writeBase83(sb *strings.Builder, v, digits int) {
+	for i := digits - 1; i >= 0; i-- {
+		d := v / int(math.Pow(83, float64(i))) % 83
+		sb.WriteByte(base83[d])
+	}
+}
+
+func srgbToLinear(v uint8) float64 {
+	f := float64(v) / 255
+	if f <= 0.04045 {
+		return f / 12.92
+	}
+	return math.Pow((f+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(v float64) int {
+	v = math.Max(0, math.Min(1, v))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(v, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(v), exp), v)
+}
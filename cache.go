@@ -0,0 +1,243 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The listing is revalidated rather than rebuilt: its ETag is derived from
+// the index version (see indexVersion) and from what shapes the response,
+// the query and whose images the caller sees, and Last-Modified is when the
+// index last changed. Polling clients that send If-None-Match or
+// If-Modified-Since get a 304 without the listing being queried.
+
+// listETag is the entity tag of the listing for q at the given index
+// version. It is weak, as compressed responses differ in bytes.
+func listETag(version int64, q listQuery, rawQuery string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%d\x00%s\x00%s\x00%t\x00%s", version, q.Owner, q.Rater, q.HideProtected, rawQuery)
+	return `W/"` + hex.EncodeToString(h.Sum(nil)[:12]) + `"`
+}
+
+// listNotModified sets the validators of the listing for q and answers the
+// request with 304 if the client's copy is current. It reports whether the
+// request has been handled. Should the index version be unavailable the
+// listing is simply served in full.
+func listNotModified(w http.ResponseWriter, r *http.Request, q listQuery) bool {
+	version, changed, err := indexVersion()
+	if err != nil {
+		return false
+	}
+	etag := listETag(version, q, r.URL.RawQuery)
+	h := w.Header()
+	h.Set("ETag", etag)
+	h.Set("Last-Modified", changed.Format(http.TimeFormat))
+	// cached copies must be revalidated, and belong to the one caller
+	h.Set("Cache-Control", "private, no-cache")
+	h.Add("Vary", "Cookie, Authorization, X-API-Key")
+
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return false
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if !etagMatches(inm, etag) {
+			return false
+		}
+	} else if ims, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err != nil || changed.After(ims.Truncate(time.Second)) {
+		return false
+	}
+	h.Del("Content-Type")
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// etagMatches is the weak comparison of If-None-Match against etag.
+func etagMatches(header, etag string) bool {
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || strings.TrimPrefix(t, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Originals and renditions are linked with ?v= naming the content they
+// were listed with (see imageURLs). A request whose v matches the image as
+// it is now may be cached for good, as the same URL never serves other
+// bytes: a changed image, say stripped of its metadata, is listed under a
+// new one. Without v, or with a stale one, the usual caching applies.
+const immutableCache = "max-age=31536000, immutable"
+
+// originalVersion is the ?v= of an original with content hash sum, ""
+// while the hash is not known yet.
+func originalVersion(sum string) string {
+	if len(sum) < 16 {
+		return ""
+	}
+	return sum[:16]
+}
+
+// renditionVersionOf is the ?v= of the thumbnails and /img/ renditions of
+// meta, which also change with the rendering and the watermark.
+func renditionVersionOf(meta ImageMeta) string {
+	v := originalVersion(meta.SHA256)
+	if v == "" {
+		return ""
+	}
+	v += "." + renditionVersion
+	if wm := watermarkVersion(meta); wm != "" {
+		v += "." + wm
+	}
+	return v
+}
+
+// imageURLs returns the URL of the original and the default thumbnail.
+func imageURLs(meta ImageMeta) (string, string) {
+	url := sitePath("/uploads/" + meta.ID)
+	if v := originalVersion(meta.SHA256); v != "" {
+		url += "?v=" + v
+	}
+	return url, thumbURL(meta, defaultThumbWidth)
+}
+
+// thumbURL returns the URL of the thumbnail of meta width wide.
+func thumbURL(meta ImageMeta, width int) string {
+	thumb := sitePath("/thumbs/" + meta.ID + "?w=" + strconv.Itoa(width))
+	if v := renditionVersionOf(meta); v != "" {
+		thumb += "&v=" + v
+	}
+	return thumb
+}
+
+// setContentCache marks the response immutable if the request names the
+// current version of meta. Shared caches may only keep images anyone can
+// see, not those of accounts or password protected albums.
+func setContentCache(w http.ResponseWriter, r *http.Request, meta ImageMeta, version string) {
+	if version == "" || r.URL.Query().Get("v") != version {
+		return
+	}
+	scope := "public, "
+	if !publicImage(meta) {
+		scope = "private, "
+	}
+	w.Header().Set("Cache-Control", scope+immutableCache)
+}
+
+// setRenditionCache sets the caching headers of a rendition of meta: a
+// day in shared caches for public images, revalidation by the one caller
+// otherwise, and immutable when the request is versioned.
+func setRenditionCache(w http.ResponseWriter, r *http.Request, meta ImageMeta) {
+	cacheControl := "private, no-cache"
+	if publicImage(meta) {
+		cacheControl = "public, max-age=86400"
+	}
+	w.Header().Set("Cache-Control", cacheControl)
+	setContentCache(w, r, meta, renditionVersionOf(meta))
+}
+
+// publicImage reports whether meta is served to anyone without logging in
+// or unlocking an album.
+func publicImage(meta ImageMeta) bool {
+	if cfg.Accounts || meta.Pending {
+		return false
+	}
+	var protected bool
+	err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM album_images ai JOIN albums a ON a.id = ai.album_id
+		WHERE ai.image_id = ? AND a.password_hash != '')`, meta.ID).Scan(&protected)
+	return err == nil && !protected
+}
+
+// Listings and image metadata are also kept in memory for the index
+// version they were read at, so repeated requests skip the queries until
+// something changes; a new version drops them all. View and download
+// counts do not bump the version: listings carry them as of the version,
+// as their ETag does, single images read them afresh and the "popular"
+// order is never cached.
+// Changes to the files behind the index's back are picked up by
+// watchStorage, see watch.go.
+
+const (
+	maxCachedLists  = 256
+	maxCachedImages = 10000
+)
+
+var indexCache struct {
+	sync.Mutex
+	version int64
+	lists   map[string]ImageList
+	images  map[string]ImageMeta
+}
+
+// cacheAt readies the cache for version; the caller holds its lock.
+func cacheAt(version int64) {
+	if indexCache.lists == nil || indexCache.version != version {
+		indexCache.version = version
+		indexCache.lists = map[string]ImageList{}
+		indexCache.images = map[string]ImageMeta{}
+	}
+}
+
+// cachedList returns the listing for q at the current index version,
+// querying it on a miss.
+func cachedList(q listQuery) (ImageList, error) {
+	version, _, err := indexVersion()
+	if err != nil || q.Sort == "popular" {
+		return queryImages(q)
+	}
+	key := fmt.Sprintf("%#v", q)
+	indexCache.Lock()
+	cacheAt(version)
+	list, ok := indexCache.lists[key]
+	indexCache.Unlock()
+	if !ok {
+		if list, err = queryImages(q); err != nil {
+			return list, err
+		}
+		indexCache.Lock()
+		cacheAt(version)
+		if len(indexCache.lists) >= maxCachedLists {
+			indexCache.lists = map[string]ImageList{}
+		}
+		indexCache.lists[key] = list
+		indexCache.Unlock()
+	}
+	// callers may change the images they get
+	list.Images = slices.Clone(list.Images)
+	return list, nil
+}
+
+// cachedImage returns the image id at the current index version, querying
+// it on a miss.
+func cachedImage(id string) (ImageMeta, error) {
+	version, _, err := indexVersion()
+	if err != nil {
+		return queryImage(id)
+	}
+	indexCache.Lock()
+	cacheAt(version)
+	meta, ok := indexCache.images[id]
+	indexCache.Unlock()
+	if !ok {
+		if meta, err = queryImage(id); err != nil {
+			return meta, err
+		}
+		indexCache.Lock()
+		cacheAt(version)
+		if len(indexCache.images) >= maxCachedImages {
+			indexCache.images = map[string]ImageMeta{}
+		}
+		indexCache.images[id] = meta
+		indexCache.Unlock()
+		return meta, nil
+	}
+	db.QueryRow(`SELECT views, downloads FROM image_views WHERE image_id = ?`, id).Scan(&meta.Views, &meta.Downloads)
+	return meta, nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+// Images can be given a title, a description in Markdown and alt text:
+//
+//	PATCH /api/v1/images/{id}   {"title": "...", "description": "...", "alt": "..."}
+//
+// Fields left out keep their value and "" clears one; custom fields can
+// be set in the same request, see fields.go. The listing returns
+// them, the search finds titles and descriptions, and the viewer shows the
+// title and description under the image and uses the alt text for screen
+// readers, falling back to the title and then the file name.
+
+const (
+	maxTitleLength       = 200
+	maxDescriptionLength = 10000
+	maxAltLength         = 1000
+)
+
+type imageUpdate struct {
+	Title       *string            `json:"title"`
+	Description *string            `json:"description"`
+	Alt         *string            `json:"alt"`
+	Fields      map[string]*string `json:"fields"` // see fields.go
+}
+
+func handleUpdateImage(w http.ResponseWriter, r *http.Request, meta ImageMeta) {
+	var req imageUpdate
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64*1024)).Decode(&req); err != nil {
+		writeJSONError(w, "Expected JSON body with title, description, alt or fields", http.StatusBadRequest)
+		return
+	}
+	sets, args, err := req.columns()
+	if err == nil {
+		req.Fields, err = cleanFields(req.Fields)
+	}
+	if err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	changed := len(sets) > 0 || len(req.Fields) > 0
+	if changed {
+		if err := updateImage(meta.ID, sets, args, req.Fields); errors.Is(err, errTooManyFields) {
+			writeJSONError(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if err != nil {
+			writeJSONError(w, "Could not update image", http.StatusInternalServerError)
+			return
+		}
+	}
+	meta, err = getImage(meta.ID)
+	if err != nil {
+		writeJSONError(w, "Could not update image", http.StatusInternalServerError)
+		return
+	}
+	if changed {
+		notify(webhookEvent{Event: "image.updated", Image: meta})
+	}
+	json.NewEncoder(w).Encode(meta)
+}
+
+func updateImage(id string, sets []string, args []any, fields map[string]*string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if len(sets) > 0 {
+		if _, err := tx.Exec(`UPDATE images SET `+strings.Join(sets, ", ")+` WHERE id = ?`, append(args, id)...); err != nil {
+			return err
+		}
+	}
+	if err := setImageFields(tx, id, fields); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// columns checks the fields given and returns their assignments.
+func (u imageUpdate) columns() ([]string, []any, error) {
+	var sets []string
+	var args []any
+	for _, f := range []struct {
+		column, label string
+		value         *string
+		max           int
+	}{
+		{"title", "Title", u.Title, maxTitleLength},
+		{"description", "Description", u.Description, maxDescriptionLength},
+		{"alt", "Alt text", u.Alt, maxAltLength},
+	} {
+		if f.value == nil {
+			continue
+		}
+		v := strings.TrimSpace(*f.value)
+		if f.column != "description" {
+			// one line
+			v = strings.Join(strings.Fields(v), " ")
+		}
+		if utf8.RuneCountInString(v) > f.max {
+			return nil, nil, fmt.Errorf("%s is too long, at most %d characters", f.label, f.max)
+		}
+		sets = append(sets, f.column+" = ?")
+		args = append(args, v)
+	}
+	return sets, args, nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// The check command compares storage, the index and the thumbnail cache
+// and reports what does not match:
+//
+//	orphan-file    a stored image without an index row; -fix indexes it
+//	orphan-heic    a HEIC original of no image; -fix deletes it
+//	missing-file   an index row whose file is gone; -fix drops the row
+//	stale-thumbs   cached renditions of an image that is not indexed, or
+//	               older than its file; -fix deletes them
+//	hash-mismatch  a file that no longer has the recorded SHA-256; -fix
+//	               records the new one
+//
+// It exits with an error while problems are left, so it can run from cron.
+// Uploads that are still being processed are left alone.
+
+type checkProblem struct {
+	kind, subject, detail string
+	fix                   func() error
+}
+
+func runCheck(name string, args []string) error {
+	var fix bool
+	if _, err := openUnsynced(name, args, func(fs *flag.FlagSet) {
+		fs.BoolVar(&fix, "fix", false, "repair what is found")
+	}); err != nil {
+		return err
+	}
+	defer db.Close()
+	maintenance()
+
+	problems, err := checkGallery()
+	if err != nil {
+		return err
+	}
+	left := 0
+	for _, p := range problems {
+		status := ""
+		if fix {
+			status = "\tfixed"
+			if err := p.fix(); err != nil {
+				status = "\tnot fixed: " + err.Error()
+				left++
+			}
+		} else {
+			left++
+		}
+		fmt.Printf("%s\t%s\t%s%s\n", p.kind, p.subject, p.detail, status)
+	}
+	fmt.Printf("%d problems, %d fixed\n", len(problems), len(problems)-left)
+	if left > 0 {
+		return fmt.Errorf("%d problems left", left)
+	}
+	return nil
+}
+
+type indexedImage struct {
+	sum        string
+	processing bool
+}
+
+func checkGallery() ([]checkProblem, error) {
+	ctx := context.Background()
+	rows, err := db.Query(`SELECT id, sha256, processing FROM images ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	indexed := map[string]indexedImage{}
+	heics := map[string]bool{}
+	for rows.Next() {
+		var id string
+		var img indexedImage
+		if err := rows.Scan(&id, &img.sum, &img.processing); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+		indexed[id] = img
+		heics[heicOriginalName(id)] = true
+	}
+	rows.Close()
+
+	objects, err := storage.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var problems []checkProblem
+	stored := map[string]time.Time{}
+	for _, obj := range objects {
+		name, mod := obj.Name, obj.ModTime
+		stored[name] = mod
+		switch img, ok := indexed[name]; {
+		case isMediaName(name) && !ok:
+			problems = append(problems, checkProblem{"orphan-file", name, "not indexed", func() error {
+				_, err := indexImage(ctx, name, mod, "")
+				return err
+			}})
+		case isMediaName(name) && !img.processing && img.sum != "":
+			sum, err := hashStored(name)
+			if err != nil {
+				return nil, fmt.Errorf("hash %s: %w", name, err)
+			}
+			if sum != img.sum {
+				problems = append(problems, checkProblem{"hash-mismatch", name, "recorded " + img.sum + ", file has " + sum, func() error {
+					_, err := db.Exec(`UPDATE images SET sha256 = ? WHERE id = ?`, sum, name)
+					return err
+				}})
+			}
+		case filepath.Ext(name) == ".heic" && !heics[name]:
+			problems = append(problems, checkProblem{"orphan-heic", name, "original of no image", func() error {
+				return storage.Delete(ctx, name)
+			}})
+		}
+	}
+
+	for _, id := range ids {
+		if _, ok := stored[id]; ok || indexed[id].processing {
+			continue
+		}
+		id := id
+		problems = append(problems, checkProblem{"missing-file", id, "indexed, but not in storage", func() error {
+			return purgeImage(ctx, id)
+		}})
+	}
+
+	entries, err := os.ReadDir(cfg.ThumbDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		id, dir := e.Name(), filepath.Join(cfg.ThumbDir, e.Name())
+		if _, ok := indexed[id]; !ok {
+			problems = append(problems, checkProblem{"stale-thumbs", id, "image is not indexed", func() error {
+				return os.RemoveAll(dir)
+			}})
+			continue
+		}
+		mod, ok := stored[id]
+		if !ok {
+			continue
+		}
+		files, err := os.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			info, err := f.Info()
+			if err != nil || !info.ModTime().Before(mod) {
+				continue
+			}
+			path := filepath.Join(dir, f.Name())
+			problems = append(problems, checkProblem{"stale-thumbs", id, f.Name() + " is older than the image", func() error {
+				return os.Remove(path)
+			}})
+		}
+	}
+	return problems, nil
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Chunked uploads let clients on unreliable connections send a file in
+// pieces and resume after a failure:
+//
+//	POST   /api/v1/uploads                 {"name": "...", "size": N} -> session
+//	GET    /api/v1/uploads/{id}            current offset, to resume
+//	PATCH  /api/v1/uploads/{id}            append bytes (Content-Range or ?offset=)
+//	POST   /api/v1/uploads/{id}/finalize   validate and move into the gallery
+//	DELETE /api/v1/uploads/{id}            abort
+//	GET    /api/v1/uploads/{id}/progress   see progress.go
+//
+// Sessions are kept in memory and do not survive a restart of the server.
+const sessionTTL = 24 * time.Hour
+
+type uploadSession struct {
+	ID      string    `json:"uploadId"`
+	Name    string    `json:"name"`
+	Total   int64     `json:"total"`
+	Offset  int64     `json:"offset"`
+	Expires time.Time `json:"expires"`
+
+	owner   string
+	strip   bool // remove metadata before storing
+	pending bool // awaits review once stored
+	mu      sync.Mutex
+}
+
+var (
+	sessionsMu sync.Mutex
+	sessions   = map[string]*uploadSession{}
+)
+
+func (s *uploadSession) path() string {
+	return filepath.Join(cfg.sessionDir(), s.ID+".part")
+}
+
+func handleUploadSessions(w http.ResponseWriter, r *http.Request) {
+	if apiPreamble(w, r) {
+		return
+	}
+
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/uploads"), "/")
+	if rest == "" {
+		if r.Method != "POST" {
+			writeJSONError(w, "Unsupported method", http.StatusMethodNotAllowed)
+			return
+		}
+		createUploadSession(w, r)
+		return
+	}
+
+	id, action, _ := strings.Cut(rest, "/")
+	if action == "progress" && r.Method == "GET" {
+		if !handleUploadProgress(w, r, id) {
+			writeJSONError(w, "Unknown upload", http.StatusNotFound)
+		}
+		return
+	}
+	s := lookupSession(id)
+	if s == nil || !requestViewer(r).sees(s.owner) {
+		writeJSONError(w, "Unknown upload session", http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case action == "" && r.Method == "GET":
+		s.mu.Lock()
+		json.NewEncoder(w).Encode(s)
+		s.mu.Unlock()
+	case action == "" && (r.Method == "PATCH" || r.Method == "POST"):
+		appendChunk(w, r, s)
+	case action == "" && r.Method == "DELETE":
+		dropSession(s)
+		w.WriteHeader(http.StatusNoContent)
+	case action == "finalize" && r.Method == "POST":
+		finalizeSession(w, s)
+	default:
+		writeJSONError(w, "Unsupported method", http.StatusMethodNotAllowed)
+	}
+}
+
+func createUploadSession(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name string `json:"name"`
+		Size int64  `json:"size"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&req); err != nil || req.Name == "" {
+		writeJSONError(w, "Expected JSON body with name and size", http.StatusBadRequest)
+		return
+	}
+	s, status, err := newUploadSession(r, req.Name, req.Size)
+	if err != nil {
+		if !writeQuotaError(w, err) {
+			writeJSONError(w, err.Error(), status)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(s)
+}
+
+// newUploadSession checks the announced size and registers an empty session
+// owned by the caller of r. Errors come with the HTTP status to report.
+func newUploadSession(r *http.Request, name string, size int64) (*uploadSession, int, error) {
+	if size <= 0 || size > cfg.maxUploadBytes() {
+		return nil, http.StatusBadRequest, fmt.Errorf("File exceeds maximum size %d MB", cfg.MaxUploadMB)
+	}
+	if !hasRoomFor(size) {
+		return nil, http.StatusInsufficientStorage, errors.New("Not enough free disk space")
+	}
+	// checked again once the upload is complete, as other uploads may
+	// have taken the room in the meantime
+	owner := requestViewer(r).UserID
+	if err := checkQuota(owner, size); err != nil {
+		var qe *quotaError
+		if errors.As(err, &qe) {
+			return nil, http.StatusRequestEntityTooLarge, err
+		}
+		return nil, http.StatusInternalServerError, errors.New("Could not create upload session")
+	}
+
+	s := &uploadSession{
+		ID:      randomString(24),
+		Name:    name,
+		Total:   size,
+		Expires: time.Now().Add(sessionTTL),
+		owner:   owner,
+		strip:   wantStripMetadata(r),
+		pending: needsReview(r),
+	}
+	f, err := os.Create(s.path())
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.New("Could not create upload session")
+	}
+	f.Close()
+
+	sessionsMu.Lock()
+	sessions[s.ID] = s
+	sessionsMu.Unlock()
+	return s, http.StatusCreated, nil
+}
+
+func appendChunk(w http.ResponseWriter, r *http.Request, s *uploadSession) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	start, length, err := chunkRange(r, s.Total)
+	if err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if start != s.Offset {
+		// The client is out of sync; tell it where to continue from
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(s)
+		return
+	}
+	if length < 0 {
+		length = s.Total - s.Offset
+	}
+
+	if err := s.write(r.Body, length); err != nil {
+		if errors.Is(err, errChunkInterrupted) {
+			writeJSONError(w, "Chunk interrupted", http.StatusBadRequest)
+		} else if errors.Is(err, errDiskFull) {
+			writeProblem(w, http.StatusInsufficientStorage, "disk_full", "Not enough free disk space", nil)
+		} else {
+			writeJSONError(w, "Could not open upload session", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	json.NewEncoder(w).Encode(s)
+}
+
+var errChunkInterrupted = errors.New("chunk interrupted")
+
+// write appends up to length bytes from body at the current offset. The
+// caller holds s.mu. Whatever arrived is kept even if the connection drops
+// mid-chunk, so the client can resume from the new offset.
+func (s *uploadSession) write(body io.Reader, length int64) error {
+	f, err := os.OpenFile(s.path(), os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Seek(s.Offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	n, err := io.Copy(f, guardSpace(io.LimitReader(body, length)))
+	s.Offset += n
+	s.Expires = time.Now().Add(sessionTTL)
+	if errors.Is(err, errDiskFull) {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", errChunkInterrupted, err)
+	}
+	return nil
+}
+
+// chunkRange works out where an incoming chunk starts and how long it is,
+// either from a "Content-Range: bytes start-end/total" header or from an
+// explicit ?offset= parameter. A length of -1 means "until the end".
+func chunkRange(r *http.Request, total int64) (start, length int64, err error) {
+	if cr := r.Header.Get("Content-Range"); cr != "" {
+		var end, size int64
+		if _, err := fmt.Sscanf(cr, "bytes %d-%d/%d", &start, &end, &size); err != nil {
+			return 0, 0, errors.New("Malformed Content-Range")
+		}
+		if size != total || start > end || end >= total {
+			return 0, 0, errors.New("Content-Range does not match upload")
+		}
+		return start, end - start + 1, nil
+	}
+
+	start, err = strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+	if err != nil || start < 0 || start > total {
+		return 0, 0, errors.New("Missing or invalid offset")
+	}
+	return start, -1, nil
+}
+
+func finalizeSession(w http.ResponseWriter, s *uploadSession) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.Offset != s.Total {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(s)
+		return
+	}
+
+	meta, duplicate, err := s.complete()
+	if err != nil {
+		writeIngestError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(UploadResponse{
+		Success:   true,
+		ID:        meta.ID,
+		URL:       meta.URL,
+		Size:      meta.Size,
+		Duplicate: duplicate,
+		Image:     &meta,
+	})
+}
+
+// complete hands a fully received session over to ingest. The caller holds
+// s.mu; the session is gone afterwards, whatever the outcome.
+func (s *uploadSession) complete() (ImageMeta, bool, error) {
+	defer dropSession(s)
+	return ingest(context.Background(), upload{Path: s.path(), Name: s.Name, Owner: s.owner, Strip: s.strip, Pending: s.pending})
+}
+
+func lookupSession(id string) *uploadSession {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	return sessions[id]
+}
+
+// dropSession forgets the session and removes its partial file, if any.
+func dropSession(s *uploadSession) {
+	sessionsMu.Lock()
+	delete(sessions, s.ID)
+	sessionsMu.Unlock()
+	os.Remove(s.path())
+}
+
+// gcUploadSessions periodically removes expired sessions, as well as stale
+// files left behind in the session directory. Sessions only live in
+// memory, so those of a previous run of the server cannot be resumed:
+// their parts go right at startup.
+func gcUploadSessions() {
+	removeOrphanedFiles(func(info fs.FileInfo) bool {
+		return strings.HasSuffix(info.Name(), ".part")
+	})
+	for range time.Tick(10 * time.Minute) {
+		now := time.Now()
+
+		sessionsMu.Lock()
+		list := make([]*uploadSession, 0, len(sessions))
+		for _, s := range sessions {
+			list = append(list, s)
+		}
+		sessionsMu.Unlock()
+		for _, s := range list {
+			// a session receiving a chunk is not expiring
+			if !s.mu.TryLock() {
+				continue
+			}
+			if now.After(s.Expires) {
+				dropSession(s)
+			}
+			s.mu.Unlock()
+		}
+
+		removeOrphanedFiles(func(info fs.FileInfo) bool {
+			return now.Sub(info.ModTime()) >= sessionTTL
+		})
+	}
+}
+
+// removeOrphanedFiles removes the files in the session directory that
+// belong to no session and are stale.
+func removeOrphanedFiles(stale func(fs.FileInfo) bool) {
+	sessionsMu.Lock()
+	live := make(map[string]bool, len(sessions))
+	for id := range sessions {
+		live[id+".part"] = true
+	}
+	sessionsMu.Unlock()
+
+	entries, err := os.ReadDir(cfg.sessionDir())
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || live[e.Name()] || !stale(info) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(cfg.sessionDir(), e.Name())); err == nil {
+			slog.Info("Removed stale upload session", "file", e.Name())
+		}
+	}
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The binary is a small CLI. Without a command it serves the gallery, as
+// it always did; the maintenance commands work on the same storage and
+// index without the HTTP server and exit when done:
+//
+//	serve                     run the server (default)
+//	import [-owner u] <dir>   add the images in dir, recursively
+//	thumbs [-regenerate]      render missing thumbnails, or all of them anew
+//	gc                        purge the expired trash, sessions, jobs and
+//	                          thumbnails of images that are gone, and
+//	                          files of interrupted writes
+//	retention [-dry-run]      apply the retention rules
+//	places                    geocode the images not geocoded yet
+//	check [-fix]              look for files and index rows that do not
+//	                          match, stale thumbnails and changed files
+//	backup [-o file]          write originals and the index to a tarball
+//	restore [-force] <file>   rebuild a gallery from a backup
+//
+// All commands accept the server's flags and config file. The maintenance
+// commands send no webhooks.
+
+type command struct {
+	summary string
+	run     func(name string, args []string) error
+}
+
+var commands map[string]command
+
+func init() {
+	// set up in init, as runHelp refers back to commands
+	commands = map[string]command{
+		"serve":     {"run the gallery server (default)", runServe},
+		"import":    {"add the images of a directory", runImport},
+		"thumbs":    {"render thumbnails", runThumbs},
+		"gc":        {"purge the expired trash, sessions, jobs and stray thumbnails", runGC},
+		"retention": {"apply the retention rules", runRetention},
+		"places":    {"geocode images with a GPS position", runPlaces},
+		"check":     {"check storage, index and thumbnails for consistency", runCheck},
+		"backup":    {"back up the originals and the index", runBackup},
+		"restore":   {"restore a gallery from a backup", runRestore},
+		"help":      {"show this help", runHelp},
+	}
+}
+
+func printUsage() {
+	bin := filepath.Base(os.Args[0])
+	fmt.Fprintf(os.Stderr, "Usage: %s [command] [flags]\n\nCommands:\n", bin)
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", name, commands[name].summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun %s <command> -h for the flags of a command.\n", bin)
+}
+
+func runHelp(name string, args []string) error {
+	printUsage()
+	return nil
+}
+
+// openGallery loads the configuration and opens storage and the index,
+// which all commands need, and brings the index up to date with storage.
+// It returns the arguments after the flags.
+func openGallery(name string, args []string, extra func(fs *flag.FlagSet)) ([]string, error) {
+	rest, err := openUnsynced(name, args, extra)
+	if err != nil {
+		return nil, err
+	}
+	if err := syncStore(); err != nil {
+		return nil, fmt.Errorf("sync metadata store: %w", err)
+	}
+	return rest, nil
+}
+
+// openUnsynced is openGallery without the sync, for check, which reports
+// what the sync would quietly repair.
+func openUnsynced(name string, args []string, extra func(fs *flag.FlagSet)) ([]string, error) {
+	c, rest, err := loadConfig(name, args, extra)
+	if err != nil {
+		return nil, err
+	}
+	cfg = c
+	if err := setupLogging(cfg); err != nil {
+		return nil, err
+	}
+
+	// Ensure directories exist
+	os.MkdirAll(cfg.UploadDir, 0755)
+	os.MkdirAll(cfg.sessionDir(), 0755)
+	os.MkdirAll(cfg.ThumbDir, 0755)
+
+	if storage, err = newStorage(cfg); err != nil {
+		return nil, fmt.Errorf("storage: %w", err)
+	}
+	if cfg.Tracing {
+		storage = tracedStorage{storage}
+	}
+	if err := setupVideos(cfg); err != nil {
+		slog.Warn("Video uploads disabled", "err", err)
+	}
+	setupEncoders(cfg)
+	if err := setupWatermark(cfg); err != nil {
+		return nil, fmt.Errorf("watermark: %w", err)
+	}
+	setupScanner(cfg)
+	if err := setupGeocoder(cfg); err != nil {
+		return nil, fmt.Errorf("geocoder: %w", err)
+	}
+
+	// Metadata index
+	if err := openStore(cfg.DBPath); err != nil {
+		return nil, fmt.Errorf("open metadata store: %w", err)
+	}
+	return rest, nil
+}
+
+// maintenance prepares a command that runs without the server.
+func maintenance() {
+	cfg.Webhooks = nil
+}
+
+func runImport(name string, args []string) error {
+	var owner string
+	var strip bool
+	rest, err := openGallery(name, args, func(fs *flag.FlagSet) {
+		fs.StringVar(&owner, "owner", "", "username the images belong to (with -accounts)")
+		fs.BoolVar(&strip, "strip", false, "remove metadata from the images")
+	})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	maintenance()
+	if len(rest) != 1 {
+		return errors.New("expected one directory to import")
+	}
+	var ownerID string
+	if owner != "" {
+		if err := db.QueryRow(`SELECT id FROM users WHERE username = ?`, owner).Scan(&ownerID); err != nil {
+			return fmt.Errorf("owner %q: %w", owner, err)
+		}
+	}
+
+	var added, duplicates, skipped int
+	err = filepath.WalkDir(rest[0], func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(d.Name(), ".") && path != rest[0] {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if info.Size() > cfg.maxUploadBytes() {
+			slog.Warn("Skipped, too large", "file", path)
+			skipped++
+			return nil
+		}
+		if !hasRoomFor(info.Size()) {
+			return errors.New("not enough disk space")
+		}
+		meta, duplicate, err := importFile(path, ownerID, strip)
+		switch {
+		case err != nil:
+			msg, _, _ := ingestErrorStatus(err)
+			slog.Warn("Skipped", "file", path, "reason", msg, "err", err)
+			skipped++
+		case duplicate:
+			slog.Info("Already there", "file", path, "image", meta.ID)
+			duplicates++
+		default:
+			slog.Info("Imported", "file", path, "image", meta.ID)
+			added++
+		}
+		return nil
+	})
+	// the uploads are processed before exiting, as there is no server to
+	// do it
+	drainJobs()
+	fmt.Printf("%d imported, %d already there, %d skipped\n", added, duplicates, skipped)
+	return err
+}
+
+// importFile ingests a copy of path; ingest consumes the files it gets.
+func importFile(path, owner string, strip bool) (ImageMeta, bool, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return ImageMeta{}, false, err
+	}
+	defer src.Close()
+	tmp, err := os.CreateTemp(cfg.sessionDir(), ".import-*")
+	if err != nil {
+		return ImageMeta{}, false, err
+	}
+	_, err = io.Copy(tmp, src)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return ImageMeta{}, false, err
+	}
+	return ingest(context.Background(), upload{Path: tmp.Name(), Name: filepath.Base(path), Owner: owner, Strip: strip})
+}
+
+func runThumbs(name string, args []string) error {
+	var regenerate bool
+	if _, err := openGallery(name, args, func(fs *flag.FlagSet) {
+		fs.BoolVar(&regenerate, "regenerate", false, "drop all cached renditions and render the thumbnails anew")
+	}); err != nil {
+		return err
+	}
+	defer db.Close()
+	maintenance()
+	drainJobs()
+
+	rendered, failed, err := renderThumbs(regenerate)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d thumbnails, %d failed\n", rendered, failed)
+	return nil
+}
+
+// renderThumbs renders the default thumbnail of every image that has none,
+// or of all of them with regenerate, with cfg.Workers workers.
+func renderThumbs(regenerate bool) (int64, int64, error) {
+	rows, err := db.Query(`SELECT id FROM images WHERE deleted_at = 0 AND processing = 0`)
+	if err != nil {
+		return 0, 0, err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	var rendered, failed atomic.Int64
+	work := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < cfg.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := range work {
+				if regenerate {
+					os.RemoveAll(filepath.Join(cfg.ThumbDir, id))
+				}
+				info, err := storage.Stat(context.Background(), id)
+				if err == nil {
+					_, err = renderCached(id, thumbTransform(id, defaultThumbWidth, 0), info.ModTime)
+				}
+				if err != nil {
+					slog.Warn("Could not render thumbnail", "image", id, "err", err)
+					failed.Add(1)
+					continue
+				}
+				rendered.Add(1)
+			}
+		}()
+	}
+	for _, id := range ids {
+		work <- id
+	}
+	close(work)
+	wg.Wait()
+	return rendered.Load(), failed.Load(), nil
+}
+
+func runPlaces(name string, args []string) error {
+	if _, err := openGallery(name, args, nil); err != nil {
+		return err
+	}
+	defer db.Close()
+	maintenance()
+	drainJobs()
+
+	done, failed, err := geocodePending(context.Background())
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d geocoded, %d failed\n", done, failed)
+	return nil
+}
+
+func runGC(name string, args []string) error {
+	if _, err := openGallery(name, args, nil); err != nil {
+		return err
+	}
+	defer db.Close()
+	maintenance()
+
+	report, err := collectGarbage()
+	if err != nil {
+		return err
+	}
+	fmt.Println(report)
+	return nil
+}
+
+// collectGarbage purges whatever has expired, as reported by the gc
+// command.
+func collectGarbage() (string, error) {
+	trashed := purgeExpiredTrash()
+	sessions, err := expireLoginSessions()
+	if err != nil {
+		return "", err
+	}
+	jobs, err := forgetOldJobs()
+	if err != nil {
+		return "", err
+	}
+	thumbs, err := pruneThumbs()
+	if err != nil {
+		return "", err
+	}
+	temps := 0
+	if l, ok := baseStorage().(localStorage); ok {
+		temps = l.removeStaleTemps(time.Hour)
+	}
+	return fmt.Sprintf("purged %d trashed images, %d login sessions, %d jobs, %d stray thumbnail directories, %d unfinished writes",
+		trashed, sessions, jobs, thumbs, temps), nil
+}
+
+func runRetention(name string, args []string) error {
+	var dryRun bool
+	if _, err := openGallery(name, args, func(fs *flag.FlagSet) {
+		fs.BoolVar(&dryRun, "dry-run", false, "only list what the rules would remove")
+	}); err != nil {
+		return err
+	}
+	defer db.Close()
+	maintenance()
+	if len(cfg.Retention) == 0 {
+		return errors.New("no retention rules configured")
+	}
+
+	entries, err := enforceRetention(dryRun || cfg.RetentionDryRun)
+	for _, e := range entries {
+		fmt.Printf("%s\t%d\t%s\n", e.Rule, e.Size, e.Image)
+	}
+	verb := "removed"
+	if dryRun || cfg.RetentionDryRun {
+		verb = "would remove"
+	}
+	fmt.Printf("%s %d images\n", verb, len(entries))
+	return err
+}
+
+// pruneThumbs removes cached renditions of images that are no longer
+// indexed.
+func pruneThumbs() (int, error) {
+	entries, err := os.ReadDir(cfg.ThumbDir)
+	if err != nil {
+		return 0, err
+	}
+	pruned := 0
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		var n int
+		if err := db.QueryRow(`SELECT COUNT(*) FROM images WHERE id = ?`, e.Name()).Scan(&n); err != nil {
+			return pruned, err
+		}
+		if n == 0 {
+			os.RemoveAll(filepath.Join(cfg.ThumbDir, e.Name()))
+			pruned++
+		}
+	}
+	return pruned, nil
+}
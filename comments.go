@@ -0,0 +1,295 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Images can be commented on, with -comments users by anyone who may
+// write to the gallery and with -comments anyone by visitors too:
+//
+//	GET    /api/v1/images/{id}/comments
+//	POST   /api/v1/images/{id}/comments                {"body": "...", "author": "...", "captcha": "...", "answer": "7"}
+//	DELETE /api/v1/images/{id}/comments/{cid}
+//	POST   /api/v1/images/{id}/comments/{cid}/approve
+//
+// Visitors without credentials, in galleries they may read without any,
+// give a name and answer a captcha from GET /api/v1/captcha, and their
+// comments wait until the owner of the image or an admin approves them;
+// until then only those see them. They may delete any comment on the
+// image, everyone else their own. The viewer lists the comments under the
+// image.
+
+const (
+	maxCommentLength = 2000
+	maxAuthorLength  = 64
+
+	captchaTTL  = 10 * time.Minute
+	maxCaptchas = 10000
+)
+
+type Comment struct {
+	ID      string    `json:"id"`
+	Image   string    `json:"image"`
+	Author  string    `json:"author"`
+	User    string    `json:"user,omitempty"`
+	Body    string    `json:"body"`
+	Pending bool      `json:"pending,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+// commentsOpen reports whether the gallery needs no credentials at all,
+// which makes every caller a moderator.
+func commentsOpen() bool {
+	return len(cfg.APIKeys) == 0 && !cfg.Accounts
+}
+
+// anonymousComments lets POSTs of comments without credentials past
+// requireAuth, rate limited, when -comments is anyone.
+func anonymousComments(guarded, h http.Handler) http.Handler {
+	limited := rateLimit(h)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := resolvePrincipal(r); !ok && cfg.Comments == "anyone" && r.Method == "POST" &&
+			strings.HasSuffix(strings.TrimSuffix(r.URL.Path, "/"), "/comments") {
+			limited.ServeHTTP(w, r)
+			return
+		}
+		guarded.ServeHTTP(w, r)
+	})
+}
+
+func handleComments(w http.ResponseWriter, r *http.Request, meta ImageMeta, rest string) {
+	if cfg.Comments == "off" {
+		writeJSONError(w, "Comments are disabled", http.StatusNotFound)
+		return
+	}
+	id, action, _ := strings.Cut(rest, "/")
+	switch {
+	case id == "" && r.Method == "GET":
+		handleListComments(w, r, meta)
+	case id == "" && r.Method == "POST":
+		handleAddComment(w, r, meta)
+	case id != "" && action == "" && r.Method == "DELETE":
+		handleDeleteComment(w, r, meta, id)
+	case id != "" && action == "approve" && r.Method == "POST":
+		handleApproveComment(w, r, meta, id)
+	default:
+		writeJSONError(w, "Unsupported method", http.StatusMethodNotAllowed)
+	}
+}
+
+func handleListComments(w http.ResponseWriter, r *http.Request, meta ImageMeta) {
+	moderator := canSeePending(r, meta)
+	query := `SELECT ` + commentColumns + ` FROM comments WHERE image_id = ?`
+	if !moderator {
+		query += ` AND pending = 0`
+	}
+	rows, err := db.Query(query+` ORDER BY created_at, id`, meta.ID)
+	if err != nil {
+		writeJSONError(w, "Could not load comments", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	comments := []Comment{}
+	for rows.Next() {
+		c, err := scanComment(rows)
+		if err != nil {
+			writeJSONError(w, "Could not load comments", http.StatusInternalServerError)
+			return
+		}
+		comments = append(comments, c)
+	}
+	if rows.Err() != nil {
+		writeJSONError(w, "Could not load comments", http.StatusInternalServerError)
+		return
+	}
+	_, authenticated := resolvePrincipal(r)
+	anonymous := !authenticated && !commentsOpen()
+	json.NewEncoder(w).Encode(map[string]any{
+		"id":        meta.ID,
+		"comments":  comments,
+		"moderator": moderator,
+		"captcha":   anonymous && cfg.Comments == "anyone",
+		"canPost":   !anonymous || cfg.Comments == "anyone",
+	})
+}
+
+func handleAddComment(w http.ResponseWriter, r *http.Request, meta ImageMeta) {
+	var req struct {
+		Body    string `json:"body"`
+		Author  string `json:"author"`
+		Captcha string `json:"captcha"`
+		Answer  string `json:"answer"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 16*1024)).Decode(&req); err != nil {
+		writeJSONError(w, "Expected JSON body with a comment body", http.StatusBadRequest)
+		return
+	}
+	body := strings.TrimSpace(req.Body)
+	if body == "" {
+		writeJSONError(w, "Missing comment body", http.StatusBadRequest)
+		return
+	}
+	if utf8.RuneCountInString(body) > maxCommentLength {
+		writeJSONError(w, fmt.Sprintf("Comment is too long, at most %d characters", maxCommentLength), http.StatusBadRequest)
+		return
+	}
+
+	c := Comment{ID: randomString(16), Image: meta.ID, Body: body, Created: time.Now().UTC()}
+	if p, ok := resolvePrincipal(r); ok {
+		c.Author, c.User = p.Name, p.UserID
+	} else if commentsOpen() {
+		c.Author = strings.Join(strings.Fields(req.Author), " ")
+	} else {
+		if !solveCaptcha(req.Captcha, req.Answer) {
+			writeJSONError(w, "Wrong or expired captcha", http.StatusBadRequest)
+			return
+		}
+		c.Author = strings.Join(strings.Fields(req.Author), " ")
+		c.Pending = true
+	}
+	if utf8.RuneCountInString(c.Author) > maxAuthorLength {
+		writeJSONError(w, fmt.Sprintf("Author is too long, at most %d characters", maxAuthorLength), http.StatusBadRequest)
+		return
+	}
+
+	_, err := db.Exec(`INSERT INTO comments (id, image_id, user_id, author, body, pending, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		c.ID, c.Image, c.User, c.Author, c.Body, c.Pending, c.Created.UnixNano())
+	if err != nil {
+		writeJSONError(w, "Could not save comment", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(c)
+}
+
+func handleDeleteComment(w http.ResponseWriter, r *http.Request, meta ImageMeta, id string) {
+	c, err := getComment(meta.ID, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeJSONError(w, "Comment not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		writeJSONError(w, "Could not load comment", http.StatusInternalServerError)
+		return
+	}
+	p, _ := resolvePrincipal(r)
+	if !canSeePending(r, meta) && (p.UserID == "" || p.UserID != c.User) {
+		writeJSONError(w, "Only the author, the owner of the image or an admin may delete a comment", http.StatusForbidden)
+		return
+	}
+	if _, err := db.Exec(`DELETE FROM comments WHERE id = ?`, c.ID); err != nil {
+		writeJSONError(w, "Could not delete comment", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handleApproveComment(w http.ResponseWriter, r *http.Request, meta ImageMeta, id string) {
+	if !canSeePending(r, meta) {
+		writeJSONError(w, "Only the owner of the image or an admin may approve comments", http.StatusForbidden)
+		return
+	}
+	res, err := db.Exec(`UPDATE comments SET pending = 0 WHERE id = ? AND image_id = ?`, id, meta.ID)
+	if err != nil {
+		writeJSONError(w, "Could not approve comment", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		writeJSONError(w, "Comment not found", http.StatusNotFound)
+		return
+	}
+	c, err := getComment(meta.ID, id)
+	if err != nil {
+		writeJSONError(w, "Could not load comment", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(c)
+}
+
+const commentColumns = `id, image_id, user_id, author, body, pending, created_at`
+
+func getComment(image, id string) (Comment, error) {
+	return scanComment(db.QueryRow(`SELECT `+commentColumns+` FROM comments WHERE id = ? AND image_id = ?`, id, image))
+}
+
+func scanComment(row interface{ Scan(...any) error }) (Comment, error) {
+	var c Comment
+	var created int64
+	err := row.Scan(&c.ID, &c.Image, &c.User, &c.Author, &c.Body, &c.Pending, &created)
+	c.Created = time.Unix(0, created).UTC()
+	return c, err
+}
+
+// The captcha is a small sum to work out, kept in memory until it is
+// answered once or expires.
+
+type captcha struct {
+	answer  int
+	expires time.Time
+}
+
+var (
+	captchaMu sync.Mutex
+	captchas  = map[string]captcha{}
+)
+
+func handleCaptcha(w http.ResponseWriter, r *http.Request) {
+	if apiPreamble(w, r) {
+		return
+	}
+	if r.Method != "GET" {
+		writeJSONError(w, "Unsupported method", http.StatusMethodNotAllowed)
+		return
+	}
+	if cfg.Comments != "anyone" {
+		writeJSONError(w, "Comments by visitors are disabled", http.StatusNotFound)
+		return
+	}
+	a, b := 1+rand.Intn(9), 1+rand.Intn(9)
+	now := time.Now()
+
+	captchaMu.Lock()
+	for id, c := range captchas {
+		if now.After(c.expires) {
+			delete(captchas, id)
+		}
+	}
+	full := len(captchas) >= maxCaptchas
+	id := randomString(24)
+	if !full {
+		captchas[id] = captcha{answer: a + b, expires: now.Add(captchaTTL)}
+	}
+	captchaMu.Unlock()
+
+	if full {
+		writeJSONError(w, "Too many open captchas, try again later", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]any{
+		"captcha":   id,
+		"question":  fmt.Sprintf("%d + %d", a, b),
+		"expiresAt": now.Add(captchaTTL).UTC(),
+	})
+}
+
+// solveCaptcha reports whether answer solves the captcha id, which can be
+// tried only once.
+func solveCaptcha(id, answer string) bool {
+	captchaMu.Lock()
+	c, ok := captchas[id]
+	delete(captchas, id)
+	captchaMu.Unlock()
+	n, err := strconv.Atoi(strings.TrimSpace(answer))
+	return ok && err == nil && n == c.answer && time.Now().Before(c.expires)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"compress/gzip"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// compressResponses gzips text responses, the pages, scripts and styles and
+// above all the JSON of the API, for clients that accept it: the listing of
+// a large gallery is megabytes of JSON that shrink about tenfold. Images and
+// videos are compressed already and pass through, as do event streams,
+// partial content and responses that announce less than compressMinSize.
+// Brotli would do a little better but needs an encoder outside the
+// standard library.
+const compressMinSize = 1024
+
+var gzipWriters = sync.Pool{New: func() any {
+	w, _ := gzip.NewWriterLevel(nil, gzip.DefaultCompression)
+	return w
+}}
+
+func compressResponses(h http.Handler) http.Handler {
+	if !cfg.Compress {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !acceptsGzip(r.Header.Get("Accept-Encoding")) || r.Header.Get("Range") != "" {
+			w.Header().Add("Vary", "Accept-Encoding")
+			h.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, head: r.Method == "HEAD"}
+		defer cw.close()
+		h.ServeHTTP(cw, r)
+	})
+}
+
+// acceptsGzip reports whether an Accept-Encoding header allows gzip.
+func acceptsGzip(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if c := strings.TrimSpace(coding); c != "gzip" && c != "*" {
+			continue
+		}
+		q, ok := strings.CutPrefix(strings.TrimSpace(params), "q=")
+		if !ok {
+			return true
+		}
+		if v, err := strconv.ParseFloat(q, 64); err == nil && v > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// compressible reports whether responses of type ct are worth compressing.
+func compressible(ct string) bool {
+	t, _, _ := mime.ParseMediaType(ct)
+	switch {
+	case t == "text/event-stream":
+		return false
+	case strings.HasPrefix(t, "text/"):
+		return true
+	}
+	switch t {
+	case "application/json", "application/problem+json", "application/javascript", "application/xml", "image/svg+xml":
+		return true
+	}
+	return false
+}
+
+// compressWriter decides on the first write, once the headers are known,
+// whether the response is gzipped.
+type compressWriter struct {
+	http.ResponseWriter
+	head    bool
+	decided bool
+	gz      *gzip.Writer
+}
+
+func (c *compressWriter) decide(code int) {
+	c.decided = true
+	h := c.Header()
+	if !compressible(h.Get("Content-Type")) {
+		return
+	}
+	h.Add("Vary", "Accept-Encoding")
+	if c.head || code < 200 || code == http.StatusNoContent || code == http.StatusPartialContent || code == http.StatusNotModified ||
+		h.Get("Content-Encoding") != "" || h.Get("Content-Range") != "" {
+		return
+	}
+	if n, err := strconv.Atoi(h.Get("Content-Length")); err == nil && n < compressMinSize {
+		return
+	}
+	h.Del("Content-Length")
+	h.Set("Content-Encoding", "gzip")
+	// a strong validator would claim the compressed bytes equal the plain ones
+	if etag := h.Get("ETag"); strings.HasPrefix(etag, `"`) {
+		h.Set("ETag", "W/"+etag)
+	}
+	c.gz = gzipWriters.Get().(*gzip.Writer)
+	c.gz.Reset(c.ResponseWriter)
+}
+
+func (c *compressWriter) WriteHeader(code int) {
+	if !c.decided {
+		c.decide(code)
+	}
+	c.ResponseWriter.WriteHeader(code)
+}
+
+func (c *compressWriter) Write(b []byte) (int, error) {
+	if !c.decided {
+		c.WriteHeader(http.StatusOK)
+	}
+	if c.gz != nil {
+		return c.gz.Write(b)
+	}
+	return c.ResponseWriter.Write(b)
+}
+
+// FlushError sends what has been compressed so far; http.ResponseController
+// calls it.
+func (c *compressWriter) FlushError() error {
+	if c.gz != nil {
+		if err := c.gz.Flush(); err != nil {
+			return err
+		}
+	}
+	return http.NewResponseController(c.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (c *compressWriter) Unwrap() http.ResponseWriter { return c.ResponseWriter }
+
+func (c *compressWriter) close() {
+	if c.gz == nil {
+		return
+	}
+	c.gz.Close()
+	c.gz.Reset(nil)
+	gzipWriters.Put(c.gz)
+	c.gz = nil
+}
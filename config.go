@@ -0,0 +1,673 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds everything that used to be hard-coded. Values are layered:
+// built-in defaults, then the optional YAML file (-config or GALLERY_CONFIG),
+// then GALLERY_* environment variables, then command line flags.
+type Config struct {
+	Addr          string `yaml:"addr"`
+	UploadDir     string `yaml:"upload_dir"`
+	TemplateDir   string `yaml:"template_dir"`
+	StaticDir     string `yaml:"static_dir"`
+	ThumbDir      string `yaml:"thumb_dir"`
+	DBPath        string `yaml:"db_path"`
+	MaxUploadMB   int64  `yaml:"max_upload_mb"`
+	DiskReserveMB int64  `yaml:"disk_reserve_mb"` // see hasRoomFor
+
+	// MaxMegapixels caps the size of the images that are accepted and
+	// decoded, see pixels.go; 0 is no limit.
+	MaxMegapixels int64 `yaml:"max_megapixels"`
+
+	// SrcsetWidths are the thumbnail widths rendered for every image and
+	// offered as its srcset, see thumbs.go; empty for none.
+	SrcsetWidths intList `yaml:"srcset_widths"`
+
+	// ImagePresets are the /img/ query strings, say "w=800&h=600&fit=cover",
+	// served to callers without credentials, see handleTransform.
+	// RenditionCacheMB caps the thumbnails and renditions kept in ThumbDir,
+	// see renditions.go; 0 is no limit.
+	ImagePresets     stringList `yaml:"image_presets"`
+	RenditionCacheMB int64      `yaml:"rendition_cache_mb"`
+
+	// Watermark is an image file, WatermarkText a text, drawn on the
+	// renditions of images in watermarked albums, see watermark.go.
+	Watermark         string  `yaml:"watermark"`
+	WatermarkText     string  `yaml:"watermark_text"`
+	WatermarkPosition string  `yaml:"watermark_position"`
+	WatermarkOpacity  float64 `yaml:"watermark_opacity"`
+
+	// QuotaMB caps what the gallery stores in all, UserQuotaMB what each
+	// user may store, see quota.go; 0 is no limit.
+	QuotaMB     int64 `yaml:"quota_mb"`
+	UserQuotaMB int64 `yaml:"user_quota_mb"`
+
+	// LogLevel is debug, info, warn or error; LogFormat is text or json.
+	LogLevel  string `yaml:"log_level"`
+	LogFormat string `yaml:"log_format"`
+
+	// ShutdownTimeout bounds how long a stopping server waits for
+	// in-flight requests.
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+
+	// TrashRetention is how long deleted images stay restorable; 0 deletes
+	// right away.
+	TrashRetention time.Duration `yaml:"trash_retention"`
+
+	// Retention rules remove old images every RetentionInterval, see
+	// retention.go; RetentionDryRun only logs what they would remove.
+	Retention         stringList    `yaml:"retention"`
+	RetentionInterval time.Duration `yaml:"retention_interval"`
+	RetentionDryRun   bool          `yaml:"retention_dry_run"`
+
+	// Duplicates decides what happens to an upload whose content the owner
+	// already has: "link" returns the existing image, "reject" refuses it
+	// and "allow" stores it again.
+	StripExif  bool   `yaml:"strip_exif"`
+	Duplicates string `yaml:"duplicates"`
+
+	// Formats are the accepted upload formats, see formats.go.
+	Formats stringList `yaml:"formats"`
+
+	// Reencode decodes and encodes every image upload anew, keeping only
+	// its pixels, see reencode.go.
+	Reencode bool `yaml:"reencode"`
+
+	// Moderation holds untrusted uploads for review by an admin: "off",
+	// "guests" for guest link uploads or "users" for those of non-admin
+	// accounts too. See moderation.go.
+	Moderation string `yaml:"moderation"`
+
+	// Comments on images: "off", "users" for callers who may write to the
+	// gallery or "anyone" for visitors too, behind a captcha and held for
+	// the image owner to approve. See comments.go.
+	Comments string `yaml:"comments"`
+
+	// FeedItems is the number of latest uploads in /feed.xml, 0 for no
+	// feed. See feed.go.
+	FeedItems int `yaml:"feed_items"`
+
+	// ScreenshotURL is the link screenshot tools get for an upload, with
+	// {url}, {page}, {thumb}, {id} and {origin} filled in. See sharex.go.
+	ScreenshotURL string `yaml:"screenshot_url"`
+
+	// Uploads are checked for malware by a ClamAV daemon at Clamd (socket
+	// path or host:port) or by MalwareCommand, see malware.go.
+	Clamd          string `yaml:"clamd"`
+	MalwareCommand string `yaml:"malware_command"`
+
+	// A content-safety scanner checks uploads, see scan.go: ScanCommand or
+	// ScanURL, flagging images that score ScanThreshold or more for one of
+	// ScanLabels. ScanAction "quarantine" also holds them for review.
+	ScanCommand   string     `yaml:"scan_command"`
+	ScanURL       string     `yaml:"scan_url"`
+	ScanLabels    stringList `yaml:"scan_labels"`
+	ScanThreshold float64    `yaml:"scan_threshold"`
+	ScanAction    string     `yaml:"scan_action"`
+
+	// Geocoder turns GPS positions into places, see geocode.go: "nominatim"
+	// asks the server at GeocodeURL, "offline" uses the GeoNames file
+	// GeocodeData; empty for none.
+	Geocoder    string `yaml:"geocoder"`
+	GeocodeURL  string `yaml:"geocode_url"`
+	GeocodeData string `yaml:"geocode_data"`
+
+	// HEICConverter turns HEIC uploads into JPEG, see heic.go; empty
+	// rejects them. KeepHEICOriginal stores the HEIC file as well.
+	HEICConverter    string `yaml:"heic_converter"`
+	KeepHEICOriginal bool   `yaml:"keep_heic_original"`
+
+	// FFmpeg and FFprobe handle video uploads, see video.go. Without them
+	// (or with FFmpeg empty) videos are refused.
+	FFmpeg  string `yaml:"ffmpeg"`
+	FFprobe string `yaml:"ffprobe"`
+
+	// AVIFEnc and CJXL are the avifenc and cjxl commands that encode AVIF
+	// and JPEG XL renditions, see avif.go; empty leaves the format out.
+	AVIFEnc string `yaml:"avifenc"`
+	CJXL    string `yaml:"cjxl"`
+
+	// Workers run the background processing of uploads, see jobs.go; a
+	// failing job is given JobAttempts tries.
+	Workers     int `yaml:"workers"`
+	JobAttempts int `yaml:"job_attempts"`
+
+	// ImportTimeout bounds a whole URL import, see import.go. Imports from
+	// private and loopback addresses are refused unless ImportAllowPrivate.
+	ImportTimeout      time.Duration `yaml:"import_timeout"`
+	ImportAllowPrivate bool          `yaml:"import_allow_private"`
+
+	// HotFolders are watched for files to import, see hotfolder.go; they
+	// belong to the account HotFolderOwner, a username, if set.
+	HotFolders     stringList `yaml:"hot_folders"`
+	HotFolderOwner string     `yaml:"hot_folder_owner"`
+
+	// Rate limits in requests per minute and client, 0 for none; see
+	// ratelimit.go. Upload sessions count once, not per chunk.
+	UploadRateLimit float64 `yaml:"upload_rate_limit"`
+	UploadRateBurst int     `yaml:"upload_rate_burst"`
+	ListRateLimit   float64 `yaml:"list_rate_limit"`
+	ListRateBurst   int     `yaml:"list_rate_burst"`
+
+	// UploadConcurrency caps the requests sending files at once and
+	// MaxQueuedJobs the uploads waiting for the workers; over either,
+	// uploads get 503. 0 is no cap. See backpressure.go.
+	UploadConcurrency int `yaml:"upload_concurrency"`
+	MaxQueuedJobs     int `yaml:"max_queued_jobs"`
+
+	// TLSCert and TLSKey serve HTTPS with a certificate of your own.
+	// AutocertDomains instead gets certificates from Let's Encrypt, which
+	// needs HTTPAddr reachable on port 80 for the HTTP-01 challenge.
+	TLSCert          string     `yaml:"tls_cert"`
+	TLSKey           string     `yaml:"tls_key"`
+	AutocertDomains  stringList `yaml:"autocert_domains"`
+	AutocertEmail    string     `yaml:"autocert_email"`
+	AutocertCacheDir string     `yaml:"autocert_cache_dir"`
+	HTTPAddr         string     `yaml:"http_addr"`
+
+	// Webhooks receive upload, delete and tag events, signed with
+	// WebhookSecret if set; see webhooks.go.
+	Webhooks      stringList `yaml:"webhooks"`
+	WebhookSecret string     `yaml:"webhook_secret"`
+
+	// SourceDirs are shown in the gallery too, read-only, with an album
+	// for each folder, see sources.go; symlinks in them are followed with
+	// FollowSymlinks. Local storage only.
+	SourceDirs     stringList `yaml:"source_dirs"`
+	FollowSymlinks bool       `yaml:"follow_symlinks"`
+
+	// Storage selects where originals are kept: "local" (UploadDir) or
+	// "s3". With s3, UploadDir is still used for scratch files and the index.
+	Storage     string `yaml:"storage"`
+	S3Endpoint  string `yaml:"s3_endpoint"`
+	S3Bucket    string `yaml:"s3_bucket"`
+	S3Prefix    string `yaml:"s3_prefix"`
+	S3Region    string `yaml:"s3_region"`
+	S3AccessKey string `yaml:"s3_access_key"`
+	S3SecretKey string `yaml:"s3_secret_key"`
+	S3UseSSL    bool   `yaml:"s3_use_ssl"`
+
+	// APIKeys maps key names to keys. When set, uploads and other changes
+	// require a key; ProtectReads extends that to reads, the read-only API
+	// as well as the pages and files.
+	APIKeys      apiKeys `yaml:"api_keys"`
+	ProtectReads bool    `yaml:"protect_reads"`
+
+	// CORSOrigins may call the API from other sites, see cors.go; "*" is
+	// any origin. CORSCredentials lets them send cookies and API keys.
+	CORSOrigins     stringList `yaml:"cors_origins"`
+	CORSMethods     stringList `yaml:"cors_methods"`
+	CORSCredentials bool       `yaml:"cors_credentials"`
+
+	// Security headers sent with every response, see headers.go; an empty
+	// value leaves the header out.
+	ContentSecurityPolicy string `yaml:"content_security_policy"`
+	FrameOptions          string `yaml:"frame_options"`
+	ReferrerPolicy        string `yaml:"referrer_policy"`
+
+	// EmbedOrigins are the sites that may frame the album widget
+	// /embed/{album}, see widget.go; "*" is any.
+	EmbedOrigins stringList `yaml:"embed_origins"`
+
+	// Tracing logs spans of requests, uploads, metadata reads and storage
+	// calls with W3C trace context ids, see trace.go.
+	Tracing bool `yaml:"tracing"`
+
+	// DebugAddr, if set, is a separate listener with pprof and runtime
+	// stats, see debug.go.
+	DebugAddr string `yaml:"debug_addr"`
+
+	// Compress gzips text and JSON responses for clients that accept it,
+	// see compress.go.
+	Compress bool `yaml:"compress"`
+
+	// TrustProxy believes the X-Forwarded-* headers of a reverse proxy;
+	// BasePath serves the gallery under a sub-path. See proxy.go.
+	TrustProxy bool   `yaml:"trust_proxy"`
+	BasePath   string `yaml:"base_path"`
+
+	// Accounts turns on user logins with per-user galleries. The first
+	// account to register becomes admin; further sign-ups need
+	// AllowRegistration.
+	Accounts          bool `yaml:"accounts"`
+	AllowRegistration bool `yaml:"allow_registration"`
+}
+
+var cfg = defaultConfig()
+
+// stringList is a list setting, written as "a,b,c" in flags and the
+// environment.
+type stringList []string
+
+func (l *stringList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	var list stringList
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			list = append(list, s)
+		}
+	}
+	*l = list
+	return nil
+}
+
+// intList is a list of numbers, written as "1,2,3" in flags and the
+// environment.
+type intList []int
+
+func (l *intList) String() string {
+	if l == nil {
+		return ""
+	}
+	s := make([]string, len(*l))
+	for i, n := range *l {
+		s[i] = strconv.Itoa(n)
+	}
+	return strings.Join(s, ",")
+}
+
+func (l *intList) Set(v string) error {
+	var list intList
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return err
+		}
+		list = append(list, n)
+	}
+	*l = list
+	return nil
+}
+
+func defaultConfig() Config {
+	return Config{
+		Addr:              ":8080",
+		UploadDir:         "./uploads",
+		TemplateDir:       "./templates",
+		StaticDir:         "./static",
+		ThumbDir:          "./thumbs",
+		MaxUploadMB:       50,
+		DiskReserveMB:     100,
+		MaxMegapixels:     100,
+		SrcsetWidths:      intList{320, 640, 1280, 2048},
+		RenditionCacheMB:  4096,
+		WatermarkPosition: "bottom-right",
+		WatermarkOpacity:  0.5,
+		Duplicates:        "link",
+		Moderation:        "off",
+		Comments:          "users",
+		FeedItems:         30,
+		ScreenshotURL:     "{url}",
+		Formats:           defaultFormats,
+		ScanLabels:        stringList{"nsfw", "porn", "hentai", "sexy"},
+		ScanThreshold:     0.8,
+		ScanAction:        "flag",
+		GeocodeURL:        "https://nominatim.openstreetmap.org",
+		ShutdownTimeout:   30 * time.Second,
+		TrashRetention:    30 * 24 * time.Hour,
+		RetentionInterval: 24 * time.Hour,
+		ImportTimeout:     30 * time.Second,
+		UploadRateBurst:   10,
+		ListRateBurst:     60,
+		UploadConcurrency: 32,
+		MaxQueuedJobs:     1000,
+		HTTPAddr:          ":80",
+		CORSMethods:       stringList{"GET", "HEAD", "POST", "PATCH", "DELETE"},
+		HEICConverter:     "heif-convert",
+		FFmpeg:            "ffmpeg",
+		FFprobe:           "ffprobe",
+		Workers:           runtime.NumCPU(),
+		JobAttempts:       3,
+		LogLevel:          "info",
+		LogFormat:         "text",
+		Storage:           "local",
+		S3UseSSL:          true,
+		Compress:          true,
+
+		ContentSecurityPolicy: defaultCSP,
+		FrameOptions:          "DENY",
+		ReferrerPolicy:        "strict-origin-when-cross-origin",
+	}
+}
+
+// bindFlags registers one flag per setting, writing into c.
+func (c *Config) bindFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Addr, "addr", c.Addr, "listen address")
+	fs.StringVar(&c.UploadDir, "upload-dir", c.UploadDir, "directory for uploaded images")
+	fs.StringVar(&c.TemplateDir, "template-dir", c.TemplateDir, "directory with HTML templates")
+	fs.StringVar(&c.StaticDir, "static-dir", c.StaticDir, "directory with static assets")
+	fs.StringVar(&c.ThumbDir, "thumb-dir", c.ThumbDir, "thumbnail cache directory")
+	fs.StringVar(&c.DBPath, "db", c.DBPath, "metadata database (default <upload-dir>/.gallery.db)")
+	fs.Int64Var(&c.MaxUploadMB, "max-upload-mb", c.MaxUploadMB, "maximum size of a single upload in MB")
+	fs.Int64Var(&c.DiskReserveMB, "disk-reserve-mb", c.DiskReserveMB, "free space in MB to keep on the upload filesystem")
+	fs.Int64Var(&c.MaxMegapixels, "max-megapixels", c.MaxMegapixels, "largest image in megapixels that is accepted and decoded, 0 for no limit")
+	fs.Var(&c.SrcsetWidths, "srcset-widths", "comma separated thumbnail widths rendered for srcset, empty for none")
+	fs.Var(&c.ImagePresets, "image-presets", "comma separated /img/ query strings anyone may request, such as w=800&h=600&fit=cover")
+	fs.Int64Var(&c.RenditionCacheMB, "rendition-cache-mb", c.RenditionCacheMB, "largest size in MB of the cached thumbnails and renditions, 0 for no limit")
+	fs.StringVar(&c.Watermark, "watermark", c.Watermark, "image file drawn as the watermark of watermarked albums")
+	fs.StringVar(&c.WatermarkText, "watermark-text", c.WatermarkText, "text drawn as the watermark of watermarked albums")
+	fs.StringVar(&c.WatermarkPosition, "watermark-position", c.WatermarkPosition, "watermark position: top-left, top-right, bottom-left, bottom-right or center")
+	fs.Float64Var(&c.WatermarkOpacity, "watermark-opacity", c.WatermarkOpacity, "watermark opacity between 0 and 1")
+	fs.Int64Var(&c.QuotaMB, "quota-mb", c.QuotaMB, "total storage quota in MB, 0 for none")
+	fs.Int64Var(&c.UserQuotaMB, "user-quota-mb", c.UserQuotaMB, "storage quota of each user in MB, 0 for none")
+	fs.StringVar(&c.LogLevel, "log-level", c.LogLevel, "log level: debug, info, warn or error")
+	fs.StringVar(&c.LogFormat, "log-format", c.LogFormat, "log format: text or json")
+	fs.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", c.ShutdownTimeout, "how long to wait for in-flight requests on shutdown")
+	fs.DurationVar(&c.TrashRetention, "trash-retention", c.TrashRetention, "how long deleted images can be restored (0 deletes immediately)")
+	fs.Var(&c.Retention, "retention", "comma separated retention rules, e.g. unalbumed-older-than:90d,max-total:10GB")
+	fs.DurationVar(&c.RetentionInterval, "retention-interval", c.RetentionInterval, "how often the retention rules are applied")
+	fs.BoolVar(&c.RetentionDryRun, "retention-dry-run", c.RetentionDryRun, "only log what the retention rules would remove")
+	fs.BoolVar(&c.StripExif, "strip-exif", c.StripExif, "remove EXIF, GPS and other metadata from every upload")
+	fs.Var(&c.Formats, "formats", "comma separated upload formats: jpeg, png, gif, webp, bmp, tiff, avif, heic, svg, mp4, webm, mov")
+	fs.BoolVar(&c.Reencode, "reencode", c.Reencode, "decode and re-encode every image upload, dropping anything but the pixels")
+	fs.StringVar(&c.Duplicates, "duplicates", c.Duplicates, "handling of re-uploaded files: link, reject or allow")
+	fs.StringVar(&c.Clamd, "clamd", c.Clamd, "ClamAV daemon checking uploads for malware: socket path or host:port")
+	fs.StringVar(&c.MalwareCommand, "malware-command", c.MalwareCommand, "malware scanner run as <cmd> file, exiting 1 for infected files (like clamscan)")
+	fs.StringVar(&c.ScanCommand, "scan-command", c.ScanCommand, "content scanner run as <cmd> file mime, printing JSON label scores")
+	fs.StringVar(&c.ScanURL, "scan-url", c.ScanURL, "content scanner API the upload is POSTed to, answering with JSON label scores")
+	fs.Var(&c.ScanLabels, "scan-labels", "comma separated scanner labels that flag an image")
+	fs.Float64Var(&c.ScanThreshold, "scan-threshold", c.ScanThreshold, "score from which a scan label flags an image")
+	fs.StringVar(&c.ScanAction, "scan-action", c.ScanAction, "what happens to flagged images: flag or quarantine (hold for review)")
+	fs.StringVar(&c.Geocoder, "geocoder", c.Geocoder, "turn GPS positions into places: nominatim or offline (empty for none)")
+	fs.StringVar(&c.GeocodeURL, "geocode-url", c.GeocodeURL, "Nominatim server for -geocoder nominatim")
+	fs.StringVar(&c.GeocodeData, "geocode-data", c.GeocodeData, "GeoNames cities file for -geocoder offline")
+	fs.StringVar(&c.Moderation, "moderation", c.Moderation, "hold uploads for review: off, guests (guest links) or users (non-admin accounts too)")
+	fs.StringVar(&c.Comments, "comments", c.Comments, "who may comment on images: off, users or anyone (visitors after a captcha, held for approval)")
+	fs.IntVar(&c.FeedItems, "feed-items", c.FeedItems, "latest uploads in the RSS feed /feed.xml (0 for no feed)")
+	fs.StringVar(&c.ScreenshotURL, "screenshot-url", c.ScreenshotURL, "link handed to screenshot tools, from {url} (the file), {page}, {thumb}, {id} and {origin}")
+	fs.StringVar(&c.HEICConverter, "heic-converter", c.HEICConverter, "command converting HEIC uploads to JPEG, run as <cmd> in out.jpg (empty rejects HEIC)")
+	fs.BoolVar(&c.KeepHEICOriginal, "keep-heic-original", c.KeepHEICOriginal, "store the HEIC original next to the converted JPEG")
+	fs.StringVar(&c.FFmpeg, "ffmpeg", c.FFmpeg, "ffmpeg binary for video posters (empty refuses videos)")
+	fs.StringVar(&c.FFprobe, "ffprobe", c.FFprobe, "ffprobe binary for video dimensions")
+	fs.StringVar(&c.AVIFEnc, "avifenc", c.AVIFEnc, "avifenc binary for AVIF renditions (empty for none)")
+	fs.StringVar(&c.CJXL, "cjxl", c.CJXL, "cjxl binary for JPEG XL renditions (empty for none)")
+	fs.IntVar(&c.Workers, "workers", c.Workers, "background workers processing uploads")
+	fs.IntVar(&c.JobAttempts, "job-attempts", c.JobAttempts, "tries for a failing background job")
+	fs.DurationVar(&c.ImportTimeout, "import-timeout", c.ImportTimeout, "time limit for fetching an image by URL")
+	fs.BoolVar(&c.ImportAllowPrivate, "import-allow-private", c.ImportAllowPrivate, "allow URL imports from private and loopback addresses")
+	fs.Var(&c.HotFolders, "hot-folders", "comma separated directories whose files are imported and removed")
+	fs.StringVar(&c.HotFolderOwner, "hot-folder-owner", c.HotFolderOwner, "username the hot folder imports belong to (with -accounts)")
+	fs.Float64Var(&c.UploadRateLimit, "upload-rate-limit", c.UploadRateLimit, "uploads per minute and client (0 for no limit)")
+	fs.IntVar(&c.UploadRateBurst, "upload-rate-burst", c.UploadRateBurst, "uploads a client may send at once before the limit applies")
+	fs.Float64Var(&c.ListRateLimit, "list-rate-limit", c.ListRateLimit, "listing requests per minute and client (0 for no limit)")
+	fs.IntVar(&c.ListRateBurst, "list-rate-burst", c.ListRateBurst, "listing requests a client may send at once before the limit applies")
+	fs.IntVar(&c.UploadConcurrency, "upload-concurrency", c.UploadConcurrency, "uploads received at once, more get 503 (0 for no cap)")
+	fs.IntVar(&c.MaxQueuedJobs, "max-queued-jobs", c.MaxQueuedJobs, "uploads waiting for processing from which new ones get 503 (0 for no cap)")
+	fs.StringVar(&c.TLSCert, "tls-cert", c.TLSCert, "TLS certificate file (PEM), with -tls-key")
+	fs.StringVar(&c.TLSKey, "tls-key", c.TLSKey, "TLS private key file (PEM)")
+	fs.Var(&c.AutocertDomains, "autocert-domains", "comma separated domains to get Let's Encrypt certificates for")
+	fs.StringVar(&c.AutocertEmail, "autocert-email", c.AutocertEmail, "contact address for Let's Encrypt")
+	fs.StringVar(&c.AutocertCacheDir, "autocert-cache-dir", c.AutocertCacheDir, "certificate cache (default <upload-dir>/.autocert)")
+	fs.StringVar(&c.HTTPAddr, "http-addr", c.HTTPAddr, "plain HTTP listener for ACME challenges and redirects in autocert mode")
+	fs.Var(&c.Webhooks, "webhooks", "comma separated webhook URLs for image events")
+	fs.StringVar(&c.WebhookSecret, "webhook-secret", c.WebhookSecret, "key for the HMAC-SHA256 signature of webhook payloads")
+	fs.StringVar(&c.Storage, "storage", c.Storage, "storage backend for originals: local or s3")
+	fs.Var(&c.SourceDirs, "source-dirs", "comma separated directories shown read-only in the gallery, an album per folder")
+	fs.BoolVar(&c.FollowSymlinks, "follow-symlinks", c.FollowSymlinks, "follow symlinks in source-dirs")
+	fs.StringVar(&c.S3Endpoint, "s3-endpoint", c.S3Endpoint, "S3 endpoint host[:port]")
+	fs.StringVar(&c.S3Bucket, "s3-bucket", c.S3Bucket, "S3 bucket name")
+	fs.StringVar(&c.S3Prefix, "s3-prefix", c.S3Prefix, "key prefix inside the bucket")
+	fs.StringVar(&c.S3Region, "s3-region", c.S3Region, "S3 region")
+	fs.StringVar(&c.S3AccessKey, "s3-access-key", c.S3AccessKey, "S3 access key")
+	fs.StringVar(&c.S3SecretKey, "s3-secret-key", c.S3SecretKey, "S3 secret key")
+	fs.BoolVar(&c.S3UseSSL, "s3-use-ssl", c.S3UseSSL, "use HTTPS for S3")
+	fs.Var(&c.APIKeys, "api-keys", "API keys as name:key,name2:key2 (required for uploads when set)")
+	fs.BoolVar(&c.ProtectReads, "protect-reads", c.ProtectReads, "require an API key for reads too")
+	fs.Var(&c.EmbedOrigins, "embed-origins", "comma separated sites that may embed albums with /embed/{album}, * for any")
+	fs.Var(&c.CORSOrigins, "cors-origins", "comma separated origins allowed to call the API from the browser, * for any")
+	fs.Var(&c.CORSMethods, "cors-methods", "comma separated methods allowed cross-origin")
+	fs.BoolVar(&c.CORSCredentials, "cors-credentials", c.CORSCredentials, "let the allowed origins send cookies and API keys")
+	fs.StringVar(&c.ContentSecurityPolicy, "csp", c.ContentSecurityPolicy, "Content-Security-Policy header, empty for none")
+	fs.StringVar(&c.FrameOptions, "frame-options", c.FrameOptions, "X-Frame-Options header: DENY, SAMEORIGIN or empty for none")
+	fs.StringVar(&c.ReferrerPolicy, "referrer-policy", c.ReferrerPolicy, "Referrer-Policy header, empty for none")
+	fs.BoolVar(&c.Tracing, "tracing", c.Tracing, "log spans of requests, uploads and storage calls (W3C trace context)")
+	fs.StringVar(&c.DebugAddr, "debug-addr", c.DebugAddr, "listen address for pprof and runtime stats, e.g. 127.0.0.1:6060; empty for none")
+	fs.BoolVar(&c.Compress, "compress", c.Compress, "gzip text and JSON responses")
+	fs.BoolVar(&c.TrustProxy, "trust-proxy", c.TrustProxy, "take client address and host from X-Forwarded-For and X-Forwarded-Host")
+	fs.StringVar(&c.BasePath, "base-path", c.BasePath, "serve under this sub-path, e.g. /gallery")
+	fs.BoolVar(&c.Accounts, "accounts", c.Accounts, "enable user accounts with per-user galleries")
+	fs.BoolVar(&c.AllowRegistration, "allow-registration", c.AllowRegistration, "let anyone register an account")
+}
+
+// loadConfig reads the configuration for command name from args, the
+// environment and the config file. extra, if set, adds the command's own
+// flags. The arguments after the flags are returned.
+func loadConfig(name string, args []string, extra func(fs *flag.FlagSet)) (Config, []string, error) {
+	// First pass only finds out which flags were given on the command line
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	staged := defaultConfig()
+	staged.bindFlags(fs)
+	configPath := fs.String("config", os.Getenv("GALLERY_CONFIG"), "optional YAML config file")
+	if extra != nil {
+		extra(fs)
+	}
+	if err := fs.Parse(args); err != nil {
+		return Config{}, nil, err
+	}
+	c, err := resolveConfig(fs, *configPath)
+	return c, fs.Args(), err
+}
+
+// resolveConfig layers defaults, the config file, the environment and the
+// flags given in fs, in that order.
+func resolveConfig(fs *flag.FlagSet, configPath string) (Config, error) {
+	c := defaultConfig()
+	if configPath != "" {
+		data, err := os.ReadFile(configPath)
+		if err != nil {
+			return c, err
+		}
+		if err := yaml.Unmarshal(data, &c); err != nil {
+			return c, fmt.Errorf("%s: %w", configPath, err)
+		}
+	}
+
+	final := flag.NewFlagSet("", flag.ContinueOnError)
+	c.bindFlags(final)
+	var err error
+	final.VisitAll(func(f *flag.Flag) {
+		key := "GALLERY_" + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		if v, ok := os.LookupEnv(key); ok && err == nil {
+			if err = final.Set(f.Name, v); err != nil {
+				err = fmt.Errorf("%s: %w", key, err)
+			}
+		}
+	})
+	fs.Visit(func(f *flag.Flag) {
+		// the command's own flags are none of the config's business
+		if final.Lookup(f.Name) != nil && err == nil {
+			err = final.Set(f.Name, f.Value.String())
+		}
+	})
+	if err != nil {
+		return c, err
+	}
+
+	if c.DBPath == "" {
+		c.DBPath = filepath.Join(c.UploadDir, ".gallery.db")
+	}
+	if c.AutocertCacheDir == "" {
+		c.AutocertCacheDir = filepath.Join(c.UploadDir, ".autocert")
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		return c, fmt.Errorf("tls-cert and tls-key go together")
+	}
+	if c.TLSCert != "" && len(c.AutocertDomains) > 0 {
+		return c, fmt.Errorf("use either tls-cert or autocert-domains")
+	}
+	if c.MaxUploadMB <= 0 {
+		return c, fmt.Errorf("max-upload-mb must be positive")
+	}
+	if _, err := parseRetentionRules(c.Retention); err != nil {
+		return c, err
+	}
+	if c.RetentionInterval <= 0 {
+		return c, fmt.Errorf("retention-interval must be positive")
+	}
+	switch strings.ToUpper(c.FrameOptions) {
+	case "", "DENY", "SAMEORIGIN":
+		c.FrameOptions = strings.ToUpper(c.FrameOptions)
+	default:
+		return c, fmt.Errorf("frame-options must be DENY, SAMEORIGIN or empty")
+	}
+	if err := validateCORS(c); err != nil {
+		return c, err
+	}
+	if err := validateEmbedOrigins(c.EmbedOrigins); err != nil {
+		return c, err
+	}
+	if c.BasePath, err = validateBasePath(c.BasePath); err != nil {
+		return c, err
+	}
+	if c.MaxMegapixels < 0 {
+		return c, fmt.Errorf("max-megapixels must not be negative")
+	}
+	for _, w := range c.SrcsetWidths {
+		if w < 1 || w > maxThumbSide {
+			return c, fmt.Errorf("srcset-widths must be between 1 and %d", maxThumbSide)
+		}
+	}
+	for _, p := range c.ImagePresets {
+		if _, err := url.ParseQuery(p); err != nil {
+			return c, fmt.Errorf("image-presets: %q: %w", p, err)
+		}
+	}
+	if c.RenditionCacheMB < 0 {
+		return c, fmt.Errorf("rendition-cache-mb must not be negative")
+	}
+	if c.Watermark != "" && c.WatermarkText != "" {
+		return c, fmt.Errorf("watermark and watermark-text are exclusive")
+	}
+	if !slices.Contains(watermarkPositions, c.WatermarkPosition) {
+		return c, fmt.Errorf("watermark-position must be one of %s", strings.Join(watermarkPositions, ", "))
+	}
+	if c.WatermarkOpacity <= 0 || c.WatermarkOpacity > 1 {
+		return c, fmt.Errorf("watermark-opacity must be above 0 and at most 1")
+	}
+	if c.QuotaMB < 0 || c.UserQuotaMB < 0 {
+		return c, fmt.Errorf("quota-mb and user-quota-mb must not be negative")
+	}
+	if c.ImportTimeout <= 0 {
+		return c, fmt.Errorf("import-timeout must be positive")
+	}
+	for _, dir := range c.HotFolders {
+		if inDir(dir, c.UploadDir) {
+			return c, fmt.Errorf("hot folder %s must not be in upload-dir", dir)
+		}
+	}
+	if len(c.SourceDirs) > 0 && c.Storage != "" && c.Storage != "local" {
+		return c, fmt.Errorf("source-dirs need local storage")
+	}
+	for _, dir := range c.SourceDirs {
+		if inDir(dir, c.UploadDir) || inDir(c.UploadDir, dir) {
+			return c, fmt.Errorf("source directory %s must not overlap upload-dir", dir)
+		}
+	}
+	if c.Duplicates != "link" && c.Duplicates != "reject" && c.Duplicates != "allow" {
+		return c, fmt.Errorf("duplicates must be link, reject or allow")
+	}
+	switch c.Moderation {
+	case "off":
+	case "guests", "users":
+		// without them every visitor is an admin, with nobody to review for
+		if len(c.APIKeys) == 0 && !c.Accounts {
+			return c, fmt.Errorf("moderation needs api keys or accounts")
+		}
+		if c.Moderation == "users" && !c.Accounts {
+			return c, fmt.Errorf("moderation users needs accounts")
+		}
+	default:
+		return c, fmt.Errorf("moderation must be off, guests or users")
+	}
+	if c.FeedItems < 0 || c.FeedItems > maxPageSize {
+		return c, fmt.Errorf("feed-items must be between 0 and %d", maxPageSize)
+	}
+	if err := validateScreenshotURL(c.ScreenshotURL); err != nil {
+		return c, err
+	}
+	switch c.Comments {
+	case "off", "users":
+	case "anyone":
+		// visitors only comment on what they can read
+		if c.ProtectReads || c.Accounts {
+			return c, fmt.Errorf("comments anyone needs a gallery visitors can read, without protect-reads or accounts")
+		}
+	default:
+		return c, fmt.Errorf("comments must be off, users or anyone")
+	}
+	if c.Clamd != "" && c.MalwareCommand != "" {
+		return c, fmt.Errorf("set clamd or malware-command, not both")
+	}
+	if c.ScanCommand != "" && c.ScanURL != "" {
+		return c, fmt.Errorf("set scan-command or scan-url, not both")
+	}
+	if c.ScanThreshold < 0 || c.ScanThreshold > 1 {
+		return c, fmt.Errorf("scan-threshold must be between 0 and 1")
+	}
+	if c.ScanAction != "flag" && c.ScanAction != "quarantine" {
+		return c, fmt.Errorf("scan-action must be flag or quarantine")
+	}
+	switch c.Geocoder {
+	case "", "nominatim":
+	case "offline":
+		if c.GeocodeData == "" {
+			return c, fmt.Errorf("geocoder offline needs geocode-data")
+		}
+	default:
+		return c, fmt.Errorf("geocoder must be nominatim or offline")
+	}
+	for _, name := range c.Formats {
+		if _, ok := formatByName(name); !ok {
+			return c, fmt.Errorf("unknown format %q", name)
+		}
+	}
+	if c.Workers < 1 || c.JobAttempts < 1 {
+		return c, fmt.Errorf("workers and job-attempts must be positive")
+	}
+	if c.UploadConcurrency < 0 || c.MaxQueuedJobs < 0 {
+		return c, fmt.Errorf("upload-concurrency and max-queued-jobs must not be negative")
+	}
+	return c, nil
+}
+
+// inDir reports whether path is dir or in it.
+func inDir(path, dir string) bool {
+	path, _ = filepath.Abs(path)
+	dir, _ = filepath.Abs(dir)
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+func (c Config) maxUploadBytes() int64 { return c.MaxUploadMB * 1024 * 1024 }
+
+func (c Config) diskReserveBytes() int64 { return c.DiskReserveMB * 1024 * 1024 }
+
+func (c Config) quotaBytes() int64 { return c.QuotaMB * 1024 * 1024 }
+
+func (c Config) userQuotaBytes() int64 { return c.UserQuotaMB * 1024 * 1024 }
+
+// sessionDir holds in-progress chunked uploads. It sits inside the upload
+// directory so finished files can be renamed into place atomically.
+func (c Config) sessionDir() string { return filepath.Join(c.UploadDir, ".sessions") }
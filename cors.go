@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// CORS lets web apps on other sites use the API. withCORS wraps the whole
+// server, so preflights and the actual requests get the same answer:
+// origins in cfg.CORSOrigins ("*" for any) are allowed cfg.CORSMethods,
+// the headers the API and tus read, and with cfg.CORSCredentials cookies
+// and API keys. Other origins get no CORS headers, and their preflights
+// 403. Without configured origins only the gallery's own pages can call
+// the API, as browsers do by default.
+
+const (
+	corsAllowHeaders  = "Content-Type, Content-Range, Authorization, X-API-Key, X-CSRF-Token, X-Request-ID, X-Upload-ID, Idempotency-Key, If-None-Match, traceparent, Tus-Resumable, Upload-Length, Upload-Offset, Upload-Metadata"
+	corsExposeHeaders = "Location, Link, Deprecation, Retry-After, X-Request-ID, Idempotent-Replayed, traceparent, X-Image-Id, Tus-Resumable, Tus-Version, Tus-Extension, Tus-Max-Size, Upload-Offset, Upload-Length, Upload-Expires"
+	corsMaxAge        = "600"
+)
+
+func validateCORS(c Config) error {
+	for _, o := range c.CORSOrigins {
+		if o == "*" {
+			if c.CORSCredentials {
+				return fmt.Errorf(`cors-credentials cannot be used with the origin "*"`)
+			}
+			continue
+		}
+		u, err := url.Parse(o)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || strings.TrimSuffix(u.Path, "/") != "" {
+			return fmt.Errorf("cors origin %q must be like https://example.com", o)
+		}
+	}
+	for _, m := range c.CORSMethods {
+		if m != strings.ToUpper(m) || strings.ContainsAny(m, " ,") {
+			return fmt.Errorf("cors method %q must be an upper case method name", m)
+		}
+	}
+	return nil
+}
+
+// corsOrigin returns what Access-Control-Allow-Origin says to origin, or
+// "" if it is not allowed.
+func corsOrigin(origin string) string {
+	for _, o := range cfg.CORSOrigins {
+		if o == "*" {
+			return "*"
+		}
+		if strings.EqualFold(strings.TrimSuffix(o, "/"), origin) {
+			return origin
+		}
+	}
+	return ""
+}
+
+func withCORS(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		preflight := r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != ""
+		if origin == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		// caches must not hand one origin's answer to another
+		w.Header().Add("Vary", "Origin")
+		allowed := corsOrigin(origin)
+		if allowed == "" {
+			if preflight {
+				writeProblem(w, http.StatusForbidden, "origin_not_allowed", "Origin not allowed", nil)
+				return
+			}
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Origin", allowed)
+		if cfg.CORSCredentials {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+		if !preflight {
+			w.Header().Set("Access-Control-Expose-Headers", corsExposeHeaders)
+			h.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Methods", strings.Join(cfg.CORSMethods, ", ")+", OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", corsAllowHeaders)
+		w.Header().Set("Access-Control-Max-Age", corsMaxAge)
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
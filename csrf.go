@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// Browsers send the gallery's cookies along with requests that other sites
+// make, so a page elsewhere could upload or delete on behalf of a logged in
+// user. csrfProtect stops that with a double submit token: the pages put
+// the token of the gallery_csrf cookie into
+//
+//	<meta name="csrf-token" content="{{.CSRFToken}}">
+//
+// (forms into a csrf_token field), the scripts send it back as
+// X-CSRF-Token, and changing requests that carry the gallery's cookies
+// must match the cookie. Requests with an API key and no cookies are not
+// checked; no other site can make a browser send those. Scripts that log
+// in with a cookie jar get a token from GET /api/v1/auth/csrf.
+
+const (
+	csrfCookie = "gallery_csrf"
+	csrfHeader = "X-CSRF-Token"
+	csrfField  = "csrf_token"
+)
+
+// secureRequest reports whether the client talks HTTPS to us, directly
+// or through a trusted proxy, see fromProxy; cookies are marked Secure then.
+func secureRequest(r *http.Request) bool {
+	https, _ := r.Context().Value(proxiedHTTPS{}).(bool)
+	return r.TLS != nil || https
+}
+
+// csrfToken returns the token of the browser, handing out a new one if it
+// has none yet. Pages pass it to their template.
+func csrfToken(w http.ResponseWriter, r *http.Request) string {
+	if c, err := r.Cookie(csrfCookie); err == nil && len(c.Value) == 32 {
+		return c.Value
+	}
+	token := randomString(32)
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    token,
+		Path:     sitePath("/"),
+		HttpOnly: true,
+		Secure:   secureRequest(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+	// later reads in this request see it too
+	r.AddCookie(&http.Cookie{Name: csrfCookie, Value: token})
+	return token
+}
+
+// hasGalleryCookies reports whether the browser sent credentials in
+// cookies, which is what a forged request would ride on.
+func hasGalleryCookies(r *http.Request) bool {
+	for _, c := range r.Cookies() {
+		if c.Name == sessionCookie || c.Name == csrfCookie || strings.HasPrefix(c.Name, "gallery_album_") {
+			return true
+		}
+	}
+	return false
+}
+
+func csrfProtect(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET", "HEAD", "OPTIONS":
+			h.ServeHTTP(w, r)
+			return
+		}
+		if !hasGalleryCookies(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		sent := r.Header.Get(csrfHeader)
+		if sent == "" && strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+			sent = r.PostFormValue(csrfField)
+		}
+		c, err := r.Cookie(csrfCookie)
+		if err != nil || sent == "" || subtle.ConstantTimeCompare([]byte(sent), []byte(c.Value)) != 1 {
+			if strings.HasPrefix(r.URL.Path, "/api") {
+				writeProblem(w, http.StatusForbidden, "csrf_token", "Missing or invalid CSRF token", nil)
+			} else {
+				http.Error(w, "Missing or invalid CSRF token, reload the page", http.StatusForbidden)
+			}
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
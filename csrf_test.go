@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCSRFProtect(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	h := csrfProtect(ok)
+	session := &http.Cookie{Name: sessionCookie, Value: "s"}
+	token := strings.Repeat("a", 32)
+	csrf := &http.Cookie{Name: csrfCookie, Value: token}
+
+	tests := []struct {
+		name    string
+		method  string
+		path    string
+		header  string // X-CSRF-Token
+		form    string // csrf_token field
+		cookies []*http.Cookie
+		want    int
+	}{
+		{"read with cookies", "GET", "/api/v1/images", "", "", []*http.Cookie{session}, http.StatusOK},
+		{"no cookies", "POST", "/api/v1/images", "", "", nil, http.StatusOK},
+		{"session without token", "POST", "/api/v1/images", "", "", []*http.Cookie{session}, http.StatusForbidden},
+		{"header without cookie", "POST", "/api/v1/images", token, "", []*http.Cookie{session}, http.StatusForbidden},
+		{"wrong header", "DELETE", "/api/v1/images/a.png", strings.Repeat("b", 32), "", []*http.Cookie{session, csrf}, http.StatusForbidden},
+		{"matching header", "DELETE", "/api/v1/images/a.png", token, "", []*http.Cookie{session, csrf}, http.StatusOK},
+		{"matching form field", "POST", "/d/x", "", token, []*http.Cookie{session, csrf}, http.StatusOK},
+		{"wrong form field", "POST", "/d/x", "", "nope", []*http.Cookie{session, csrf}, http.StatusForbidden},
+		{"album cookie without token", "POST", "/a/locked", "", "", []*http.Cookie{{Name: albumCookie("locked"), Value: "v"}}, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var r *http.Request
+			if tt.form != "" {
+				r = httptest.NewRequest(tt.method, tt.path, strings.NewReader(url.Values{csrfField: {tt.form}}.Encode()))
+				r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			} else {
+				r = httptest.NewRequest(tt.method, tt.path, nil)
+			}
+			if tt.header != "" {
+				r.Header.Set(csrfHeader, tt.header)
+			}
+			for _, c := range tt.cookies {
+				r.AddCookie(c)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Errorf("got %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+}
+
+func TestSecureRequestTrustsOnlyProxies(t *testing.T) {
+	saved := cfg
+	t.Cleanup(func() { cfg = saved })
+	for _, trust := range []bool{false, true} {
+		cfg.TrustProxy = trust
+		var secure bool
+		h := fromProxy(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { secure = secureRequest(r) }))
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("X-Forwarded-Proto", "https")
+		h.ServeHTTP(httptest.NewRecorder(), r)
+		if secure != trust {
+			t.Errorf("trust-proxy %v: X-Forwarded-Proto https made the request secure: %v", trust, secure)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"time"
+)
+
+// cfg.DebugAddr starts a second listener for profiling, kept off the public
+// one:
+//
+//	/debug/pprof/   the net/http/pprof profiles (heap, allocs, goroutine,
+//	                profile?seconds=, trace?seconds=, ...)
+//	GET /debug/runtime  heap and GC numbers as JSON
+//
+// Bind it to localhost or an internal network. When API keys or accounts are
+// configured it also wants an admin's key or session, like the admin API.
+// The gallery itself serves its own mux, so the handlers net/http/pprof
+// registers on the default one are never exposed.
+
+type runtimeStats struct {
+	Goroutines   int       `json:"goroutines"`
+	GOMAXPROCS   int       `json:"gomaxprocs"`
+	HeapAlloc    uint64    `json:"heap_alloc"`
+	HeapInuse    uint64    `json:"heap_inuse"`
+	HeapIdle     uint64    `json:"heap_idle"`
+	HeapReleased uint64    `json:"heap_released"`
+	HeapObjects  uint64    `json:"heap_objects"`
+	TotalAlloc   uint64    `json:"total_alloc"`
+	Sys          uint64    `json:"sys"`
+	NextGC       uint64    `json:"next_gc"`
+	NumGC        uint32    `json:"num_gc"`
+	PauseTotal   float64   `json:"gc_pause_total_seconds"`
+	LastPause    float64   `json:"gc_last_pause_seconds"`
+	LastGC       time.Time `json:"last_gc,omitempty"`
+}
+
+func debugHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/debug/runtime", handleRuntimeStats)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(cfg.APIKeys) > 0 || cfg.Accounts {
+			if p, _ := resolvePrincipal(r); !p.Admin {
+				writeJSONError(w, "Admin credentials required", http.StatusUnauthorized)
+				return
+			}
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func handleRuntimeStats(w http.ResponseWriter, r *http.Request) {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	s := runtimeStats{
+		Goroutines:   runtime.NumGoroutine(),
+		GOMAXPROCS:   runtime.GOMAXPROCS(0),
+		HeapAlloc:    m.HeapAlloc,
+		HeapInuse:    m.HeapInuse,
+		HeapIdle:     m.HeapIdle,
+		HeapReleased: m.HeapReleased,
+		HeapObjects:  m.HeapObjects,
+		TotalAlloc:   m.TotalAlloc,
+		Sys:          m.Sys,
+		NextGC:       m.NextGC,
+		NumGC:        m.NumGC,
+		PauseTotal:   time.Duration(m.PauseTotalNs).Seconds(),
+	}
+	if m.NumGC > 0 {
+		s.LastPause = time.Duration(m.PauseNs[(m.NumGC+255)%256]).Seconds()
+		s.LastGC = time.Unix(0, int64(m.LastGC)).UTC()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
+
+// serveDebug runs the debug listener until srv shuts down.
+func serveDebug(srv *http.Server) {
+	if cfg.DebugAddr == "" {
+		return
+	}
+	dbg := &http.Server{Addr: cfg.DebugAddr, Handler: debugHandler(), ReadHeaderTimeout: 10 * time.Second}
+	srv.RegisterOnShutdown(func() { dbg.Close() })
+	go func() {
+		slog.Info("Debug listener starting", "addr", cfg.DebugAddr)
+		if err := dbg.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fatal("Debug listener", "err", err)
+		}
+	}()
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !freebsd
+
+package main
+
+import "errors"
+
+// freeSpace is not implemented on this platform; callers treat the error as
+// "unknown" and skip the check.
+func freeSpace(dir string) (uint64, error) {
+	return 0, errors.New("free space check not supported on this platform")
+}
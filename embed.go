@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Every image the visitor may see has a page of its own, /i/{id}, with
+// OpenGraph and Twitter card tags, so links to it posted to chat apps and
+// social networks unfurl with a preview. The page names its oEmbed
+// endpoint,
+//
+//	GET /oembed?url=https://gallery.example/i/{id}&maxwidth=600&maxheight=400
+//
+// which answers with a photo, or a video player, fitting the bounds.
+// Only JSON is offered. Both are public pages; images the visitor cannot
+// see are not found, so previews show only what anyone may open.
+
+// previewWidth is the width of the thumbnail previews show.
+const previewWidth = 1280
+
+var imagePageTemplate = template.Must(template.New("image").Parse(`<!doctype html>
+<html lang="cs">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<link rel="canonical" href="{{.PageURL}}">
+<link rel="alternate" type="application/json+oembed" href="{{.OEmbedURL}}" title="{{.Title}}">
+<meta property="og:site_name" content="AI-Morph Galerie">
+<meta property="og:type" content="{{if .Video}}video.other{{else}}website{{end}}">
+<meta property="og:title" content="{{.Title}}">
+<meta property="og:url" content="{{.PageURL}}">
+{{if .Description}}<meta property="og:description" content="{{.Description}}">
+<meta name="description" content="{{.Description}}">
+{{end}}{{if .PreviewURL}}<meta property="og:image" content="{{.PreviewURL}}">
+<meta property="og:image:width" content="{{.PreviewWidth}}">
+<meta property="og:image:height" content="{{.PreviewHeight}}">
+<meta property="og:image:alt" content="{{.Alt}}">
+{{end}}{{if .Video}}<meta property="og:video" content="{{.FileURL}}">
+<meta property="og:video:type" content="{{.Meta.Mime}}">
+{{if .Meta.Width}}<meta property="og:video:width" content="{{.Meta.Width}}">
+<meta property="og:video:height" content="{{.Meta.Height}}">
+{{end}}{{end}}<meta name="twitter:card" content="{{if .PreviewURL}}summary_large_image{{else}}summary{{end}}">
+<meta name="twitter:title" content="{{.Title}}">
+{{if .Description}}<meta name="twitter:description" content="{{.Description}}">
+{{end}}{{if .PreviewURL}}<meta name="twitter:image" content="{{.PreviewURL}}">
+<meta name="twitter:image:alt" content="{{.Alt}}">
+{{end}}<link rel="stylesheet" href="{{.Base}}/static/styles.css">
+</head>
+<body class="dark">
+<main class="container">
+{{if .Video}}<video src="{{.Meta.URL}}" poster="{{.Meta.Thumb}}" controls></video>
+{{else}}<img src="{{.Meta.URL}}" alt="{{.Alt}}"{{if .Meta.Width}} width="{{.Meta.Width}}" height="{{.Meta.Height}}"{{end}} style="max-width:100%;height:auto">
+{{end}}<h1>{{.Title}}</h1>
+{{if .Meta.Description}}<p style="white-space:pre-line">{{.Meta.Description}}</p>
+{{end}}<p><a href="{{.DownloadURL}}">Stáhnout</a> · <a href="{{.Base}}/">Galerie</a></p>
+</main>
+</body>
+</html>
+`))
+
+// handleImagePage serves /i/{id}.
+func handleImagePage(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/i/")
+	if id == "" || strings.Contains(id, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	meta, ok := servableImage(r, id)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	origin := siteOrigin(r)
+	page := origin + sitePath("/i/"+meta.ID)
+	data := struct {
+		Meta                        ImageMeta
+		Title, Description, Alt     string
+		PageURL, FileURL, OEmbedURL string
+		DownloadURL                 string
+		PreviewURL                  string
+		PreviewWidth, PreviewHeight int
+		Video                       bool
+		Base                        string
+	}{
+		Meta:        meta,
+		Title:       imageTitle(meta),
+		Description: previewText(meta.Description),
+		Alt:         altOf(meta),
+		PageURL:     page,
+		FileURL:     origin + meta.URL,
+		DownloadURL: downloadURL(meta),
+		OEmbedURL:   origin + sitePath("/oembed?"+url.Values{"url": {page}, "format": {"json"}}.Encode()),
+		Video:       strings.HasPrefix(meta.Mime, "video/"),
+		Base:        cfg.BasePath,
+	}
+	if meta.Thumb != "" && meta.Width > 0 && meta.Height > 0 {
+		data.PreviewWidth, data.PreviewHeight = fitSize(meta.Width, meta.Height, previewWidth, 0)
+		data.PreviewURL = origin + thumbURL(meta, data.PreviewWidth)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "private, no-cache")
+	if err := imagePageTemplate.Execute(w, data); err != nil {
+		slog.ErrorContext(r.Context(), "Image page", "err", err)
+	}
+}
+
+type oEmbed struct {
+	Version         string `json:"version"`
+	Type            string `json:"type"`
+	Title           string `json:"title,omitempty"`
+	ProviderName    string `json:"provider_name"`
+	ProviderURL     string `json:"provider_url"`
+	URL             string `json:"url,omitempty"`  // of the photo
+	HTML            string `json:"html,omitempty"` // of the video player
+	Width           int    `json:"width"`
+	Height          int    `json:"height"`
+	ThumbnailURL    string `json:"thumbnail_url,omitempty"`
+	ThumbnailWidth  int    `json:"thumbnail_width,omitempty"`
+	ThumbnailHeight int    `json:"thumbnail_height,omitempty"`
+}
+
+// handleOEmbed serves /oembed for the URLs of image pages.
+func handleOEmbed(w http.ResponseWriter, r *http.Request) {
+	v := r.URL.Query()
+	if f := v.Get("format"); f != "" && f != "json" {
+		http.Error(w, "Only JSON is supported", http.StatusNotImplemented)
+		return
+	}
+	u, err := url.Parse(v.Get("url"))
+	if err != nil {
+		http.Error(w, "Invalid url", http.StatusBadRequest)
+		return
+	}
+	id, ok := strings.CutPrefix(u.Path, sitePath("/i/"))
+	if !ok || id == "" || strings.Contains(id, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	meta, ok := servableImage(r, id)
+	if !ok || meta.Width == 0 || meta.Height == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	maxW, err1 := thumbSide(v.Get("maxwidth"))
+	maxH, err2 := thumbSide(v.Get("maxheight"))
+	if err1 != nil || err2 != nil {
+		http.Error(w, "Invalid maxwidth or maxheight", http.StatusBadRequest)
+		return
+	}
+
+	origin := siteOrigin(r)
+	bound := previewWidth
+	if maxW > 0 && maxW < bound {
+		bound = maxW
+	}
+	width, height := fitSize(meta.Width, meta.Height, bound, maxH)
+	e := oEmbed{
+		Version:      "1.0",
+		Type:         "photo",
+		Title:        imageTitle(meta),
+		ProviderName: "AI-Morph Galerie",
+		ProviderURL:  origin + sitePath("/"),
+		Width:        width,
+		Height:       height,
+	}
+	if strings.HasPrefix(meta.Mime, "video/") {
+		e.Type = "video"
+		e.HTML = `<video src="` + template.HTMLEscapeString(origin+meta.URL) + `" poster="` +
+			template.HTMLEscapeString(origin+meta.Thumb) + `" width="` + strconv.Itoa(width) +
+			`" height="` + strconv.Itoa(height) + `" controls></video>`
+	} else if meta.Thumb != "" {
+		e.URL = origin + thumbURL(meta, width)
+	} else {
+		// served as it is, see srcset
+		e.URL = origin + meta.URL
+	}
+	if meta.Thumb != "" {
+		e.ThumbnailWidth, e.ThumbnailHeight = fitSize(meta.Width, meta.Height, defaultThumbWidth, 0)
+		e.ThumbnailURL = origin + thumbURL(meta, e.ThumbnailWidth)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "private, no-cache")
+	json.NewEncoder(w).Encode(e)
+}
+
+// imageTitle is what pages and previews call meta.
+func imageTitle(meta ImageMeta) string {
+	if meta.Title != "" {
+		return meta.Title
+	}
+	return meta.Name
+}
+
+// altOf describes meta for those who cannot see it, like altText in
+// main.js.
+func altOf(meta ImageMeta) string {
+	if meta.Alt != "" {
+		return meta.Alt
+	}
+	return imageTitle(meta)
+}
+
+// downloadURL is the URL of meta's original counted as a download, see
+// views.go.
+func downloadURL(meta ImageMeta) string {
+	if strings.Contains(meta.URL, "?") {
+		return meta.URL + "&download=1"
+	}
+	return meta.URL + "?download=1"
+}
+
+// previewText shortens a description to the one line previews show.
+func previewText(s string) string {
+	s = strings.Join(strings.Fields(s), " ")
+	if r := []rune(s); len(r) > 200 {
+		s = strings.TrimSpace(string(r[:199])) + "…"
+	}
+	return s
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// GET /api/v1/events is a Server-Sent Events stream of the same events the
+// webhooks get, so open pages can update without polling. Each message has
+// the event name as its type and the webhookEvent as data. Subscribers
+// only hear about images they are allowed to see.
+
+type subscriber struct {
+	r      *http.Request
+	events chan webhookEvent
+}
+
+var (
+	subscribersMu sync.Mutex
+	subscribers   = map[*subscriber]bool{}
+
+	// eventsDone is closed on shutdown to end all streams, which the server
+	// would otherwise wait for until its timeout.
+	eventsDone = make(chan struct{})
+)
+
+// publish hands ev to every subscriber that is keeping up; slow ones miss
+// events rather than holding up the caller.
+func publish(ev webhookEvent) {
+	subscribersMu.Lock()
+	defer subscribersMu.Unlock()
+	for s := range subscribers {
+		select {
+		case s.events <- ev:
+		default:
+		}
+	}
+}
+
+func handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeJSONError(w, "Unsupported method", http.StatusMethodNotAllowed)
+		return
+	}
+	rc := http.NewResponseController(w)
+	s := &subscriber{r: r, events: make(chan webhookEvent, 32)}
+	subscribersMu.Lock()
+	subscribers[s] = true
+	subscribersMu.Unlock()
+	defer func() {
+		subscribersMu.Lock()
+		delete(subscribers, s)
+		subscribersMu.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	// reconnect after 5s if the connection drops
+	fmt.Fprint(w, "retry: 5000\n\n")
+	if rc.Flush() != nil {
+		return
+	}
+
+	// a comment now and then keeps proxies from closing an idle stream
+	ping := time.NewTicker(30 * time.Second)
+	defer ping.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-eventsDone:
+			return
+		case <-ping.C:
+			fmt.Fprint(w, ": ping\n\n")
+		case ev := <-s.events:
+			if !subscriberSees(s, ev) {
+				continue
+			}
+			data, err := json.Marshal(ev)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", ev.ID, ev.Event, data)
+		}
+		if rc.Flush() != nil {
+			return
+		}
+	}
+}
+
+func subscriberSees(s *subscriber, ev webhookEvent) bool {
+	if ev.Permanent {
+		// the image is gone already; ownership is all that is left to check
+		return requestViewer(s.r).sees(ev.Image.Owner)
+	}
+	return canOpenImage(s.r, ev.Image)
+}
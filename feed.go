@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/xml"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// /feed.xml is an RSS 2.0 feed of the latest cfg.FeedItems uploads anyone
+// may see, so feed readers can follow the gallery. Each item encloses the
+// original. Galleries that need credentials to read have no feed, nor do
+// images in password protected albums or waiting for review. It is served
+// with the listing's validators, so readers polling it mostly get 304.
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Atom    string     `xml:"xmlns:atom,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Self          rssLink   `xml:"atom:link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate,omitempty"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr"`
+	Type string `xml:"type,attr"`
+}
+
+type rssItem struct {
+	Title       string       `xml:"title"`
+	Link        string       `xml:"link"`
+	Description string       `xml:"description,omitempty"`
+	GUID        rssGUID      `xml:"guid"`
+	PubDate     string       `xml:"pubDate"`
+	Enclosure   rssEnclosure `xml:"enclosure"`
+}
+
+type rssGUID struct {
+	ID        string `xml:",chardata"`
+	Permalink bool   `xml:"isPermaLink,attr"`
+}
+
+type rssEnclosure struct {
+	URL    string `xml:"url,attr"`
+	Length int64  `xml:"length,attr"`
+	Type   string `xml:"type,attr"`
+}
+
+// feedEnabled reports whether the gallery has a public feed.
+func feedEnabled() bool {
+	return cfg.FeedItems > 0 && publicReads()
+}
+
+func handleFeed(w http.ResponseWriter, r *http.Request) {
+	if !feedEnabled() {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := listQuery{Limit: cfg.FeedItems, Sort: "uploaded", Desc: true, HideProtected: true}
+	if listNotModified(w, r, q) {
+		return
+	}
+	list, err := listImages(q)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Feed", "err", err)
+		http.Error(w, "Could not load feed", http.StatusInternalServerError)
+		return
+	}
+
+	origin := siteOrigin(r)
+	feed := rssFeed{Version: "2.0", Atom: "http://www.w3.org/2005/Atom", Channel: rssChannel{
+		Title:       "AI-Morph Galerie",
+		Link:        origin + sitePath("/"),
+		Self:        rssLink{Href: origin + sitePath("/feed.xml"), Rel: "self", Type: "application/rss+xml"},
+		Description: "Nejnovější obrázky v galerii",
+	}}
+	for _, m := range list.Images {
+		if m.Processing {
+			continue
+		}
+		description := m.Description
+		if description == "" {
+			description = m.Alt
+		}
+		feed.Channel.Items = append(feed.Channel.Items, rssItem{
+			Title:       imageTitle(m),
+			Link:        origin + m.URL,
+			Description: description,
+			GUID:        rssGUID{ID: m.ID},
+			PubDate:     m.Uploaded.Format(time.RFC1123Z),
+			Enclosure:   rssEnclosure{URL: origin + m.URL, Length: m.Size, Type: m.Mime},
+		})
+	}
+	if len(list.Images) > 0 {
+		feed.Channel.LastBuildDate = list.Images[0].Uploaded.Format(time.RFC1123Z)
+	}
+
+	out, err := xml.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		http.Error(w, "Could not encode feed", http.StatusInternalServerError)
+		return
+	}
+	out = append([]byte(xml.Header), out...)
+	w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+	w.Write(out)
+}
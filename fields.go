@@ -0,0 +1,102 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Images can carry custom fields, free key/value pairs such as client,
+// project or license, set along with the title:
+//
+//	PATCH /api/v1/images/{id}   {"fields": {"client": "ACME", "license": null}}
+//
+// merges them in, null removing a field. Keys are lower case letters,
+// digits and "_-."; values are one line. The listing returns them, the
+// search finds their keys and values, ?field=key:value filters on one,
+// ignoring case, and ZIP archives list them in metadata.json.
+
+const (
+	maxFields           = 50
+	maxFieldKeyLength   = 64
+	maxFieldValueLength = 1000
+)
+
+var fieldKeyPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]*$`)
+
+// normalizeFieldKey lower-cases and trims a key; it returns "" for keys
+// that cannot be stored.
+func normalizeFieldKey(key string) string {
+	key = strings.ToLower(strings.TrimSpace(key))
+	if len(key) > maxFieldKeyLength || !fieldKeyPattern.MatchString(key) {
+		return ""
+	}
+	return key
+}
+
+// parseFieldFilter reads a ?field= filter, "key:value".
+func parseFieldFilter(s string) ([2]string, error) {
+	key, value, ok := strings.Cut(s, ":")
+	key = normalizeFieldKey(key)
+	if !ok || key == "" {
+		return [2]string{}, errors.New("Invalid field, expected key:value")
+	}
+	return [2]string{key, strings.TrimSpace(value)}, nil
+}
+
+var errTooManyFields = fmt.Errorf("At most %d fields per image", maxFields)
+
+// cleanFields normalizes the keys and values of a fields update.
+func cleanFields(fields map[string]*string) (map[string]*string, error) {
+	clean := make(map[string]*string, len(fields))
+	for k, v := range fields {
+		key := normalizeFieldKey(k)
+		if key == "" {
+			return nil, fmt.Errorf("Invalid field key: %q", k)
+		}
+		if v != nil {
+			value := strings.Join(strings.Fields(*v), " ")
+			if utf8.RuneCountInString(value) > maxFieldValueLength {
+				return nil, fmt.Errorf("Field %s is too long, at most %d characters", key, maxFieldValueLength)
+			}
+			v = &value
+		}
+		clean[key] = v
+	}
+	return clean, nil
+}
+
+// setImageFields merges cleaned fields into those of the image id,
+// removing the ones set to nil. It fails with errTooManyFields when the
+// image would end up with more than maxFields.
+func setImageFields(tx *sql.Tx, id string, fields map[string]*string) error {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		var err error
+		if v := fields[key]; v == nil {
+			_, err = tx.Exec(`DELETE FROM image_fields WHERE image_id = ? AND key = ?`, id, key)
+		} else {
+			_, err = tx.Exec(`INSERT INTO image_fields (image_id, key, value) VALUES (?, ?, ?)
+				ON CONFLICT(image_id, key) DO UPDATE SET value = excluded.value`, id, key, *v)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	var n int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM image_fields WHERE image_id = ?`, id).Scan(&n); err != nil {
+		return err
+	}
+	if n > maxFields {
+		return errTooManyFields
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/tiff"
+)
+
+// The formats accepted for upload are cfg.Formats, names from
+// mediaFormats. Uploads are recognized by their content, never by their
+// name, and stored with the format's extension. Formats Go decodes get
+// the pixel limit, thumbnails and placeholders; AVIF and SVG are served
+// as they are, their renditions being the original. HEIC is converted to
+// JPEG and also needs cfg.HEICConverter, videos need cfg.FFmpeg and SVGs
+// are sanitized (svg.go). Files already stored stay servable when their
+// format is taken off the list; it only governs what comes in.
+
+type mediaFormat struct {
+	name    string
+	mime    string
+	exts    []string // the first is given to uploads; none for HEIC
+	decodes bool     // Go decodes it
+}
+
+var mediaFormats = []mediaFormat{
+	{"jpeg", "image/jpeg", []string{".jpg", ".jpeg"}, true},
+	{"png", "image/png", []string{".png"}, true},
+	{"gif", "image/gif", []string{".gif"}, true},
+	{"webp", "image/webp", []string{".webp"}, true},
+	{"bmp", "image/bmp", []string{".bmp"}, true},
+	{"tiff", "image/tiff", []string{".tif", ".tiff"}, true},
+	{"avif", "image/avif", []string{".avif"}, false},
+	{"heic", "image/heic", nil, false},
+	{"svg", svgType, []string{".svg"}, false},
+	{"mp4", "video/mp4", []string{".mp4", ".m4v"}, false},
+	{"webm", "video/webm", []string{".webm"}, false},
+	{"mov", "video/quicktime", []string{".mov"}, false},
+}
+
+// defaultFormats are accepted unless configured otherwise.
+var defaultFormats = stringList{"jpeg", "png", "gif", "webp", "heic", "mp4", "webm", "mov"}
+
+func formatByName(name string) (mediaFormat, bool) {
+	for _, f := range mediaFormats {
+		if f.name == name {
+			return f, true
+		}
+	}
+	return mediaFormat{}, false
+}
+
+// formatOf returns the format of a stored file by its extension.
+func formatOf(name string) (mediaFormat, bool) {
+	ext := strings.ToLower(filepath.Ext(name))
+	for _, f := range mediaFormats {
+		if slices.Contains(f.exts, ext) {
+			return f, true
+		}
+	}
+	return mediaFormat{}, false
+}
+
+// mediaType returns the content type of a stored file, "" for others.
+// Minimal systems have no mime.types, so it is not left to the mime package.
+func mediaType(name string) string {
+	f, _ := formatOf(name)
+	return f.mime
+}
+
+// accepts reports whether uploads in format f are allowed.
+func (c Config) accepts(f mediaFormat) bool {
+	return slices.Contains(c.Formats, f.name)
+}
+
+// rendersAsIs reports whether the renditions of the stored file name are
+// the file itself, for formats the gallery cannot decode.
+func rendersAsIs(name string) bool {
+	f, ok := formatOf(name)
+	return ok && !f.decodes && !isVideoName(name)
+}
+
+// sniffFormat recognizes the format of a file from its first bytes.
+func sniffFormat(head []byte) (mediaFormat, bool) {
+	var name string
+	switch {
+	case isSVG(head):
+		name = "svg"
+	case isHEIF(head):
+		name = "heic"
+	case len(head) >= 12 && string(head[4:8]) == "ftyp" && (string(head[8:12]) == "avif" || string(head[8:12]) == "avis"):
+		name = "avif"
+	case bytes.HasPrefix(head, []byte("II*\x00")) || bytes.HasPrefix(head, []byte("MM\x00*")):
+		name = "tiff"
+	default:
+		mime := http.DetectContentType(head)
+		if !strings.HasPrefix(mime, "image/") && !strings.HasPrefix(mime, "video/") {
+			mime = sniffVideo(head)
+		}
+		for _, f := range mediaFormats {
+			if f.mime == mime {
+				return f, true
+			}
+		}
+		return mediaFormat{}, false
+	}
+	return formatByName(name)
+}
+
+// formatName gives name the extension of f unless it has one already.
+func formatName(name string, f mediaFormat) string {
+	if len(f.exts) == 0 || slices.Contains(f.exts, strings.ToLower(filepath.Ext(name))) {
+		return name
+	}
+	return strings.TrimSuffix(name, filepath.Ext(name)) + f.exts[0]
+}
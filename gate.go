@@ -0,0 +1,236 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Password protected albums are opened through a small gate page at
+// /a/{id}. The right password gets the visitor an access cookie for that
+// album, which also unlocks its images under /uploads/, /thumbs/ and /img/.
+// Images of a protected album are otherwise only served to callers with an
+// API key or account that may see them.
+const albumAccessTTL = 7 * 24 * time.Hour
+
+func albumCookie(id string) string { return "gallery_album_" + id }
+
+func handleSetAlbumPassword(w http.ResponseWriter, r *http.Request, album Album) {
+	var req struct {
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&req); err != nil || req.Password == "" {
+		writeJSONError(w, "Expected JSON body with password", http.StatusBadRequest)
+		return
+	}
+	if len(req.Password) > 72 {
+		writeJSONError(w, "Password must be at most 72 characters long", http.StatusBadRequest)
+		return
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		writeJSONError(w, "Could not update album", http.StatusInternalServerError)
+		return
+	}
+	if _, err := db.Exec(`UPDATE albums SET password_hash = ? WHERE id = ?`, string(hash), album.ID); err != nil {
+		writeJSONError(w, "Could not update album", http.StatusInternalServerError)
+		return
+	}
+	// a new password locks out everyone who knew the old one
+	db.Exec(`DELETE FROM album_access WHERE album_id = ?`, album.ID)
+	album.Protected = true
+	json.NewEncoder(w).Encode(album)
+}
+
+// canOpenAlbum reports whether the caller may see what is in album.
+func canOpenAlbum(r *http.Request, album Album) bool {
+	p, ok := resolvePrincipal(r)
+	if !album.Protected {
+		return p.sees(album.Owner)
+	}
+	return (ok && p.sees(album.Owner)) || hasAlbumAccess(r, album.ID)
+}
+
+// canOpenImage reports whether the caller may see an image. Besides the
+// usual ownership rules, images of protected albums need an API key or
+// account, or a visitor who has been let into one of those albums, and
+// images awaiting review are only for admins and their owner. The album
+// password only counts for reading, GET and HEAD. With reads protected the
+// rest need credentials too.
+func canOpenImage(r *http.Request, meta ImageMeta) bool {
+	if meta.Pending && !canSeePending(r, meta) {
+		return false
+	}
+	rows, err := db.Query(`SELECT ai.album_id FROM album_images ai JOIN albums a ON a.id = ai.album_id
+		WHERE ai.image_id = ? AND a.password_hash != ''`, meta.ID)
+	if err != nil {
+		return false
+	}
+	var albums []string
+	for rows.Next() {
+		var id string
+		if rows.Scan(&id) == nil {
+			albums = append(albums, id)
+		}
+	}
+	rows.Close()
+	if r.Method == "GET" || r.Method == "HEAD" {
+		for _, id := range albums {
+			if hasAlbumAccess(r, id) {
+				return true
+			}
+		}
+	}
+
+	p, ok := resolvePrincipal(r)
+	return p.sees(meta.Owner) && (ok || (len(albums) == 0 && anonymousReads()))
+}
+
+// canChangeImage reports whether the caller may change meta: its owner or
+// an admin, or anyone in a gallery without credentials. Seeing an image,
+// through an album password say, is not enough.
+func canChangeImage(r *http.Request, meta ImageMeta) bool {
+	p, ok := resolvePrincipal(r)
+	return (ok || (len(cfg.APIKeys) == 0 && !cfg.Accounts)) && p.sees(meta.Owner)
+}
+
+func hasAlbumAccess(r *http.Request, albumID string) bool {
+	c, err := r.Cookie(albumCookie(albumID))
+	if err != nil || c.Value == "" {
+		return false
+	}
+	var one int
+	err = db.QueryRow(`SELECT 1 FROM album_access WHERE token_hash = ? AND album_id = ? AND expires_at > ?`,
+		hashToken(c.Value), albumID, time.Now().UnixNano()).Scan(&one)
+	return err == nil
+}
+
+var gateTemplate = template.Must(template.New("gate").Parse(`<!doctype html>
+<html lang="cs">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Album.Name}}</title>
+<link rel="stylesheet" href="{{.Base}}/static/style.css">
+</head>
+<body>
+<main>
+<h1>{{.Album.Name}}</h1>
+{{if .Locked}}
+<form method="post">
+  <p>Album je chráněné heslem.</p>
+  {{if .Wrong}}<p class="error">Nesprávné heslo.</p>{{end}}
+  <input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+  <input type="password" name="password" autofocus required>
+  <button type="submit">Otevřít</button>
+</form>
+{{else}}
+<div id="grid">
+{{range .Images}}<a class="tile" href="{{.URL}}"><img src="{{.Thumb}}" alt="{{.Name}}" loading="lazy"></a>
+{{end}}
+</div>
+{{end}}
+</main>
+</body>
+</html>
+`))
+
+// handleAlbumGate serves /a/{id}: the album's images for visitors who may
+// see them, a password form for protected albums otherwise.
+// albumGateClient names the client behind r per album, so guessing the
+// password of one album is limited without locking the client out of
+// the others.
+func albumGateClient(r *http.Request) string {
+	return rateClient(r) + " album:" + strings.Trim(strings.TrimPrefix(r.URL.Path, "/a/"), "/")
+}
+
+func handleAlbumGate(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/a/"), "/")
+	album, err := getAlbum(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Could not load album", http.StatusInternalServerError)
+		return
+	}
+
+	data := struct {
+		Album     Album
+		Images    []ImageMeta
+		Locked    bool
+		Wrong     bool
+		CSRFToken string
+		Base      string
+	}{Album: album, CSRFToken: csrfToken(w, r), Base: cfg.BasePath}
+
+	if r.Method == "POST" && album.Protected {
+		if unlockAlbum(w, r, album) {
+			http.Redirect(w, r, sitePath("/a/"+album.ID), http.StatusSeeOther)
+			return
+		}
+		data.Wrong = true
+	}
+
+	if !canOpenAlbum(r, album) {
+		if !album.Protected {
+			// private albums of other users simply don't exist
+			http.NotFound(w, r)
+			return
+		}
+		data.Locked = true
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if data.Wrong {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+		gateTemplate.Execute(w, data)
+		return
+	}
+
+	list, err := listImages(listQuery{Album: album.ID})
+	if err != nil {
+		http.Error(w, "Could not load album", http.StatusInternalServerError)
+		return
+	}
+	data.Images = list.Images
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	gateTemplate.Execute(w, data)
+}
+
+// unlockAlbum checks the submitted password and hands out an access cookie.
+func unlockAlbum(w http.ResponseWriter, r *http.Request, album Album) bool {
+	var hash string
+	if err := db.QueryRow(`SELECT password_hash FROM albums WHERE id = ?`, album.ID).Scan(&hash); err != nil || hash == "" {
+		return false
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(r.PostFormValue("password"))) != nil {
+		return false
+	}
+
+	token := randomString(48)
+	expires := time.Now().Add(albumAccessTTL)
+	if _, err := db.Exec(`INSERT INTO album_access (token_hash, album_id, expires_at) VALUES (?, ?, ?)`,
+		hashToken(token), album.ID, expires.UnixNano()); err != nil {
+		return false
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     albumCookie(album.ID),
+		Value:    token,
+		Path:     sitePath("/"),
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   secureRequest(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+	return true
+}
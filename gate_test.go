@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAlbumCookieOnlyReads(t *testing.T) {
+	testGallery(t)
+	alice, _ := testUser(t, "alice", false)
+	testImage(t, "a.png", alice)
+	testImage(t, "b.png", alice)
+	testAlbum(t, "locked", alice, true, "a.png")
+	testAlbum(t, "other", alice, true, "b.png")
+	pass := testAlbumCookie(t, "locked")
+	meta, err := getImage("a.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := getImage("b.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, method := range []string{"GET", "HEAD"} {
+		r := httptest.NewRequest(method, "/i/a.png", nil)
+		r.AddCookie(pass)
+		if !canOpenImage(r, meta) {
+			t.Errorf("%s with the album cookie: image hidden", method)
+		}
+		if canOpenImage(r, other) {
+			t.Errorf("%s with the album cookie: image of another album shown", method)
+		}
+	}
+	for _, method := range []string{"POST", "PATCH", "DELETE"} {
+		r := httptest.NewRequest(method, "/api/v1/images/a.png", nil)
+		r.AddCookie(pass)
+		if canOpenImage(r, meta) {
+			t.Errorf("%s with the album cookie: image opened", method)
+		}
+		if canChangeImage(r, meta) {
+			t.Errorf("%s with the album cookie: image may be changed", method)
+		}
+	}
+}
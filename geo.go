@@ -0,0 +1,197 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Geotagged images can be browsed on a map: the page /map shows them on
+// Leaflet with OpenStreetMap tiles, fed by
+//
+//	GET /api/v1/geo?bbox=west,south,east,north&zoom=z
+//
+// which clusters the images in the box on a grid of geoCellPixels at the
+// zoom level, the way a map would draw them. Each cluster has its images'
+// mean position, how many there are and one of them to show. The
+// coordinates come from EXIF and are indexed in the lat and lon columns.
+
+const (
+	geoCellPixels = 80
+	maxGeoZoom    = 22
+)
+
+// GeoCluster is a group of images close together at the requested zoom.
+type GeoCluster struct {
+	Lat   float64   `json:"lat"`
+	Lon   float64   `json:"lon"`
+	Count int       `json:"count"`
+	Image ImageMeta `json:"image"` // one of them
+}
+
+func handleGeo(w http.ResponseWriter, r *http.Request) {
+	if apiPreamble(w, r) {
+		return
+	}
+	if r.Method != "GET" {
+		writeJSONError(w, "Unsupported method", http.StatusMethodNotAllowed)
+		return
+	}
+	west, south, east, north, err := parseBBox(r.URL.Query().Get("bbox"))
+	if err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	zoom, err := strconv.Atoi(r.URL.Query().Get("zoom"))
+	if err != nil || zoom < 0 || zoom > maxGeoZoom {
+		writeJSONError(w, "Invalid zoom, expected 0 to "+strconv.Itoa(maxGeoZoom), http.StatusBadRequest)
+		return
+	}
+	p, authenticated := resolvePrincipal(r)
+	q := listQuery{Owner: p.ownerFilter(), HideProtected: !authenticated}
+	clusters, err := geoClusters(q, west, south, east, north, zoom)
+	if err != nil {
+		writeJSONError(w, "Could not list images", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]any{"clusters": clusters})
+}
+
+// parseBBox reads west,south,east,north in degrees, as Leaflet's
+// toBBoxString gives them. Longitudes past the antimeridian are wrapped.
+func parseBBox(s string) (west, south, east, north float64, err error) {
+	errBBox := errors.New("Invalid bbox, expected west,south,east,north")
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return 0, 0, 0, 0, errBBox
+	}
+	var v [4]float64
+	for i, part := range parts {
+		if v[i], err = strconv.ParseFloat(strings.TrimSpace(part), 64); err != nil || math.IsNaN(v[i]) || math.IsInf(v[i], 0) {
+			return 0, 0, 0, 0, errBBox
+		}
+	}
+	west, south, east, north = v[0], v[1], v[2], v[3]
+	if south > north || west > east {
+		return 0, 0, 0, 0, errBBox
+	}
+	south, north = max(south, -90), min(north, 90)
+	if east-west >= 360 {
+		return -180, south, 180, north, nil
+	}
+	return wrapLon(west), south, wrapLon(east), north, nil
+}
+
+// wrapLon brings a longitude into [-180, 180).
+func wrapLon(lon float64) float64 {
+	return math.Mod(math.Mod(lon+180, 360)+360, 360) - 180
+}
+
+// geoClusters groups the images of q inside the box on the grid for zoom.
+// A box across the antimeridian has west > east.
+func geoClusters(q listQuery, west, south, east, north float64, zoom int) ([]GeoCluster, error) {
+	cell := 360 / math.Exp2(float64(zoom)) * geoCellPixels / 256
+	conds, args := q.filters()
+	conds = append(conds, `lat IS NOT NULL AND lat BETWEEN ? AND ?`)
+	args = append(args, south, north)
+	if west <= east {
+		conds = append(conds, `lon BETWEEN ? AND ?`)
+	} else {
+		conds = append(conds, `(lon >= ? OR lon <= ?)`)
+	}
+	args = append(args, west, east)
+	// lat and lon are shifted to be positive, so CAST rounds down
+	rows, err := db.Query(`SELECT AVG(lat), AVG(lon), COUNT(*), MIN(id) FROM images`+whereClause(conds)+`
+		GROUP BY CAST((lat + 90) / ? AS INTEGER), CAST((lon + 180) / ? AS INTEGER)`, append(args, cell, cell)...)
+	if err != nil {
+		return nil, err
+	}
+	clusters := []GeoCluster{}
+	var ids []string
+	for rows.Next() {
+		var c GeoCluster
+		if err := rows.Scan(&c.Lat, &c.Lon, &c.Count, &c.Image.ID); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		clusters = append(clusters, c)
+		ids = append(ids, c.Image.ID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	images, err := imagesByID(ids)
+	if err != nil {
+		return nil, err
+	}
+	for i := range clusters {
+		clusters[i].Image = images[clusters[i].Image.ID]
+	}
+	return clusters, nil
+}
+
+// imagesByID loads the images with the given ids.
+func imagesByID(ids []string) (map[string]ImageMeta, error) {
+	images := map[string]ImageMeta{}
+	for len(ids) > 0 {
+		// stay below SQLite's limit on parameters
+		batch := ids[:min(len(ids), 500)]
+		ids = ids[len(batch):]
+		args := make([]any, len(batch))
+		for i, id := range batch {
+			args[i] = id
+		}
+		rows, err := db.Query(`SELECT `+imageColumns+` FROM images WHERE id IN (?`+strings.Repeat(`, ?`, len(batch)-1)+`)`, args...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			meta, err := scanImageRow(rows)
+			if err != nil {
+				rows.Close()
+				return nil, err
+			}
+			images[meta.ID] = meta
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return images, nil
+}
+
+// exifPosition returns the position indexImage stores for meta, NULL for
+// images without one.
+func exifPosition(meta ImageMeta) (sql.NullFloat64, sql.NullFloat64) {
+	lat, err1 := strconv.ParseFloat(meta.Exif["Latitude"], 64)
+	lon, err2 := strconv.ParseFloat(meta.Exif["Longitude"], 64)
+	if err1 != nil || err2 != nil || math.Abs(lat) > 90 || math.Abs(lon) > 180 || (lat == 0 && lon == 0) {
+		return sql.NullFloat64{}, sql.NullFloat64{}
+	}
+	return sql.NullFloat64{Float64: lat, Valid: true}, sql.NullFloat64{Float64: lon, Valid: true}
+}
+
+// handleMapPage serves the map. Like the gallery page it is only the
+// page; the images come from the API.
+func handleMapPage(w http.ResponseWriter, r *http.Request) {
+	tmpl, err := template.ParseFS(templateFS(), "map.html")
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Map template", "err", err)
+		http.Error(w, "Template error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	tmpl.Execute(w, struct {
+		CSRFToken string
+		Base      string
+	}{csrfToken(w, r), cfg.BasePath})
+}
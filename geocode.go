@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The positions of geotagged images can be turned into places, a country
+// and a city, which the listing filters on (?country=, ?city=). The
+// provider is cfg.Geocoder: "nominatim" asks a Nominatim server
+// (cfg.GeocodeURL, the OpenStreetMap one by default, whose usage policy
+// allows a request per second), "offline" looks up the nearest place in a
+// GeoNames cities file (cfg.GeocodeData, e.g. cities15000.txt) and takes
+// country names from the countryInfo.txt next to it, if there is one, or
+// else only has country codes. Uploads are geocoded in their processing
+// job; images indexed before, or whose lookup failed, are done by the
+// places command or maintenance task. An image whose position changes
+// loses its place until it is geocoded again.
+
+const (
+	geocodeTimeout = 30 * time.Second
+	// nominatimInterval spaces the requests to Nominatim
+	nominatimInterval = time.Second
+	// placeRadius is how close, in degrees, an image already geocoded has
+	// to be for its place to be reused without asking the provider
+	placeRadius = 0.01
+)
+
+// Place is where an image was taken.
+type Place struct {
+	Country     string `json:"country,omitempty"`
+	CountryCode string `json:"countryCode,omitempty"` // ISO 3166-1 alpha-2, lower case
+	City        string `json:"city,omitempty"`
+}
+
+type geocoder interface {
+	Reverse(ctx context.Context, lat, lon float64) (Place, error)
+}
+
+// geocoding is nil without a configured provider.
+var geocoding geocoder
+
+func setupGeocoder(c Config) error {
+	geocoding = nil
+	switch c.Geocoder {
+	case "nominatim":
+		geocoding = &nominatim{url: strings.TrimRight(c.GeocodeURL, "/"), client: &http.Client{Timeout: geocodeTimeout}}
+	case "offline":
+		g, err := loadGeoNames(c.GeocodeData)
+		if err != nil {
+			return err
+		}
+		geocoding = g
+	}
+	return nil
+}
+
+type nominatim struct {
+	url    string
+	client *http.Client
+
+	mu   sync.Mutex
+	last time.Time
+}
+
+func (n *nominatim) Reverse(ctx context.Context, lat, lon float64) (Place, error) {
+	n.mu.Lock()
+	wait := time.Until(n.last.Add(nominatimInterval))
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+	n.last = time.Now()
+	n.mu.Unlock()
+
+	q := url.Values{
+		"format": {"jsonv2"},
+		"lat":    {strconv.FormatFloat(lat, 'f', 6, 64)},
+		"lon":    {strconv.FormatFloat(lon, 'f', 6, 64)},
+		"zoom":   {"10"},
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", n.url+"/reverse?"+q.Encode(), nil)
+	if err != nil {
+		return Place{}, err
+	}
+	req.Header.Set("User-Agent", "ai-morph-gallery")
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return Place{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Place{}, fmt.Errorf("nominatim answered %s", resp.Status)
+	}
+	var res struct {
+		Address map[string]string `json:"address"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&res); err != nil {
+		return Place{}, fmt.Errorf("nominatim: %w", err)
+	}
+	a := res.Address
+	p := Place{Country: a["country"], CountryCode: strings.ToLower(a["country_code"])}
+	for _, key := range []string{"city", "town", "village", "municipality"} {
+		if a[key] != "" {
+			p.City = a[key]
+			break
+		}
+	}
+	return p, nil
+}
+
+// geoNames finds the nearest place of a GeoNames dump, bucketed by whole
+// degrees.
+type geoNames struct {
+	cells     map[[2]int][]geoName
+	countries map[string]string // code to name
+}
+
+type geoName struct {
+	name     string
+	lat, lon float64
+	country  string
+}
+
+func geoCell(lat, lon float64) [2]int {
+	return [2]int{int(math.Floor(lat)), int(math.Floor(lon))}
+}
+
+// loadGeoNames reads a GeoNames cities file: tab separated, the name in
+// the second column, latitude and longitude in the fifth and sixth and the
+// country code in the ninth.
+func loadGeoNames(path string) (*geoNames, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	g := &geoNames{cells: map[[2]int][]geoName{}, countries: map[string]string{}}
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64<<10), 1<<20)
+	for sc.Scan() {
+		cols := strings.Split(sc.Text(), "\t")
+		if len(cols) < 9 {
+			continue
+		}
+		lat, err1 := strconv.ParseFloat(cols[4], 64)
+		lon, err2 := strconv.ParseFloat(cols[5], 64)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		n := geoName{name: cols[1], lat: lat, lon: lon, country: strings.ToLower(cols[8])}
+		c := geoCell(lat, lon)
+		g.cells[c] = append(g.cells[c], n)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(g.cells) == 0 {
+		return nil, fmt.Errorf("%s: no places", path)
+	}
+
+	// countryInfo.txt: the code in the first column, the name in the fifth
+	if f, err := os.Open(filepath.Join(filepath.Dir(path), "countryInfo.txt")); err == nil {
+		defer f.Close()
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			cols := strings.Split(sc.Text(), "\t")
+			if len(cols) >= 5 && !strings.HasPrefix(cols[0], "#") {
+				g.countries[strings.ToLower(cols[0])] = cols[4]
+			}
+		}
+	}
+	return g, nil
+}
+
+// Reverse returns the nearest place in the cells around the position,
+// nothing when there is none within about a degree.
+func (g *geoNames) Reverse(ctx context.Context, lat, lon float64) (Place, error) {
+	c := geoCell(lat, lon)
+	var best *geoName
+	bestDist := math.Inf(1)
+	scale := math.Cos(lat * math.Pi / 180)
+	for dy := -1; dy <= 1; dy++ {
+		for dx := -1; dx <= 1; dx++ {
+			cell := g.cells[[2]int{c[0] + dy, wrapCell(c[1] + dx)}]
+			for i := range cell {
+				n := &cell[i]
+				x := math.Abs(n.lon - lon)
+				if x > 180 {
+					x = 360 - x
+				}
+				x *= scale
+				y := n.lat - lat
+				if d := x*x + y*y; d < bestDist {
+					best, bestDist = n, d
+				}
+			}
+		}
+	}
+	if best == nil {
+		return Place{}, nil
+	}
+	return Place{Country: g.countries[best.country], CountryCode: best.country, City: best.name}, nil
+}
+
+// wrapCell wraps a degree cell of longitude around the antimeridian.
+func wrapCell(lon int) int {
+	return (lon+180+360)%360 - 180
+}
+
+// geocodeImage finds the place of meta, if it has a position, and records
+// it. Nearby images already geocoded save asking the provider.
+func geocodeImage(ctx context.Context, meta ImageMeta) (*Place, error) {
+	lat, lon := exifPosition(meta)
+	if geocoding == nil || !lat.Valid {
+		return nil, nil
+	}
+	ctx, s := startSpan(ctx, "upload.geocode")
+	var p Place
+	err := db.QueryRowContext(ctx, `SELECT country, country_code, city FROM images
+		WHERE geocoded = 1 AND lat BETWEEN ? AND ? AND lon BETWEEN ? AND ? LIMIT 1`,
+		lat.Float64-placeRadius, lat.Float64+placeRadius, lon.Float64-placeRadius, lon.Float64+placeRadius).
+		Scan(&p.Country, &p.CountryCode, &p.City)
+	if err == sql.ErrNoRows {
+		ctx, cancel := context.WithTimeout(ctx, geocodeTimeout)
+		p, err = geocoding.Reverse(ctx, lat.Float64, lon.Float64)
+		cancel()
+	}
+	s.end(ctx, err)
+	if err != nil {
+		return nil, err
+	}
+	// only while the position is still the one looked up
+	_, err = db.Exec(`UPDATE images SET country = ?, country_code = ?, city = ?, geocoded = 1 WHERE id = ? AND lat = ? AND lon = ?`,
+		p.Country, p.CountryCode, p.City, meta.ID, lat, lon)
+	if err != nil {
+		return nil, err
+	}
+	return placeOf(p), nil
+}
+
+// placeOf is p, or nil for no place.
+func placeOf(p Place) *Place {
+	if p == (Place{}) {
+		return nil
+	}
+	return &p
+}
+
+// geocodePending geocodes the images that have a position but have not
+// been looked up yet, one after another, as providers want it.
+func geocodePending(ctx context.Context) (int, int, error) {
+	if geocoding == nil {
+		return 0, 0, fmt.Errorf("no geocoder configured")
+	}
+	rows, err := db.QueryContext(ctx, `SELECT `+imageColumns+` FROM images
+		WHERE geocoded = 0 AND lat IS NOT NULL AND deleted_at = 0 AND processing = 0`)
+	if err != nil {
+		return 0, 0, err
+	}
+	var pending []ImageMeta
+	for rows.Next() {
+		meta, err := scanImageRow(rows)
+		if err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+		pending = append(pending, meta)
+	}
+	rows.Close()
+
+	done, failed := 0, 0
+	for _, meta := range pending {
+		if ctx.Err() != nil {
+			return done, failed, ctx.Err()
+		}
+		if _, err := geocodeImage(ctx, meta); err != nil {
+			slog.Warn("Could not geocode image", "image", meta.ID, "err", err)
+			failed++
+			continue
+		}
+		done++
+	}
+	return done, failed, nil
+}
@@ -3,5 +3,10 @@ module ai-morph-gallery
 go 1.21
 
 require (
+	github.com/minio/minio-go/v7 v7.0.70
 	github.com/rwcarlsen/goexif v0.0.0-20190111140314-5f4b3f6b0b40
+	golang.org/x/crypto v0.21.0
+	golang.org/x/image v0.15.0
+	gopkg.in/yaml.v3 v3.0.1
+	modernc.org/sqlite v1.29.6
 )
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Guest upload links let people without an account add images to one
+// album, say the guests of a wedding:
+//
+//	GET    /api/v1/albums/{id}/upload-links       the album's links
+//	POST   /api/v1/albums/{id}/upload-links       {"expiresIn": seconds, "maxUploads": n, "maxBytes": n}
+//	DELETE /api/v1/albums/{id}/upload-links/{lid} revoke a link
+//	GET    /u/{token}                             upload page for guests
+//	POST   /u/{token}                             multipart upload, field "file"
+//
+// All limits are optional: expiresIn ends the link, maxUploads caps the
+// number of files (1 for a one-time link) and maxBytes the size of each,
+// on top of the usual upload size. Uploads belong to the album's owner and
+// count towards their quota. Like share links, only the token's hash is
+// stored, so its URL is only in the response that creates it.
+
+type UploadLink struct {
+	ID         string     `json:"id"`
+	URL        string     `json:"url,omitempty"`
+	QR         string     `json:"qr,omitempty"` // see shares.go
+	Album      string     `json:"album"`
+	Expires    *time.Time `json:"expires,omitempty"`
+	MaxUploads int        `json:"maxUploads,omitempty"`
+	MaxBytes   int64      `json:"maxBytes,omitempty"`
+	Uploads    int        `json:"uploads"`
+	Created    time.Time  `json:"created"`
+}
+
+func handleUploadLinks(w http.ResponseWriter, r *http.Request, album Album, id string) {
+	switch {
+	case id == "" && r.Method == "GET":
+		links, err := listUploadLinks(album.ID)
+		if err != nil {
+			writeJSONError(w, "Could not list upload links", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(links)
+	case id == "" && r.Method == "POST":
+		handleCreateUploadLink(w, r, album)
+	case id != "" && r.Method == "DELETE":
+		res, err := db.Exec(`DELETE FROM upload_links WHERE id = ? AND album_id = ?`, id, album.ID)
+		if err != nil {
+			writeJSONError(w, "Could not revoke upload link", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			writeJSONError(w, "Upload link not found", http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"success": true, "id": id})
+	default:
+		writeJSONError(w, "Unsupported method", http.StatusMethodNotAllowed)
+	}
+}
+
+func handleCreateUploadLink(w http.ResponseWriter, r *http.Request, album Album) {
+	var req struct {
+		ExpiresIn  int64 `json:"expiresIn"`
+		MaxUploads int   `json:"maxUploads"`
+		MaxBytes   int64 `json:"maxBytes"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		writeJSONError(w, "Expected JSON body with expiresIn, maxUploads and maxBytes", http.StatusBadRequest)
+		return
+	}
+	if req.ExpiresIn < 0 || req.MaxUploads < 0 || req.MaxBytes < 0 {
+		writeJSONError(w, "expiresIn, maxUploads and maxBytes must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	token := randomString(32)
+	link := UploadLink{
+		ID:         randomString(16),
+		URL:        sitePath("/u/" + token),
+		QR:         shareQRPath(token),
+		Album:      album.ID,
+		MaxUploads: req.MaxUploads,
+		MaxBytes:   req.MaxBytes,
+		Created:    time.Now().UTC(),
+	}
+	var expires int64
+	if req.ExpiresIn > 0 {
+		t := time.Now().Add(time.Duration(req.ExpiresIn) * time.Second).UTC()
+		link.Expires = &t
+		expires = t.UnixNano()
+	}
+	_, err := db.Exec(`INSERT INTO upload_links (id, token_hash, album_id, expires_at, max_uploads, max_bytes, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`, link.ID, hashToken(token), album.ID, expires, link.MaxUploads, link.MaxBytes, link.Created.UnixNano())
+	if err != nil {
+		writeJSONError(w, "Could not create upload link", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(link)
+}
+
+func listUploadLinks(albumID string) ([]UploadLink, error) {
+	rows, err := db.Query(`SELECT id, album_id, expires_at, max_uploads, max_bytes, uploads, created_at
+		FROM upload_links WHERE album_id = ? ORDER BY created_at`, albumID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	links := []UploadLink{}
+	for rows.Next() {
+		var l UploadLink
+		var expires, created int64
+		if err := rows.Scan(&l.ID, &l.Album, &expires, &l.MaxUploads, &l.MaxBytes, &l.Uploads, &created); err != nil {
+			return nil, err
+		}
+		if expires > 0 {
+			t := time.Unix(0, expires).UTC()
+			l.Expires = &t
+		}
+		l.Created = time.Unix(0, created).UTC()
+		links = append(links, l)
+	}
+	return links, rows.Err()
+}
+
+// guestLink is a usable link with its album, for the guest side.
+type guestLink struct {
+	UploadLink
+	album Album
+}
+
+// openUploadLink finds the link of token if it can still take an upload.
+// Expired, used up and revoked links look like they never existed.
+func openUploadLink(token string) (guestLink, error) {
+	var l guestLink
+	var expires int64
+	err := db.QueryRow(`SELECT id, album_id, expires_at, max_uploads, max_bytes, uploads FROM upload_links
+		WHERE token_hash = ? AND (expires_at = 0 OR expires_at > ?) AND (max_uploads = 0 OR uploads < max_uploads)`,
+		hashToken(token), time.Now().UnixNano()).
+		Scan(&l.ID, &l.Album, &expires, &l.MaxUploads, &l.MaxBytes, &l.Uploads)
+	if err != nil {
+		return l, err
+	}
+	if expires > 0 {
+		t := time.Unix(0, expires).UTC()
+		l.Expires = &t
+	}
+	l.album, err = getAlbum(l.Album)
+	return l, err
+}
+
+// reserveUpload takes one of the link's uploads before the file is
+// received, so parallel uploads cannot go over maxUploads. A failed upload
+// gives it back with releaseUpload.
+func reserveUpload(id string) bool {
+	res, err := db.Exec(`UPDATE upload_links SET uploads = uploads + 1
+		WHERE id = ? AND (expires_at = 0 OR expires_at > ?) AND (max_uploads = 0 OR uploads < max_uploads)`, id, time.Now().UnixNano())
+	if err != nil {
+		return false
+	}
+	n, _ := res.RowsAffected()
+	return n == 1
+}
+
+func releaseUpload(id string) {
+	db.Exec(`UPDATE upload_links SET uploads = uploads - 1 WHERE id = ? AND uploads > 0`, id)
+}
+
+var guestTemplate = template.Must(template.New("guest").Parse(`<!doctype html>
+<html lang="cs">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="csrf-token" content="{{.CSRFToken}}">
+<title>{{.Album.Name}}</title>
+<link rel="stylesheet" href="{{.Base}}/static/style.css">
+</head>
+<body>
+<main>
+<h1>{{.Album.Name}}</h1>
+<p>Sem můžete nahrát své fotky.
+{{if .Link.MaxUploads}}Zbývá {{.Left}} souborů.{{end}}
+{{if .Link.MaxBytes}}Jeden soubor smí mít nejvýše {{.MaxMB}} MB.{{end}}
+{{if .Link.Expires}}Odkaz platí do {{.Link.Expires.Local.Format "2. 1. 2006 15:04"}}.{{end}}</p>
+<form id="guest-upload">
+  <input type="file" name="file" accept="image/*,video/*" multiple required>
+  <button type="submit">Nahrát</button>
+</form>
+<ul id="guest-status"></ul>
+</main>
+<script>
+document.getElementById('guest-upload').addEventListener('submit', async (e) => {
+  e.preventDefault();
+  const token = document.querySelector('meta[name="csrf-token"]').content;
+  const status = document.getElementById('guest-status');
+  for (const file of e.target.file.files) {
+    const li = document.createElement('li');
+    li.textContent = file.name + ': nahrávám…';
+    status.appendChild(li);
+    const body = new FormData();
+    body.append('file', file);
+    try {
+      const res = await fetch(location.pathname, {method: 'POST', body, headers: {'X-CSRF-Token': token}});
+      const data = await res.json();
+      li.textContent = file.name + ': ' + (res.ok ? 'hotovo' : (data.detail || data.error));
+    } catch (err) {
+      li.textContent = file.name + ': chyba spojení';
+    }
+  }
+  e.target.reset();
+});
+</script>
+</body>
+</html>
+`))
+
+// handleGuestUpload serves /u/{token}: the upload page, and the uploads
+// posted from it.
+func handleGuestUpload(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.URL.Path, "/u/")
+	if token == "" || strings.Contains(token, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	link, err := openUploadLink(token)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Could not read upload link", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	switch r.Method {
+	case "GET", "HEAD":
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		guestTemplate.Execute(w, struct {
+			Album     Album
+			Link      UploadLink
+			Left      int
+			MaxMB     string
+			CSRFToken string
+			Base      string
+		}{link.album, link.UploadLink, link.MaxUploads - link.Uploads, fmt.Sprintf("%.1f", float64(link.MaxBytes)/(1<<20)),
+			csrfToken(w, r), cfg.BasePath})
+	case "POST":
+		apiPreamble(w, r)
+		if err != nil {
+			writeJSONError(w, "Upload link not found", http.StatusNotFound)
+			return
+		}
+		guestUpload(w, r, link)
+	default:
+		http.Error(w, "Unsupported method", http.StatusMethodNotAllowed)
+	}
+}
+
+func guestUpload(w http.ResponseWriter, r *http.Request, link guestLink) {
+	if !reserveUpload(link.ID) {
+		writeJSONError(w, "Upload link is used up", http.StatusNotFound)
+		return
+	}
+	stored := false
+	defer func() {
+		if !stored {
+			releaseUpload(link.ID)
+		}
+	}()
+
+	limit := cfg.maxUploadBytes()
+	tooLarge := fmt.Sprintf("File exceeds maximum size %d MB", cfg.MaxUploadMB)
+	if link.MaxBytes > 0 && link.MaxBytes < limit {
+		limit = link.MaxBytes
+		tooLarge = fmt.Sprintf("File exceeds maximum size %d bytes", limit)
+	}
+	path, name, ok := stageMultipart(w, r, limit, tooLarge)
+	if !ok {
+		return
+	}
+	meta, _, err := ingest(r.Context(), upload{
+		Path:    path,
+		Name:    name,
+		Owner:   link.album.Owner,
+		Strip:   wantStripMetadata(r),
+		Pending: guestNeedsReview(),
+		Guest:   true,
+	})
+	var qe *quotaError
+	if errors.As(err, &qe) {
+		// the owner's usage is none of the guest's business
+		writeProblem(w, http.StatusRequestEntityTooLarge, "quota_exceeded", "The album cannot take more uploads", nil)
+		return
+	}
+	if err != nil {
+		writeIngestError(w, err)
+		return
+	}
+	stored = true
+	if _, err := db.Exec(`INSERT OR IGNORE INTO album_images (album_id, image_id, added_at) VALUES (?, ?, ?)`,
+		link.album.ID, meta.ID, time.Now().UnixNano()); err != nil {
+		writeJSONError(w, "Could not add image to album", http.StatusInternalServerError)
+		return
+	}
+	// guests learn no more about the album than that their file is in it
+	json.NewEncoder(w).Encode(UploadResponse{Success: true, ID: meta.ID, Size: meta.Size})
+}
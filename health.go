@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Probes for Kubernetes and load balancers:
+//
+//	GET /healthz  the process is up and serving (liveness)
+//	GET /readyz   it can take traffic (readiness): the database answers,
+//	              storage takes a write and the index has been synced
+//
+// The server starts listening before the index is synced, which can take a
+// while with many images or a remote bucket, so liveness passes meanwhile;
+// other requests get 503 until it is done (waitForIndex).
+
+var indexReady atomic.Bool
+
+const readyTimeout = 5 * time.Second
+
+type readiness struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// isProbe tells whether r is for one of the probes, which are logged at
+// debug level only and answered while the index syncs.
+func isProbe(path string) bool {
+	return path == sitePath("/healthz") || path == sitePath("/readyz")
+}
+
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+	defer cancel()
+	res := readiness{Status: "ready", Checks: map[string]string{}}
+	check := func(name string, err error) {
+		if err == nil {
+			res.Checks[name] = "ok"
+			return
+		}
+		// details stay in the log, the probe is unauthenticated
+		slog.WarnContext(ctx, "Readiness check failed", "check", name, "err", err)
+		res.Checks[name] = "failed"
+		res.Status = "not ready"
+	}
+	check("db", db.PingContext(ctx))
+	check("storage", probeStorage(ctx))
+	if indexReady.Load() {
+		res.Checks["index"] = "ok"
+	} else {
+		res.Checks["index"] = "syncing"
+		res.Status = "not ready"
+	}
+	// reads still work with a full disk, so it is only reported
+	if hasRoomFor(0) {
+		res.Checks["disk"] = "ok"
+	} else {
+		res.Checks["disk"] = "low"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if res.Status != "ready" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+// probeStorage writes and removes a small object, which also catches a
+// read-only volume or a bucket without write access.
+func probeStorage(ctx context.Context) error {
+	const name = ".readyz"
+	if err := storage.Put(ctx, name, strings.NewReader("ok"), 2, "text/plain"); err != nil {
+		return err
+	}
+	return storage.Delete(ctx, name)
+}
+
+// waitForIndex answers everything but the probes with 503 until the index
+// is synced, so nothing is served from a partial one.
+func waitForIndex(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !indexReady.Load() && r.URL.Path != "/healthz" && r.URL.Path != "/readyz" {
+			w.Header().Set("Retry-After", "5")
+			writeProblem(w, http.StatusServiceUnavailable, "starting", "Starting up, the index is being synced", nil)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
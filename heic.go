@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// HEIC/HEIF photos, as iPhones take them, are neither recognized by
+// http.DetectContentType nor displayable by most browsers. Uploads in that
+// format are converted to JPEG with an external tool, cfg.HEICConverter,
+// which is run as "converter input output.jpg" (heif-convert from libheif
+// and ImageMagick's convert both work that way). With cfg.KeepHEICOriginal
+// the HEIC file is stored next to the JPEG and served by
+// /uploads/{id}?original=1.
+
+var errConversion = errors.New("could not convert image")
+
+// heifBrands are the ftyp major brands of HEIF still images.
+var heifBrands = []string{"heic", "heix", "heim", "heis", "hevc", "hevx", "mif1", "msf1"}
+
+// isHEIF reports whether the start of a file looks like a HEIF image.
+func isHEIF(head []byte) bool {
+	if len(head) < 12 || !bytes.Equal(head[4:8], []byte("ftyp")) {
+		return false
+	}
+	brand := string(head[8:12])
+	for _, b := range heifBrands {
+		if brand == b {
+			return true
+		}
+	}
+	return false
+}
+
+// convertHEIF writes a JPEG version of the HEIF file at path into a new
+// scratch file and returns its path.
+func convertHEIF(ctx context.Context, path string) (string, error) {
+	if cfg.HEICConverter == "" {
+		return "", errInvalidType
+	}
+	dir, err := os.MkdirTemp(cfg.sessionDir(), ".heic-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Minute)
+	defer cancel()
+	out := filepath.Join(dir, "out.jpg")
+	cmd := exec.CommandContext(ctx, cfg.HEICConverter, path, out)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		slog.Warn("HEIC conversion failed", "converter", cfg.HEICConverter, "err", err, "output", strings.TrimSpace(string(output)))
+		return "", errConversion
+	}
+
+	tmp, err := os.CreateTemp(cfg.sessionDir(), ".upload-*")
+	if err != nil {
+		return "", err
+	}
+	tmp.Close()
+	if err := os.Rename(out, tmp.Name()); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
+
+// heicOriginalName is where the HEIC original of a converted image is kept.
+// It is no image name, so listings and the index never pick it up.
+func heicOriginalName(name string) string {
+	return strings.TrimSuffix(name, filepath.Ext(name)) + ".heic"
+}
+
+// jpegName swaps the extension of a HEIC file name for .jpg.
+func jpegName(name string) string {
+	return strings.TrimSuffix(name, filepath.Ext(name)) + ".jpg"
+}
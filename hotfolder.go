@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Files dropped into one of cfg.HotFolders, by an SFTP client or a camera
+// sync say, are added like uploads, through ingest with its checks and
+// background processing, and then removed from the folder. Files it
+// refuses are moved to the .failed subfolder, the reason is logged.
+// Subfolders are watched too, but not dot files and dot folders, as
+// uploaders often write to such names and rename them when done. A file
+// is taken once it has not changed for watchDelay.
+
+type hotFolder struct {
+	dir     string
+	owner   string
+	changes chan string
+}
+
+// watchHotFolders starts watching cfg.HotFolders, taking what is in them
+// already.
+func watchHotFolders() {
+	if len(cfg.HotFolders) == 0 {
+		return
+	}
+	var owner string
+	if cfg.HotFolderOwner != "" {
+		if err := db.QueryRow(`SELECT id FROM users WHERE username = ?`, cfg.HotFolderOwner).Scan(&owner); err != nil {
+			slog.Error("Not watching hot folders, no such owner", "user", cfg.HotFolderOwner, "err", err)
+			return
+		}
+	}
+	for _, dir := range cfg.HotFolders {
+		h := hotFolder{dir: dir, owner: owner, changes: make(chan string, 256)}
+		if err := watchTree(dir, h.changes); err != nil {
+			slog.Warn("Not watching hot folder", "dir", dir, "err", err)
+			continue
+		}
+		h.changes <- ""
+		go gatherChanges(h.changes, watchDelay, h.take)
+		slog.Info("Watching hot folder", "dir", dir)
+	}
+}
+
+// take imports the files at paths, or all in the folder for "".
+func (h hotFolder) take(paths map[string]bool) {
+	if paths[""] {
+		paths = map[string]bool{}
+		filepath.WalkDir(h.dir, func(p string, d fs.DirEntry, err error) error {
+			switch {
+			case err != nil:
+			case d.IsDir() && p != h.dir && strings.HasPrefix(d.Name(), "."):
+				return filepath.SkipDir
+			case d.Type().IsRegular():
+				paths[p] = true
+			}
+			return nil
+		})
+	}
+	for p := range paths {
+		h.takeFile(p)
+	}
+}
+
+func (h hotFolder) takeFile(path string) {
+	rel, err := filepath.Rel(h.dir, path)
+	if err != nil || hiddenPath(rel) {
+		return
+	}
+	info, err := os.Lstat(path)
+	if err != nil || !info.Mode().IsRegular() {
+		return
+	}
+	if time.Since(info.ModTime()) < watchDelay {
+		// still being written, perhaps
+		h.later(path, watchDelay)
+		return
+	}
+	if !hasRoomFor(info.Size()) {
+		slog.Warn("Hot folder waits for disk space", "file", path)
+		h.later(path, time.Minute)
+		return
+	}
+	if info.Size() > cfg.maxUploadBytes() {
+		slog.Warn("Hot folder file refused, too large", "file", path)
+		h.fail(rel)
+		return
+	}
+	meta, duplicate, err := importFile(path, h.owner, false)
+	switch {
+	case errors.Is(err, errDuplicate) || (err == nil && duplicate):
+		slog.Info("Hot folder file already there", "file", path, "image", meta.ID)
+	case err != nil:
+		msg, _, _ := ingestErrorStatus(err)
+		slog.Warn("Hot folder file refused", "file", path, "reason", msg, "err", err)
+		h.fail(rel)
+		return
+	default:
+		slog.Info("Hot folder file imported", "file", path, "image", meta.ID)
+	}
+	os.Remove(path)
+}
+
+// later looks at path again after d.
+func (h hotFolder) later(path string, d time.Duration) {
+	time.AfterFunc(d, func() { h.changes <- path })
+}
+
+// fail moves the file at rel out of the way, into .failed.
+func (h hotFolder) fail(rel string) {
+	dst := filepath.Join(h.dir, ".failed", rel)
+	err := os.MkdirAll(filepath.Dir(dst), 0755)
+	if err == nil {
+		err = os.Rename(filepath.Join(h.dir, rel), dst)
+	}
+	if err != nil {
+		slog.Error("Could not move refused file", "file", filepath.Join(h.dir, rel), "err", err)
+	}
+}
+
+// hiddenPath reports whether a relative path is or is in a dot file.
+func hiddenPath(rel string) bool {
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		if strings.HasPrefix(part, ".") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Uploads that fail on the way back, after the server stored the file,
+// are safe to retry with an Idempotency-Key header:
+//
+//	POST /api/v1/images
+//	Idempotency-Key: 6c1f0e0a-2b7e-4f55-9a0e-2f0e1c4b7d11
+//
+// The first request with a key runs as usual and a successful response is
+// kept for idempotencyTTL; later requests with the same key get it again,
+// with Idempotent-Replayed: true, without storing anything. A key still in
+// use by a running request answers 409, one reused for another endpoint
+// 422. Failed requests keep nothing and can be retried. Keys belong to
+// the caller's account.
+//
+// A client that knows the SHA-256 of its file can also send it as
+//
+//	If-None-Match: "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+//
+// and gets 412, with the id of the image, without sending the file again
+// if it already has that image.
+
+const (
+	idempotencyTTL     = 24 * time.Hour
+	maxIdempotencyKey  = 255
+	maxIdempotentReply = 1 << 20
+)
+
+var sha256Regex = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// idempotent guards an upload endpoint with Idempotency-Key and
+// If-None-Match.
+func idempotent(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" && r.Method != "PUT" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		owner := requestViewer(r).UserID
+		if sum := contentHash(r.Header.Get("If-None-Match")); sum != "" {
+			if existing, err := findDuplicate(sum, owner); err == nil {
+				apiPreamble(w, r)
+				writeProblem(w, http.StatusPreconditionFailed, "image_exists", "An image with this content exists",
+					map[string]any{"id": existing.ID, "url": existing.URL})
+				return
+			}
+		}
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		apiPreamble(w, r)
+		if len(key) > maxIdempotencyKey {
+			writeJSONError(w, "Idempotency-Key is too long", http.StatusBadRequest)
+			return
+		}
+
+		request := r.Method + " " + r.URL.Path
+		now := time.Now()
+		db.Exec(`DELETE FROM idempotency_keys WHERE created_at < ?`, now.Add(-idempotencyTTL).UnixNano())
+		res, err := db.Exec(`INSERT OR IGNORE INTO idempotency_keys (owner, key, request, created_at) VALUES (?, ?, ?, ?)`,
+			owner, key, request, now.UnixNano())
+		if err != nil {
+			writeJSONError(w, "Could not check Idempotency-Key", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			replayIdempotent(w, owner, key, request)
+			return
+		}
+
+		rec := &replyRecorder{ResponseWriter: w}
+		kept := false
+		defer func() {
+			// a failed or panicking request leaves the key free to retry
+			if !kept {
+				db.Exec(`DELETE FROM idempotency_keys WHERE owner = ? AND key = ?`, owner, key)
+			}
+		}()
+		h.ServeHTTP(rec, r)
+		if rec.status >= 200 && rec.status < 300 && !rec.overflow {
+			_, err := db.Exec(`UPDATE idempotency_keys SET status = ?, content_type = ?, body = ? WHERE owner = ? AND key = ?`,
+				rec.status, w.Header().Get("Content-Type"), rec.body.Bytes(), owner, key)
+			kept = err == nil
+		}
+	})
+}
+
+// replayIdempotent answers a request whose key is taken.
+func replayIdempotent(w http.ResponseWriter, owner, key, request string) {
+	var stored, contentType string
+	var status int
+	var body []byte
+	err := db.QueryRow(`SELECT request, status, content_type, body FROM idempotency_keys WHERE owner = ? AND key = ?`, owner, key).
+		Scan(&stored, &status, &contentType, &body)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		// the first request failed meanwhile
+		writeJSONError(w, "A request with this Idempotency-Key just failed, retry", http.StatusConflict)
+	case err != nil:
+		writeJSONError(w, "Could not check Idempotency-Key", http.StatusInternalServerError)
+	case stored != request:
+		writeJSONError(w, "Idempotency-Key was used for another request", http.StatusUnprocessableEntity)
+	case status == 0:
+		writeJSONError(w, "A request with this Idempotency-Key is in progress", http.StatusConflict)
+	default:
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Idempotent-Replayed", "true")
+		w.WriteHeader(status)
+		w.Write(body)
+	}
+}
+
+// contentHash reads a SHA-256 from an If-None-Match header, which may be
+// quoted, weak or prefixed with "sha256:".
+func contentHash(h string) string {
+	h = strings.TrimPrefix(strings.TrimSpace(h), "W/")
+	h = strings.TrimPrefix(strings.Trim(h, `"`), "sha256:")
+	h = strings.ToLower(h)
+	if !sha256Regex.MatchString(h) {
+		return ""
+	}
+	return h
+}
+
+// replyRecorder keeps a copy of a response small enough to replay.
+type replyRecorder struct {
+	http.ResponseWriter
+	status   int
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (s *replyRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *replyRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	if s.body.Len()+len(b) > maxIdempotentReply {
+		s.overflow = true
+	} else if !s.overflow {
+		s.body.Write(b)
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (s *replyRecorder) Unwrap() http.ResponseWriter { return s.ResponseWriter }
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/rwcarlsen/goexif/exif"
+	"github.com/rwcarlsen/goexif/tiff"
+)
+
+// handleImage routes /api/v1/images/{id}[/...] requests.
+func handleImage(w http.ResponseWriter, r *http.Request) {
+	if apiPreamble(w, r) {
+		return
+	}
+
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/images/"), "/")
+	id, action, _ := strings.Cut(rest, "/")
+	if id == "" || id != filepath.Base(id) || strings.HasPrefix(id, ".") {
+		writeJSONError(w, "Image not found", http.StatusNotFound)
+		return
+	}
+	meta, err := visibleImage(r, id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeJSONError(w, "Image not found", http.StatusNotFound)
+		} else {
+			writeJSONError(w, "Could not load image", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	// comments have their own rules, see comments.go
+	if r.Method != "GET" && r.Method != "HEAD" && action != "comments" && !strings.HasPrefix(action, "comments/") &&
+		!canChangeImage(r, meta) {
+		writeJSONError(w, "Image not found", http.StatusNotFound)
+		return
+	}
+
+	if meta.Deleted != nil && action != "" && action != "restore" {
+		writeJSONError(w, "Image is in the trash", http.StatusConflict)
+		return
+	}
+
+	switch {
+	case action == "" && r.Method == "GET":
+		handleGetImage(w, r, meta)
+	case action == "" && r.Method == "PATCH":
+		handleUpdateImage(w, r, meta)
+	case action == "" && r.Method == "DELETE":
+		handleDeleteImage(w, r, meta)
+	case action == "restore" && r.Method == "POST":
+		handleRestoreImage(w, meta)
+	case action == "exif" && r.Method == "GET":
+		handleImageExif(w, r, meta)
+	case action == "similar" && r.Method == "GET":
+		handleSimilarImages(w, r, meta)
+	case action == "favorite" && (r.Method == "POST" || r.Method == "DELETE"):
+		handleFavorite(w, r, meta)
+	case action == "rating" && (r.Method == "POST" || r.Method == "DELETE"):
+		handleRating(w, r, meta)
+	case action == "comments" || strings.HasPrefix(action, "comments/"):
+		handleComments(w, r, meta, strings.TrimPrefix(strings.TrimPrefix(action, "comments"), "/"))
+	case action == "share" && r.Method == "POST":
+		handleCreateShare(w, r, meta)
+	case action == "tags" && r.Method == "POST":
+		handleAddTags(w, r, id)
+	case strings.HasPrefix(action, "tags/") && r.Method == "DELETE":
+		handleRemoveTag(w, id, strings.TrimPrefix(action, "tags/"))
+	default:
+		writeJSONError(w, "Unsupported method", http.StatusMethodNotAllowed)
+	}
+}
+
+// ImageDetail is the full record of one image: the listing metadata with
+// every EXIF field of the original and the albums it belongs to.
+type ImageDetail struct {
+	ImageMeta
+	Albums []Album `json:"albums"`
+}
+
+func handleGetImage(w http.ResponseWriter, r *http.Request, meta ImageMeta) {
+	viewer := requestViewer(r)
+	albums, err := imageAlbums(meta.ID, viewer.ownerFilter())
+	if err == nil {
+		images := []ImageMeta{meta}
+		err = addRatings(viewer.UserID, images)
+		meta = images[0]
+	}
+	if err != nil {
+		writeJSONError(w, "Could not load image", http.StatusInternalServerError)
+		return
+	}
+	if full, err := readFullExif(r.Context(), meta.ID); err == nil && len(full) > 0 {
+		// keep the friendly names from the index, add everything else
+		for k, v := range meta.Exif {
+			full[k] = v
+		}
+		meta.Exif = full
+	}
+	json.NewEncoder(w).Encode(ImageDetail{ImageMeta: meta, Albums: albums})
+}
+
+// readFullExif returns all EXIF fields of a stored original, keyed by their
+// EXIF names, as the text of the exifTags. The maker note is skipped; it is
+// a vendor blob.
+func readFullExif(ctx context.Context, id string) (map[string]string, error) {
+	f, _, err := storage.Open(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	x, err := exif.Decode(f)
+	if err != nil {
+		return nil, err
+	}
+	tags := exifTags{}
+	x.Walk(tags)
+	fields := make(map[string]string, len(tags))
+	for name, t := range tags {
+		if t.Text != "" {
+			fields[name] = t.Text
+		} else {
+			fields[name] = fmt.Sprint(t.Value)
+		}
+	}
+	return fields, nil
+}
+
+// ExifTag is one EXIF field with its value typed: a string, a number or,
+// for fields holding several, an array of numbers. Fractions such as
+// ExposureTime are numbers too and also given as written in Text.
+type ExifTag struct {
+	Value any    `json:"value"`
+	Text  string `json:"text,omitempty"`
+}
+
+// handleImageExif serves every EXIF field of the original, for those who
+// want the ISO, aperture or lens and not just the camera. Images without
+// EXIF have none.
+func handleImageExif(w http.ResponseWriter, r *http.Request, meta ImageMeta) {
+	f, _, err := storage.Open(r.Context(), meta.ID)
+	if errors.Is(err, fs.ErrNotExist) {
+		writeJSONError(w, "Image not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeJSONError(w, "Could not read image", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	tags := exifTags{}
+	// a broken field leaves the ones read before it
+	if x, err := exif.Decode(f); x != nil && (err == nil || !exif.IsCriticalError(err)) {
+		x.Walk(tags)
+	}
+	json.NewEncoder(w).Encode(map[string]any{"id": meta.ID, "tags": tags})
+}
+
+type exifTags map[string]ExifTag
+
+func (e exifTags) Walk(name exif.FieldName, tag *tiff.Tag) error {
+	if name == exif.MakerNote {
+		return nil
+	}
+	t := ExifTag{}
+	n := int(tag.Count)
+	switch tag.Format() {
+	case tiff.IntVal:
+		vals := make([]int64, 0, n)
+		for i := 0; i < n; i++ {
+			if v, err := tag.Int64(i); err == nil {
+				vals = append(vals, v)
+			}
+		}
+		t.Value = exifValue(vals)
+	case tiff.RatVal:
+		vals := make([]float64, 0, n)
+		var text []string
+		for i := 0; i < n; i++ {
+			num, den, err := tag.Rat2(i)
+			if err != nil || den == 0 {
+				continue
+			}
+			vals = append(vals, float64(num)/float64(den))
+			text = append(text, strconv.FormatInt(num, 10)+"/"+strconv.FormatInt(den, 10))
+		}
+		t.Value, t.Text = exifValue(vals), strings.Join(text, " ")
+	case tiff.FloatVal:
+		vals := make([]float64, 0, n)
+		for i := 0; i < n; i++ {
+			if v, err := tag.Float(i); err == nil {
+				vals = append(vals, v)
+			}
+		}
+		t.Value = exifValue(vals)
+	default:
+		v, err := tag.StringVal()
+		if err != nil {
+			v = tag.String()
+		}
+		if len(v) > 256 {
+			v = v[:256]
+		}
+		t.Value = strings.TrimSpace(strings.TrimRight(v, "\x00"))
+	}
+	e[string(name)] = t
+	return nil
+}
+
+// exifValue is a single number as itself, several as an array.
+func exifValue[T int64 | float64](vals []T) any {
+	if len(vals) == 1 {
+		return vals[0]
+	}
+	return vals
+}
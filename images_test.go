@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestImageChangesNeedOwner(t *testing.T) {
+	testGallery(t)
+	alice, aliceSession := testUser(t, "alice", false)
+	_, bobSession := testUser(t, "bob", false)
+	_, adminSession := testUser(t, "root", true)
+	testImage(t, "a.png", alice)
+	testAlbum(t, "locked", alice, true, "a.png")
+	pass := testAlbumCookie(t, "locked")
+	api := newAPIRouter()
+
+	tests := []struct {
+		name    string
+		method  string
+		target  string
+		body    string
+		cookies []*http.Cookie
+		want    int
+	}{
+		{"owner edits", "PATCH", "/api/v1/images/a.png", `{"title":"mine"}`, []*http.Cookie{aliceSession}, http.StatusOK},
+		{"admin edits", "PATCH", "/api/v1/images/a.png", `{"title":"theirs"}`, []*http.Cookie{adminSession}, http.StatusOK},
+		{"stranger edits", "PATCH", "/api/v1/images/a.png", `{"title":"x"}`, []*http.Cookie{bobSession}, http.StatusNotFound},
+		{"album visitor reads", "GET", "/api/v1/images/a.png/comments", "", []*http.Cookie{bobSession, pass}, http.StatusOK},
+		{"album visitor edits", "PATCH", "/api/v1/images/a.png", `{"title":"x"}`, []*http.Cookie{bobSession, pass}, http.StatusNotFound},
+		{"album visitor tags", "POST", "/api/v1/images/a.png/tags", `{"tags":["x"]}`, []*http.Cookie{bobSession, pass}, http.StatusNotFound},
+		{"album visitor shares", "POST", "/api/v1/images/a.png/share", `{}`, []*http.Cookie{bobSession, pass}, http.StatusNotFound},
+		{"album visitor deletes", "DELETE", "/api/v1/images/a.png", "", []*http.Cookie{bobSession, pass}, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serveTest(api, tt.method, tt.target, tt.body, tt.cookies...)
+			if w.Code != tt.want {
+				t.Errorf("%s %s: got %d, want %d: %s", tt.method, tt.target, w.Code, tt.want, w.Body)
+			}
+		})
+	}
+	if meta, err := getImage("a.png"); err != nil || meta.Deleted != nil {
+		t.Errorf("image was deleted: %v %v", meta.Deleted, err)
+	}
+}
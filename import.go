@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// POST /api/v1/import?url=... fetches an image from another server and adds
+// it like an upload. Since the server makes the request, it must not become
+// a way into the network it runs in: every connection, including those of
+// redirects, is checked against the address it actually dials.
+
+var errForbiddenAddress = errors.New("address not allowed")
+
+var importClient = &http.Client{
+	Transport: &http.Transport{
+		// no proxy: it would dial on our behalf and dodge the address check
+		Proxy: nil,
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: checkImportAddress,
+		}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 15 * time.Second,
+		MaxIdleConns:          4,
+		IdleConnTimeout:       30 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 5 {
+			return errors.New("too many redirects")
+		}
+		if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+			return errForbiddenAddress
+		}
+		return nil
+	},
+}
+
+// importBlocked are the ranges that pass as global unicast but are not
+// public, or reach IPv4 addresses through a translator.
+var importBlocked = func() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range []string{
+		"0.0.0.0/8",      // "this network", 0.0.0.0 reaches the host itself
+		"100.64.0.0/10",  // carrier-grade NAT
+		"192.0.0.0/24",   // IETF protocol assignments
+		"198.18.0.0/15",  // benchmarking
+		"240.0.0.0/4",    // reserved
+		"64:ff9b::/96",   // NAT64
+		"64:ff9b:1::/48", // local NAT64
+		"2002::/16",      // 6to4
+		"2001::/32",      // Teredo
+	} {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}()
+
+// checkImportAddress refuses connections to anything but public unicast
+// addresses. It is the dialer's Control hook, so it sees the address
+// actually dialed, after DNS resolution: names pointing inside don't get
+// through either.
+func checkImportAddress(network, address string, _ syscall.RawConn) error {
+	if cfg.ImportAllowPrivate {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return errForbiddenAddress
+	}
+	for _, n := range importBlocked {
+		if n.Contains(ip) {
+			return errForbiddenAddress
+		}
+	}
+	return nil
+}
+
+func handleImport(w http.ResponseWriter, r *http.Request) {
+	if apiPreamble(w, r) {
+		return
+	}
+	if r.Method != "POST" {
+		writeJSONError(w, "Unsupported method", http.StatusMethodNotAllowed)
+		return
+	}
+	src, err := url.Parse(r.URL.Query().Get("url"))
+	if err != nil || (src.Scheme != "http" && src.Scheme != "https") || src.Host == "" {
+		writeJSONError(w, "Expected an http or https url", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), cfg.ImportTimeout)
+	defer cancel()
+	tmp, status, err := fetchImport(ctx, src)
+	if err != nil {
+		writeJSONError(w, err.Error(), status)
+		return
+	}
+
+	meta, duplicate, err := ingest(r.Context(), upload{
+		Path:    tmp,
+		Name:    importName(src),
+		Owner:   requestViewer(r).UserID,
+		Strip:   wantStripMetadata(r),
+		Pending: needsReview(r),
+	})
+	if err != nil {
+		writeIngestError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(UploadResponse{
+		Success:   true,
+		ID:        meta.ID,
+		URL:       meta.URL,
+		Size:      meta.Size,
+		Duplicate: duplicate,
+		Image:     &meta,
+	})
+}
+
+// fetchImport downloads src into a scratch file, enforcing the upload size
+// limit. On failure it returns a message and status for the client.
+func fetchImport(ctx context.Context, src *url.URL) (string, int, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", src.String(), nil)
+	if err != nil {
+		return "", http.StatusBadRequest, errors.New("Expected an http or https url")
+	}
+	req.Header.Set("Accept", "image/*")
+	req.Header.Set("User-Agent", "ai-morph-gallery")
+	resp, err := importClient.Do(req)
+	if err != nil {
+		if errors.Is(err, errForbiddenAddress) {
+			return "", http.StatusBadRequest, errors.New("URL points to a forbidden address")
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			return "", http.StatusGatewayTimeout, errors.New("Fetching the URL timed out")
+		}
+		return "", http.StatusBadGateway, errors.New("Could not fetch URL")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", http.StatusBadGateway, fmt.Errorf("Remote server answered %d", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "" && !strings.HasPrefix(ct, "image/") && !strings.HasPrefix(ct, "application/octet-stream") {
+		return "", http.StatusBadRequest, errors.New("Invalid file type")
+	}
+	if resp.ContentLength > cfg.maxUploadBytes() {
+		return "", http.StatusBadRequest, fmt.Errorf("File exceeds maximum size %d MB", cfg.MaxUploadMB)
+	}
+	if !hasRoomFor(max(resp.ContentLength, 0)) {
+		return "", http.StatusInsufficientStorage, errors.New("Not enough free disk space")
+	}
+
+	tmp, err := os.CreateTemp(cfg.sessionDir(), ".import-*")
+	if err != nil {
+		return "", http.StatusInternalServerError, errors.New("Could not save file")
+	}
+	n, err := io.Copy(tmp, guardSpace(io.LimitReader(resp.Body, cfg.maxUploadBytes()+1)))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	switch {
+	case errors.Is(err, errDiskFull):
+		os.Remove(tmp.Name())
+		return "", http.StatusInsufficientStorage, errors.New("Not enough free disk space")
+	case errors.Is(err, context.DeadlineExceeded):
+		os.Remove(tmp.Name())
+		return "", http.StatusGatewayTimeout, errors.New("Fetching the URL timed out")
+	case err != nil:
+		os.Remove(tmp.Name())
+		return "", http.StatusBadGateway, errors.New("Could not fetch URL")
+	case n > cfg.maxUploadBytes():
+		os.Remove(tmp.Name())
+		return "", http.StatusBadRequest, fmt.Errorf("File exceeds maximum size %d MB", cfg.MaxUploadMB)
+	}
+	return tmp.Name(), http.StatusOK, nil
+}
+
+// importName picks a file name from the URL. ingest gives it the extension
+// of the downloaded content.
+func importName(src *url.URL) string {
+	name := path.Base(src.Path)
+	if name == "/" || name == "." {
+		name = "import"
+	}
+	return name
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestCheckImportAddress(t *testing.T) {
+	for host, allowed := range map[string]bool{
+		"93.184.216.34":        true,
+		"2606:2800:220:1::248": true,
+		"0.0.0.0":              false,
+		"0.1.2.3":              false,
+		"127.0.0.1":            false,
+		"10.1.2.3":             false,
+		"100.64.0.1":           false,
+		"169.254.169.254":      false,
+		"::ffff:127.0.0.1":     false,
+		"::1":                  false,
+		"fd00::1":              false,
+		"64:ff9b::7f00:1":      false,
+		"64:ff9b::a9fe:a9fe":   false,
+	} {
+		err := checkImportAddress("tcp", net.JoinHostPort(host, "80"), nil)
+		if (err == nil) != allowed {
+			t.Errorf("%s: got %v, want allowed %v", host, err, allowed)
+		}
+	}
+}
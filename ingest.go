@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// upload is a file that has arrived completely on local disk, by multipart
+// form or through an upload session, and is waiting to join the gallery.
+type upload struct {
+	Path    string // local file, consumed by ingest
+	Name    string // client side file name
+	Owner   string
+	Strip   bool // remove metadata first
+	Pending bool // hold for review, see moderation.go
+	Guest   bool // through an upload link, never matched with the owner's images
+}
+
+var (
+	errInvalidType = errors.New("invalid file type")
+	errDuplicate   = errors.New("duplicate image")
+)
+
+// ingest validates an upload and moves it into storage and the index. With
+// cfg.Duplicates "link" an upload identical to one the owner already has is
+// not stored again; the existing image is returned with duplicate set.
+// Guest uploads are always stored, as the match would tell a guest what the
+// owner has.
+func ingest(ctx context.Context, u upload) (meta ImageMeta, duplicate bool, err error) {
+	defer os.Remove(u.Path)
+	ctx, s := startSpan(ctx, "upload.ingest", slog.String("file", u.Name), slog.String("owner", u.Owner))
+	defer func() { s.end(ctx, err) }()
+	setUploadPhase(ctx, "checking")
+	defer func() {
+		if err == nil {
+			uploadStored(ctx, meta.ID)
+		}
+	}()
+
+	// before anything looks at the content
+	if err := checkMalware(ctx, u.Path); err != nil {
+		return meta, false, err
+	}
+
+	f, err := os.Open(u.Path)
+	if err != nil {
+		return meta, false, err
+	}
+	buffer := make([]byte, 512)
+	n, _ := io.ReadFull(f, buffer)
+	f.Close()
+	format, ok := sniffFormat(buffer[:n])
+	if !ok || !cfg.accepts(format) {
+		return meta, false, errInvalidType
+	}
+	contentType := format.mime
+	// Duplicates are recognized by the hash of the file as stored, so with
+	// duplicate detection on, hashing and HEIC conversion cannot be left
+	// to the processing job.
+	dedupe := cfg.Duplicates != "allow"
+	var heic string  // original of a converted HEIC upload
+	var convert bool // u.Path is a HEIC upload the job converts
+	switch {
+	case format.name == "heic" && !dedupe:
+		if cfg.HEICConverter == "" {
+			return meta, false, errInvalidType
+		}
+		convert, u.Name, contentType = true, jpegName(u.Name), "image/jpeg"
+	case format.name == "heic":
+		jpg, err := convertHEIF(ctx, u.Path)
+		if err != nil {
+			return meta, false, err
+		}
+		defer os.Remove(jpg)
+		heic, u.Path, u.Name, contentType = u.Path, jpg, jpegName(u.Name), "image/jpeg"
+		format, _ = formatByName("jpeg")
+	case format.name == "svg":
+		if err := sanitizeSVGFile(u.Path); err != nil {
+			return meta, false, err
+		}
+	case strings.HasPrefix(contentType, "video/"):
+		if videos == nil {
+			return meta, false, errInvalidType
+		}
+	}
+	u.Name = formatName(u.Name, format)
+
+	// a HEIC upload left to the job is checked once converted
+	if format.decodes {
+		if err := checkPixelsFile(u.Path); err != nil {
+			return meta, false, err
+		}
+	}
+
+	if cfg.Reencode && format.decodes {
+		ctx, rs := startSpan(ctx, "upload.reencode")
+		was := contentType
+		contentType, err = reencodeFile(u.Path, contentType)
+		rs.end(ctx, err)
+		if err != nil {
+			return meta, false, err
+		}
+		if contentType != was {
+			u.Name = pngName(u.Name)
+		}
+	}
+
+	if u.Strip && !convert {
+		if err := stripFileMetadata(u.Path, contentType); err != nil {
+			return meta, false, err
+		}
+	}
+
+	var sum string
+	if dedupe {
+		if sum, err = hashFile(u.Path); err != nil {
+			return meta, false, err
+		}
+		existing, err := findDuplicate(sum, u.Owner)
+		if err == nil && !u.Guest {
+			if cfg.Duplicates == "reject" {
+				return existing, true, errDuplicate
+			}
+			return existing, true, nil
+		}
+	}
+
+	info, err := os.Stat(u.Path)
+	if err != nil {
+		return meta, false, err
+	}
+	if err := checkQuota(u.Owner, info.Size()); err != nil {
+		return meta, false, err
+	}
+	name := uniqueFileName(u.Name)
+	arriving.Store(name, true)
+	defer arriving.Delete(name)
+	if convert {
+		err = storeLocalFile(ctx, u.Path, heicOriginalName(name), "image/heic")
+	} else {
+		err = storeLocalFile(ctx, u.Path, name, contentType)
+	}
+	if err != nil {
+		return meta, false, err
+	}
+	// a stripped upload must not keep its metadata in the original, nor a
+	// re-encoded one the file it was made from
+	if heic != "" && cfg.KeepHEICOriginal && !u.Strip && !cfg.Reencode {
+		if err := storeLocalFile(ctx, heic, heicOriginalName(name), "image/heic"); err != nil {
+			slog.WarnContext(ctx, "Could not keep HEIC original", "image", name, "err", err)
+		}
+	}
+	meta, err = queueUpload(name, u.Owner, contentType, info.Size(), sum, u.Pending, processJob{Convert: convert, Strip: u.Strip})
+	return meta, false, err
+}
+
+// processJob is the background part of an upload, see jobs.go.
+type processJob struct {
+	Convert bool `json:"convert,omitempty"` // HEIC original waiting to become the image
+	Strip   bool `json:"strip,omitempty"`
+}
+
+// queueUpload records a stored upload as processing and queues its job.
+func queueUpload(id, owner, contentType string, size int64, sum string, pending bool, p processJob) (ImageMeta, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return ImageMeta{}, err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`INSERT INTO images (id, name, size, mime, sha256, owner_id, processing, pending, mod_time, uploaded_at)
+		VALUES (?, ?, ?, ?, ?, ?, 1, ?, 0, ?)`, id, id, size, contentType, sum, owner, pending, time.Now().UnixNano())
+	if err != nil {
+		return ImageMeta{}, err
+	}
+	if _, err := queueJob(tx, "process", id, owner, p); err != nil {
+		return ImageMeta{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return ImageMeta{}, err
+	}
+	wakeJobs()
+	return getImage(id)
+}
+
+// processUpload converts, indexes and renders the thumbnail of an upload.
+// Each step can be repeated, so a retry simply starts over.
+func processUpload(ctx context.Context, j Job) error {
+	var p processJob
+	if err := json.Unmarshal([]byte(j.payload), &p); err != nil {
+		return err
+	}
+	meta, err := getImage(j.Image)
+	if errors.Is(err, sql.ErrNoRows) {
+		// deleted in the meantime
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := storage.Stat(ctx, meta.ID); p.Convert && err != nil {
+		if err := convertStoredHEIF(ctx, meta.ID, p.Strip); err != nil {
+			return err
+		}
+	}
+	if meta, err = indexImage(ctx, meta.ID, meta.Uploaded, meta.SHA256); err != nil {
+		return err
+	}
+	if err := scanImage(ctx, meta); err != nil {
+		return fmt.Errorf("content scan: %w", err)
+	}
+	if place, err := geocodeImage(ctx, meta); err != nil {
+		// left to the places task
+		slog.WarnContext(ctx, "Could not geocode image", "image", meta.ID, "err", err)
+	} else if place != nil {
+		meta.Place = place
+	}
+	if info, err := storage.Stat(ctx, meta.ID); err == nil && !rendersAsIs(meta.ID) {
+		t := thumbTransform(meta.ID, defaultThumbWidth, 0)
+		t.Watermark = watermarkVersion(meta)
+		if _, err := renderCached(meta.ID, t, info.ModTime); err != nil {
+			// served on demand later, or not at all if the file is broken
+			slog.WarnContext(ctx, "Could not render thumbnail", "image", meta.ID, "err", err)
+		} else {
+			renderSrcset(ctx, meta, info.ModTime)
+		}
+	}
+	if _, err := db.Exec(`UPDATE images SET processing = 0 WHERE id = ?`, meta.ID); err != nil {
+		return err
+	}
+	meta.Processing = false
+	notify(webhookEvent{Event: "image.uploaded", Image: meta})
+	return nil
+}
+
+// convertStoredHEIF turns the stored HEIC original of id into the image
+// itself. The original goes unless it is to be kept.
+func convertStoredHEIF(ctx context.Context, id string, strip bool) error {
+	src, done, err := localMediaFile(ctx, heicOriginalName(id))
+	if err != nil {
+		return err
+	}
+	defer done()
+	jpg, err := convertHEIF(ctx, src)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(jpg)
+	if cfg.Reencode {
+		if _, err := reencodeFile(jpg, "image/jpeg"); err != nil {
+			return err
+		}
+	}
+	if strip {
+		if err := stripFileMetadata(jpg, "image/jpeg"); err != nil {
+			return err
+		}
+	}
+	if err := storeLocalFile(ctx, jpg, id, "image/jpeg"); err != nil {
+		return err
+	}
+	// a stripped upload must not keep its metadata in the original
+	if !cfg.KeepHEICOriginal || strip || cfg.Reencode {
+		storage.Delete(ctx, heicOriginalName(id))
+	}
+	return nil
+}
+
+// processFailed gives up on an upload. Without a converted image there is
+// nothing to show, so it goes; otherwise it is listed as far as it got.
+func processFailed(j Job, err error) {
+	if _, serr := storage.Stat(context.Background(), j.Image); serr != nil {
+		purgeImage(context.Background(), j.Image)
+		return
+	}
+	db.Exec(`UPDATE images SET processing = 0 WHERE id = ?`, j.Image)
+	notifyImage("image.uploaded", j.Image)
+}
+
+// writeIngestError reports a failed ingest to an API client.
+func writeIngestError(w http.ResponseWriter, err error) {
+	if writeQuotaError(w, err) {
+		return
+	}
+	msg, status, code := ingestErrorStatus(err)
+	writeProblem(w, status, code, msg, nil)
+}
+
+// ingestErrorStatus returns the message, status and problem code of a
+// failed ingest.
+func ingestErrorStatus(err error) (string, int, string) {
+	var qe *quotaError
+	var pe *pixelLimitError
+	switch {
+	case errors.As(err, &qe):
+		return qe.Error(), http.StatusRequestEntityTooLarge, "quota_exceeded"
+	case errors.As(err, &pe):
+		return pe.Error(), http.StatusBadRequest, "too_many_pixels"
+	case errors.Is(err, errMalformedImage):
+		return "Malformed image", http.StatusBadRequest, "malformed_image"
+	case errors.Is(err, errInvalidType):
+		return "Invalid file type", http.StatusBadRequest, "invalid_type"
+	case errors.Is(err, errBadImage):
+		return "Could not remove metadata", http.StatusBadRequest, "strip_failed"
+	case errors.Is(err, errConversion):
+		return "Could not convert HEIC image", http.StatusBadRequest, "conversion_failed"
+	case errors.Is(err, errDuplicate):
+		return "Image already uploaded", http.StatusConflict, "duplicate"
+	case errors.Is(err, errMalware):
+		return "File is infected", http.StatusBadRequest, "malware"
+	case errors.Is(err, errMalwareRun):
+		return "Could not scan file for malware", http.StatusServiceUnavailable, "scan_failed"
+	default:
+		return "Could not save file", http.StatusInternalServerError, "internal"
+	}
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return hashReader(f)
+}
+
+func hashReader(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Heavy work on uploads (reading metadata, hashing, converting HEIC,
+// rendering the default thumbnail) runs in the background so an upload
+// returns as soon as the file is stored. Jobs are kept in the jobs table,
+// which makes them survive restarts, and run by cfg.Workers workers. A
+// failed job is tried again later, up to cfg.JobAttempts times in all.
+//
+//	GET /api/v1/jobs?status=&image=  recent jobs, newest first
+//	GET /api/v1/jobs/{id}            one job
+//
+// Finished jobs are forgotten after jobRetention.
+
+const (
+	jobQueued  = "queued"
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+
+	jobRetention = 7 * 24 * time.Hour
+	maxJobList   = 100
+)
+
+type Job struct {
+	ID       string    `json:"id"`
+	Kind     string    `json:"kind"`
+	Image    string    `json:"image,omitempty"`
+	Status   string    `json:"status"`
+	Attempts int       `json:"attempts"`
+	Error    string    `json:"error,omitempty"`
+	Created  time.Time `json:"created"`
+	Updated  time.Time `json:"updated"`
+
+	owner   string
+	payload string
+}
+
+// jobKind runs the jobs of one kind. failed is called once the last
+// attempt has failed, to clean up after it.
+type jobKind struct {
+	run    func(ctx context.Context, j Job) error
+	failed func(j Job, err error)
+}
+
+var jobKinds = map[string]jobKind{
+	"process": {run: processUpload, failed: processFailed},
+	"gc":      {run: runMaintenance},
+	"thumbs":  {run: runMaintenance},
+	"places":  {run: runMaintenance},
+}
+
+// jobWake tells idle workers that a job has been queued.
+var jobWake chan struct{}
+
+// startJobs starts the workers. Jobs that were running when the server
+// last stopped are queued again.
+func startJobs() {
+	db.Exec(`UPDATE jobs SET status = ? WHERE status = ?`, jobQueued, jobRunning)
+	jobWake = make(chan struct{}, cfg.Workers)
+	for i := 0; i < cfg.Workers; i++ {
+		go jobWorker()
+	}
+	go gcJobs()
+}
+
+// queueJob adds a job within tx; it runs once tx is committed.
+func queueJob(tx *sql.Tx, kind, image, owner string, payload any) (string, error) {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+	id := randomString(16)
+	now := time.Now().UnixNano()
+	_, err = tx.Exec(`INSERT INTO jobs (id, kind, image_id, owner_id, payload, status, run_at, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`, id, kind, image, owner, string(b), jobQueued, now, now, now)
+	return id, err
+}
+
+// wakeJobs nudges a worker after jobs have been committed.
+func wakeJobs() {
+	select {
+	case jobWake <- struct{}{}:
+	default:
+	}
+}
+
+func jobWorker() {
+	for {
+		j, err := claimJob()
+		if errors.Is(err, sql.ErrNoRows) {
+			select {
+			case <-jobWake:
+			case <-time.After(5 * time.Second):
+			}
+			continue
+		}
+		if err != nil {
+			slog.Warn("Could not claim job", "err", err)
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		runJob(j)
+	}
+}
+
+// claimJob marks the next due job as running and returns it.
+func claimJob() (Job, error) {
+	now := time.Now().UnixNano()
+	return scanJobRow(db.QueryRow(`UPDATE jobs SET status = ?, attempts = attempts + 1, updated_at = ?
+		WHERE id = (SELECT id FROM jobs WHERE status = ? AND run_at <= ? ORDER BY run_at LIMIT 1)
+		RETURNING `+jobColumns, jobRunning, now, jobQueued, now))
+}
+
+func runJob(j Job) {
+	kind, ok := jobKinds[j.Kind]
+	err := errors.New("unknown job kind")
+	if ok {
+		ctx, s := startSpan(context.Background(), "job."+j.Kind, slog.String("job", j.ID), slog.String("image", j.Image))
+		err = kind.run(ctx, j)
+		s.end(ctx, err)
+	}
+	now := time.Now()
+	switch {
+	case err == nil:
+		db.Exec(`UPDATE jobs SET status = ?, error = '', updated_at = ? WHERE id = ?`, jobDone, now.UnixNano(), j.ID)
+	case ok && j.Attempts < cfg.JobAttempts:
+		// back off a little more each time
+		retry := now.Add(time.Duration(j.Attempts*j.Attempts) * 10 * time.Second)
+		slog.Warn("Job failed, will retry", "job", j.ID, "kind", j.Kind, "image", j.Image, "attempt", j.Attempts, "err", err)
+		db.Exec(`UPDATE jobs SET status = ?, error = ?, run_at = ?, updated_at = ? WHERE id = ?`,
+			jobQueued, err.Error(), retry.UnixNano(), now.UnixNano(), j.ID)
+	default:
+		slog.Error("Job failed", "job", j.ID, "kind", j.Kind, "image", j.Image, "err", err)
+		db.Exec(`UPDATE jobs SET status = ?, error = ?, updated_at = ? WHERE id = ?`, jobFailed, err.Error(), now.UnixNano(), j.ID)
+		if ok && kind.failed != nil {
+			kind.failed(j, err)
+		}
+	}
+}
+
+// gcJobs forgets finished jobs once a day.
+func gcJobs() {
+	for {
+		forgetOldJobs()
+		time.Sleep(24 * time.Hour)
+	}
+}
+
+// forgetOldJobs drops jobs finished more than jobRetention ago.
+func forgetOldJobs() (int64, error) {
+	cutoff := time.Now().Add(-jobRetention).UnixNano()
+	res, err := db.Exec(`DELETE FROM jobs WHERE status IN (?, ?) AND updated_at < ?`, jobDone, jobFailed, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// drainJobs runs the jobs that are due with cfg.Workers workers until there
+// are none left, for commands that run without the server. Retries that are
+// not due yet stay queued for the server.
+func drainJobs() {
+	var wg sync.WaitGroup
+	for i := 0; i < cfg.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				j, err := claimJob()
+				if err != nil {
+					if !errors.Is(err, sql.ErrNoRows) {
+						slog.Warn("Could not claim job", "err", err)
+					}
+					return
+				}
+				runJob(j)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+const jobColumns = `id, kind, image_id, owner_id, payload, status, attempts, error, created_at, updated_at`
+
+func scanJobRow(row rowScanner) (Job, error) {
+	var j Job
+	var created, updated int64
+	err := row.Scan(&j.ID, &j.Kind, &j.Image, &j.owner, &j.payload, &j.Status, &j.Attempts, &j.Error, &created, &updated)
+	j.Created = time.Unix(0, created).UTC()
+	j.Updated = time.Unix(0, updated).UTC()
+	return j, err
+}
+
+// handleJobs serves the job status endpoints.
+func handleJobs(w http.ResponseWriter, r *http.Request) {
+	if apiPreamble(w, r) {
+		return
+	}
+	if r.Method != "GET" {
+		writeJSONError(w, "Unsupported method", http.StatusMethodNotAllowed)
+		return
+	}
+	viewer := requestViewer(r)
+
+	if id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/jobs"), "/"); id != "" {
+		j, err := scanJobRow(db.QueryRow(`SELECT `+jobColumns+` FROM jobs WHERE id = ?`, id))
+		if err == nil && !viewer.sees(j.owner) {
+			err = sql.ErrNoRows
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			writeJSONError(w, "Job not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			writeJSONError(w, "Could not load job", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(j)
+		return
+	}
+
+	conds := []string{}
+	args := []any{}
+	if owner := viewer.ownerFilter(); owner != "" {
+		conds = append(conds, "owner_id = ?")
+		args = append(args, owner)
+	}
+	if s := r.URL.Query().Get("status"); s != "" {
+		conds = append(conds, "status = ?")
+		args = append(args, s)
+	}
+	if img := r.URL.Query().Get("image"); img != "" {
+		conds = append(conds, "image_id = ?")
+		args = append(args, img)
+	}
+	rows, err := db.Query(`SELECT `+jobColumns+` FROM jobs`+whereClause(conds)+
+		` ORDER BY created_at DESC LIMIT `+strconv.Itoa(maxJobList), args...)
+	if err != nil {
+		writeJSONError(w, "Could not list jobs", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	jobs := []Job{}
+	for rows.Next() {
+		j, err := scanJobRow(rows)
+		if err != nil {
+			writeJSONError(w, "Could not list jobs", http.StatusInternalServerError)
+			return
+		}
+		jobs = append(jobs, j)
+	}
+	json.NewEncoder(w).Encode(map[string]any{"jobs": jobs})
+}
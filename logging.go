@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// setupLogging installs the default slog logger as configured. The standard
+// log package, used by net/http for its own errors, ends up there as well.
+func setupLogging(c Config) error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.LogLevel)); err != nil {
+		return fmt.Errorf("log-level: %w", err)
+	}
+	opts := &slog.HandlerOptions{Level: level}
+
+	var h slog.Handler
+	switch strings.ToLower(c.LogFormat) {
+	case "", "text":
+		h = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		h = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return fmt.Errorf("log-format must be text or json")
+	}
+	slog.SetDefault(slog.New(contextHandler{h}))
+	return nil
+}
+
+// contextHandler adds the request id and trace id of the context to the
+// records logged with one, so a handler's log lines can be told apart from
+// those of other requests.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id, ok := ctx.Value(ctxRequestID).(string); ok {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	if s, ok := ctx.Value(ctxSpan).(*span); ok {
+		r.AddAttrs(slog.String("trace_id", s.traceID))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// fatal logs an error and exits, like log.Fatal.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+var requestIDRegex = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// statusRecorder remembers what a handler wrote, for the access log.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(b)
+	s.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (s *statusRecorder) Unwrap() http.ResponseWriter { return s.ResponseWriter }
+
+// logRequests writes one structured log line per request. Every request
+// gets an id, taken from X-Request-ID if the client or a proxy sent a sane
+// one, which is echoed back and included in error responses and in what
+// handlers log with the request's context.
+// With tracing the request is also the root span of its work, see trace.go.
+func logRequests(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := r.Header.Get("X-Request-ID")
+		if !requestIDRegex.MatchString(id) {
+			id = randomString(16)
+		}
+		w.Header().Set("X-Request-ID", id)
+		ctx := context.WithValue(r.Context(), ctxRequestID, id)
+		if parent, ok := remoteSpan(r.Header.Get("traceparent")); ok && cfg.Tracing {
+			ctx = context.WithValue(ctx, ctxSpan, parent)
+		}
+		ctx, s := startSpan(ctx, "http.request", slog.String("method", r.Method), slog.String("path", r.URL.Path))
+		if s != nil {
+			w.Header().Set("traceparent", s.traceparent())
+		}
+		r = r.WithContext(ctx)
+
+		rec := &statusRecorder{ResponseWriter: w}
+		h.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		s.end(ctx, nil)
+
+		level := slog.LevelInfo
+		if rec.status >= 500 {
+			level = slog.LevelError
+		} else if isProbe(r.URL.Path) {
+			level = slog.LevelDebug
+		}
+		slog.LogAttrs(r.Context(), level, "request",
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", rec.status),
+			slog.Int64("bytes", rec.bytes),
+			slog.Duration("duration", time.Since(start)),
+			slog.String("remote", r.RemoteAddr),
+			slog.String("user_agent", r.UserAgent()),
+		)
+	})
+}
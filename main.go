@@ -1,74 +1,197 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"html/template"
 	"image"
 	_ "image/gif"
 	_ "image/jpeg"
 	_ "image/png"
-	_ "image/webp"
 	"io"
-	"log"
+	"io/fs"
+	"log/slog"
 	"mime"
+	"mime/multipart"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"regexp"
-	"sort"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/rwcarlsen/goexif/exif"
+	_ "golang.org/x/image/webp"
 )
 
 const (
-	uploadDir   = "./uploads"
-	maxSize     = 50 * 1024 * 1024 // 50 MB
-	templateDir = "./templates"
+	defaultPageSize = 100
+	maxPageSize     = 500
 )
 
 type ImageMeta struct {
-	ID     string            `json:"id"`
-	Name   string            `json:"name"`
-	URL    string            `json:"url"`
-	Size   int64             `json:"size"`
-	Mime   string            `json:"mime"`
-	Width  int               `json:"width,omitempty"`
-	Height int               `json:"height,omitempty"`
-	Exif   map[string]string `json:"exif,omitempty"`
+	ID          string             `json:"id"`
+	Name        string             `json:"name"`
+	Title       string             `json:"title,omitempty"`       // see captions.go
+	Description string             `json:"description,omitempty"` // Markdown
+	Alt         string             `json:"alt,omitempty"`         // text alternative for screen readers
+	Fields      map[string]string  `json:"fields,omitempty"`      // custom, see fields.go
+	Favorite    bool               `json:"favorite,omitempty"`    // of the caller, see ratings.go
+	Rating      int                `json:"rating,omitempty"`      // the caller's, 1 to 5 stars
+	Views       int64              `json:"views,omitempty"`       // see views.go
+	Downloads   int64              `json:"downloads,omitempty"`
+	URL         string             `json:"url"`
+	Size        int64              `json:"size"`
+	Mime        string             `json:"mime"`
+	Thumb       string             `json:"thumb,omitempty"`
+	Srcset      string             `json:"srcset,omitempty"` // thumbnail widths, see thumbs.go
+	Width       int                `json:"width,omitempty"`
+	Height      int                `json:"height,omitempty"`
+	Blurhash    string             `json:"blurhash,omitempty"`    // placeholder, see blurhash.go
+	Color       string             `json:"color,omitempty"`       // dominant, as #rrggbb
+	Palette     []string           `json:"palette,omitempty"`     // main colors, dominant first
+	Focus       []float64          `json:"focus,omitempty"`       // [x, y] as fractions, see crop.go
+	PHash       string             `json:"phash,omitempty"`       // perceptual hash, see phash.go
+	Place       *Place             `json:"place,omitempty"`       // from the GPS position, see geocode.go
+	Watermarked bool               `json:"watermarked,omitempty"` // renditions are watermarked, see watermark.go
+	Processing  bool               `json:"processing,omitempty"`  // until the upload's job is done, see jobs.go
+	Pending     bool               `json:"pending,omitempty"`     // awaiting review, see moderation.go
+	Flagged     bool               `json:"flagged,omitempty"`     // by the content scan, see scan.go
+	Scan        map[string]float64 `json:"scan,omitempty"`        // its label scores
+	Exif        map[string]string  `json:"exif,omitempty"`
+	Tags        []string           `json:"tags"`
+	Owner       string             `json:"owner,omitempty"`
+	SHA256      string             `json:"sha256,omitempty"`
+	Taken       *time.Time         `json:"taken,omitempty"` // from EXIF, if known
+	Uploaded    time.Time          `json:"uploaded"`
+	Deleted     *time.Time         `json:"deleted,omitempty"` // in the trash since
 }
 
 type UploadResponse struct {
-	Success bool   `json:"success"`
-	ID      string `json:"id"`
-	URL     string `json:"url"`
-	Size    int64  `json:"size"`
-	Error   string `json:"error,omitempty"`
+	Success   bool       `json:"success"`
+	ID        string     `json:"id"`
+	URL       string     `json:"url"`
+	Size      int64      `json:"size"`
+	Duplicate bool       `json:"duplicate,omitempty"` // ID is an existing image
+	Image     *ImageMeta `json:"image,omitempty"`
+	Error     string     `json:"error,omitempty"`
 }
 
 func main() {
-	// Ensure directories exist
-	os.MkdirAll(uploadDir, 0755)
-	os.MkdirAll(templateDir, 0755)
-	os.MkdirAll("./static", 0755)
+	name, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+		printUsage()
+		os.Exit(2)
+	}
+	if err := cmd.run(filepath.Base(os.Args[0])+" "+name, args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return
+		}
+		fatal("Failed", "command", name, "err", err)
+	}
+}
+
+// runServe is the gallery server, the default command.
+func runServe(name string, args []string) error {
+	// the index is synced once the server listens, see health.go
+	rest, err := openUnsynced(name, args, nil)
+	if err != nil {
+		return err
+	}
+	if len(rest) > 0 {
+		return fmt.Errorf("unexpected arguments %q", rest)
+	}
+
+	mux := http.NewServeMux()
 
-	// Create templates if missing
-	createTemplates()
+	// Probes
+	mux.HandleFunc("/healthz", handleHealthz)
+	mux.HandleFunc("/readyz", handleReadyz)
 
 	// Static file server
-	http.Handle("/uploads/", http.StripPrefix("/uploads/", http.FileServer(http.Dir(uploadDir))))
-	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("./static"))))
+	mux.HandleFunc("/uploads/", handleOriginal)
+	mux.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.FS(staticFS()))))
 
 	// Routes
-	http.HandleFunc("/", handleIndex)
-	http.HandleFunc("/api", handleAPI)
+	mux.HandleFunc("/", handleIndex)
+	mux.HandleFunc("/admin", handleAdminPage)
+	mux.HandleFunc("/map", handleMapPage)
+	mux.HandleFunc("/feed.xml", handleFeed)
+	mux.HandleFunc("/i/", handleImagePage)
+	mux.HandleFunc("/oembed", handleOEmbed)
+	mux.HandleFunc("/sitemap.xml", handleSitemap)
+	mux.HandleFunc("/embed/", handleWidget)
+	mux.HandleFunc("/thumbs/", handleThumb)
+	mux.Handle("/img/", rateLimit(http.HandlerFunc(handleTransform)))
+	mux.HandleFunc("/s/", handleShare)
+	mux.HandleFunc("/d/", handleDeletionLink)
+	mux.Handle("/a/", rateLimitBy(albumGateClient, http.HandlerFunc(handleAlbumGate)))
+	setupRateLimits()
+	setupBackpressure()
+	mux.Handle("/u/", rateLimit(backpressure(http.HandlerFunc(handleGuestUpload))))
+	api := newAPIRouter()
+	mux.Handle(apiV1+"/", api)
+	mux.Handle("/api", legacyAPI(api))
+	mux.Handle("/api/", legacyAPI(api))
+
+	srv := &http.Server{Addr: cfg.Addr, Handler: fromProxy(logRequests(withBasePath(securityHeaders(withCORS(csrfProtect(compressResponses(waitForIndex(mux))))))))}
+	srv.RegisterOnShutdown(func() { close(eventsDone) })
+	serveDebug(srv)
+	go func() {
+		if err := serve(srv); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fatal("Server", "err", err)
+		}
+	}()
 
-	log.Println("Server starting on :8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	if err := syncStore(); err != nil {
+		return fmt.Errorf("sync metadata store: %w", err)
+	}
+	startJobs()
+	watchStorage()
+	watchHotFolders()
+	indexReady.Store(true)
+	if cfg.Accounts {
+		go gcLoginSessions()
+	} else if len(cfg.APIKeys) == 0 {
+		slog.Warn("No API keys configured: anyone can upload and delete")
+	}
+
+	// Drop upload sessions that were never finalized
+	go gcUploadSessions()
+	go gcTrash()
+	if len(cfg.Retention) > 0 {
+		go gcRetention()
+	}
+	go deliverWebhooks()
+	go writeViews()
+
+	// On SIGINT/SIGTERM stop accepting connections and let in-flight
+	// requests, uploads in particular, finish before exiting
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	<-ctx.Done()
+	stop()
+	slog.Info("Shutting down, waiting for in-flight requests", "timeout", cfg.ShutdownTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		slog.Error("Shutdown", "err", err)
+	}
+	flushViews()
+	db.Close()
+	return nil
 }
 
 func handleIndex(w http.ResponseWriter, r *http.Request) {
@@ -77,7 +200,17 @@ func handleIndex(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	images := scanImages(uploadDir)
+	_, authenticated := resolvePrincipal(r)
+	if !authenticated && !anonymousReads() {
+		http.Error(w, "Authentication required", http.StatusUnauthorized)
+		return
+	}
+	var images []string
+	if list, err := listImages(listQuery{Owner: requestViewer(r).ownerFilter(), HideProtected: !authenticated}); err == nil {
+		for _, m := range list.Images {
+			images = append(images, m.ID)
+		}
+	}
 	shuffleImages(images)
 	bgPool := images
 	if len(images) > 6 {
@@ -85,199 +218,454 @@ func handleIndex(w http.ResponseWriter, r *http.Request) {
 	}
 
 	data := struct {
-		Images []string
-		BGPool []string
-		Year   int
+		Images    []string
+		BGPool    []string
+		Year      int
+		CSRFToken string
+		Base      string
+		Feed      bool
 	}{
-		Images: images,
-		BGPool: bgPool,
-		Year:   time.Now().Year(),
+		Images:    images,
+		BGPool:    bgPool,
+		Year:      time.Now().Year(),
+		CSRFToken: csrfToken(w, r),
+		Base:      cfg.BasePath,
+		Feed:      feedEnabled(),
 	}
 
-	tmpl := template.Must(template.ParseFiles(filepath.Join(templateDir, "index.html")))
+	// parsed on every request so edits of an override show up right away
+	tmpl, err := template.ParseFS(templateFS(), "index.html")
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Parse template", "err", err)
+		http.Error(w, "Could not load page", http.StatusInternalServerError)
+		return
+	}
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	tmpl.Execute(w, data)
 }
 
 func handleAPI(w http.ResponseWriter, r *http.Request) {
-	// Common headers
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
-	// Allow preflight
-	if r.Method == "OPTIONS" {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-		w.WriteHeader(http.StatusNoContent)
+	if apiPreamble(w, r) {
 		return
 	}
 	switch r.Method {
 	case "GET":
 		handleListImages(w, r)
 	case "POST":
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+			handleJSONUpload(w, r)
+			return
+		}
 		handleUpload(w, r)
 	default:
 		writeJSONError(w, "Unsupported method", http.StatusMethodNotAllowed)
 	}
 }
 
+// apiPreamble sets the headers shared by all API responses and answers
+// OPTIONS requests; CORS is up to withCORS. It reports whether the request
+// has been fully handled.
+func apiPreamble(w http.ResponseWriter, r *http.Request) bool {
+	// Common headers
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	if r.Method == "OPTIONS" {
+		w.Header().Set("Allow", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+		w.WriteHeader(http.StatusNoContent)
+		return true
+	}
+	return false
+}
+
 func handleListImages(w http.ResponseWriter, r *http.Request) {
-	images := scanImages(uploadDir)
-	var result []ImageMeta
+	q, page, err := parseListQuery(r)
+	if err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	p, authenticated := resolvePrincipal(r)
+	q.Owner = p.ownerFilter()
+	q.HideProtected = !authenticated
+	q.Rater = p.UserID
+	if listNotModified(w, r, q) {
+		return
+	}
+	result, err := listImages(q)
+	if errors.Is(err, errBadCursor) {
+		writeProblem(w, http.StatusBadRequest, "invalid_cursor", "Invalid cursor", nil)
+		return
+	}
+	if err == nil {
+		err = addRatings(p.UserID, result.Images)
+	}
+	if err != nil {
+		writeJSONError(w, "Could not list images", http.StatusInternalServerError)
+		return
+	}
+	result.Page = page
 
-	for _, img := range images {
-		filePath := filepath.Join(uploadDir, img)
-		info, err := os.Stat(filePath)
-		if err != nil {
-			continue
-		}
+	json.NewEncoder(w).Encode(result)
+}
+
+// parseListQuery reads ?page=, ?limit=, ?cursor=, ?sort=, ?order= and the
+// filters from the request. The returned page number is 0 when the client
+// pages by cursor.
+func parseListQuery(r *http.Request) (listQuery, int, error) {
+	v := r.URL.Query()
+	q := listQuery{Limit: defaultPageSize, Cursor: v.Get("cursor"), Sort: v.Get("sort")}
+	if _, ok := sortColumns[q.Sort]; q.Sort != "" && !ok {
+		return q, 0, errors.New("Invalid sort, expected uploaded, taken, size, name or popular")
+	}
+	switch v.Get("order") {
+	case "":
+		// the most popular first, everything else ascending
+		q.Desc = q.Sort == "popular"
+	case "asc":
+	case "desc":
+		q.Desc = true
+	default:
+		return q, 0, errors.New("Invalid order, expected asc or desc")
+	}
+	if err := parseListFilters(v, &q); err != nil {
+		return q, 0, err
+	}
 
-		mimeType := mime.TypeByExtension(filepath.Ext(img))
-		if mimeType == "" {
-			// try to detect
-			f, _ := os.Open(filePath)
-			buf := make([]byte, 512)
-			n, _ := f.Read(buf)
-			mimeType = http.DetectContentType(buf[:n])
-			f.Close()
+	if s := v.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return q, 0, errors.New("Invalid limit")
 		}
+		q.Limit = min(n, maxPageSize)
+	}
 
-		meta := ImageMeta{
-			ID:   img,
-			Name: img,
-			URL:  "/uploads/" + img,
-			Size: info.Size(),
-			Mime: mimeType,
+	page := 0
+	if q.Cursor == "" {
+		page = 1
+		if s := v.Get("page"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 1 {
+				return q, 0, errors.New("Invalid page")
+			}
+			page = n
 		}
+		q.Offset = (page - 1) * q.Limit
+	}
+	return q, page, nil
+}
 
-		// Get image dimensions
-		f, err := os.Open(filePath)
-		if err == nil {
-			cfg, _, err := image.DecodeConfig(f)
-			if err == nil {
-				meta.Width = cfg.Width
-				meta.Height = cfg.Height
+// parseListFilters reads the filters of the listing, ?tag=, the EXIF and
+// the place ones, into q.
+func parseListFilters(v url.Values, q *listQuery) error {
+	for _, t := range v["tag"] {
+		if tag := normalizeTag(t); tag != "" {
+			q.Tags = append(q.Tags, tag)
+		}
+	}
+	q.Camera = strings.TrimSpace(v.Get("camera"))
+	q.Lens = strings.TrimSpace(v.Get("lens"))
+	q.Country = strings.TrimSpace(v.Get("country"))
+	q.City = strings.TrimSpace(v.Get("city"))
+	switch v.Get("favorites") {
+	case "", "0":
+	case "1":
+		q.Favorites = true
+	default:
+		return errors.New("Invalid favorites, expected 1")
+	}
+	if s := v.Get("min_rating"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxRating {
+			return errors.New("Invalid min_rating, expected 1 to 5")
+		}
+		q.MinRating = n
+	}
+	for _, s := range v["field"] {
+		f, err := parseFieldFilter(s)
+		if err != nil {
+			return err
+		}
+		q.Fields = append(q.Fields, f)
+	}
+	for _, p := range []struct {
+		name string
+		to   *int
+	}{{"iso_min", &q.ISOMin}, {"iso_max", &q.ISOMax}} {
+		if s := v.Get(p.name); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 1 {
+				return errors.New("Invalid " + p.name)
 			}
-			f.Seek(0, 0)
-			// Read EXIF (best-effort)
-			x, err := exif.Decode(f)
-			if err == nil && x != nil {
-				meta.Exif = map[string]string{}
-				if tm, err := x.DateTime(); err == nil {
-					meta.Exif["DateTime"] = tm.Format(time.RFC3339)
-				}
-				if cam, err := x.Get(exif.Model); err == nil {
-					meta.Exif["CameraModel"], _ = cam.StringVal()
-				}
-				if make, err := x.Get(exif.Make); err == nil {
-					meta.Exif["CameraMake"], _ = make.StringVal()
-				}
-				if lat, long, err := x.LatLong(); err == nil {
-					meta.Exif["Latitude"] = fmt.Sprintf("%f", lat)
-					meta.Exif["Longitude"] = fmt.Sprintf("%f", long)
-				}
+			*p.to = n
+		}
+	}
+	for _, p := range []struct {
+		name string
+		to   *time.Time
+	}{{"taken_after", &q.TakenAfter}, {"taken_before", &q.TakenBefore}} {
+		if s := v.Get(p.name); s != "" {
+			t, err := parseFilterTime(s)
+			if err != nil {
+				return errors.New("Invalid " + p.name + ", expected a date like 2024-01-01 or an RFC 3339 time")
 			}
-			f.Close()
+			*p.to = t
 		}
-
-		result = append(result, meta)
 	}
-
-	// Sort by name
-	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
-
-	json.NewEncoder(w).Encode(result)
+	return nil
 }
 
-func handleUpload(w http.ResponseWriter, r *http.Request) {
-	if err := r.ParseMultipartForm(maxSize); err != nil {
-		writeJSONError(w, "File too large", http.StatusBadRequest)
-		return
+// parseFilterTime reads the taken_after and taken_before filters: a day,
+// meaning its start in UTC, or an exact time.
+func parseFilterTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.DateOnly, s); err == nil {
+		return t, nil
 	}
+	return time.Parse(time.RFC3339, s)
+}
 
-	file, header, err := r.FormFile("file")
+// readImageMeta collects size, type, dimensions and EXIF for a stored file.
+func readImageMeta(ctx context.Context, img string) (ImageMeta, ObjectInfo, error) {
+	f, info, err := storage.Open(ctx, img)
 	if err != nil {
-		writeJSONError(w, "Missing file", http.StatusBadRequest)
-		return
+		return ImageMeta{}, info, err
 	}
-	defer file.Close()
-
-	// Check file size
-	if header.Size > maxSize {
-		writeJSONError(w, "File exceeds maximum size 50 MB", http.StatusBadRequest)
-		return
+	defer f.Close()
+
+	mimeType := mediaType(img)
+	if mimeType == "" {
+		// try to detect
+		buf := make([]byte, 512)
+		n, _ := io.ReadFull(f, buf)
+		mimeType = http.DetectContentType(buf[:n])
+		f.Seek(0, io.SeekStart)
 	}
 
-	// Read first 512 bytes to detect content type
-	buffer := make([]byte, 512)
-	_, err = file.Read(buffer)
-	if err != nil && err != io.EOF {
-		writeJSONError(w, "Invalid file type", http.StatusBadRequest)
-		return
+	meta := ImageMeta{
+		ID:   img,
+		Name: img,
+		Size: info.Size,
+		Mime: mimeType,
 	}
+	meta.URL, meta.Thumb = imageURLs(meta)
 
-	file.Seek(0, 0) // Reset file pointer
+	if isVideoName(img) {
+		if w, h, err := probeVideo(ctx, img); err == nil {
+			meta.Width, meta.Height = w, h
+		}
+		return meta, info, nil
+	}
+	if isSVGName(img) {
+		meta.Width, meta.Height = svgSize(f)
+		return meta, info, nil
+	}
 
-	contentType := http.DetectContentType(buffer)
-	if !strings.HasPrefix(contentType, "image/") {
-		writeJSONError(w, "Invalid file type", http.StatusBadRequest)
-		return
+	// Get image dimensions
+	dim, _, err := image.DecodeConfig(f)
+	if err == nil {
+		meta.Width = dim.Width
+		meta.Height = dim.Height
+	}
+	f.Seek(0, io.SeekStart)
+	// Read EXIF (best-effort)
+	sctx, s := startSpan(ctx, "exif.decode", slog.String("image", img))
+	x, err := exif.Decode(f)
+	s.end(sctx, nil)
+	if err == nil && x != nil {
+		meta.Exif = map[string]string{}
+		if tm, err := x.DateTime(); err == nil {
+			meta.Exif["DateTime"] = tm.Format(time.RFC3339)
+			meta.Taken = &tm
+		}
+		if cam, err := x.Get(exif.Model); err == nil {
+			meta.Exif["CameraModel"], _ = cam.StringVal()
+		}
+		if make, err := x.Get(exif.Make); err == nil {
+			meta.Exif["CameraMake"], _ = make.StringVal()
+		}
+		if lens, err := x.Get(exif.LensModel); err == nil {
+			meta.Exif["LensModel"], _ = lens.StringVal()
+		}
+		if iso, err := x.Get(exif.ISOSpeedRatings); err == nil {
+			if n, err := iso.Int(0); err == nil && n > 0 {
+				meta.Exif["ISO"] = strconv.Itoa(n)
+			}
+		}
+		if lat, long, err := x.LatLong(); err == nil {
+			meta.Exif["Latitude"] = fmt.Sprintf("%f", lat)
+			meta.Exif["Longitude"] = fmt.Sprintf("%f", long)
+		}
+		if o := exifOrientation(x); o > 1 {
+			meta.Exif["Orientation"] = strconv.Itoa(o)
+			if swapsAxes(o) {
+				// report the size as displayed
+				meta.Width, meta.Height = meta.Height, meta.Width
+			}
+		}
 	}
 
-	// Generate safe filename
-	ext := filepath.Ext(header.Filename)
-	_ = ext
-	safeName := regexp.MustCompile(`[^a-zA-Z0-9\.\-_]`).ReplaceAllString(header.Filename, "_")
-	uniqueName := randomString(12) + "_" + safeName
+	return meta, info, nil
+}
+
+// multipartOverhead is what a form may add around the file: boundaries,
+// part headers and small fields.
+const multipartOverhead = 64 << 10
 
-	// Create target file
-	targetPath := filepath.Join(uploadDir, uniqueName)
-	targetFile, err := os.Create(targetPath)
-	if err != nil {
-		writeJSONError(w, "Could not save file", http.StatusInternalServerError)
+// handleUpload takes the image from the "file" field of a multipart form.
+func handleUpload(w http.ResponseWriter, r *http.Request) {
+	tooLarge := fmt.Sprintf("File exceeds maximum size %d MB", cfg.MaxUploadMB)
+	path, name, ok := stageMultipart(w, r, cfg.maxUploadBytes(), tooLarge)
+	if !ok {
 		return
 	}
-	defer targetFile.Close()
-
-	// Copy file content
-	_, err = io.Copy(targetFile, file)
+	meta, duplicate, err := ingest(r.Context(), upload{
+		Path:    path,
+		Name:    name,
+		Owner:   requestViewer(r).UserID,
+		Strip:   wantStripMetadata(r),
+		Pending: needsReview(r),
+	})
 	if err != nil {
-		writeJSONError(w, "Could not save file", http.StatusInternalServerError)
+		writeIngestError(w, err)
 		return
 	}
-
-	info, _ := os.Stat(targetPath)
 	response := UploadResponse{
-		Success: true,
-		ID:      uniqueName,
-		URL:     "/uploads/" + uniqueName,
-		Size:    info.Size(),
+		Success:   true,
+		ID:        meta.ID,
+		URL:       meta.URL,
+		Size:      meta.Size,
+		Duplicate: duplicate,
+		Image:     &meta,
 	}
 
 	json.NewEncoder(w).Encode(response)
 }
 
-func scanImages(dir string) []string {
-	var images []string
-
-	entries, err := os.ReadDir(dir)
+// stageMultipart saves the "file" part of a multipart form to a staging
+// file and returns its path and the client's file name, or writes the
+// error. The part is streamed to disk as it arrives instead of being
+// buffered by ParseMultipartForm, and the byte count, not the size the
+// client claims, is held to limit.
+func stageMultipart(w http.ResponseWriter, r *http.Request, limit int64, tooLarge string) (string, string, bool) {
+	if r.ContentLength > limit+multipartOverhead {
+		writeJSONError(w, tooLarge, http.StatusRequestEntityTooLarge)
+		return "", "", false
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, limit+multipartOverhead)
+	mr, err := r.MultipartReader()
 	if err != nil {
-		return images
+		writeJSONError(w, "Expected a multipart form", http.StatusBadRequest)
+		return "", "", false
 	}
+	var part *multipart.Part
+	for {
+		if part, err = mr.NextPart(); err != nil {
+			break
+		}
+		if part.FormName() == "file" && part.FileName() != "" {
+			break
+		}
+		part.Close()
+	}
+	var maxBytes *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxBytes):
+		writeJSONError(w, tooLarge, http.StatusRequestEntityTooLarge)
+		return "", "", false
+	case err != nil:
+		writeJSONError(w, "Missing file", http.StatusBadRequest)
+		return "", "", false
+	}
+	defer part.Close()
 
-	imageRegex := regexp.MustCompile(`(?i)\.(jpe?g|png|webp|gif)$`)
+	// Refuse before writing anything if the disk is nearly full; the
+	// quota needs the real size and is checked by ingest
+	if r.ContentLength > 0 && !hasRoomFor(r.ContentLength) {
+		writeProblem(w, http.StatusInsufficientStorage, "disk_full", "Not enough free disk space", nil)
+		return "", "", false
+	}
 
-	for _, entry := range entries {
-		if entry.IsDir() {
-			continue
+	// Stage the upload on local disk, where it is checked and hashed;
+	// nothing reaches storage before the whole file is here
+	tmp, err := os.CreateTemp(cfg.sessionDir(), ".upload-*")
+	if err != nil {
+		writeJSONError(w, "Could not save file", http.StatusInternalServerError)
+		return "", "", false
+	}
+	n, err := io.Copy(tmp, guardSpace(io.LimitReader(part, limit+1)))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil || n > limit {
+		os.Remove(tmp.Name())
+		if n > limit || errors.As(err, &maxBytes) {
+			writeJSONError(w, tooLarge, http.StatusRequestEntityTooLarge)
+			return "", "", false
 		}
-		if imageRegex.MatchString(entry.Name()) {
-			images = append(images, entry.Name())
+		if errors.Is(err, errDiskFull) {
+			writeProblem(w, http.StatusInsufficientStorage, "disk_full", "Not enough free disk space", nil)
+			return "", "", false
 		}
+		slog.WarnContext(r.Context(), "Upload incomplete", "file", part.FileName(), "err", err)
+		writeJSONError(w, "Could not save file", http.StatusInternalServerError)
+		return "", "", false
 	}
+	return tmp.Name(), part.FileName(), true
+}
 
-	sort.Strings(images)
-	return images
+// handleOriginal serves /uploads/{id} from storage. Only names that look
+// like images are served, which keeps the index and session files private.
+func handleOriginal(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/uploads/")
+	if name != filepath.Base(name) || !isMediaName(name) {
+		http.NotFound(w, r)
+		return
+	}
+	meta, ok := servableImage(r, name)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	download := r.URL.Query().Get("download") == "1"
+	if download {
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": meta.Name}))
+	}
+	if countedRequest(r) {
+		countView(meta.ID, download)
+	}
+	marked := watermarkVersion(meta) != ""
+	if marked {
+		// owners and visitors get different files under the same URL
+		w.Header().Set("Cache-Control", "private, no-cache")
+		w.Header().Add("Vary", "Cookie, Authorization, X-API-Key")
+		if !seesUnmarked(r, meta) && !isVideoName(name) && !rendersAsIs(name) {
+			serveWatermarkedOriginal(w, r, meta)
+			return
+		}
+	}
+	file := name
+	if r.URL.Query().Get("original") == "1" {
+		// the HEIC an upload was converted from, see heic.go
+		file = heicOriginalName(name)
+		w.Header().Set("Content-Type", "image/heic")
+	} else {
+		w.Header().Set("Content-Type", mediaType(name))
+		if isSVGName(name) {
+			setSVGHeaders(w)
+		}
+		if !marked {
+			setContentCache(w, r, meta, originalVersion(meta.SHA256))
+		}
+	}
+	f, info, err := storage.Open(r.Context(), file)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			http.NotFound(w, r)
+		} else {
+			http.Error(w, "Could not read file", http.StatusInternalServerError)
+		}
+		return
+	}
+	defer f.Close()
+	http.ServeContent(w, r, file, info.ModTime, f)
 }
 
 func shuffleImages(images []string) {
@@ -299,6 +687,17 @@ func shuffleImages(images []string) {
 	}
 }
 
+// uniqueFileName turns a client supplied name into a safe, collision-free
+// file name inside the upload directory.
+func uniqueFileName(original string) string {
+	return randomString(12) + "_" + safeFileName(original)
+}
+
+// safeFileName is the base of path with anything unusual replaced.
+func safeFileName(path string) string {
+	return regexp.MustCompile(`[^a-zA-Z0-9\.\-_]`).ReplaceAllString(filepath.Base(path), "_")
+}
+
 func randomString(length int) string {
 	const chars = "0123456789abcdef"
 	bytes := make([]byte, length)
@@ -309,122 +708,56 @@ func randomString(length int) string {
 	return string(bytes)
 }
 
-func writeJSONError(w http.ResponseWriter, msg string, code int) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(code)
-	json.NewEncoder(w).Encode(map[string]string{"error": msg})
-}
-
-func createTemplates() {
-	// Only create if missing
-	path := filepath.Join(templateDir, "index.html")
-	if _, err := os.Stat(path); err == nil {
-		return
+// hasRoomFor reports whether n more bytes fit into the staging directory
+// and storage while still leaving the configured reserve free. If free
+// space cannot be determined, or the backend has no local capacity limit,
+// that check is skipped.
+func hasRoomFor(n int64) bool {
+	need := uint64(n + cfg.diskReserveBytes())
+	if free, err := freeSpace(cfg.sessionDir()); err == nil && need > free {
+		return false
 	}
-
-	indexHTML := ` + "`" + `<!doctype html>
-<html lang="cs">
-<head>
-<meta charset="utf-8" />
-<meta name="viewport" content="width=device-width,initial-scale=1" />
-<title>AI-Morph Galerie — Neuromorphic</title>
-
-<script src="https://cdn.tailwindcss.com"></script>
-<script src="https://unpkg.com/feather-icons"></script>
-
-<link rel="stylesheet" href="/static/styles.css" />
-
-</head>
-<body class="dark"> 
-<div id="bg-wrap" aria-hidden="true">
-  {{range $i, $bg := .BGPool}}
-  <div class="bg-layer" id="bg-{{$i}}" data-bg-url="/uploads/{{$bg}}"></div>
-  {{end}}
-</div>
-
-<header class="w-full">
-  <div class="container flex items-center justify-between">
-    <div>
-      <h1 class="text-2xl font-semibold">AI-Morph Galerie</h1>
-      <p class="text-sm text-gray-300/70">Neuromorphic UI · ratio-aware modal · AI-like morph</p>
-    </div>
-
-    <div class="flex items-center gap-3">
-      <label id="upload-label" class="inline-flex items-center gap-2 px-3 py-2 rounded-lg bg-white/6 hover:bg-white/8 cursor-pointer card">
-        <svg data-feather="upload" class="w-4 h-4"></svg>
-        <span class="text-sm">Nahrát</span>
-        <input id="upload" type="file" accept="image/*" multiple class="sr-only" />
-      </label>
-
-      <button id="toggle-theme" class="inline-flex items-center gap-2 px-3 py-2 rounded-lg bg-white/6 hover:bg-white/8 card" title="Přepnout motiv">
-        <svg data-feather="moon" class="w-4 h-4"></svg>
-      </button>
-    </div>
-  </div>
-</header>
-
-<main class="container mt-6">
-  <div id="grid" class="grid"></div>
-</main>
-
-<footer class="container mt-10 mb-12 text-sm text-gray-300/70">
-  © {{.Year}} — Until Design Fluent
-</footer>
-
-<div id="modal" aria-hidden="true" role="dialog">
-  <div id="modal-overlay" onclick="closeModal()"></div>
-  <div id="modal-body" role="document" aria-label="Image preview">
-    <div id="layer1" class="morph-layer">
-      <img src="" alt="">
-      <div class="layer-spinner" id="spinner1">⌛</div>
-    </div>
-    <div id="layer2" class="morph-layer">
-      <img src="" alt="">
-      <div class="layer-spinner" id="spinner2">⌛</div>
-    </div>
-
-    <div id="btn-close" class="ctrl" title="Zavřít" onclick="closeModal()"><svg data-feather="x" class="w-5 h-5"></svg></div>
-    <div id="btn-prev" class="ctrl" title="Předchozí" onclick="prevImage()"><svg data-feather="chevron-left" class="w-5 h-5"></svg></div>
-    <div id="btn-next" class="ctrl" title="Další" onclick="nextImage()"><svg data-feather="chevron-right" class="w-5 h-5"></svg></div>
-    <div id="btn-download" class="ctrl" title="Stáhnout" onclick="downloadCurrent()"><svg data-feather="download" class="w-5 h-5"></svg></div>
-  </div>
-</div>
-
-<div id="upload-modal" aria-hidden="true">
-  <div class="upload-card card">
-    <div>
-      <div style="font-weight:700">Nahrávání souborů</div>
-      <div id="upload-fname" style="opacity:.85;margin-top:6px;font-size:13px">Vyber soubory...</div>
-      <div id="upload-status" style="opacity:.8;margin-top:8px;font-size:13px">0 / 0 • 0 B / 0 B</div>
-    </div>
-
-    <div style="display:flex;align-items:center;gap:12px">
-      <div class="progress-wrap" aria-hidden="true">
-        <svg class="progress-svg" width="108" height="108" viewBox="0 0 100 100">
-          <circle cx="50" cy="50" r="40" stroke="rgba(255,255,255,0.12)" stroke-width="10" fill="none"></circle>
-          <circle id="progress-circle" cx="50" cy="50" r="40" stroke="#ffffff" stroke-width="10" stroke-linecap="round" fill="none" stroke-dasharray="251.2" stroke-dashoffset="251.2"></circle>
-        </svg>
-        <div class="progress-text" id="progress-text">0%</div>
-      </div>
-    </div>
-  </div>
-</div>
-
-<script src="/static/main.js"></script>
-
-</body>
-</html>` + "`" + `
-
-	tmpl := template.Must(template.New("index.html").Funcs(template.FuncMap{
-		"Year": func() int { return time.Now().Year() },
-	}).Parse(indexHTML))
-
-	file, err := os.Create(path)
+	sr, ok := baseStorage().(spaceReporter)
+	if !ok {
+		return true
+	}
+	free, err := sr.FreeSpace()
 	if err != nil {
-		log.Println("Error creating template:", err)
-		return
+		return true
 	}
-	defer file.Close()
+	return need <= free
+}
 
-	tmpl.Execute(file, nil)
+// spaceCheckEvery is how many bytes a spaceGuard lets through between
+// looks at the free space.
+const spaceCheckEvery = 8 << 20
+
+var errDiskFull = errors.New("not enough free disk space")
+
+// spaceGuard stops a copy into the staging directory with errDiskFull
+// before it eats into the reserve, so bodies of unknown or understated
+// length cannot fill the disk and leave half written files behind.
+type spaceGuard struct {
+	r       io.Reader
+	pending int64 // bytes since the last look
+}
+
+func guardSpace(r io.Reader) io.Reader {
+	return &spaceGuard{r: r, pending: spaceCheckEvery}
+}
+
+func (g *spaceGuard) Read(b []byte) (int, error) {
+	if g.pending >= spaceCheckEvery {
+		g.pending = 0
+		free, err := freeSpace(cfg.sessionDir())
+		if err == nil && free < uint64(cfg.diskReserveBytes()+spaceCheckEvery) {
+			return 0, errDiskFull
+		}
+	}
+	if len(b) > spaceCheckEvery {
+		b = b[:spaceCheckEvery]
+	}
+	n, err := g.r.Read(b)
+	g.pending += int64(n)
+	return n, err
 }
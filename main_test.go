@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testGallery opens an empty gallery with accounts in a temporary
+// directory, restoring the configuration when the test ends.
+func testGallery(t *testing.T) {
+	t.Helper()
+	savedCfg, savedStorage := cfg, storage
+	dir := t.TempDir()
+	cfg = defaultConfig()
+	cfg.UploadDir = dir
+	cfg.ThumbDir = filepath.Join(dir, ".thumbs")
+	cfg.Accounts = true
+	if err := openStore(filepath.Join(dir, ".gallery.db")); err != nil {
+		t.Fatal(err)
+	}
+	s, err := newLocalStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage = s
+	// a new index starts over at the first version
+	indexCache.Lock()
+	indexCache.lists = nil
+	indexCache.Unlock()
+	t.Cleanup(func() {
+		db.Close()
+		cfg, storage = savedCfg, savedStorage
+	})
+}
+
+func mustExec(t *testing.T, query string, args ...any) {
+	t.Helper()
+	if _, err := db.Exec(query, args...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testUser adds an account and returns its id and a session cookie.
+func testUser(t *testing.T, name string, admin bool) (string, *http.Cookie) {
+	t.Helper()
+	id, token, role := randomString(16), randomString(32), roleUser
+	if admin {
+		role = roleAdmin
+	}
+	now := time.Now()
+	mustExec(t, `INSERT INTO users (id, username, password_hash, role, created_at) VALUES (?, ?, '', ?, ?)`,
+		id, name, role, now.UnixNano())
+	mustExec(t, `INSERT INTO user_sessions (token_hash, user_id, expires_at) VALUES (?, ?, ?)`,
+		hashToken(token), id, now.Add(time.Hour).UnixNano())
+	return id, &http.Cookie{Name: sessionCookie, Value: token}
+}
+
+func testImage(t *testing.T, id, owner string) {
+	t.Helper()
+	mustExec(t, `INSERT INTO images (id, name, size, mime, owner_id, mod_time, uploaded_at) VALUES (?, ?, 1, 'image/png', ?, 1, 1)`,
+		id, id, owner)
+}
+
+// testAlbum adds an album of owner holding images, with a password if
+// protected.
+func testAlbum(t *testing.T, id, owner string, protected bool, images ...string) {
+	t.Helper()
+	hash := ""
+	if protected {
+		hash = "x"
+	}
+	mustExec(t, `INSERT INTO albums (id, name, owner_id, password_hash, created_at) VALUES (?, ?, ?, ?, 1)`, id, id, owner, hash)
+	for _, img := range images {
+		mustExec(t, `INSERT INTO album_images (album_id, image_id, added_at) VALUES (?, ?, 1)`, id, img)
+	}
+}
+
+// testAlbumCookie lets a visitor into album as its password would.
+func testAlbumCookie(t *testing.T, album string) *http.Cookie {
+	t.Helper()
+	token := randomString(32)
+	mustExec(t, `INSERT INTO album_access (token_hash, album_id, expires_at) VALUES (?, ?, ?)`,
+		hashToken(token), album, time.Now().Add(time.Hour).UnixNano())
+	return &http.Cookie{Name: albumCookie(album), Value: token}
+}
+
+func serveTest(h http.Handler, method, target, body string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	if body != "" {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
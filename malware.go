@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Uploads can be checked for malware before they are accepted, which
+// matters because a file can be a valid image and something else at once.
+// cfg.Clamd is the address of a ClamAV daemon, a socket path or host:port,
+// that gets the file over INSTREAM. cfg.MalwareCommand is any scanner run
+// as "command file" that, like clamscan, exits with 0 for a clean file and
+// 1 for an infected one. Infected uploads are refused; so are uploads that
+// cannot be scanned, as the scanner being down should not let files through.
+
+var (
+	errMalware    = errors.New("file is infected")
+	errMalwareRun = errors.New("malware scan failed")
+)
+
+const malwareTimeout = time.Minute
+
+// clamdChunk is the size of the INSTREAM chunks, well below clamd's
+// default StreamMaxLength.
+const clamdChunk = 64 << 10
+
+// checkMalware scans the file at path with the configured scanner, if any.
+func checkMalware(ctx context.Context, path string) error {
+	if cfg.Clamd == "" && cfg.MalwareCommand == "" {
+		return nil
+	}
+	ctx, s := startSpan(ctx, "upload.malware")
+	ctx, cancel := context.WithTimeout(ctx, malwareTimeout)
+	defer cancel()
+	var verdict string
+	var err error
+	if cfg.Clamd != "" {
+		verdict, err = clamdScan(ctx, cfg.Clamd, path)
+	} else {
+		verdict, err = commandMalwareScan(ctx, cfg.MalwareCommand, path)
+	}
+	s.end(ctx, err)
+	switch {
+	case err != nil:
+		slog.WarnContext(ctx, "Malware scan failed", "err", err)
+		return errMalwareRun
+	case verdict != "":
+		slog.WarnContext(ctx, "Infected upload refused", "virus", verdict)
+		return errMalware
+	}
+	return nil
+}
+
+// clamdScan streams the file to clamd and returns the name of what it
+// found, or "" for a clean file.
+func clamdScan(ctx context.Context, addr, path string) (string, error) {
+	network := "tcp"
+	if strings.HasPrefix(addr, "/") {
+		network = "unix"
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := io.WriteString(conn, "zINSTREAM\x00"); err != nil {
+		return "", err
+	}
+	buf := make([]byte, 4+clamdChunk)
+	for {
+		n, err := f.Read(buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(n))
+			if _, err := conn.Write(buf[:4+n]); err != nil {
+				return "", err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	// a zero length chunk ends the stream
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return "", err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	reply = strings.TrimRight(reply, "\x00\n")
+	// "stream: OK", "stream: Eicar-Signature FOUND" or "... ERROR"
+	result := strings.TrimSpace(strings.TrimPrefix(reply, "stream:"))
+	switch {
+	case result == "OK":
+		return "", nil
+	case strings.HasSuffix(result, " FOUND"):
+		return strings.TrimSuffix(result, " FOUND"), nil
+	default:
+		return "", fmt.Errorf("clamd: %s", reply)
+	}
+}
+
+func commandMalwareScan(ctx context.Context, command, path string) (string, error) {
+	out, err := exec.CommandContext(ctx, command, path).CombinedOutput()
+	var exit *exec.ExitError
+	switch {
+	case err == nil:
+		return "", nil
+	case errors.As(err, &exit) && exit.ExitCode() == 1:
+		// clamscan prints "file: Name FOUND" first, then a summary
+		verdict, _, _ := strings.Cut(strings.TrimSpace(string(out)), "\n")
+		if verdict == "" {
+			verdict = "infected"
+		}
+		return verdict, nil
+	default:
+		return "", fmt.Errorf("%s: %w: %s", command, err, strings.TrimSpace(string(out)))
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// Uploads can be stripped of EXIF (and with it GPS coordinates), XMP and
+// similar embedded metadata before they are stored. Pixels are copied
+// untouched; only the metadata segments of JPEG, PNG and WebP files are
+// dropped. Other formats are stored as they are.
+
+var errBadImage = errors.New("malformed image")
+
+// wantStripMetadata reports whether the upload should lose its metadata,
+// either because the server is configured so or the client asked with
+// ?strip_exif=1.
+func wantStripMetadata(r *http.Request) bool {
+	if cfg.StripExif {
+		return true
+	}
+	v, _ := strconv.ParseBool(r.URL.Query().Get("strip_exif"))
+	return v
+}
+
+// stripFileMetadata rewrites the local file at path without metadata.
+func stripFileMetadata(path, contentType string) error {
+	var strip func(w io.Writer, f *os.File) error
+	switch contentType {
+	case "image/jpeg":
+		strip = stripJPEG
+	case "image/png":
+		strip = stripPNG
+	case "image/webp":
+		strip = stripWebP
+	default:
+		return nil
+	}
+
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	tmp, err := os.CreateTemp(cfg.sessionDir(), ".strip-*")
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(tmp)
+	err = strip(bw, src)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// stripJPEG drops APP1 (EXIF, XMP), APP13 (IPTC) and comment segments. The
+// ICC profile in APP2 is kept so colours stay right, and so is the EXIF
+// orientation, in an EXIF block of its own, lest portrait photos lie on
+// their side.
+func stripJPEG(w io.Writer, f *os.File) error {
+	orientation := readOrientation(f)
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	r := bufio.NewReader(f)
+	var soi [2]byte
+	if _, err := io.ReadFull(r, soi[:]); err != nil || soi != [2]byte{0xFF, 0xD8} {
+		return errBadImage
+	}
+	w.Write(soi[:])
+
+	for {
+		var marker [2]byte
+		if _, err := io.ReadFull(r, marker[:]); err != nil || marker[0] != 0xFF {
+			return errBadImage
+		}
+		if orientation > 1 && marker[1] != 0xE0 {
+			// after the JFIF header, if any
+			w.Write(orientationSegment(orientation))
+			orientation = 1
+		}
+		if marker[1] == 0xDA {
+			// Start of scan: the rest is entropy coded data, copy it as is
+			w.Write(marker[:])
+			_, err := io.Copy(w, r)
+			return err
+		}
+		var length [2]byte
+		if _, err := io.ReadFull(r, length[:]); err != nil {
+			return errBadImage
+		}
+		n := int64(binary.BigEndian.Uint16(length[:])) - 2
+		if n < 0 {
+			return errBadImage
+		}
+		switch marker[1] {
+		case 0xE1, 0xED, 0xFE:
+			if _, err := r.Discard(int(n)); err != nil {
+				return errBadImage
+			}
+		default:
+			w.Write(marker[:])
+			w.Write(length[:])
+			if _, err := io.CopyN(w, r, n); err != nil {
+				return errBadImage
+			}
+		}
+	}
+}
+
+// stripPNG drops the eXIf chunk and all text chunks, which is where XMP
+// and other metadata live.
+func stripPNG(w io.Writer, f *os.File) error {
+	r := bufio.NewReader(f)
+	sig := make([]byte, 8)
+	if _, err := io.ReadFull(r, sig); err != nil || string(sig) != "\x89PNG\r\n\x1a\n" {
+		return errBadImage
+	}
+	w.Write(sig)
+
+	for {
+		var head [8]byte
+		if _, err := io.ReadFull(r, head[:]); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return errBadImage
+		}
+		n := int64(binary.BigEndian.Uint32(head[:4])) + 4 // data and CRC
+		switch string(head[4:]) {
+		case "eXIf", "tEXt", "zTXt", "iTXt":
+			if _, err := io.CopyN(io.Discard, r, n); err != nil {
+				return errBadImage
+			}
+		default:
+			w.Write(head[:])
+			if _, err := io.CopyN(w, r, n); err != nil {
+				return errBadImage
+			}
+		}
+	}
+}
+
+// stripWebP drops the EXIF and XMP chunks and clears their flags in the
+// VP8X header. The file is read twice: once to size the new RIFF container
+// and once to copy it.
+func stripWebP(w io.Writer, f *os.File) error {
+	var head [12]byte
+	if _, err := io.ReadFull(f, head[:]); err != nil || string(head[:4]) != "RIFF" || string(head[8:]) != "WEBP" {
+		return errBadImage
+	}
+
+	type chunk struct {
+		fourcc string
+		offset int64 // of the payload
+		size   int64 // including padding
+	}
+	var chunks []chunk
+	var size int64 = 4 // "WEBP"
+	for offset := int64(12); ; {
+		var ch [8]byte
+		if _, err := f.ReadAt(ch[:], offset); err == io.EOF {
+			break
+		} else if err != nil {
+			return errBadImage
+		}
+		n := int64(binary.LittleEndian.Uint32(ch[4:]))
+		n += n & 1
+		c := chunk{fourcc: string(ch[:4]), offset: offset + 8, size: n}
+		offset += 8 + n
+		if c.fourcc == "EXIF" || c.fourcc == "XMP " {
+			continue
+		}
+		chunks = append(chunks, c)
+		size += 8 + n
+	}
+
+	binary.LittleEndian.PutUint32(head[4:], uint32(size))
+	w.Write(head[:])
+	for _, c := range chunks {
+		var ch [8]byte
+		copy(ch[:4], c.fourcc)
+		if _, err := f.ReadAt(ch[4:], c.offset-4); err != nil {
+			return errBadImage
+		}
+		w.Write(ch[:])
+		data := io.NewSectionReader(f, c.offset, c.size)
+		if c.fourcc == "VP8X" && c.size > 0 {
+			var flags [1]byte
+			data.Read(flags[:])
+			flags[0] &^= 0x08 | 0x04 // EXIF and XMP present
+			w.Write(flags[:])
+		}
+		if _, err := io.Copy(w, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
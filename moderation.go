@@ -0,0 +1,115 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+)
+
+// With cfg.Moderation uploads from people the gallery does not trust wait
+// for review: "guests" holds uploads through guest links (guest.go),
+// "users" those of accounts that are not admins as well. Pending images are
+// left out of every listing and only served to admins and their owner,
+// until an admin decides:
+//
+//	GET  /api/v1/admin/review        pending images, paged like the listing;
+//	                                 ?flagged=1 only those a scan flagged
+//	POST /api/v1/admin/review/{id}   {"decision": "approve"|"reject"}
+//
+// Approved images join the gallery; rejected ones are deleted for good.
+
+// needsReview reports whether an upload by the caller of r waits for
+// review.
+func needsReview(r *http.Request) bool {
+	if cfg.Moderation != "users" {
+		return false
+	}
+	p, _ := resolvePrincipal(r)
+	return !p.Admin
+}
+
+// guestNeedsReview reports whether guest uploads wait for review.
+func guestNeedsReview() bool {
+	return cfg.Moderation == "guests" || cfg.Moderation == "users"
+}
+
+// canSeePending reports whether the caller of r may see meta while it
+// waits for review.
+func canSeePending(r *http.Request, meta ImageMeta) bool {
+	p, _ := resolvePrincipal(r)
+	open := len(cfg.APIKeys) == 0 && !cfg.Accounts
+	return p.Admin || open || (p.UserID != "" && p.UserID == meta.Owner)
+}
+
+func handleReview(w http.ResponseWriter, r *http.Request, id string) {
+	switch {
+	case id == "" && r.Method == "GET":
+		q, page, err := parseListQuery(r)
+		if err != nil {
+			writeJSONError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		q.Pending = true
+		q.Flagged = r.URL.Query().Get("flagged") == "1"
+		if r.URL.Query().Get("sort") == "" {
+			q.Sort = "uploaded"
+		}
+		list, err := listImages(q)
+		if errors.Is(err, errBadCursor) {
+			writeProblem(w, http.StatusBadRequest, "invalid_cursor", "Invalid cursor", nil)
+			return
+		}
+		if err != nil {
+			writeJSONError(w, "Could not list images", http.StatusInternalServerError)
+			return
+		}
+		list.Page = page
+		json.NewEncoder(w).Encode(list)
+	case id != "" && r.Method == "POST":
+		handleReviewDecision(w, r, id)
+	default:
+		writeJSONError(w, "Unsupported method", http.StatusMethodNotAllowed)
+	}
+}
+
+func handleReviewDecision(w http.ResponseWriter, r *http.Request, id string) {
+	var req struct {
+		Decision string `json:"decision"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&req); err != nil || (req.Decision != "approve" && req.Decision != "reject") {
+		writeJSONError(w, "Expected JSON body with decision approve or reject", http.StatusBadRequest)
+		return
+	}
+	meta, err := getImage(id)
+	if err == nil && !meta.Pending {
+		err = sql.ErrNoRows
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		writeJSONError(w, "No image awaiting review: "+id, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeJSONError(w, "Could not load image", http.StatusInternalServerError)
+		return
+	}
+
+	if req.Decision == "approve" {
+		if _, err := db.Exec(`UPDATE images SET pending = 0 WHERE id = ?`, id); err != nil {
+			writeJSONError(w, "Could not approve image", http.StatusInternalServerError)
+			return
+		}
+		notifyImage("image.approved", id)
+	} else {
+		if err := purgeImage(r.Context(), id); err != nil {
+			slog.ErrorContext(r.Context(), "Could not delete rejected image", "image", id, "err", err)
+			writeJSONError(w, "Could not delete image", http.StatusInternalServerError)
+			return
+		}
+		notify(webhookEvent{Event: "image.deleted", Image: meta, Permanent: true})
+	}
+	slog.InfoContext(r.Context(), "Image reviewed", "image", id, "decision", req.Decision)
+	json.NewEncoder(w).Encode(map[string]any{"success": true, "id": id, "decision": req.Decision})
+}
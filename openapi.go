@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"net/http"
+)
+
+// The OpenAPI document is maintained by hand next to the handlers; keep it
+// in step when routes or response types change. It is served at
+// /api/v1/openapi.json, with Swagger UI on top at /api/v1/docs.
+
+//go:embed openapi.json
+var openapiSpec []byte
+
+const swaggerUIVersion = "5.17.14"
+
+var swaggerPage = []byte(`<!doctype html>
+<html lang="cs">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>AI-Morph Gallery API</title>
+<link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@` + swaggerUIVersion + `/swagger-ui.css">
+</head>
+<body>
+<div id="swagger-ui"></div>
+<script src="https://unpkg.com/swagger-ui-dist@` + swaggerUIVersion + `/swagger-ui-bundle.js" crossorigin></script>
+<script>
+window.onload = () => { window.ui = SwaggerUIBundle({ url: '/api/v1/openapi.json', dom_id: '#swagger-ui' }); };
+</script>
+</body>
+</html>
+`)
+
+func handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	if apiPreamble(w, r) {
+		return
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	spec := openapiSpec
+	if cfg.BasePath != "" {
+		// the paths in the document are relative to the server, the
+		// gallery's root
+		spec = bytes.Replace(spec, []byte(`"url": "/"`), []byte(`"url": "`+cfg.BasePath+`"`), 1)
+	}
+	w.Write(spec)
+}
+
+func handleAPIDocs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(bytes.Replace(swaggerPage, []byte(apiV1+"/openapi.json"), []byte(sitePath(apiV1+"/openapi.json")), 1))
+}
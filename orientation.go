@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/binary"
+	"image"
+	"image/draw"
+	"io"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// Cameras store portrait photos sideways and record how to turn them in
+// the EXIF Orientation tag (1 to 8, 1 being upright). Renditions are turned
+// upright when they are generated, and the index reports the dimensions as
+// displayed.
+
+// readOrientation returns the EXIF orientation of an image, 1 if unknown.
+func readOrientation(r io.Reader) int {
+	x, err := exif.Decode(r)
+	if err != nil {
+		return 1
+	}
+	return exifOrientation(x)
+}
+
+func exifOrientation(x *exif.Exif) int {
+	tag, err := x.Get(exif.Orientation)
+	if err != nil {
+		return 1
+	}
+	o, err := tag.Int(0)
+	if err != nil || o < 1 || o > 8 {
+		return 1
+	}
+	return o
+}
+
+// swapsAxes reports whether orientation o turns the image by 90 degrees.
+func swapsAxes(o int) bool { return o >= 5 && o <= 8 }
+
+// applyOrientation returns img turned upright according to orientation o.
+func applyOrientation(img image.Image, o int) image.Image {
+	if o <= 1 || o > 8 {
+		return img
+	}
+	b := img.Bounds()
+	src := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if swapsAxes(o) {
+		dw, dh = h, w
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch o {
+			case 2: // mirrored
+				sx, sy = w-1-x, y
+			case 3: // upside down
+				sx, sy = w-1-x, h-1-y
+			case 4: // upside down, mirrored
+				sx, sy = x, h-1-y
+			case 5: // transposed
+				sx, sy = y, x
+			case 6: // needs a quarter turn clockwise
+				sx, sy = y, h-1-x
+			case 7: // transversed
+				sx, sy = w-1-y, h-1-x
+			case 8: // needs a quarter turn counter-clockwise
+				sx, sy = w-1-y, x
+			}
+			copy(dst.Pix[dst.PixOffset(x, y):][:4], src.Pix[src.PixOffset(sx, sy):][:4])
+		}
+	}
+	return dst
+}
+
+// orientationSegment is a JPEG APP1 segment with an EXIF block holding
+// nothing but the orientation tag.
+func orientationSegment(o int) []byte {
+	tiff := []byte{
+		'M', 'M', 0, 42, 0, 0, 0, 8, // big endian header, IFD0 at offset 8
+		0, 1, // one entry
+		0x01, 0x12, 0, 3, 0, 0, 0, 1, 0, byte(o), 0, 0, // Orientation, SHORT, 1 value
+		0, 0, 0, 0, // no next IFD
+	}
+	payload := append([]byte("Exif\x00\x00"), tiff...)
+	seg := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(seg[2:], uint16(len(payload)+2))
+	return append(seg, payload...)
+}
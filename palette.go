@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"sort"
+)
+
+// The palette of an image is its most common colors, dominant first, for
+// tinting tiles and backgrounds. Pixels of the tiny copy (see blurhash.go)
+// are counted in buckets of similar colors; each bucket stands for its
+// average color, and buckets too close to a more common one are skipped so
+// the palette does not come out as five shades of the same sky.
+
+const paletteSize = 5
+
+// paletteDistance is how far apart, in squared RGB distance, two palette
+// colors must be at least.
+const paletteDistance = 48 * 48
+
+// palette returns up to n colors of img as #rrggbb. img is never empty, so
+// neither is the palette.
+func palette(img *image.RGBA, n int) []string {
+	type bucket struct{ r, g, b, count int }
+	buckets := map[int]*bucket{}
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			p := img.Pix[img.PixOffset(x, y):]
+			key := int(p[0]>>4)<<8 | int(p[1]>>4)<<4 | int(p[2]>>4)
+			bk := buckets[key]
+			if bk == nil {
+				bk = &bucket{}
+				buckets[key] = bk
+			}
+			bk.r += int(p[0])
+			bk.g += int(p[1])
+			bk.b += int(p[2])
+			bk.count++
+		}
+	}
+
+	sorted := make([]*bucket, 0, len(buckets))
+	for _, bk := range buckets {
+		bk.r, bk.g, bk.b = bk.r/bk.count, bk.g/bk.count, bk.b/bk.count
+		sorted = append(sorted, bk)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].count != sorted[j].count {
+			return sorted[i].count > sorted[j].count
+		}
+		// map order is random; keep the result stable
+		return sorted[i].r<<16|sorted[i].g<<8|sorted[i].b < sorted[j].r<<16|sorted[j].g<<8|sorted[j].b
+	})
+
+	var picked []*bucket
+	for _, bk := range sorted {
+		if len(picked) == n {
+			break
+		}
+		distinct := true
+		for _, p := range picked {
+			dr, dg, db := bk.r-p.r, bk.g-p.g, bk.b-p.b
+			if dr*dr+dg*dg+db*db < paletteDistance {
+				distinct = false
+				break
+			}
+		}
+		if distinct {
+			picked = append(picked, bk)
+		}
+	}
+
+	colors := make([]string, len(picked))
+	for i, p := range picked {
+		colors[i] = fmt.Sprintf("#%02x%02x%02x", p.r, p.g, p.b)
+	}
+	return colors
+}
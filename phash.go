@@ -0,0 +1,365 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"math"
+	"math/bits"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+
+	"golang.org/x/image/draw"
+)
+
+// Every image gets a perceptual hash when it is indexed, so copies that
+// differ in encoding, size or a few pixels are found even though their
+// bytes differ: burst shots, re-saves, resized exports. It is the classic
+// pHash, the signs of the lowest 8x8 frequencies of a 32 pixel grayscale
+// copy against their median, as 16 hex digits. Hashes of similar images
+// differ in few bits;
+//
+//	GET /api/v1/duplicates?distance=6
+//
+// groups the images the caller sees whose hashes are at most distance bits
+// apart, largest groups first, for cleanup. 0 finds only visually
+// identical ones. GET /api/v1/images/{id}/similar finds the images close
+// to one, with a looser default.
+
+const (
+	phashSize          = 32
+	defaultDupDistance = 6
+	maxDupDistance     = 16
+	defaultDupGroups   = 100
+	maxDupGroups       = 1000
+	// other shots of a scene differ more than copies do
+	defaultSimilarDistance = 12
+	maxSimilarDistance     = 24
+	defaultSimilarImages   = 20
+	maxSimilarImages       = 200
+)
+
+// phashCos are the DCT basis functions of the 8 lowest frequencies.
+var phashCos [8][phashSize]float64
+
+func init() {
+	for u := range phashCos {
+		for x := 0; x < phashSize; x++ {
+			phashCos[u][x] = math.Cos(float64(2*x+1) * float64(u) * math.Pi / (2 * phashSize))
+		}
+	}
+}
+
+// phash returns the perceptual hash of img.
+func phash(img image.Image) uint64 {
+	small := image.NewRGBA(image.Rect(0, 0, phashSize, phashSize))
+	draw.BiLinear.Scale(small, small.Bounds(), img, img.Bounds(), draw.Src, nil)
+	var lum [phashSize][phashSize]float64
+	for y := 0; y < phashSize; y++ {
+		for x := 0; x < phashSize; x++ {
+			p := small.Pix[small.PixOffset(x, y):]
+			lum[y][x] = 0.299*float64(p[0]) + 0.587*float64(p[1]) + 0.114*float64(p[2])
+		}
+	}
+
+	// the DCT is separable: rows first, then the columns of the result
+	var rows [phashSize][8]float64
+	for y := 0; y < phashSize; y++ {
+		for u := 0; u < 8; u++ {
+			var sum float64
+			for x := 0; x < phashSize; x++ {
+				sum += lum[y][x] * phashCos[u][x]
+			}
+			rows[y][u] = sum
+		}
+	}
+	coeffs := make([]float64, 0, 64)
+	for v := 0; v < 8; v++ {
+		for u := 0; u < 8; u++ {
+			var sum float64
+			for y := 0; y < phashSize; y++ {
+				sum += rows[y][u] * phashCos[v][y]
+			}
+			coeffs = append(coeffs, sum)
+		}
+	}
+
+	sorted := slices.Clone(coeffs)
+	slices.Sort(sorted)
+	median := (sorted[31] + sorted[32]) / 2
+	var h uint64
+	for i, c := range coeffs {
+		if c > median {
+			h |= 1 << uint(i)
+		}
+	}
+	return h
+}
+
+func formatPHash(h uint64) string { return fmt.Sprintf("%016x", h) }
+
+// DuplicateGroup is a set of images that look alike.
+type DuplicateGroup struct {
+	Distance int         `json:"distance"` // the largest between two of them
+	Images   []ImageMeta `json:"images"`   // oldest first
+}
+
+func handleDuplicates(w http.ResponseWriter, r *http.Request) {
+	if apiPreamble(w, r) {
+		return
+	}
+	if r.Method != "GET" {
+		writeJSONError(w, "Unsupported method", http.StatusMethodNotAllowed)
+		return
+	}
+	v := r.URL.Query()
+	distance := defaultDupDistance
+	if s := v.Get("distance"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 || n > maxDupDistance {
+			writeJSONError(w, "Invalid distance, expected 0 to "+strconv.Itoa(maxDupDistance), http.StatusBadRequest)
+			return
+		}
+		distance = n
+	}
+	limit, err := queryInt(v.Get("limit"), defaultDupGroups, maxDupGroups)
+	if err != nil {
+		writeJSONError(w, "Invalid limit", http.StatusBadRequest)
+		return
+	}
+	p, authenticated := resolvePrincipal(r)
+	q := listQuery{Owner: p.ownerFilter(), HideProtected: !authenticated}
+	groups, err := duplicateGroups(q, distance, limit)
+	if err != nil {
+		writeJSONError(w, "Could not find duplicates", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]any{"groups": groups})
+}
+
+// duplicateGroups groups the images of q whose hashes are within distance,
+// transitively: a burst whose first and last shot differ more still ends
+// up in one group when the shots in between link them.
+func duplicateGroups(q listQuery, distance, limit int) ([]DuplicateGroup, error) {
+	ids, hashes, err := imageHashes(q)
+	if err != nil {
+		return nil, err
+	}
+
+	// union-find over the pairs a BK-tree turns up
+	parent := make([]int, len(ids))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	tree := &bkNode{}
+	for i, h := range hashes {
+		tree.search(hashes, h, distance, func(j int) {
+			if a, b := find(i), find(j); a != b {
+				parent[max(a, b)] = min(a, b)
+			}
+		})
+		tree.add(hashes, i)
+	}
+
+	members := map[int][]int{}
+	for i := range ids {
+		root := find(i)
+		members[root] = append(members[root], i)
+	}
+	var sets [][]int
+	for _, m := range members {
+		if len(m) > 1 {
+			sets = append(sets, m)
+		}
+	}
+	sort.Slice(sets, func(a, b int) bool {
+		if len(sets[a]) != len(sets[b]) {
+			return len(sets[a]) > len(sets[b])
+		}
+		return sets[a][0] < sets[b][0]
+	})
+	if len(sets) > limit {
+		sets = sets[:limit]
+	}
+
+	var want []string
+	for _, m := range sets {
+		for _, i := range m {
+			want = append(want, ids[i])
+		}
+	}
+	images, err := imagesByID(want)
+	if err != nil {
+		return nil, err
+	}
+	groups := []DuplicateGroup{}
+	for _, m := range sets {
+		g := DuplicateGroup{Images: []ImageMeta{}}
+		for a, i := range m {
+			if meta, ok := images[ids[i]]; ok {
+				g.Images = append(g.Images, meta)
+			}
+			for _, j := range m[a+1:] {
+				g.Distance = max(g.Distance, bits.OnesCount64(hashes[i]^hashes[j]))
+			}
+		}
+		groups = append(groups, g)
+	}
+	return groups, nil
+}
+
+// imageHashes returns the ids and perceptual hashes of the images of q that
+// have one, oldest upload first.
+func imageHashes(q listQuery) ([]string, []uint64, error) {
+	conds, args := q.filters()
+	conds = append(conds, `phash != ''`)
+	rows, err := db.Query(`SELECT id, phash FROM images`+whereClause(conds)+` ORDER BY uploaded_at, id`, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	var ids []string
+	var hashes []uint64
+	for rows.Next() {
+		var id, hex string
+		if err := rows.Scan(&id, &hex); err != nil {
+			return nil, nil, err
+		}
+		h, err := strconv.ParseUint(hex, 16, 64)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+		hashes = append(hashes, h)
+	}
+	return ids, hashes, rows.Err()
+}
+
+// SimilarImage is an image that looks like another.
+type SimilarImage struct {
+	ImageMeta
+	Distance int `json:"distance"` // bits its hash differs in
+}
+
+// handleSimilarImages serves GET /api/v1/images/{id}/similar?distance=12,
+// the images the caller sees whose hashes are within distance of meta's,
+// closest first: other shots of the same scene. Images without a hash,
+// such as SVGs, have none.
+func handleSimilarImages(w http.ResponseWriter, r *http.Request, meta ImageMeta) {
+	v := r.URL.Query()
+	distance := defaultSimilarDistance
+	if s := v.Get("distance"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 || n > maxSimilarDistance {
+			writeJSONError(w, "Invalid distance, expected 0 to "+strconv.Itoa(maxSimilarDistance), http.StatusBadRequest)
+			return
+		}
+		distance = n
+	}
+	limit, err := queryInt(v.Get("limit"), defaultSimilarImages, maxSimilarImages)
+	if err != nil {
+		writeJSONError(w, "Invalid limit", http.StatusBadRequest)
+		return
+	}
+	similar, err := similarImages(r, meta, distance, limit)
+	if err != nil {
+		writeJSONError(w, "Could not find similar images", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]any{"id": meta.ID, "images": similar})
+}
+
+func similarImages(r *http.Request, meta ImageMeta, distance, limit int) ([]SimilarImage, error) {
+	similar := []SimilarImage{}
+	h, err := strconv.ParseUint(meta.PHash, 16, 64)
+	if err != nil {
+		return similar, nil
+	}
+	p, authenticated := resolvePrincipal(r)
+	ids, hashes, err := imageHashes(listQuery{Owner: p.ownerFilter(), HideProtected: !authenticated})
+	if err != nil {
+		return nil, err
+	}
+	type match struct{ i, d int }
+	var matches []match
+	for i, other := range hashes {
+		if d := bits.OnesCount64(h ^ other); d <= distance && ids[i] != meta.ID {
+			matches = append(matches, match{i, d})
+		}
+	}
+	// closest first, the newest of equally close ones
+	sort.SliceStable(matches, func(a, b int) bool {
+		if matches[a].d != matches[b].d {
+			return matches[a].d < matches[b].d
+		}
+		return matches[a].i > matches[b].i
+	})
+	if len(matches) > limit {
+		matches = matches[:limit]
+	}
+	want := make([]string, len(matches))
+	for k, m := range matches {
+		want[k] = ids[m.i]
+	}
+	images, err := imagesByID(want)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range matches {
+		if img, ok := images[ids[m.i]]; ok {
+			similar = append(similar, SimilarImage{ImageMeta: img, Distance: m.d})
+		}
+	}
+	return similar, nil
+}
+
+// bkNode is a BK-tree over Hamming distance, holding indexes into the
+// hashes; it finds the hashes near one without comparing against all.
+type bkNode struct {
+	index    int
+	used     bool
+	children map[int]*bkNode
+}
+
+func (n *bkNode) add(hashes []uint64, i int) {
+	for {
+		if !n.used {
+			n.index, n.used = i, true
+			return
+		}
+		d := bits.OnesCount64(hashes[n.index] ^ hashes[i])
+		child, ok := n.children[d]
+		if !ok {
+			if n.children == nil {
+				n.children = map[int]*bkNode{}
+			}
+			n.children[d] = &bkNode{index: i, used: true}
+			return
+		}
+		n = child
+	}
+}
+
+func (n *bkNode) search(hashes []uint64, h uint64, distance int, found func(int)) {
+	if !n.used {
+		return
+	}
+	d := bits.OnesCount64(hashes[n.index] ^ h)
+	if d <= distance {
+		found(n.index)
+	}
+	for cd, child := range n.children {
+		if cd >= d-distance && cd <= d+distance {
+			child.search(hashes, h, distance, found)
+		}
+	}
+}
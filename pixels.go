@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"os"
+)
+
+// A small file can declare a huge canvas: a PNG of a few kilobytes may
+// decode to 50000x50000 pixels, 10 GB in memory. Before anything is
+// decoded the header is read on its own and images of more than
+// cfg.MaxMegapixels are refused, at upload with 400 and later wherever
+// the gallery would decode them (thumbnails, blurhashes, palettes, video
+// posters). Headers that cannot be read are refused the same way.
+
+var errMalformedImage = errors.New("malformed image header")
+
+// pixelLimitError is an image larger than cfg.MaxMegapixels.
+type pixelLimitError struct {
+	Width, Height int
+}
+
+func (e *pixelLimitError) Error() string {
+	return fmt.Sprintf("Image too large: %dx%d pixels, the limit is %d megapixels", e.Width, e.Height, cfg.MaxMegapixels)
+}
+
+// checkPixels reads the image header from r and tells whether the image
+// may be decoded.
+func checkPixels(r io.Reader) error {
+	c, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errMalformedImage, err)
+	}
+	if c.Width <= 0 || c.Height <= 0 {
+		return errMalformedImage
+	}
+	if cfg.MaxMegapixels > 0 && int64(c.Width)*int64(c.Height) > cfg.MaxMegapixels*1000*1000 {
+		return &pixelLimitError{c.Width, c.Height}
+	}
+	return nil
+}
+
+func checkPixelsFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return checkPixels(f)
+}
+
+// decodeLimited decodes r after checking its header.
+func decodeLimited(r io.ReadSeeker) (image.Image, error) {
+	if err := checkPixels(r); err != nil {
+		return nil, err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(r)
+	return img, err
+}
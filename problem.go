@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// API errors are problem details (RFC 7807), sent as
+// application/problem+json:
+//
+//	{"type": "about:blank", "title": "Not Found", "status": 404,
+//	 "detail": "Image not found", "code": "not_found", "error": "Image not found"}
+//
+// code is what clients branch on. Most errors use the code of their status
+// (statusCodes); the ones a client can act on have their own, like
+// quota_exceeded or duplicate. Extra data, such as the numbers of a quota
+// error, is in "details". "error" repeats detail for clients written against
+// the old {"error": "..."} responses, and requestId finds the request in the
+// logs.
+
+type problem struct {
+	Type      string         `json:"type"`
+	Title     string         `json:"title"`
+	Status    int            `json:"status"`
+	Detail    string         `json:"detail,omitempty"`
+	Code      string         `json:"code"`
+	Error     string         `json:"error"`
+	Details   map[string]any `json:"details,omitempty"`
+	RequestID string         `json:"requestId,omitempty"` // as in X-Request-ID and the logs
+}
+
+// statusCodes are the codes of errors without a more specific one.
+var statusCodes = map[int]string{
+	http.StatusBadRequest:            "bad_request",
+	http.StatusUnauthorized:          "unauthorized",
+	http.StatusForbidden:             "forbidden",
+	http.StatusNotFound:              "not_found",
+	http.StatusMethodNotAllowed:      "method_not_allowed",
+	http.StatusConflict:              "conflict",
+	http.StatusRequestEntityTooLarge: "too_large",
+	http.StatusTooManyRequests:       "rate_limited",
+	http.StatusInsufficientStorage:   "insufficient_storage",
+}
+
+func statusCode(status int) string {
+	if code, ok := statusCodes[status]; ok {
+		return code
+	}
+	if status >= 500 {
+		return "internal"
+	}
+	return "error"
+}
+
+// writeJSONError writes a problem with the generic code of status.
+func writeJSONError(w http.ResponseWriter, msg string, status int) {
+	writeProblem(w, status, statusCode(status), msg, nil)
+}
+
+// writeProblem writes a problem with its own code and optional details.
+func writeProblem(w http.ResponseWriter, status int, code, detail string, details map[string]any) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(problem{
+		Type:      "about:blank",
+		Title:     http.StatusText(status),
+		Status:    status,
+		Detail:    detail,
+		Code:      code,
+		Error:     detail,
+		Details:   details,
+		RequestID: w.Header().Get("X-Request-ID"),
+	})
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Clients that want to show how far an upload got, beyond what their own
+// request body transfer tells them, pick an id for it and send it along:
+//
+//	POST /api/v1/images
+//	X-Upload-ID: 3f7a9c2e1b
+//
+//	GET  /api/v1/uploads/{id}/progress
+//	{"uploadId": "3f7a9c2e1b", "received": 1048576, "total": 4194304, "phase": "receiving"}
+//
+// The phase goes from receiving through checking (malware scan, type and
+// pixel checks, hashing, storing) to processing (metadata and thumbnail
+// in the background, see jobs.go) and done, or failed. Ids belong to the
+// caller and are forgotten progressTTL after the request ends. Chunked
+// upload sessions answer the same way while they receive.
+
+const (
+	progressTTL    = 10 * time.Minute
+	maxProgressIDs = 10000
+)
+
+var uploadIDRegex = regexp.MustCompile(`^[A-Za-z0-9_-]{8,64}$`)
+
+type uploadProgress struct {
+	ID       string `json:"uploadId"`
+	Received int64  `json:"received"`
+	Total    int64  `json:"total"`
+	Phase    string `json:"phase"`
+	Image    string `json:"image,omitempty"`
+	Status   int    `json:"status,omitempty"` // of the failed request
+
+	owner    string
+	received atomic.Int64
+	ended    time.Time // zero while the request runs
+}
+
+var (
+	progressMu sync.Mutex
+	progresses = map[string]*uploadProgress{}
+)
+
+type progressKey struct{}
+
+// trackProgress follows uploads sent with X-Upload-ID.
+func trackProgress(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Upload-ID")
+		if (r.Method != "POST" && r.Method != "PUT") || !uploadIDRegex.MatchString(id) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		p := &uploadProgress{ID: id, Total: r.ContentLength, Phase: "receiving", owner: requestViewer(r).UserID}
+		now := time.Now()
+		progressMu.Lock()
+		for k, q := range progresses {
+			if !q.ended.IsZero() && now.Sub(q.ended) > progressTTL {
+				delete(progresses, k)
+			}
+		}
+		tracked := len(progresses) < maxProgressIDs
+		if tracked {
+			progresses[p.owner+"/"+id] = p
+		}
+		progressMu.Unlock()
+		if !tracked {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		r.Body = &countingBody{ReadCloser: r.Body, n: &p.received}
+		rec := &statusRecorder{ResponseWriter: w}
+		h.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), progressKey{}, p)))
+
+		progressMu.Lock()
+		if p.Image == "" || rec.status >= 300 {
+			p.Phase, p.Status = "failed", rec.status
+		} else {
+			p.Phase = "processing"
+		}
+		p.ended = time.Now()
+		progressMu.Unlock()
+	})
+}
+
+// setUploadPhase moves the upload of ctx, if it is followed, to phase.
+func setUploadPhase(ctx context.Context, phase string) {
+	if p, ok := ctx.Value(progressKey{}).(*uploadProgress); ok {
+		progressMu.Lock()
+		p.Phase = phase
+		progressMu.Unlock()
+	}
+}
+
+// uploadStored records the image the upload of ctx became.
+func uploadStored(ctx context.Context, id string) {
+	if p, ok := ctx.Value(progressKey{}).(*uploadProgress); ok {
+		progressMu.Lock()
+		p.Image = id
+		progressMu.Unlock()
+	}
+}
+
+// handleUploadProgress serves /api/v1/uploads/{id}/progress. It reports
+// whether it found the upload.
+func handleUploadProgress(w http.ResponseWriter, r *http.Request, id string) bool {
+	viewer := requestViewer(r)
+	progressMu.Lock()
+	p, ok := progresses[viewer.UserID+"/"+id]
+	var out uploadProgress
+	if ok {
+		out = uploadProgress{ID: p.ID, Received: p.received.Load(), Total: p.Total, Phase: p.Phase, Image: p.Image, Status: p.Status}
+	}
+	progressMu.Unlock()
+
+	if !ok {
+		s := lookupSession(id)
+		if s == nil || !viewer.sees(s.owner) {
+			return false
+		}
+		s.mu.Lock()
+		out = uploadProgress{ID: s.ID, Received: s.Offset, Total: s.Total, Phase: "receiving"}
+		s.mu.Unlock()
+	}
+	if out.Phase == "processing" {
+		if meta, err := getImage(out.Image); err != nil || !meta.Processing {
+			out.Phase = "done"
+		}
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(&out)
+	return true
+}
+
+// countingBody counts the bytes read from a request body.
+type countingBody struct {
+	io.ReadCloser
+	n *atomic.Int64
+}
+
+func (c *countingBody) Read(b []byte) (int, error) {
+	n, err := c.ReadCloser.Read(b)
+	c.n.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Behind a reverse proxy the gallery sees the proxy as its client. With
+// cfg.TrustProxy, fromProxy takes the client address from the last entry of
+// X-Forwarded-For, the one the proxy added, the host from X-Forwarded-Host
+// and the scheme from X-Forwarded-Proto, so logs and rate limits are about
+// the real client and the host and scheme are the ones it asked for. Only
+// turn it on when the proxy is the sole way in; anyone talking to the
+// gallery directly could claim any address.
+//
+// cfg.BasePath serves the gallery under a sub-path such as /gallery, for a
+// proxy that forwards that path unchanged. withBasePath strips the prefix
+// before routing, so handlers see the same paths as at the root, and
+// sitePath puts it in front of every URL the gallery hands out.
+
+func validateBasePath(p string) (string, error) {
+	p = strings.TrimSuffix(p, "/")
+	if p == "" {
+		return "", nil
+	}
+	if !strings.HasPrefix(p, "/") || strings.ContainsAny(p, "?#") || strings.Contains(p, "//") {
+		return "", fmt.Errorf("base-path %q must be a path like /gallery", p)
+	}
+	return p, nil
+}
+
+// sitePath is the URL of the gallery path p, which starts with a slash.
+func sitePath(p string) string {
+	return cfg.BasePath + p
+}
+
+// siteOrigin is the scheme and host r was sent to, for the absolute URLs
+// feeds and link previews need.
+func siteOrigin(r *http.Request) string {
+	if secureRequest(r) {
+		return "https://" + r.Host
+	}
+	return "http://" + r.Host
+}
+
+// proxiedHTTPS marks requests a trusted proxy received over HTTPS.
+type proxiedHTTPS struct{}
+
+func fromProxy(h http.Handler) http.Handler {
+	if !cfg.TrustProxy {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+			hops := strings.Split(xff, ",")
+			if ip := net.ParseIP(strings.TrimSpace(hops[len(hops)-1])); ip != nil {
+				r.RemoteAddr = net.JoinHostPort(ip.String(), "0")
+			}
+		}
+		if host := r.Header.Get("X-Forwarded-Host"); host != "" {
+			r.Host = host
+		}
+		if strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https") {
+			r = r.WithContext(context.WithValue(r.Context(), proxiedHTTPS{}, true))
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func withBasePath(h http.Handler) http.Handler {
+	if cfg.BasePath == "" {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == cfg.BasePath {
+			http.Redirect(w, r, cfg.BasePath+"/", http.StatusMovedPermanently)
+			return
+		}
+		rest, ok := strings.CutPrefix(r.URL.Path, cfg.BasePath+"/")
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		r2 := r.Clone(r.Context())
+		r2.URL.Path = "/" + rest
+		r2.URL.RawPath = ""
+		h.ServeHTTP(w, r2)
+	})
+}
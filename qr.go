@@ -0,0 +1,444 @@
+package main
+
+import (
+	"errors"
+	"image"
+	"image/color"
+)
+
+// A QR code encoder, enough for links: byte mode at error correction level
+// M, versions 1 to 10, which hold up to 213 bytes. The steps and names
+// follow ISO/IEC 18004.
+
+const qrMaxVersion = 10
+
+var errQRTooLong = errors.New("Too long for a QR code")
+
+// qrBlocks gives per version the error correction codewords of each block
+// and the blocks with their data codewords, at level M.
+var qrBlocks = [qrMaxVersion + 1]struct {
+	ec     int
+	groups [][2]int // blocks, data codewords each
+}{
+	1:  {10, [][2]int{{1, 16}}},
+	2:  {16, [][2]int{{1, 28}}},
+	3:  {26, [][2]int{{1, 44}}},
+	4:  {18, [][2]int{{2, 32}}},
+	5:  {24, [][2]int{{2, 43}}},
+	6:  {16, [][2]int{{4, 27}}},
+	7:  {18, [][2]int{{4, 31}}},
+	8:  {22, [][2]int{{2, 38}, {2, 39}}},
+	9:  {22, [][2]int{{3, 36}, {2, 37}}},
+	10: {26, [][2]int{{4, 43}, {1, 44}}},
+}
+
+// qrAlignment gives per version the rows and columns of the alignment
+// patterns' centers.
+var qrAlignment = [qrMaxVersion + 1][]int{
+	2: {6, 18}, 3: {6, 22}, 4: {6, 26}, 5: {6, 30}, 6: {6, 34},
+	7: {6, 22, 38}, 8: {6, 24, 42}, 9: {6, 26, 46}, 10: {6, 28, 50},
+}
+
+// qrCode encodes data and returns its modules by row, true for dark.
+func qrCode(data []byte) ([][]bool, error) {
+	version := 0
+	for v := 1; v <= qrMaxVersion; v++ {
+		if qrDataBits(data, v) <= qrDataCodewords(v)*8 {
+			version = v
+			break
+		}
+	}
+	if version == 0 {
+		return nil, errQRTooLong
+	}
+	q := newQRMatrix(version)
+	q.placeData(qrCodewords(data, version))
+
+	// the mask leaving the fewest patterns confusing readers
+	best, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		q.applyMask(mask)
+		q.drawFormat(mask)
+		if p := q.penalty(); bestPenalty < 0 || p < bestPenalty {
+			best, bestPenalty = mask, p
+		}
+		q.applyMask(mask) // undone, it is its own inverse
+	}
+	q.applyMask(best)
+	q.drawFormat(best)
+	return q.modules, nil
+}
+
+func qrDataCodewords(version int) int {
+	n := 0
+	for _, g := range qrBlocks[version].groups {
+		n += g[0] * g[1]
+	}
+	return n
+}
+
+// qrDataBits is the length of data encoded in byte mode.
+func qrDataBits(data []byte, version int) int {
+	count := 8
+	if version >= 10 {
+		count = 16
+	}
+	return 4 + count + 8*len(data)
+}
+
+// qrCodewords is the final sequence of codewords: the data split into
+// blocks, each followed by its error correction, interleaved.
+func qrCodewords(data []byte, version int) []byte {
+	var bits qrBits
+	bits.append(0b0100, 4) // byte mode
+	if version >= 10 {
+		bits.append(len(data), 16)
+	} else {
+		bits.append(len(data), 8)
+	}
+	for _, b := range data {
+		bits.append(int(b), 8)
+	}
+	capacity := qrDataCodewords(version) * 8
+	bits.append(0, min(4, capacity-bits.n)) // terminator
+	bits.append(0, (8-bits.n%8)%8)
+	for pad := 0xEC; bits.n < capacity; pad ^= 0xEC ^ 0x11 {
+		bits.append(pad, 8)
+	}
+
+	spec := qrBlocks[version]
+	var blocks, ecs [][]byte
+	rest := bits.bytes
+	for _, g := range spec.groups {
+		for i := 0; i < g[0]; i++ {
+			blocks = append(blocks, rest[:g[1]])
+			ecs = append(ecs, reedSolomon(rest[:g[1]], spec.ec))
+			rest = rest[g[1]:]
+		}
+	}
+	var out []byte
+	for i := 0; i < len(blocks[len(blocks)-1]); i++ {
+		for _, b := range blocks {
+			if i < len(b) {
+				out = append(out, b[i])
+			}
+		}
+	}
+	for i := 0; i < spec.ec; i++ {
+		for _, ec := range ecs {
+			out = append(out, ec[i])
+		}
+	}
+	return out
+}
+
+type qrBits struct {
+	bytes []byte
+	n     int
+}
+
+// append adds the low n bits of v, most significant first.
+func (b *qrBits) append(v, n int) {
+	for i := n - 1; i >= 0; i-- {
+		if b.n%8 == 0 {
+			b.bytes = append(b.bytes, 0)
+		}
+		if v>>i&1 == 1 {
+			b.bytes[b.n/8] |= 0x80 >> (b.n % 8)
+		}
+		b.n++
+	}
+}
+
+// reedSolomon returns the n error correction codewords of data, over
+// GF(256) with the polynomial x^8 + x^4 + x^3 + x^2 + 1.
+func reedSolomon(data []byte, n int) []byte {
+	// the generator (x - a^0)(x - a^1)...(x - a^(n-1)), leading 1 left out
+	gen := make([]byte, n)
+	gen[n-1] = 1
+	root := byte(1)
+	for i := 0; i < n; i++ {
+		for j := range gen {
+			gen[j] = gfMul(gen[j], root)
+			if j+1 < n {
+				gen[j] ^= gen[j+1]
+			}
+		}
+		root = gfMul(root, 2)
+	}
+	rem := make([]byte, n)
+	for _, b := range data {
+		factor := b ^ rem[0]
+		copy(rem, rem[1:])
+		rem[n-1] = 0
+		for j := range rem {
+			rem[j] ^= gfMul(gen[j], factor)
+		}
+	}
+	return rem
+}
+
+func gfMul(x, y byte) byte {
+	var z byte
+	for i := 7; i >= 0; i-- {
+		z = z<<1 ^ (z>>7)*0x1D
+		z ^= (y >> i & 1) * x
+	}
+	return z
+}
+
+type qrMatrix struct {
+	size     int
+	version  int
+	modules  [][]bool
+	function [][]bool // finder, timing, alignment and format modules
+}
+
+func newQRMatrix(version int) *qrMatrix {
+	size := version*4 + 17
+	q := &qrMatrix{size: size, version: version, modules: make([][]bool, size), function: make([][]bool, size)}
+	for y := range q.modules {
+		q.modules[y] = make([]bool, size)
+		q.function[y] = make([]bool, size)
+	}
+	for i := 0; i < size; i++ {
+		q.set(6, i, i%2 == 0)
+		q.set(i, 6, i%2 == 0)
+	}
+	q.drawFinder(3, 3)
+	q.drawFinder(size-4, 3)
+	q.drawFinder(3, size-4)
+	pos := qrAlignment[version]
+	for i, y := range pos {
+		for j, x := range pos {
+			// not where the finders are
+			if (i == 0 && j == 0) || (i == 0 && j == len(pos)-1) || (i == len(pos)-1 && j == 0) {
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					q.set(x+dx, y+dy, max(abs(dx), abs(dy)) != 1)
+				}
+			}
+		}
+	}
+	q.drawFormat(0) // reserves the modules until the mask is known
+	q.drawVersion()
+	return q
+}
+
+// set sets the function module at column x, row y.
+func (q *qrMatrix) set(x, y int, dark bool) {
+	q.modules[y][x] = dark
+	q.function[y][x] = true
+}
+
+// drawFinder draws a finder pattern with its separator around x, y.
+func (q *qrMatrix) drawFinder(x, y int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			if xx, yy := x+dx, y+dy; xx >= 0 && xx < q.size && yy >= 0 && yy < q.size {
+				d := max(abs(dx), abs(dy))
+				q.set(xx, yy, d != 2 && d != 4)
+			}
+		}
+	}
+}
+
+// drawFormat draws both copies of the format information for level M
+// and mask, and the dark module.
+func (q *qrMatrix) drawFormat(mask int) {
+	data := 0b00<<3 | mask // M
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = rem<<1 ^ (rem>>9)*0x537
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return bits>>i&1 == 1 }
+	for i := 0; i <= 5; i++ {
+		q.set(8, i, bit(i))
+	}
+	q.set(8, 7, bit(6))
+	q.set(8, 8, bit(7))
+	q.set(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		q.set(14-i, 8, bit(i))
+	}
+	for i := 0; i < 8; i++ {
+		q.set(q.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		q.set(8, q.size-15+i, bit(i))
+	}
+	q.set(8, q.size-8, true)
+}
+
+// drawVersion draws both copies of the version information, which
+// versions from 7 on carry.
+func (q *qrMatrix) drawVersion() {
+	if q.version < 7 {
+		return
+	}
+	rem := q.version
+	for i := 0; i < 12; i++ {
+		rem = rem<<1 ^ (rem>>11)*0x1F25
+	}
+	bits := q.version<<12 | rem
+	for i := 0; i < 18; i++ {
+		dark := bits>>i&1 == 1
+		a, b := q.size-11+i%3, i/3
+		q.set(a, b, dark)
+		q.set(b, a, dark)
+	}
+}
+
+// placeData fills the remaining modules with codewords, in two module
+// wide columns zigzagging up and down from the bottom right.
+func (q *qrMatrix) placeData(codewords []byte) {
+	i := 0
+	for right := q.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			// the vertical timing pattern
+			right = 5
+		}
+		upward := (right+1)&2 == 0
+		for vert := 0; vert < q.size; vert++ {
+			y := vert
+			if upward {
+				y = q.size - 1 - vert
+			}
+			for j := 0; j < 2; j++ {
+				x := right - j
+				if q.function[y][x] {
+					continue
+				}
+				// left over modules stay light
+				if i < len(codewords)*8 {
+					q.modules[y][x] = codewords[i/8]>>(7-i%8)&1 == 1
+					i++
+				}
+			}
+		}
+	}
+}
+
+// applyMask flips the data modules mask selects.
+func (q *qrMatrix) applyMask(mask int) {
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			if q.function[y][x] {
+				continue
+			}
+			var flip bool
+			switch mask {
+			case 0:
+				flip = (x+y)%2 == 0
+			case 1:
+				flip = y%2 == 0
+			case 2:
+				flip = x%3 == 0
+			case 3:
+				flip = (x+y)%3 == 0
+			case 4:
+				flip = (x/3+y/2)%2 == 0
+			case 5:
+				flip = x*y%2+x*y%3 == 0
+			case 6:
+				flip = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				flip = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if flip {
+				q.modules[y][x] = !q.modules[y][x]
+			}
+		}
+	}
+}
+
+// penalty scores the patterns of the symbol that make it hard to read:
+// long runs, 2x2 blocks, look-alikes of finders and an uneven balance of
+// dark and light.
+func (q *qrMatrix) penalty() int {
+	at := func(x, y int, transposed bool) bool {
+		if transposed {
+			return q.modules[x][y]
+		}
+		return q.modules[y][x]
+	}
+	finder := [11]bool{true, false, true, true, true, false, true, false, false, false, false}
+	score, dark := 0, 0
+	for _, transposed := range []bool{false, true} {
+		for y := 0; y < q.size; y++ {
+			run := 0
+			for x := 0; x < q.size; x++ {
+				if x > 0 && at(x, y, transposed) == at(x-1, y, transposed) {
+					run++
+				} else {
+					run = 1
+				}
+				if run == 5 {
+					score += 3
+				} else if run > 5 {
+					score++
+				}
+				if x+11 <= q.size {
+					forward, backward := true, true
+					for k := 0; k < 11; k++ {
+						m := at(x+k, y, transposed)
+						forward = forward && m == finder[k]
+						backward = backward && m == finder[10-k]
+					}
+					if forward {
+						score += 40
+					}
+					if backward {
+						score += 40
+					}
+				}
+			}
+		}
+	}
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			if q.modules[y][x] {
+				dark++
+			}
+			if x+1 < q.size && y+1 < q.size {
+				m := q.modules[y][x]
+				if q.modules[y][x+1] == m && q.modules[y+1][x] == m && q.modules[y+1][x+1] == m {
+					score += 3
+				}
+			}
+		}
+	}
+	total := q.size * q.size
+	return score + abs(dark*20-total*10)/total*10
+}
+
+// qrImage draws modules scale pixels each, with the quiet zone of four
+// modules around them readers need.
+func qrImage(modules [][]bool, scale int) *image.Paletted {
+	const quiet = 4
+	side := (len(modules) + 2*quiet) * scale
+	img := image.NewPaletted(image.Rect(0, 0, side, side), color.Palette{color.White, color.Black})
+	for y, row := range modules {
+		for x, dark := range row {
+			if !dark {
+				continue
+			}
+			for py := 0; py < scale; py++ {
+				for px := 0; px < scale; px++ {
+					img.SetColorIndex((x+quiet)*scale+px, (y+quiet)*scale+py, 1)
+				}
+			}
+		}
+	}
+	return img
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Storage quotas cap what the gallery stores in all (cfg.QuotaMB) and what
+// each user stores (cfg.UserQuotaMB, with accounts). Usage is the size of
+// the stored images, trashed ones included until they are purged. Uploads
+// that would go over a quota are refused with 413, the problem code
+// quota_exceeded and the numbers (see problem.go):
+//
+//	"details": {"quota": "user", "used": 1234, "limit": 5678, "size": 99}
+//
+// GET /api/v1/usage reports the caller's usage and the gallery's.
+
+// quotaError is an upload that does not fit into a quota.
+type quotaError struct {
+	Scope string // "user" or "total"
+	Used  int64
+	Limit int64
+	Size  int64
+}
+
+func (e *quotaError) Error() string {
+	scope := "Gallery storage quota"
+	if e.Scope == "user" {
+		scope = "User storage quota"
+	}
+	return fmt.Sprintf("%s exceeded: %s of %s used, the upload needs %s",
+		scope, formatMB(e.Used), formatMB(e.Limit), formatMB(e.Size))
+}
+
+func formatMB(n int64) string { return fmt.Sprintf("%.1f MB", float64(n)/(1024*1024)) }
+
+type quotaUsage struct {
+	Used   int64 `json:"used"`
+	Limit  int64 `json:"limit,omitempty"` // none if missing
+	Images int   `json:"images"`
+}
+
+// storageUsage sums up the images of owner, or of everyone for "".
+func storageUsage(owner string) (quotaUsage, error) {
+	var u quotaUsage
+	q, args := `SELECT COUNT(*), COALESCE(SUM(size), 0) FROM images`, []any{}
+	if owner != "" {
+		q, args = q+` WHERE owner_id = ?`, append(args, owner)
+	}
+	err := db.QueryRow(q, args...).Scan(&u.Images, &u.Used)
+	return u, err
+}
+
+// checkQuota returns a *quotaError if n more bytes of owner do not fit.
+func checkQuota(owner string, n int64) error {
+	if limit := cfg.userQuotaBytes(); limit > 0 && owner != "" {
+		u, err := storageUsage(owner)
+		if err != nil {
+			return err
+		}
+		if u.Used+n > limit {
+			return &quotaError{Scope: "user", Used: u.Used, Limit: limit, Size: n}
+		}
+	}
+	if limit := cfg.quotaBytes(); limit > 0 {
+		u, err := storageUsage("")
+		if err != nil {
+			return err
+		}
+		if u.Used+n > limit {
+			return &quotaError{Scope: "total", Used: u.Used, Limit: limit, Size: n}
+		}
+	}
+	return nil
+}
+
+// writeQuotaError reports err if it is a *quotaError.
+func writeQuotaError(w http.ResponseWriter, err error) bool {
+	var qe *quotaError
+	if !errors.As(err, &qe) {
+		return false
+	}
+	writeProblem(w, http.StatusRequestEntityTooLarge, "quota_exceeded", qe.Error(), map[string]any{
+		"quota": qe.Scope,
+		"used":  qe.Used,
+		"limit": qe.Limit,
+		"size":  qe.Size,
+	})
+	return true
+}
+
+// handleUsage serves GET /api/v1/usage. "user" is only there for logged in
+// users.
+func handleUsage(w http.ResponseWriter, r *http.Request) {
+	if apiPreamble(w, r) {
+		return
+	}
+	if r.Method != "GET" {
+		writeJSONError(w, "Unsupported method", http.StatusMethodNotAllowed)
+		return
+	}
+	resp := map[string]quotaUsage{}
+	if id := requestViewer(r).UserID; id != "" {
+		u, err := storageUsage(id)
+		if err != nil {
+			writeJSONError(w, "Could not compute usage", http.StatusInternalServerError)
+			return
+		}
+		u.Limit = cfg.userQuotaBytes()
+		resp["user"] = u
+	}
+	total, err := storageUsage("")
+	if err != nil {
+		writeJSONError(w, "Could not compute usage", http.StatusInternalServerError)
+		return
+	}
+	total.Limit = cfg.quotaBytes()
+	resp["total"] = total
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Uploads and listings are rate limited per client with token buckets: a
+// client may send a burst of requests at once, then perMinute a minute.
+// Clients are told apart by API key or account if they have one, by IP
+// address otherwise. Behind a reverse proxy all anonymous clients share
+// the proxy's address.
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type rateLimiter struct {
+	perMinute float64
+	burst     float64
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+func newRateLimiter(perMinute float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{perMinute: perMinute, burst: float64(burst), buckets: map[string]*bucket{}}
+}
+
+// allow takes a token for client. Without one it reports how long until
+// the next token is due.
+func (l *rateLimiter) allow(client string) (bool, time.Duration) {
+	if l == nil || l.perMinute <= 0 {
+		return true, 0
+	}
+	now := time.Now()
+	rate := l.perMinute / 60 // tokens per second
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+}
+
+// forgetIdle drops buckets that have filled up again; they are no
+// different from new ones.
+func (l *rateLimiter) forgetIdle() {
+	now := time.Now()
+	rate := l.perMinute / 60
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for client, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*rate >= l.burst {
+			delete(l.buckets, client)
+		}
+	}
+}
+
+var uploadLimiter, listLimiter *rateLimiter
+
+// setupRateLimits creates the limiters from cfg and keeps their memory in
+// check.
+func setupRateLimits() {
+	uploadLimiter = newRateLimiter(cfg.UploadRateLimit, cfg.UploadRateBurst)
+	listLimiter = newRateLimiter(cfg.ListRateLimit, cfg.ListRateBurst)
+	go func() {
+		for {
+			time.Sleep(5 * time.Minute)
+			uploadLimiter.forgetIdle()
+			listLimiter.forgetIdle()
+		}
+	}()
+}
+
+// rateClient names the client behind r for rate limiting.
+func rateClient(r *http.Request) string {
+	if p, ok := resolvePrincipal(r); ok {
+		if p.UserID != "" {
+			return "user:" + p.UserID
+		}
+		return "key:" + p.Name
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// rateLimit guards h with the upload limiter for POST and PUT requests and
+// the list limiter for reads. The chunks of an upload session are not counted,
+// only creating the session is.
+func rateLimit(h http.Handler) http.Handler {
+	return rateLimitBy(rateClient, h)
+}
+
+// rateLimitBy is rateLimit with the buckets named by client instead.
+func rateLimitBy(client func(*http.Request) string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var l *rateLimiter
+		switch r.Method {
+		case "POST", "PUT":
+			l = uploadLimiter
+		case "GET", "HEAD":
+			l = listLimiter
+		}
+		if ok, wait := l.allow(client(r)); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			apiPreamble(w, r)
+			writeJSONError(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Every user can mark images as favorites and rate them with 1 to 5
+// stars, to cull a shoot:
+//
+//	POST   /api/v1/images/{id}/favorite
+//	DELETE /api/v1/images/{id}/favorite
+//	POST   /api/v1/images/{id}/rating    {"rating": 4}
+//	DELETE /api/v1/images/{id}/rating
+//
+// The listing, search and image detail give the caller's own favorite
+// and rating, and ?favorites=1 and ?min_rating=4 filter on them. Without
+// accounts all callers share one set.
+
+const maxRating = 5
+
+func handleFavorite(w http.ResponseWriter, r *http.Request, meta ImageMeta) {
+	favorite := r.Method == "POST"
+	p, _ := resolvePrincipal(r)
+	_, err := db.Exec(`INSERT INTO image_ratings (user_id, image_id, favorite) VALUES (?, ?, ?)
+		ON CONFLICT(user_id, image_id) DO UPDATE SET favorite = excluded.favorite`, p.UserID, meta.ID, favorite)
+	if err == nil {
+		err = tidyRating(p.UserID, meta.ID)
+	}
+	if err != nil {
+		writeJSONError(w, "Could not update favorite", http.StatusInternalServerError)
+		return
+	}
+	writeRating(w, p.UserID, meta)
+}
+
+func handleRating(w http.ResponseWriter, r *http.Request, meta ImageMeta) {
+	var rating int
+	if r.Method == "POST" {
+		var req struct {
+			Rating int `json:"rating"`
+		}
+		if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&req); err != nil || req.Rating < 1 || req.Rating > maxRating {
+			writeJSONError(w, "Expected JSON body with a rating from 1 to 5", http.StatusBadRequest)
+			return
+		}
+		rating = req.Rating
+	}
+	p, _ := resolvePrincipal(r)
+	_, err := db.Exec(`INSERT INTO image_ratings (user_id, image_id, rating) VALUES (?, ?, ?)
+		ON CONFLICT(user_id, image_id) DO UPDATE SET rating = excluded.rating`, p.UserID, meta.ID, rating)
+	if err == nil {
+		err = tidyRating(p.UserID, meta.ID)
+	}
+	if err != nil {
+		writeJSONError(w, "Could not update rating", http.StatusInternalServerError)
+		return
+	}
+	writeRating(w, p.UserID, meta)
+}
+
+// tidyRating drops the row of an image neither favorite nor rated.
+func tidyRating(user, id string) error {
+	_, err := db.Exec(`DELETE FROM image_ratings WHERE user_id = ? AND image_id = ? AND favorite = 0 AND rating = 0`, user, id)
+	return err
+}
+
+func writeRating(w http.ResponseWriter, user string, meta ImageMeta) {
+	images := []ImageMeta{meta}
+	if err := addRatings(user, images); err != nil {
+		writeJSONError(w, "Could not load rating", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]any{"id": meta.ID, "favorite": images[0].Favorite, "rating": images[0].Rating})
+}
+
+// addRatings fills in the favorite flags and ratings user gave images.
+func addRatings(user string, images []ImageMeta) error {
+	if len(images) == 0 {
+		return nil
+	}
+	at := make(map[string]int, len(images))
+	for i := range images {
+		at[images[i].ID] = i
+	}
+	ids := make([]string, 0, len(at))
+	for id := range at {
+		ids = append(ids, id)
+	}
+	for len(ids) > 0 {
+		// stay below SQLite's limit on parameters
+		batch := ids[:min(len(ids), 500)]
+		ids = ids[len(batch):]
+		args := []any{user}
+		for _, id := range batch {
+			args = append(args, id)
+		}
+		rows, err := db.Query(`SELECT image_id, favorite, rating FROM image_ratings
+			WHERE user_id = ? AND image_id IN (?`+strings.Repeat(`, ?`, len(batch)-1)+`)`, args...)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var id string
+			var favorite bool
+			var rating int
+			if err := rows.Scan(&id, &favorite, &rating); err != nil {
+				rows.Close()
+				return err
+			}
+			i := at[id]
+			images[i].Favorite, images[i].Rating = favorite, rating
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Uploads can also send the file as the whole request body, for curl
+// --upload-file and scripts that would rather not build a form:
+//
+//	PUT /api/v1/upload/{filename}
+//
+// As with forms the type is sniffed from the content, whatever the
+// Content-Type header or the extension say; the file name only names the
+// image. ?strip_exif=1 works the same way.
+//
+// Clients that can neither build a form nor send a bare body, such as a
+// page pasting a screenshot from the clipboard, may POST JSON to
+// /api/v1/images instead:
+//
+//	{"name": "screenshot.png", "data": "<base64>"}
+//
+// data may also be a data: URL as FileReader.readAsDataURL gives it.
+
+func handleRawUpload(w http.ResponseWriter, r *http.Request) {
+	if apiPreamble(w, r) {
+		return
+	}
+	if r.Method != "PUT" {
+		writeJSONError(w, "Unsupported method", http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, apiV1+"/upload/")
+	if name == "" || strings.Contains(name, "/") {
+		writeJSONError(w, "Expected a file name, PUT /api/v1/upload/{filename}", http.StatusBadRequest)
+		return
+	}
+	path, ok := stageBody(w, r, cfg.maxUploadBytes(), fmt.Sprintf("File exceeds maximum size %d MB", cfg.MaxUploadMB))
+	if !ok {
+		return
+	}
+	meta, duplicate, err := ingest(r.Context(), upload{
+		Path:    path,
+		Name:    name,
+		Owner:   requestViewer(r).UserID,
+		Strip:   wantStripMetadata(r),
+		Pending: needsReview(r),
+	})
+	if err != nil {
+		writeIngestError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(UploadResponse{
+		Success:   true,
+		ID:        meta.ID,
+		URL:       meta.URL,
+		Size:      meta.Size,
+		Duplicate: duplicate,
+		Image:     &meta,
+	})
+}
+
+// handleJSONUpload takes the image base64 encoded in a JSON body.
+func handleJSONUpload(w http.ResponseWriter, r *http.Request) {
+	limit := cfg.maxUploadBytes()
+	tooLarge := fmt.Sprintf("File exceeds maximum size %d MB", cfg.MaxUploadMB)
+	// base64 takes four bytes for every three
+	bodyLimit := base64.StdEncoding.EncodedLen(int(limit)) + multipartOverhead
+	if r.ContentLength > int64(bodyLimit) {
+		writeJSONError(w, tooLarge, http.StatusRequestEntityTooLarge)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, int64(bodyLimit))
+	var req struct {
+		Name string `json:"name"`
+		Data string `json:"data"`
+	}
+	var maxBytes *http.MaxBytesError
+	if err := json.NewDecoder(r.Body).Decode(&req); errors.As(err, &maxBytes) {
+		writeJSONError(w, tooLarge, http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
+		writeJSONError(w, `Expected JSON body like {"name": "...", "data": "<base64>"}`, http.StatusBadRequest)
+		return
+	}
+	data := req.Data
+	if rest, ok := strings.CutPrefix(data, "data:"); ok {
+		_, data, _ = strings.Cut(rest, ";base64,")
+	}
+	if data == "" {
+		writeJSONError(w, "Missing file", http.StatusBadRequest)
+		return
+	}
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		name = "pasted"
+	}
+	if n := int64(base64.StdEncoding.DecodedLen(len(data))); n > 0 && !hasRoomFor(n) {
+		writeProblem(w, http.StatusInsufficientStorage, "disk_full", "Not enough free disk space", nil)
+		return
+	}
+
+	tmp, err := os.CreateTemp(cfg.sessionDir(), ".upload-*")
+	if err != nil {
+		writeJSONError(w, "Could not save file", http.StatusInternalServerError)
+		return
+	}
+	n, err := io.Copy(tmp, guardSpace(io.LimitReader(base64.NewDecoder(base64.StdEncoding, strings.NewReader(data)), limit+1)))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	var corrupt base64.CorruptInputError
+	switch {
+	case errors.As(err, &corrupt):
+		os.Remove(tmp.Name())
+		writeJSONError(w, "Invalid base64 in data", http.StatusBadRequest)
+		return
+	case errors.Is(err, errDiskFull):
+		os.Remove(tmp.Name())
+		writeProblem(w, http.StatusInsufficientStorage, "disk_full", "Not enough free disk space", nil)
+		return
+	case err != nil:
+		os.Remove(tmp.Name())
+		writeJSONError(w, "Could not save file", http.StatusInternalServerError)
+		return
+	case n > limit:
+		os.Remove(tmp.Name())
+		writeJSONError(w, tooLarge, http.StatusRequestEntityTooLarge)
+		return
+	}
+	meta, duplicate, err := ingest(r.Context(), upload{
+		Path:    tmp.Name(),
+		Name:    name,
+		Owner:   requestViewer(r).UserID,
+		Strip:   wantStripMetadata(r),
+		Pending: needsReview(r),
+	})
+	if err != nil {
+		writeIngestError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(UploadResponse{
+		Success:   true,
+		ID:        meta.ID,
+		URL:       meta.URL,
+		Size:      meta.Size,
+		Duplicate: duplicate,
+		Image:     &meta,
+	})
+}
+
+// stageBody saves the request body to a staging file and returns its path,
+// or writes the error, holding it to limit like stageMultipart.
+func stageBody(w http.ResponseWriter, r *http.Request, limit int64, tooLarge string) (string, bool) {
+	if r.ContentLength > limit {
+		writeJSONError(w, tooLarge, http.StatusRequestEntityTooLarge)
+		return "", false
+	}
+	if r.ContentLength == 0 {
+		writeJSONError(w, "Missing file", http.StatusBadRequest)
+		return "", false
+	}
+	if r.ContentLength > 0 && !hasRoomFor(r.ContentLength) {
+		writeProblem(w, http.StatusInsufficientStorage, "disk_full", "Not enough free disk space", nil)
+		return "", false
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+
+	tmp, err := os.CreateTemp(cfg.sessionDir(), ".upload-*")
+	if err != nil {
+		writeJSONError(w, "Could not save file", http.StatusInternalServerError)
+		return "", false
+	}
+	n, err := io.Copy(tmp, guardSpace(r.Body))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	var maxBytes *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxBytes):
+		os.Remove(tmp.Name())
+		writeJSONError(w, tooLarge, http.StatusRequestEntityTooLarge)
+		return "", false
+	case errors.Is(err, errDiskFull):
+		os.Remove(tmp.Name())
+		writeProblem(w, http.StatusInsufficientStorage, "disk_full", "Not enough free disk space", nil)
+		return "", false
+	case err != nil:
+		os.Remove(tmp.Name())
+		slog.WarnContext(r.Context(), "Upload incomplete", "err", err)
+		writeJSONError(w, "Could not save file", http.StatusInternalServerError)
+		return "", false
+	case n == 0:
+		os.Remove(tmp.Name())
+		writeJSONError(w, "Missing file", http.StatusBadRequest)
+		return "", false
+	}
+	return tmp.Name(), true
+}
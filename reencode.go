@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// With cfg.Reencode every image upload is decoded and encoded anew before
+// it is stored, so what the gallery keeps is nothing but pixels: data
+// appended after the image, polyglot tricks, malformed chunks and all
+// metadata are gone. JPEG stays JPEG, PNG stays PNG and GIF keeps its
+// frames; WebP, which we cannot encode, becomes PNG, as do BMP and TIFF.
+// JPEGs lose a little quality each time, and the EXIF orientation is
+// applied to the pixels as the tag itself does not survive. Formats Go
+// does not decode, videos among them, are stored as they are.
+
+// reencodeQuality is the JPEG quality of re-encoded uploads, high enough
+// that a second pass is hard to tell from the first.
+const reencodeQuality = 92
+
+// reencodeFile rewrites the local image at path and returns its content
+// type afterwards. An image that does not decode is errMalformedImage.
+func reencodeFile(path, contentType string) (string, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	var encode func(w io.Writer) error
+	switch contentType {
+	case "image/gif":
+		g, err := gif.DecodeAll(src)
+		if err != nil {
+			return "", fmt.Errorf("%w: %v", errMalformedImage, err)
+		}
+		encode = func(w io.Writer) error { return gif.EncodeAll(w, g) }
+	case "image/jpeg", "image/png", "image/webp", "image/bmp", "image/tiff":
+		orientation := readOrientation(src)
+		if _, err := src.Seek(0, io.SeekStart); err != nil {
+			return "", err
+		}
+		img, err := decodeLimited(src)
+		if err != nil {
+			return "", fmt.Errorf("%w: %v", errMalformedImage, err)
+		}
+		img = applyOrientation(img, orientation)
+		if contentType == "image/jpeg" {
+			encode = func(w io.Writer) error { return jpeg.Encode(w, img, &jpeg.Options{Quality: reencodeQuality}) }
+		} else {
+			contentType = "image/png"
+			encode = func(w io.Writer) error { return png.Encode(w, img) }
+		}
+	default:
+		// no other format decodes
+		return "", errInvalidType
+	}
+
+	tmp, err := os.CreateTemp(cfg.sessionDir(), ".reencode-*")
+	if err != nil {
+		return "", err
+	}
+	bw := bufio.NewWriter(tmp)
+	err = encode(bw)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return contentType, os.Rename(tmp.Name(), path)
+}
+
+// pngName replaces the extension of name with .png.
+func pngName(name string) string {
+	return strings.TrimSuffix(name, filepath.Ext(name)) + ".png"
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Thumbnails and /img/ renditions are cached in cfg.ThumbDir. With
+// cfg.RenditionCacheMB set, new renditions that take the cache over that
+// size make the ones served longest ago go, down to nine tenths of it;
+// they are rendered again should anyone ask. The size is an estimate
+// between trims, which count the files anew.
+var renditionCache = struct {
+	sync.Mutex
+	size     int64
+	counted  bool
+	trimming bool
+	used     map[string]time.Time // last served, by path
+}{used: map[string]time.Time{}}
+
+// renditionUsed records that the cached rendition path is being served,
+// added bytes of it just rendered, and trims the cache if it got too big.
+func renditionUsed(path string, added int64) {
+	if cfg.RenditionCacheMB <= 0 {
+		return
+	}
+	c := &renditionCache
+	c.Lock()
+	defer c.Unlock()
+	c.used[path] = time.Now()
+	c.size += added
+	if (!c.counted || c.size > cfg.RenditionCacheMB<<20) && !c.trimming {
+		c.trimming = true
+		go trimRenditions()
+	}
+}
+
+// trimRenditions removes the renditions served longest ago until the
+// cache fits cfg.RenditionCacheMB again.
+func trimRenditions() {
+	type rendition struct {
+		path string
+		size int64
+		used time.Time
+	}
+	var files []rendition
+	var total int64
+	filepath.WalkDir(cfg.ThumbDir, func(path string, d fs.DirEntry, err error) error {
+		// renditions being written start with a dot
+		if err != nil || d.IsDir() || strings.HasPrefix(d.Name(), ".") {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		files = append(files, rendition{path, info.Size(), info.ModTime()})
+		total += info.Size()
+		return nil
+	})
+
+	c := &renditionCache
+	c.Lock()
+	for i, f := range files {
+		if used, ok := c.used[f.path]; ok && used.After(f.used) {
+			files[i].used = used
+		}
+	}
+	c.Unlock()
+
+	limit := cfg.RenditionCacheMB << 20
+	var removed []string
+	if total > limit {
+		sort.Slice(files, func(i, j int) bool { return files[i].used.Before(files[j].used) })
+		for _, f := range files {
+			if total <= limit/10*9 {
+				break
+			}
+			if err := os.Remove(f.path); err == nil || errors.Is(err, fs.ErrNotExist) {
+				total -= f.size
+				removed = append(removed, f.path)
+			}
+		}
+		slog.Info("Trimmed rendition cache", "removed", len(removed), "mb", total>>20)
+	}
+
+	c.Lock()
+	for _, path := range removed {
+		delete(c.used, path)
+	}
+	c.size, c.counted, c.trimming = total, true, false
+	c.Unlock()
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Retention rules (cfg.Retention) remove images automatically, checked
+// every cfg.RetentionInterval. Rules are applied in order:
+//
+//	older-than:365d            images uploaded more than a year ago
+//	unalbumed-older-than:90d   the same, for images that are in no album
+//	max-total:10GB             the oldest images until the rest fits
+//
+// Removed images go to the trash like deleted ones (purged right away
+// with -trash-retention 0). With cfg.RetentionDryRun nothing is removed,
+// only written down. Every removal, real or dry, is kept in the
+// retention_log table:
+//
+//	GET  /api/v1/admin/retention?limit=   the rules and the latest entries
+//	POST /api/v1/admin/retention          {"dry_run": true} apply the rules now
+
+const (
+	defaultRetentionLog = 100
+	maxRetentionLog     = 1000
+)
+
+type retentionRule struct {
+	spec      string
+	age       time.Duration // older-than, unalbumed-older-than
+	unalbumed bool
+	maxTotal  int64 // max-total, in bytes
+}
+
+type retentionEntry struct {
+	ID        int64     `json:"id"`
+	Time      time.Time `json:"time"`
+	Rule      string    `json:"rule"`
+	Image     string    `json:"image"`
+	Name      string    `json:"name"`
+	Owner     string    `json:"owner,omitempty"`
+	Size      int64     `json:"size"`
+	DryRun    bool      `json:"dry_run,omitempty"`
+	Permanent bool      `json:"permanent,omitempty"`
+}
+
+func parseRetentionRules(specs []string) ([]retentionRule, error) {
+	var rules []retentionRule
+	for _, spec := range specs {
+		kind, value, _ := strings.Cut(spec, ":")
+		r := retentionRule{spec: spec}
+		var err error
+		switch kind {
+		case "older-than", "unalbumed-older-than":
+			r.unalbumed = kind == "unalbumed-older-than"
+			r.age, err = parseAge(value)
+		case "max-total":
+			r.maxTotal, err = parseSize(value)
+		default:
+			return nil, fmt.Errorf("retention rule %q: unknown kind %q", spec, kind)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("retention rule %q: %w", spec, err)
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// parseAge reads a duration, which may also be given in days as "90d".
+func parseAge(s string) (time.Duration, error) {
+	var d time.Duration
+	var err error
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		var n int
+		n, err = strconv.Atoi(days)
+		d = time.Duration(n) * 24 * time.Hour
+	} else {
+		d, err = time.ParseDuration(s)
+	}
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid age %q", s)
+	}
+	return d, nil
+}
+
+// parseSize reads a size like "500MB" or "10GB"; plain numbers are bytes.
+func parseSize(s string) (int64, error) {
+	units := []struct {
+		suffix string
+		factor int64
+	}{{"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}}
+	factor := int64(1)
+	for _, u := range units {
+		if v, ok := strings.CutSuffix(strings.ToUpper(s), u.suffix); ok {
+			s, factor = v, u.factor
+			break
+		}
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * factor, nil
+}
+
+// gcRetention applies the retention rules periodically.
+func gcRetention() {
+	for {
+		if _, err := enforceRetention(cfg.RetentionDryRun); err != nil {
+			slog.Error("Retention failed", "err", err)
+		}
+		time.Sleep(cfg.RetentionInterval)
+	}
+}
+
+// enforceRetention applies the rules once and returns what it removed, or
+// would remove with dryRun.
+func enforceRetention(dryRun bool) ([]retentionEntry, error) {
+	rules, err := parseRetentionRules(cfg.Retention)
+	if err != nil {
+		return nil, err
+	}
+	entries := []retentionEntry{}
+	chosen := map[string]bool{}
+	for _, rule := range rules {
+		ids, err := rule.selectImages(chosen)
+		if err != nil {
+			return entries, err
+		}
+		for _, id := range ids {
+			chosen[id] = true
+			e, err := removeForRetention(rule, id, dryRun)
+			if err != nil {
+				slog.Warn("Could not remove image for retention", "image", id, "rule", rule.spec, "err", err)
+				continue
+			}
+			entries = append(entries, e)
+		}
+	}
+	if len(entries) > 0 {
+		slog.Info("Retention applied", "images", len(entries), "dry_run", dryRun)
+	}
+	return entries, nil
+}
+
+// selectImages returns the images rule removes, oldest first, passing over
+// those already chosen by earlier rules.
+func (rule retentionRule) selectImages(chosen map[string]bool) ([]string, error) {
+	conds := []string{"deleted_at = 0", "processing = 0"}
+	args := []any{}
+	if rule.age > 0 {
+		conds = append(conds, "uploaded_at < ?")
+		args = append(args, time.Now().Add(-rule.age).UnixNano())
+	}
+	if rule.unalbumed {
+		conds = append(conds, "id NOT IN (SELECT image_id FROM album_images)")
+	}
+	rows, err := db.Query(`SELECT id, size FROM images`+whereClause(conds)+` ORDER BY uploaded_at, id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	type sized struct {
+		id   string
+		size int64
+	}
+	var images []sized
+	for rows.Next() {
+		var s sized
+		if err := rows.Scan(&s.id, &s.size); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if !chosen[s.id] {
+			images = append(images, s)
+		}
+	}
+	rows.Close()
+
+	var ids []string
+	if rule.maxTotal == 0 {
+		for _, s := range images {
+			ids = append(ids, s.id)
+		}
+		return ids, nil
+	}
+	// what earlier rules chose no longer counts
+	var total int64
+	for _, s := range images {
+		total += s.size
+	}
+	for _, s := range images {
+		if total <= rule.maxTotal {
+			break
+		}
+		ids = append(ids, s.id)
+		total -= s.size
+	}
+	return ids, nil
+}
+
+func removeForRetention(rule retentionRule, id string, dryRun bool) (retentionEntry, error) {
+	meta, err := getImage(id)
+	if err != nil {
+		return retentionEntry{}, err
+	}
+	e := retentionEntry{
+		Time:      time.Now().UTC(),
+		Rule:      rule.spec,
+		Image:     id,
+		Name:      meta.Name,
+		Owner:     meta.Owner,
+		Size:      meta.Size,
+		DryRun:    dryRun,
+		Permanent: cfg.TrashRetention <= 0,
+	}
+	if !dryRun {
+		if e.Permanent {
+			err = purgeImage(context.Background(), id)
+		} else {
+			_, err = db.Exec(`UPDATE images SET deleted_at = ? WHERE id = ?`, e.Time.UnixNano(), id)
+		}
+		if err != nil {
+			return e, err
+		}
+		notify(webhookEvent{Event: "image.deleted", Image: meta, Permanent: e.Permanent})
+		slog.Info("Removed by retention rule", "image", id, "rule", rule.spec, "permanent", e.Permanent)
+	}
+	res, err := db.Exec(`INSERT INTO retention_log (at, rule, image_id, name, owner_id, size, dry_run, permanent)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`, e.Time.UnixNano(), e.Rule, e.Image, e.Name, e.Owner, e.Size, e.DryRun, e.Permanent)
+	if err != nil {
+		// the image is gone anyway; losing the entry must not hide that
+		slog.Error("Could not write retention log", "image", id, "err", err)
+		return e, nil
+	}
+	e.ID, _ = res.LastInsertId()
+	return e, nil
+}
+
+func retentionLog(limit int) ([]retentionEntry, error) {
+	rows, err := db.Query(`SELECT id, at, rule, image_id, name, owner_id, size, dry_run, permanent
+		FROM retention_log ORDER BY id DESC LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entries := []retentionEntry{}
+	for rows.Next() {
+		var e retentionEntry
+		var at int64
+		if err := rows.Scan(&e.ID, &at, &e.Rule, &e.Image, &e.Name, &e.Owner, &e.Size, &e.DryRun, &e.Permanent); err != nil {
+			return nil, err
+		}
+		e.Time = time.Unix(0, at).UTC()
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// handleRetention serves /api/v1/admin/retention; the caller is checked by
+// handleAdmin.
+func handleRetention(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		limit := defaultRetentionLog
+		if v := r.URL.Query().Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > maxRetentionLog {
+				writeJSONError(w, "limit must be 1-"+strconv.Itoa(maxRetentionLog), http.StatusBadRequest)
+				return
+			}
+			limit = n
+		}
+		entries, err := retentionLog(limit)
+		if err != nil {
+			writeJSONError(w, "Could not load retention log", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{
+			"rules":    append([]string{}, cfg.Retention...),
+			"interval": cfg.RetentionInterval.String(),
+			"dry_run":  cfg.RetentionDryRun,
+			"entries":  entries,
+		})
+	case "POST":
+		var req struct {
+			DryRun bool `json:"dry_run"`
+		}
+		if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&req); err != nil && err != io.EOF {
+			writeJSONError(w, "Expected JSON body with dry_run", http.StatusBadRequest)
+			return
+		}
+		entries, err := enforceRetention(req.DryRun)
+		if err != nil {
+			slog.Error("Retention failed", "err", err)
+			writeJSONError(w, "Could not apply retention rules", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"dry_run": req.DryRun, "entries": entries})
+	default:
+		writeJSONError(w, "Unsupported method", http.StatusMethodNotAllowed)
+	}
+}
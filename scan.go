@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Uploads can be checked by a content-safety scanner, a local model behind
+// a command (cfg.ScanCommand, run as "command file mime") or an external
+// API (cfg.ScanURL, which gets the file POSTed as the request body). Either
+// answers with scores between 0 and 1 per label:
+//
+//	{"labels": {"nsfw": 0.97, "neutral": 0.02}}
+//
+// An image with a score of at least cfg.ScanThreshold for one of
+// cfg.ScanLabels is flagged; with cfg.ScanAction "quarantine" it also waits
+// for review like a moderated upload (moderation.go). The scan runs in the
+// upload's processing job, and its scores are kept with the image.
+
+const scanTimeout = 2 * time.Minute
+
+type contentScanner interface {
+	Scan(ctx context.Context, path, mime string) (map[string]float64, error)
+}
+
+// scanner is nil without a configured scanner.
+var scanner contentScanner
+
+type scanResponse struct {
+	Labels map[string]float64 `json:"labels"`
+}
+
+func setupScanner(c Config) {
+	switch {
+	case c.ScanCommand != "":
+		scanner = commandScanner{c.ScanCommand}
+	case c.ScanURL != "":
+		scanner = httpScanner{url: c.ScanURL, client: &http.Client{Timeout: scanTimeout}}
+	default:
+		scanner = nil
+	}
+}
+
+type commandScanner struct {
+	command string
+}
+
+func (s commandScanner) Scan(ctx context.Context, path, mime string) (map[string]float64, error) {
+	ctx, cancel := context.WithTimeout(ctx, scanTimeout)
+	defer cancel()
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, s.command, path, mime)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w: %s", s.command, err, strings.TrimSpace(stderr.String()))
+	}
+	return decodeScan(bytes.NewReader(out))
+}
+
+type httpScanner struct {
+	url    string
+	client *http.Client
+}
+
+func (s httpScanner) Scan(ctx context.Context, path, mime string) (map[string]float64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	req, err := http.NewRequestWithContext(ctx, "POST", s.url, f)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", mime)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("scanner answered %s", resp.Status)
+	}
+	return decodeScan(io.LimitReader(resp.Body, 1<<20))
+}
+
+func decodeScan(r io.Reader) (map[string]float64, error) {
+	var res scanResponse
+	if err := json.NewDecoder(r).Decode(&res); err != nil {
+		return nil, fmt.Errorf("scanner output: %w", err)
+	}
+	if res.Labels == nil {
+		return nil, errors.New("scanner output has no labels")
+	}
+	return res.Labels, nil
+}
+
+// flaggedBy reports whether scores cross the threshold for a flagged label.
+func flaggedBy(scores map[string]float64) bool {
+	for _, label := range cfg.ScanLabels {
+		if scores[strings.ToLower(label)] >= cfg.ScanThreshold {
+			return true
+		}
+	}
+	return false
+}
+
+// scanImage scans the stored image id and records the result. Videos and
+// SVGs are not scanned.
+func scanImage(ctx context.Context, meta ImageMeta) error {
+	if scanner == nil || isVideoName(meta.ID) || isSVGName(meta.ID) {
+		return nil
+	}
+	ctx, s := startSpan(ctx, "upload.scan")
+	path, done, err := localMediaFile(ctx, meta.ID)
+	if err != nil {
+		s.end(ctx, err)
+		return err
+	}
+	scores, err := scanner.Scan(ctx, path, meta.Mime)
+	done()
+	s.end(ctx, err)
+	if err != nil {
+		return err
+	}
+	lower := make(map[string]float64, len(scores))
+	for k, v := range scores {
+		lower[strings.ToLower(k)] = v
+	}
+	b, _ := json.Marshal(lower)
+	flagged := flaggedBy(lower)
+	// quarantined images go to the review queue; scanning again never
+	// releases one
+	quarantine := flagged && cfg.ScanAction == "quarantine"
+	_, err = db.Exec(`UPDATE images SET scan = ?, flagged = ?, pending = pending OR ? WHERE id = ?`, string(b), flagged, quarantine, meta.ID)
+	return err
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strings"
+)
+
+// Full-text search over the images the caller sees:
+//
+//	GET /api/v1/search?q=prague bridge
+//
+// matches file names, titles, descriptions, tags, custom fields, camera
+// and lens, and places, ranked by BM25 with the name and title weighing
+// most. Every word has to match, as a prefix; accents are ignored. The
+// index is an FTS5 table kept up to date by triggers, see the migrations;
+// image_search gives each image a stable document number, as the rowids
+// of images are not. The listing's filters apply and results page by
+// ?page= and ?limit=.
+
+// maxSearchTerms bounds the words of a query.
+const maxSearchTerms = 16
+
+// searchDocs selects the indexed text of images, as searchColumns, from
+// image_search s joined with images i. Changes to watched columns of
+// images update the index, as do changes to tags and fields.
+const (
+	searchColumns = `name, title, description, tags, fields, camera, place`
+	searchDocs    = `SELECT s.doc, i.name, i.title, i.description, ` + searchTags + `, ` + searchFields + `, ` + searchCamera + `, ` + searchPlace + searchFrom
+	searchWatched = `name, title, description, camera, lens, country, country_code, city`
+
+	searchTags   = `COALESCE((SELECT group_concat(tag, ' ') FROM image_tags t WHERE t.image_id = i.id), '')`
+	searchFields = `COALESCE((SELECT group_concat(key || ' ' || value, ' ') FROM image_fields f WHERE f.image_id = i.id), '')`
+	searchCamera = `i.camera || ' ' || i.lens`
+	searchPlace  = `i.country || ' ' || i.country_code || ' ' || i.city`
+	searchFrom   = ` FROM image_search s JOIN images i ON i.id = s.image_id`
+)
+
+// earlier versions of the index, for their migrations: the first without
+// titles and descriptions, the second without fields
+const (
+	searchColumnsV1 = `name, tags, camera, place`
+	searchDocsV1    = `SELECT s.doc, i.name, ` + searchTags + `, ` + searchCamera + `, ` + searchPlace + searchFrom
+	searchWatchedV1 = `name, camera, lens, country, country_code, city`
+	searchColumnsV2 = `name, title, description, tags, camera, place`
+	searchDocsV2    = `SELECT s.doc, i.name, i.title, i.description, ` + searchTags + `, ` + searchCamera + `, ` + searchPlace + searchFrom
+)
+
+// searchIndex creates images_fts over docs, filled with the images there
+// are, and the triggers keeping it up to date.
+func searchIndex(columns, docs, watched string) string {
+	return `CREATE VIRTUAL TABLE images_fts USING fts5(` + columns + `, tokenize = 'unicode61 remove_diacritics 2');
+	INSERT INTO images_fts (rowid, ` + columns + `) ` + docs + `;
+	CREATE TRIGGER images_search_insert AFTER INSERT ON images BEGIN
+		INSERT INTO image_search (image_id) VALUES (new.id);
+		INSERT INTO images_fts (rowid, ` + columns + `) ` + docs + ` WHERE s.image_id = new.id;
+	END;
+	CREATE TRIGGER images_search_update AFTER UPDATE OF ` + watched + ` ON images BEGIN
+		` + searchRefresh(columns, docs, "new.id") + `
+	END;
+	CREATE TRIGGER images_search_delete AFTER DELETE ON images BEGIN
+		DELETE FROM images_fts WHERE rowid = (SELECT doc FROM image_search WHERE image_id = old.id);
+		DELETE FROM image_search WHERE image_id = old.id;
+	END;
+	CREATE TRIGGER image_tags_search_insert AFTER INSERT ON image_tags BEGIN
+		` + searchRefresh(columns, docs, "new.image_id") + `
+	END;
+	CREATE TRIGGER image_tags_search_delete AFTER DELETE ON image_tags BEGIN
+		` + searchRefresh(columns, docs, "old.image_id") + `
+	END`
+}
+
+// searchRefresh indexes the image with the id expression anew.
+func searchRefresh(columns, docs, id string) string {
+	return `DELETE FROM images_fts WHERE rowid = (SELECT doc FROM image_search WHERE image_id = ` + id + `);
+		INSERT INTO images_fts (rowid, ` + columns + `) ` + docs + ` WHERE s.image_id = ` + id + `;`
+}
+
+func handleSearch(w http.ResponseWriter, r *http.Request) {
+	if apiPreamble(w, r) {
+		return
+	}
+	if r.Method != "GET" {
+		writeJSONError(w, "Unsupported method", http.StatusMethodNotAllowed)
+		return
+	}
+	v := r.URL.Query()
+	match := ftsQuery(v.Get("q"))
+	if match == "" {
+		writeJSONError(w, "Missing q", http.StatusBadRequest)
+		return
+	}
+	limit, err := queryInt(v.Get("limit"), defaultPageSize, maxPageSize)
+	if err != nil {
+		writeJSONError(w, "Invalid limit", http.StatusBadRequest)
+		return
+	}
+	page, err := queryInt(v.Get("page"), 1, math.MaxInt32)
+	if err != nil {
+		writeJSONError(w, "Invalid page", http.StatusBadRequest)
+		return
+	}
+	q := listQuery{Limit: limit, Offset: (page - 1) * limit}
+	if err := parseListFilters(v, &q); err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	p, authenticated := resolvePrincipal(r)
+	q.Owner = p.ownerFilter()
+	q.HideProtected = !authenticated
+	q.Rater = p.UserID
+
+	result, err := searchImages(q, match)
+	if err == nil {
+		err = addRatings(p.UserID, result.Images)
+	}
+	if err != nil {
+		writeJSONError(w, "Could not search images", http.StatusInternalServerError)
+		return
+	}
+	result.Page = page
+	json.NewEncoder(w).Encode(result)
+}
+
+// ftsQuery turns what a user typed into an FTS5 query: each word quoted,
+// so nothing in it is taken for syntax, and matched as a prefix.
+func ftsQuery(s string) string {
+	var terms []string
+	for _, word := range strings.Fields(s) {
+		word = strings.ReplaceAll(word, `"`, "")
+		if word == "" {
+			continue
+		}
+		terms = append(terms, `"`+word+`"*`)
+		if len(terms) == maxSearchTerms {
+			break
+		}
+	}
+	return strings.Join(terms, " ")
+}
+
+// searchImages returns the page of q's images that match, best first.
+func searchImages(q listQuery, match string) (ImageList, error) {
+	result := ImageList{Images: []ImageMeta{}, Limit: q.Limit}
+	conds, args := q.filters()
+	// the name and title weigh most, then the description and tags
+	matches := `(SELECT s.image_id, bm25(images_fts, 4, 4, 2, 2, 1, 1, 1) AS score FROM images_fts
+		JOIN image_search s ON s.doc = images_fts.rowid WHERE images_fts MATCH ?) m ON m.image_id = images.id`
+	args = append([]any{match}, args...)
+
+	err := db.QueryRow(`SELECT COUNT(*) FROM images JOIN `+matches+whereClause(conds), args...).Scan(&result.Total)
+	if err != nil {
+		return result, err
+	}
+	rows, err := db.Query(`SELECT `+imageColumns+` FROM images JOIN `+matches+whereClause(conds)+`
+		ORDER BY m.score, images.id LIMIT ? OFFSET ?`, append(args, q.Limit, q.Offset)...)
+	if err != nil {
+		return result, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		meta, err := scanImageRow(rows)
+		if err != nil {
+			return result, err
+		}
+		result.Images = append(result.Images, meta)
+	}
+	return result, rows.Err()
+}
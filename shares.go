@@ -0,0 +1,168 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"image/png"
+	"io"
+	"io/fs"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Share links hand out a single image without an account or API key:
+//
+//	POST /api/v1/images/{id}/share  {"expiresIn": seconds, "maxDownloads": n}
+//	GET  /s/{token}
+//
+// Both limits are optional. The token is random and only its hash is
+// stored, like login sessions.
+//
+//	GET  /api/v1/share/{token}/qr?size=8
+//
+// is a QR code of a share link, or of a guest upload link, see guest.go,
+// as a PNG with size pixels per module, to print or show at events.
+// Anyone with the token may fetch it; it does not count as a download.
+
+const (
+	defaultQRScale = 8
+	maxQRScale     = 32
+)
+
+type Share struct {
+	URL          string     `json:"url"`
+	QR           string     `json:"qr"`
+	Expires      *time.Time `json:"expires,omitempty"`
+	MaxDownloads int        `json:"maxDownloads,omitempty"`
+}
+
+func handleCreateShare(w http.ResponseWriter, r *http.Request, meta ImageMeta) {
+	var req struct {
+		ExpiresIn    int64 `json:"expiresIn"`
+		MaxDownloads int   `json:"maxDownloads"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		writeJSONError(w, "Expected JSON body with expiresIn and maxDownloads", http.StatusBadRequest)
+		return
+	}
+	if req.ExpiresIn < 0 || req.MaxDownloads < 0 {
+		writeJSONError(w, "expiresIn and maxDownloads must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	token := randomString(32)
+	share := Share{URL: sitePath("/s/" + token), QR: shareQRPath(token), MaxDownloads: req.MaxDownloads}
+	var expires int64
+	if req.ExpiresIn > 0 {
+		t := time.Now().Add(time.Duration(req.ExpiresIn) * time.Second).UTC()
+		share.Expires = &t
+		expires = t.UnixNano()
+	}
+	_, err := db.Exec(`INSERT INTO shares (token_hash, image_id, expires_at, max_downloads, created_at) VALUES (?, ?, ?, ?, ?)`,
+		hashToken(token), meta.ID, expires, req.MaxDownloads, time.Now().UnixNano())
+	if err != nil {
+		writeJSONError(w, "Could not create share link", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(share)
+}
+
+// handleShare serves /s/{token}. Every request counts as a download, and
+// expired or used up links look like they never existed.
+func handleShare(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.URL.Path, "/s/")
+	if token == "" || strings.Contains(token, "/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	hash := hashToken(token)
+	res, err := db.Exec(`UPDATE shares SET downloads = downloads + 1
+		WHERE token_hash = ? AND (expires_at = 0 OR expires_at > ?) AND (max_downloads = 0 OR downloads < max_downloads)
+			AND image_id IN (SELECT id FROM images WHERE deleted_at = 0)`, hash, time.Now().UnixNano())
+	if err != nil {
+		http.Error(w, "Could not read share link", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	var id string
+	if err := db.QueryRow(`SELECT image_id FROM shares WHERE token_hash = ?`, hash).Scan(&id); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	f, info, err := storage.Open(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			http.NotFound(w, r)
+		} else {
+			http.Error(w, "Could not read file", http.StatusInternalServerError)
+		}
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.Header().Set("Content-Type", mediaType(id))
+	if isSVGName(id) {
+		setSVGHeaders(w)
+	}
+	http.ServeContent(w, r, id, info.ModTime, f)
+}
+
+// shareQRPath is the URL of the QR code of a share or upload link token.
+func shareQRPath(token string) string {
+	return sitePath(apiV1 + "/share/" + token + "/qr")
+}
+
+func handleShareQR(w http.ResponseWriter, r *http.Request) {
+	if apiPreamble(w, r) {
+		return
+	}
+	if r.Method != "GET" && r.Method != "HEAD" {
+		writeJSONError(w, "Unsupported method", http.StatusMethodNotAllowed)
+		return
+	}
+	token, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, apiV1+"/share/"), "/qr")
+	if !ok || token == "" || strings.Contains(token, "/") {
+		writeJSONError(w, "Link not found", http.StatusNotFound)
+		return
+	}
+	scale, err := queryInt(r.URL.Query().Get("size"), defaultQRScale, maxQRScale)
+	if err != nil {
+		writeJSONError(w, "Invalid size", http.StatusBadRequest)
+		return
+	}
+
+	var path string
+	var one int
+	err = db.QueryRow(`SELECT 1 FROM shares
+		WHERE token_hash = ? AND (expires_at = 0 OR expires_at > ?) AND (max_downloads = 0 OR downloads < max_downloads)
+			AND image_id IN (SELECT id FROM images WHERE deleted_at = 0)`, hashToken(token), time.Now().UnixNano()).Scan(&one)
+	if err == nil {
+		path = "/s/" + token
+	} else if _, err = openUploadLink(token); err == nil {
+		path = "/u/" + token
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		writeJSONError(w, "Link not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		writeJSONError(w, "Could not read link", http.StatusInternalServerError)
+		return
+	}
+
+	modules, err := qrCode([]byte(siteOrigin(r) + sitePath(path)))
+	if err != nil {
+		writeJSONError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "private, no-store")
+	png.Encode(w, qrImage(modules, scale))
+}
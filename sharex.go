@@ -0,0 +1,230 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Screenshot tools such as ShareX upload with a custom uploader, and
+// Flameshot or scrot with a script around curl:
+//
+//	GET  /api/v1/sharex              the uploader as a .sxcu file for ShareX
+//	POST /api/v1/sharex              multipart "file" field, like POST /api/v1/images
+//	POST /api/v1/sharex?format=text  the same, answered with just the URL
+//
+// The answer is {"url", "thumbnailUrl", "deletionUrl", "id"}. url is made
+// from cfg.ScreenshotURL, so it can point at the file, the image page or
+// a thumbnail. deletionUrl, /d/{token}, deletes the image for whoever
+// opens it, after a confirmation, so it can be kept next to the
+// screenshot without credentials. Only the token's hash is stored.
+
+// screenshotPlaceholders are what cfg.ScreenshotURL may use.
+var screenshotPlaceholders = regexp.MustCompile(`\{[a-z]+\}`)
+
+// validateScreenshotURL checks cfg.ScreenshotURL.
+func validateScreenshotURL(s string) error {
+	if s == "" {
+		return fmt.Errorf("screenshot-url must not be empty")
+	}
+	for _, p := range screenshotPlaceholders.FindAllString(s, -1) {
+		switch p {
+		case "{url}", "{page}", "{thumb}", "{id}", "{origin}":
+		default:
+			return fmt.Errorf("screenshot-url has unknown placeholder %s, use {url}, {page}, {thumb}, {id} or {origin}", p)
+		}
+	}
+	return nil
+}
+
+// screenshotURL fills in cfg.ScreenshotURL for meta.
+func screenshotURL(r *http.Request, meta ImageMeta) string {
+	origin := siteOrigin(r)
+	thumb := origin + meta.URL
+	if meta.Thumb != "" {
+		thumb = origin + meta.Thumb
+	}
+	return strings.NewReplacer(
+		"{url}", origin+meta.URL,
+		"{page}", origin+sitePath("/i/"+meta.ID),
+		"{thumb}", thumb,
+		"{id}", meta.ID,
+		"{origin}", origin,
+	).Replace(cfg.ScreenshotURL)
+}
+
+type ScreenshotResponse struct {
+	ID           string `json:"id"`
+	URL          string `json:"url"`
+	ThumbnailURL string `json:"thumbnailUrl"`
+	DeletionURL  string `json:"deletionUrl"`
+}
+
+func handleShareX(w http.ResponseWriter, r *http.Request) {
+	if apiPreamble(w, r) {
+		return
+	}
+	switch r.Method {
+	case "GET":
+		handleShareXConfig(w, r)
+	case "POST":
+		handleScreenshotUpload(w, r)
+	default:
+		writeJSONError(w, "Unsupported method", http.StatusMethodNotAllowed)
+	}
+}
+
+func handleScreenshotUpload(w http.ResponseWriter, r *http.Request) {
+	tooLarge := fmt.Sprintf("File exceeds maximum size %d MB", cfg.MaxUploadMB)
+	path, name, ok := stageMultipart(w, r, cfg.maxUploadBytes(), tooLarge)
+	if !ok {
+		return
+	}
+	meta, _, err := ingest(r.Context(), upload{
+		Path:    path,
+		Name:    name,
+		Owner:   requestViewer(r).UserID,
+		Strip:   wantStripMetadata(r),
+		Pending: needsReview(r),
+	})
+	if err != nil {
+		writeIngestError(w, err)
+		return
+	}
+	token := randomString(32)
+	if _, err := db.Exec(`INSERT INTO deletion_tokens (token_hash, image_id, created_at) VALUES (?, ?, ?)`,
+		hashToken(token), meta.ID, time.Now().UnixNano()); err != nil {
+		writeJSONError(w, "Could not create deletion link", http.StatusInternalServerError)
+		return
+	}
+
+	origin := siteOrigin(r)
+	resp := ScreenshotResponse{
+		ID:           meta.ID,
+		URL:          screenshotURL(r, meta),
+		ThumbnailURL: origin + meta.URL,
+		DeletionURL:  origin + sitePath("/d/"+token),
+	}
+	if meta.Thumb != "" {
+		resp.ThumbnailURL = origin + thumbURL(meta, defaultThumbWidth)
+	}
+	if r.URL.Query().Get("format") == "text" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintln(w, resp.URL)
+		return
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleShareXConfig hands out a ShareX custom uploader for this gallery,
+// with the caller's API key if it used one.
+func handleShareXConfig(w http.ResponseWriter, r *http.Request) {
+	uploader := map[string]any{
+		"Version":         "15.0.0",
+		"Name":            "AI-Morph Galerie",
+		"DestinationType": "ImageUploader, FileUploader",
+		"RequestMethod":   "POST",
+		"RequestURL":      siteOrigin(r) + sitePath(apiV1+"/sharex"),
+		"Body":            "MultipartFormData",
+		"FileFormName":    "file",
+		"URL":             "{json:url}",
+		"ThumbnailURL":    "{json:thumbnailUrl}",
+		"DeletionURL":     "{json:deletionUrl}",
+		"ErrorMessage":    "{json:error}",
+	}
+	if key := requestAPIKey(r); key != "" {
+		uploader["Headers"] = map[string]string{"X-API-Key": key}
+	} else if len(cfg.APIKeys) > 0 || cfg.Accounts {
+		uploader["Headers"] = map[string]string{"X-API-Key": "YOUR_API_KEY"}
+	}
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": "galerie.sxcu"}))
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(uploader)
+}
+
+var deletionTemplate = template.Must(template.New("deletion").Parse(`<!doctype html>
+<html lang="cs">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex">
+<title>Smazat {{.Meta.Name}}</title>
+<link rel="stylesheet" href="{{.Base}}/static/styles.css">
+</head>
+<body>
+<main>
+{{if .Deleted}}<h1>Obrázek je smazaný</h1>
+{{else}}<h1>Smazat {{.Meta.Name}}?</h1>
+{{if .Meta.Thumb}}<p><img src="{{.Meta.Thumb}}" alt="{{.Meta.Name}}"></p>
+{{end}}<form method="post">
+  <input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+  <button type="submit">Smazat</button>
+</form>
+{{end}}</main>
+</body>
+</html>
+`))
+
+// handleDeletionLink serves /d/{token}: a confirmation page, and the
+// deletion posted from it. Deleted images and unknown tokens are not
+// found.
+func handleDeletionLink(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.URL.Path, "/d/")
+	if token == "" || strings.Contains(token, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	var id string
+	err := db.QueryRow(`SELECT image_id FROM deletion_tokens WHERE token_hash = ?`, hashToken(token)).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Could not read deletion link", http.StatusInternalServerError)
+		return
+	}
+	meta, err := getImage(id)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && meta.Deleted != nil) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Could not load image", http.StatusInternalServerError)
+		return
+	}
+
+	data := struct {
+		Meta      ImageMeta
+		Deleted   bool
+		CSRFToken string
+		Base      string
+	}{Meta: meta, Base: cfg.BasePath}
+	switch r.Method {
+	case "GET", "HEAD":
+		data.CSRFToken = csrfToken(w, r)
+	case "POST":
+		if _, err := removeImage(r.Context(), meta, false); err != nil {
+			slog.ErrorContext(r.Context(), "Deletion link", "image", meta.ID, "err", err)
+			http.Error(w, "Could not delete image", http.StatusInternalServerError)
+			return
+		}
+		db.Exec(`DELETE FROM deletion_tokens WHERE image_id = ?`, meta.ID)
+		data.Deleted = true
+	default:
+		http.Error(w, "Unsupported method", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	deletionTemplate.Execute(w, data)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/xml"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// /sitemap.xml lists the pages of a public gallery for search engines:
+// the gallery itself, the page of every image anyone may see, see
+// embed.go, and the albums without a password, each with the time of its
+// latest upload. Galleries that need credentials to read have none.
+
+// maxSitemapURLs is the most a sitemap may list.
+const maxSitemapURLs = 50000
+
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"urlset"`
+	NS      string       `xml:"xmlns,attr"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+type sitemapURL struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+func handleSitemap(w http.ResponseWriter, r *http.Request) {
+	if !publicReads() {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := listQuery{HideProtected: true}
+	if listNotModified(w, r, q) {
+		return
+	}
+
+	origin := siteOrigin(r)
+	set := sitemapURLSet{NS: "http://www.sitemaps.org/schemas/sitemap/0.9"}
+	add := func(path string, modified int64) {
+		u := sitemapURL{Loc: origin + sitePath(path)}
+		if modified > 0 {
+			u.LastMod = time.Unix(0, modified).UTC().Format(time.RFC3339)
+		}
+		set.URLs = append(set.URLs, u)
+	}
+	// q has no filters taking arguments
+	conds, _ := q.filters()
+	where := whereClause(conds)
+	var latest int64
+	err := db.QueryRow(`SELECT COALESCE(MAX(uploaded_at), 0) FROM images` + where).Scan(&latest)
+	if err == nil {
+		add("/", latest)
+		err = sitemapRows(`SELECT a.id, (SELECT COALESCE(MAX(i.uploaded_at), 0) FROM album_images ai JOIN images i ON i.id = ai.image_id
+			WHERE ai.album_id = a.id AND i.deleted_at = 0 AND i.pending = 0) AS modified
+			FROM albums a WHERE a.password_hash = '' ORDER BY modified DESC, a.id LIMIT ?`, maxSitemapURLs-len(set.URLs), "/a/", add)
+	}
+	if err == nil {
+		err = sitemapRows(`SELECT id, uploaded_at FROM images`+where+` ORDER BY uploaded_at DESC, id LIMIT ?`, maxSitemapURLs-len(set.URLs), "/i/", add)
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Sitemap", "err", err)
+		http.Error(w, "Could not load sitemap", http.StatusInternalServerError)
+		return
+	}
+
+	out, err := xml.MarshalIndent(set, "", "  ")
+	if err != nil {
+		http.Error(w, "Could not encode sitemap", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.Write(append([]byte(xml.Header), out...))
+}
+
+// sitemapRows adds the pages prefix+id of the id and time rows query
+// returns, at most limit of them.
+func sitemapRows(query string, limit int, prefix string, add func(string, int64)) error {
+	rows, err := db.Query(query, limit)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		var modified int64
+		if err := rows.Scan(&id, &modified); err != nil {
+			return err
+		}
+		add(prefix+id, modified)
+	}
+	return rows.Err()
+}
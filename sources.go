@@ -0,0 +1,187 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cfg.SourceDirs, a photo archive or a NAS share say, are shown in the
+// gallery next to the uploads, without being copied or written to. They
+// are scanned recursively with syncStore, following symlinks with
+// cfg.FollowSymlinks, and each folder holding images becomes an album,
+// named by its path, that is kept in line with it. Their images are named
+// like uploads, from the hash of their path, so a file moved to another
+// folder is another image. The gallery cannot delete or replace them.
+// Only local storage has source directories.
+
+var errSourceFile = errors.New("image is in a read-only source directory")
+
+type sourceFile struct {
+	path   string
+	folder string // directory, the album is made from
+	album  string // album name
+}
+
+var sources struct {
+	sync.RWMutex
+	scanned bool
+	files   map[string]sourceFile // by image name
+}
+
+// sourcePath returns the path of the source file name, if it is one.
+func sourcePath(name string) (string, bool) {
+	if len(cfg.SourceDirs) == 0 {
+		return "", false
+	}
+	sources.RLock()
+	scanned := sources.scanned
+	f, ok := sources.files[name]
+	sources.RUnlock()
+	if !scanned {
+		scanSources()
+		return sourcePath(name)
+	}
+	return f.path, ok
+}
+
+func isSourceFile(name string) bool {
+	_, ok := sourcePath(name)
+	return ok
+}
+
+// scanSources walks cfg.SourceDirs and returns the media files in them.
+func scanSources() []ObjectInfo {
+	files := map[string]sourceFile{}
+	var objects []ObjectInfo
+	for _, root := range cfg.SourceDirs {
+		walkSource(root, map[string]bool{}, func(path string, info fs.FileInfo) {
+			name := sourceName(path)
+			files[name] = sourceFile{path: path, folder: filepath.Dir(path), album: sourceAlbumName(root, filepath.Dir(path))}
+			objects = append(objects, ObjectInfo{Name: name, Size: info.Size(), ModTime: info.ModTime()})
+		})
+	}
+	sources.Lock()
+	sources.files, sources.scanned = files, true
+	sources.Unlock()
+	return objects
+}
+
+// walkSource calls f for the media files under dir, leaving out dot files
+// and folders. seen are the directories walked already, by their real
+// path, so symlinks going round in circles end.
+func walkSource(dir string, seen map[string]bool, f func(string, fs.FileInfo)) {
+	real, err := filepath.EvalSymlinks(dir)
+	if err != nil || seen[real] {
+		return
+	}
+	seen[real] = true
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		slog.Warn("Could not read source directory", "dir", dir, "err", err)
+		return
+	}
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		path := filepath.Join(dir, e.Name())
+		info, err := e.Info()
+		if e.Type()&fs.ModeSymlink != 0 {
+			if !cfg.FollowSymlinks {
+				continue
+			}
+			info, err = os.Stat(path)
+		}
+		switch {
+		case err != nil:
+		case info.IsDir():
+			walkSource(path, seen, f)
+		case info.Mode().IsRegular() && isMediaName(e.Name()):
+			f(path, info)
+		}
+	}
+}
+
+// sourceName is the image name of the source file at path.
+func sourceName(path string) string {
+	sum := sha256.Sum256([]byte(path))
+	return hex.EncodeToString(sum[:6]) + "_" + safeFileName(path)
+}
+
+// sourceAlbumName names the album of folder in root: root's name and the
+// path below it.
+func sourceAlbumName(root, folder string) string {
+	name := filepath.Base(filepath.Clean(root))
+	if rel, err := filepath.Rel(root, folder); err == nil && rel != "." {
+		name += "/" + filepath.ToSlash(rel)
+	}
+	return name
+}
+
+// syncSourceAlbums makes an album of each source folder with images and
+// drops those of folders gone. The albums may be renamed; what is in them
+// follows the folder.
+func syncSourceAlbums() error {
+	folders := map[string][]string{}
+	names := map[string]string{}
+	sources.RLock()
+	for name, f := range sources.files {
+		folders[f.folder] = append(folders[f.folder], name)
+		names[f.folder] = f.album
+	}
+	sources.RUnlock()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	now := time.Now().UnixNano()
+	keep := map[string]bool{}
+	for folder, images := range folders {
+		sum := sha256.Sum256([]byte(folder))
+		id := hex.EncodeToString(sum[:6])
+		keep[id] = true
+		if _, err := tx.Exec(`INSERT OR IGNORE INTO albums (id, name, source, created_at) VALUES (?, ?, ?, ?)`,
+			id, names[folder], folder, now); err != nil {
+			return err
+		}
+		for _, image := range images {
+			// files that could not be indexed are not in images
+			if _, err := tx.Exec(`INSERT OR IGNORE INTO album_images (album_id, image_id, added_at) SELECT ?, id, ? FROM images WHERE id = ?`,
+				id, now, image); err != nil {
+				return err
+			}
+		}
+	}
+	rows, err := tx.Query(`SELECT id FROM albums WHERE source != ''`)
+	if err != nil {
+		return err
+	}
+	var gone []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		if !keep[id] {
+			gone = append(gone, id)
+		}
+	}
+	rows.Close()
+	for _, id := range gone {
+		if _, err := tx.Exec(`DELETE FROM albums WHERE id = ?`, id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
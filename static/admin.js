@@ -0,0 +1,269 @@
+// static/admin.js
+// The admin dashboard, backed by /api/v1/admin
+// the gallery may be served under a sub-path, see proxy.go
+const BASE = document.querySelector('meta[name="base-path"]')?.content || '';
+const API = `${BASE}/api/v1`;
+const ADMIN = `${API}/admin`;
+
+let userNames = {};
+
+// apiFetch adds the stored API key (if any) and asks for one when the server
+// rejects the request, like the gallery does.
+async function apiFetch(url, opts = {}) {
+  const send = () => {
+    const headers = new Headers(opts.headers || {});
+    const key = localStorage.getItem('apiKey');
+    if (key) headers.set('X-API-Key', key);
+    // the server refuses changes from pages without the token, see csrf.go
+    const csrf = document.querySelector('meta[name="csrf-token"]');
+    if (csrf) headers.set('X-CSRF-Token', csrf.content);
+    return fetch(url, { ...opts, headers });
+  };
+  let res = await send();
+  if (res.status === 401) {
+    const key = prompt('API klíč:');
+    if (key) {
+      localStorage.setItem('apiKey', key);
+      res = await send();
+    }
+  }
+  return res;
+}
+
+async function apiJSON(url, opts = {}) {
+  const res = await apiFetch(url, opts);
+  const body = await res.json().catch(() => ({}));
+  if (!res.ok) {
+    if (res.status === 401 || res.status === 403) throw new Error('Přístup jen pro správce. Přihlas se v galerii jako správce nebo zadej API klíč.');
+    throw new Error(body.error || `Chyba ${res.status}`);
+  }
+  return body;
+}
+
+function showError(err) {
+  const el = document.getElementById('admin-error');
+  el.textContent = err ? err.message : '';
+  el.hidden = !err;
+}
+
+function formatBytes(n) {
+  const units = ['B', 'KB', 'MB', 'GB', 'TB'];
+  let i = 0;
+  while (n >= 1024 && i < units.length - 1) { n /= 1024; i++; }
+  return `${n.toFixed(i ? 1 : 0)} ${units[i]}`;
+}
+
+function escapeHTML(s) {
+  const d = document.createElement('div');
+  d.textContent = s;
+  return d.innerHTML;
+}
+
+async function loadStats() {
+  const s = await apiJSON(`${ADMIN}/stats`);
+  const jobs = Object.entries(s.jobs).map(([k, v]) => `${k}: ${v}`).join(', ') || 'žádné';
+  const rows = [
+    ['Obrázky', `${s.images.count} · ${formatBytes(s.images.bytes)}`],
+    ['Koš', `${s.trash.count} · ${formatBytes(s.trash.bytes)}`],
+    ['Náhledy', `${s.thumbs.count} · ${formatBytes(s.thumbs.bytes)}`],
+    ['Zpracovává se', s.processing],
+    ['Ke schválení', s.pending],
+    ['Označené kontrolou', s.flagged],
+    ['Alba', s.albums],
+    ['Uživatelé', s.banned ? `${s.users} (zablokovaní: ${s.banned})` : s.users],
+    ['Úlohy', jobs],
+  ];
+  if (s.disk_free != null) rows.push(['Volné místo', formatBytes(s.disk_free)]);
+  document.getElementById('stats').innerHTML = rows
+    .map(([k, v]) => `<div class="card"><div class="meta">${k}</div><div>${v}</div></div>`).join('');
+}
+
+async function loadUsers() {
+  if (document.body.dataset.accounts !== 'true') return;
+  const { users } = await apiJSON(`${ADMIN}/users`);
+  userNames = Object.fromEntries(users.map(u => [u.id, u.username]));
+  document.getElementById('users-section').hidden = false;
+  const tbody = document.getElementById('users');
+  tbody.innerHTML = '';
+  users.forEach(u => {
+    const tr = document.createElement('tr');
+    if (u.banned) tr.className = 'banned';
+    tr.innerHTML = `<td>${escapeHTML(u.username)}</td><td>${u.role === 'admin' ? 'správce' : 'uživatel'}</td>
+      <td>${u.images.count}</td><td>${formatBytes(u.images.bytes)}</td>
+      <td>${new Date(u.created).toLocaleDateString('cs')}</td><td></td>`;
+    const actions = tr.lastElementChild;
+    const button = (label, update, question) => {
+      const b = document.createElement('button');
+      b.textContent = label;
+      b.onclick = () => updateUser(u, update, question);
+      actions.appendChild(b);
+    };
+    if (u.banned) button('Odblokovat', { banned: false });
+    else button('Zablokovat', { banned: true }, `Zablokovat uživatele ${u.username}? Jeho obrázky se zároveň přesunou do koše.`);
+    if (u.role === 'admin') button('Odebrat správce', { role: 'user' });
+    else button('Udělat správcem', { role: 'admin' });
+    tbody.appendChild(tr);
+  });
+}
+
+async function updateUser(u, update, question) {
+  if (question) {
+    if (!confirm(question)) return;
+    update.trash = true;
+  }
+  try {
+    await apiJSON(`${ADMIN}/users/${encodeURIComponent(u.id)}`, {
+      method: 'PATCH',
+      headers: { 'Content-Type': 'application/json' },
+      body: JSON.stringify(update),
+    });
+    showError(null);
+    await refresh();
+  } catch (err) {
+    showError(err);
+  }
+}
+
+// scanNote names the labels a content scan flagged an image for.
+function scanNote(i) {
+  if (!i.flagged) return '';
+  const top = Object.entries(i.scan || {}).sort((a, b) => b[1] - a[1])
+    .slice(0, 2).map(([k, v]) => `${escapeHTML(k)} ${Math.round(v * 100)} %`).join(', ');
+  return ` · <span class="flagged">označeno${top ? ` (${top})` : ''}</span>`;
+}
+
+async function loadUploads() {
+  const flagged = document.getElementById('uploads-flagged').checked ? '&flagged=1' : '';
+  const { images } = await apiJSON(`${ADMIN}/uploads?limit=40${flagged}`);
+  const grid = document.getElementById('uploads');
+  grid.innerHTML = '';
+  images.forEach(i => {
+    const d = document.createElement('div');
+    d.className = 'tile';
+    if (i.color) d.style.setProperty('--tint', i.color);
+    const owner = userNames[i.owner] ? ` · ${escapeHTML(userNames[i.owner])}` : '';
+    d.innerHTML = `<a href="${i.url}" target="_blank"><img src="${i.thumb || i.url}" alt="${escapeHTML(i.name)}" loading="lazy"></a>
+      <div class="meta">${escapeHTML(i.name)} · ${formatBytes(i.size)}${owner}${scanNote(i)}</div>`;
+    const del = document.createElement('button');
+    del.textContent = 'Smazat';
+    del.onclick = () => deleteImage(i);
+    d.appendChild(del);
+    grid.appendChild(d);
+  });
+}
+
+async function loadReview() {
+  const { images } = await apiJSON(`${ADMIN}/review?limit=100`);
+  document.getElementById('review-section').hidden = !images.length;
+  const grid = document.getElementById('review');
+  grid.innerHTML = '';
+  images.forEach(i => {
+    const d = document.createElement('div');
+    d.className = 'tile';
+    const owner = userNames[i.owner] ? ` · ${escapeHTML(userNames[i.owner])}` : '';
+    d.innerHTML = `<a href="${i.url}" target="_blank"><img src="${i.thumb || i.url}" alt="${escapeHTML(i.name)}" loading="lazy"></a>
+      <div class="meta">${escapeHTML(i.name)} · ${formatBytes(i.size)}${owner}${scanNote(i)}</div>`;
+    const button = (label, decision) => {
+      const b = document.createElement('button');
+      b.textContent = label;
+      b.onclick = () => review(i, decision);
+      d.appendChild(b);
+    };
+    button('Schválit', 'approve');
+    button('Zamítnout', 'reject');
+    grid.appendChild(d);
+  });
+}
+
+async function review(i, decision) {
+  if (decision === 'reject' && !confirm(`Zamítnout a smazat ${i.name}?`)) return;
+  try {
+    await apiJSON(`${ADMIN}/review/${encodeURIComponent(i.id)}`, {
+      method: 'POST',
+      headers: { 'Content-Type': 'application/json' },
+      body: JSON.stringify({ decision }),
+    });
+    showError(null);
+    await refresh();
+  } catch (err) {
+    showError(err);
+  }
+}
+
+async function deleteImage(i) {
+  if (!confirm(`Přesunout ${i.name} do koše?`)) return;
+  try {
+    await apiJSON(`${API}/images/${encodeURIComponent(i.id)}`, { method: 'DELETE' });
+    showError(null);
+    await refresh();
+  } catch (err) {
+    showError(err);
+  }
+}
+
+async function runTask(task) {
+  try {
+    await apiJSON(`${ADMIN}/maintenance`, {
+      method: 'POST',
+      headers: { 'Content-Type': 'application/json' },
+      body: JSON.stringify({ task }),
+    });
+    showError(null);
+    await loadStats();
+  } catch (err) {
+    showError(err);
+  }
+}
+
+function retentionRows(entries) {
+  document.getElementById('retention').innerHTML = entries.map(e => `<tr>
+    <td>${new Date(e.time).toLocaleString('cs')}</td><td>${escapeHTML(e.rule)}</td>
+    <td>${escapeHTML(e.name)}</td><td>${formatBytes(e.size)}</td>
+    <td>${e.dry_run ? 'nanečisto' : e.permanent ? 'smazáno' : 'v koši'}</td></tr>`).join('');
+}
+
+async function loadRetention() {
+  const r = await apiJSON(`${ADMIN}/retention?limit=50`);
+  if (!r.rules.length && !r.entries.length) return;
+  document.getElementById('retention-section').hidden = false;
+  const rules = r.rules.length ? r.rules.join(', ') : 'žádná';
+  document.getElementById('retention-rules').textContent =
+    `${rules} · každých ${r.interval}${r.dry_run ? ' · jen nanečisto' : ''} `;
+  retentionRows(r.entries);
+}
+
+async function retentionDryRun() {
+  try {
+    const r = await apiJSON(`${ADMIN}/retention`, {
+      method: 'POST',
+      headers: { 'Content-Type': 'application/json' },
+      body: JSON.stringify({ dry_run: true }),
+    });
+    showError(null);
+    alert(r.entries.length ? `Pravidla by odstranila ${r.entries.length} obrázků.` : 'Pravidla by nic neodstranila.');
+    await loadRetention();
+  } catch (err) {
+    showError(err);
+  }
+}
+
+async function refresh() {
+  try {
+    // users first, the uploads show their owners' names
+    await loadStats();
+    await loadUsers();
+    await loadRetention();
+    await loadReview();
+    await loadUploads();
+    showError(null);
+  } catch (err) {
+    showError(err);
+  }
+}
+
+document.querySelectorAll('[data-task]').forEach(b => {
+  b.onclick = () => runTask(b.dataset.task);
+});
+document.getElementById('retention-dry-run').onclick = retentionDryRun;
+document.getElementById('uploads-flagged').onchange = () => loadUploads().catch(showError);
+refresh();
@@ -0,0 +1,28 @@
+// static/embed.js
+// Embeds an album of the gallery in another site, see widget.go:
+//   <script src="https://gallery.example/static/embed.js" data-album="{id}" async></script>
+// Loaded by the widget itself it reports the page's height to the
+// embedding site instead, so the iframe needs no scrollbar.
+(function () {
+  const script = document.currentScript;
+  const album = script && script.dataset.album;
+  if (!album) {
+    const report = () => parent.postMessage({ galleryEmbed: location.pathname, height: document.documentElement.scrollHeight }, '*');
+    addEventListener('load', report);
+    addEventListener('resize', report);
+    return;
+  }
+  const src = new URL(script.src);
+  const base = src.pathname.replace(/\/static\/embed\.js$/, '');
+  const path = `${base}/embed/${encodeURIComponent(album)}`;
+  const frame = document.createElement('iframe');
+  frame.src = `${src.origin}${path}${script.dataset.limit ? `?limit=${encodeURIComponent(script.dataset.limit)}` : ''}`;
+  frame.title = script.dataset.title || 'Galerie';
+  frame.loading = 'lazy';
+  frame.style.cssText = 'width:100%;height:400px;border:0;';
+  addEventListener('message', e => {
+    if (e.origin !== src.origin || !e.data || e.data.galleryEmbed !== path) return;
+    frame.style.height = `${Math.ceil(e.data.height)}px`;
+  });
+  script.replaceWith(frame);
+})();
@@ -1,30 +1,356 @@
 // static/main.js
-// Minimal placeholder JS to call /api for listing images
-const API = '/api';
+// Minimal placeholder JS to call /api/v1/images for listing images
+// the gallery may be served under a sub-path, see proxy.go
+const BASE = document.querySelector('meta[name="base-path"]')?.content || '';
+const API = `${BASE}/api/v1`;
+const PAGE_SIZE = 60;
 
-async function loadImages() {
-  const res = await fetch(API);
-  const imgs = await res.json();
+let nextCursor = null;
+let loading = false;
+// the images in the grid, in order, for the viewer
+let images = [];
+let current = -1;
+
+// apiFetch adds the stored API key (if any) and asks for one when the server
+// rejects the request.
+async function apiFetch(url, opts = {}) {
+  const send = () => {
+    const headers = new Headers(opts.headers || {});
+    const key = localStorage.getItem('apiKey');
+    if (key) headers.set('X-API-Key', key);
+    // the server refuses changes from pages without the token, see csrf.go
+    const csrf = document.querySelector('meta[name="csrf-token"]');
+    if (csrf) headers.set('X-CSRF-Token', csrf.content);
+    return fetch(url, { ...opts, headers });
+  };
+  let res = await send();
+  if (res.status === 401) {
+    const key = prompt('API klíč:');
+    if (key) {
+      localStorage.setItem('apiKey', key);
+      res = await send();
+    }
+  }
+  return res;
+}
+
+function tile(i) {
+  const d = document.createElement('div');
+  d.className = 'tile';
+  d.dataset.id = i.id;
+  // tinted with the photo's dominant color until it loads
+  if (i.color) d.style.setProperty('--tint', i.color);
+  // the tile crops the thumbnail; keep its most detailed part in view
+  if (i.focus) d.style.setProperty('--focus', `${i.focus[0] * 100}% ${i.focus[1] * 100}%`);
+  const media = (i.mime || '').startsWith('video/')
+    ? `<video src="${i.url}" poster="${i.thumb}" controls preload="none"></video>`
+    : `<img src="${i.thumb || i.url}"${i.srcset ? ` srcset="${i.srcset}" sizes="(max-width: 400px) 100vw, 360px"` : ''} alt="${escapeHTML(altText(i))}" loading="lazy">`;
+  d.innerHTML = `${media}<div class="meta">${i.title ? `${escapeHTML(i.title)} · ` : ''}${i.width}×${i.height}</div>`;
+  if (!(i.mime || '').startsWith('video/')) {
+    d.querySelector('img').addEventListener('click', () => openModal(images.findIndex(x => x.id === i.id)));
+  }
+  return d;
+}
+
+function renderTiles(imgs) {
   const grid = document.getElementById('grid');
-  grid.innerHTML = '';
-  imgs.forEach(i => {
-    const d = document.createElement('div');
-    d.className = 'tile';
-    d.innerHTML = `<img src="${i.url}" alt="${i.name}" loading="lazy"><div class="meta">${i.width}×${i.height}</div>`;
-    grid.appendChild(d);
+  imgs.forEach(i => grid.appendChild(tile(i)));
+}
+
+function escapeHTML(s) {
+  return String(s).replace(/[&<>"']/g, c => ({ '&': '&amp;', '<': '&lt;', '>': '&gt;', '"': '&quot;', "'": '&#39;' })[c]);
+}
+
+// altText describes an image for screen readers, see captions.go
+function altText(i) {
+  return i.alt || i.title || i.name;
+}
+
+// markdown renders the little Markdown descriptions use: paragraphs, line
+// breaks, **bold**, *italic*, `code` and [links](https://...). Everything
+// else stays text.
+function markdown(src) {
+  const inline = s => escapeHTML(s)
+    .replace(/`([^`]+)`/g, '<code>$1</code>')
+    .replace(/\*\*([^*]+)\*\*/g, '<strong>$1</strong>')
+    .replace(/\*([^*]+)\*/g, '<em>$1</em>')
+    .replace(/\[([^\]]+)\]\((https?:\/\/[^\s)]+)\)/g, '<a href="$2" rel="nofollow noopener" target="_blank">$1</a>');
+  return src.split(/\n\s*\n/).filter(p => p.trim())
+    .map(p => `<p>${p.trim().split('\n').map(inline).join('<br>')}</p>`).join('');
+}
+
+function openModal(index) {
+  const i = images[index];
+  if (!i) return;
+  current = index;
+  const modal = document.getElementById('modal');
+  const img = document.querySelector('#layer1 img');
+  img.src = i.url;
+  img.alt = altText(i);
+  document.getElementById('modal-body').setAttribute('aria-label', i.title || i.name);
+  document.getElementById('modal-title').textContent = i.title || '';
+  document.getElementById('modal-description').innerHTML = markdown(i.description || '');
+  modal.setAttribute('aria-hidden', 'false');
+  loadComments(i.id);
+}
+
+// Comments under the image in the viewer, see comments.go. Visitors
+// answer a captcha and their comments wait for approval.
+let captchaID = '';
+
+async function loadComments(id) {
+  const section = document.getElementById('modal-comments');
+  const res = await apiFetch(`${API}/images/${encodeURIComponent(id)}/comments`);
+  if (!res.ok || images[current]?.id !== id) {
+    if (!res.ok) section.hidden = true;
+    return;
+  }
+  const data = await res.json();
+  const list = document.getElementById('comment-list');
+  list.innerHTML = '';
+  data.comments.forEach(c => {
+    const li = document.createElement('li');
+    if (c.pending) li.className = 'pending';
+    li.innerHTML = `<span class="author">${escapeHTML(c.author || 'Anonym')}</span>${escapeHTML(c.body)}`
+      + (c.pending ? ' <button data-act="approve">Schválit</button>' : '')
+      + (data.moderator ? ' <button data-act="delete">Smazat</button>' : '');
+    li.querySelectorAll('button').forEach(b => b.addEventListener('click', () => moderateComment(id, c.id, b.dataset.act)));
+    list.appendChild(li);
+  });
+  const form = document.getElementById('comment-form');
+  form.hidden = !data.canPost;
+  form.author.hidden = !data.captcha;
+  document.getElementById('comment-status').textContent = '';
+  if (data.captcha) await newCaptcha();
+  section.hidden = false;
+}
+
+async function newCaptcha() {
+  const res = await fetch(`${API}/captcha`);
+  const label = document.getElementById('comment-captcha');
+  if (!res.ok) return;
+  const c = await res.json();
+  captchaID = c.captcha;
+  label.querySelector('span').textContent = c.question;
+  label.querySelector('input').value = '';
+  label.hidden = false;
+}
+
+async function moderateComment(image, id, act) {
+  const url = `${API}/images/${encodeURIComponent(image)}/comments/${encodeURIComponent(id)}`;
+  const res = await apiFetch(act === 'approve' ? `${url}/approve` : url, { method: act === 'approve' ? 'POST' : 'DELETE' });
+  if (res.ok) loadComments(image);
+}
+
+async function postComment(e) {
+  e.preventDefault();
+  const i = images[current];
+  if (!i) return;
+  const form = e.target;
+  const status = document.getElementById('comment-status');
+  const res = await apiFetch(`${API}/images/${encodeURIComponent(i.id)}/comments`, {
+    method: 'POST',
+    headers: { 'Content-Type': 'application/json' },
+    body: JSON.stringify({ body: form.body.value, author: form.author.value, captcha: captchaID, answer: form.answer.value }),
+  });
+  if (!res.ok) {
+    status.textContent = (await res.json().catch(() => ({}))).error || 'Komentář se nepodařilo odeslat';
+    if (captchaID) newCaptcha();
+    return;
+  }
+  const c = await res.json();
+  form.body.value = '';
+  await loadComments(i.id);
+  if (c.pending) status.textContent = 'Komentář se zobrazí po schválení';
+}
+
+function closeModal() {
+  document.getElementById('modal').setAttribute('aria-hidden', 'true');
+  current = -1;
+}
+
+function prevImage() {
+  if (current > 0) openModal(current - 1);
+}
+
+function nextImage() {
+  if (current >= 0 && current < images.length - 1) openModal(current + 1);
+}
+
+function downloadCurrent() {
+  const i = images[current];
+  if (!i) return;
+  const a = document.createElement('a');
+  // counted as a download, see views.go
+  a.href = `${i.url}${i.url.includes('?') ? '&' : '?'}download=1`;
+  a.download = i.name;
+  a.click();
+}
+
+// Keep the grid in sync with uploads and deletions from other tabs and users
+function watchEvents() {
+  if (!window.EventSource) return;
+  const events = new EventSource(`${API}/events`);
+  const find = id => document.querySelector(`#grid .tile[data-id="${CSS.escape(id)}"]`);
+  const added = e => {
+    const i = JSON.parse(e.data).image;
+    // uploads are listed while still processing; swap in the finished tile
+    const at = images.findIndex(x => x.id === i.id);
+    if (at >= 0) images[at] = i;
+    else images.unshift(i);
+    const old = find(i.id);
+    if (old) old.replaceWith(tile(i));
+    else document.getElementById('grid').prepend(tile(i));
+  };
+  events.addEventListener('image.uploaded', added);
+  events.addEventListener('image.restored', added);
+  events.addEventListener('image.updated', e => {
+    const i = JSON.parse(e.data).image;
+    const at = images.findIndex(x => x.id === i.id);
+    if (at < 0) return;
+    images[at] = i;
+    const old = find(i.id);
+    if (old) old.replaceWith(tile(i));
+    if (current === at) openModal(at);
+  });
+  events.addEventListener('image.deleted', e => {
+    const id = JSON.parse(e.data).image.id;
+    images = images.filter(x => x.id !== id);
+    const t = find(id);
+    if (t) t.remove();
+  });
+}
+
+async function loadPage(cursor) {
+  const params = new URLSearchParams({ limit: PAGE_SIZE });
+  if (cursor) params.set('cursor', cursor);
+  const res = await apiFetch(`${API}/images?${params}`);
+  const page = await res.json();
+  images.push(...(page.images || []));
+  renderTiles(page.images || []);
+  nextCursor = page.nextCursor || null;
+}
+
+async function loadImages() {
+  document.getElementById('grid').innerHTML = '';
+  images = [];
+  await loadPage(null);
+}
+
+async function loadMore() {
+  if (loading || !nextCursor) return;
+  loading = true;
+  try {
+    await loadPage(nextCursor);
+  } finally {
+    loading = false;
+  }
+}
+
+function formatBytes(n) {
+  const units = ['B', 'KB', 'MB', 'GB', 'TB'];
+  let i = 0;
+  while (n >= 1024 && i < units.length - 1) { n /= 1024; i++; }
+  return `${n.toFixed(i ? 1 : 0)} ${units[i]}`;
+}
+
+const uploadPhases = {
+  receiving: 'Nahrávám',
+  checking: 'Kontroluji',
+  processing: 'Zpracovávám',
+  done: 'Hotovo',
+  failed: 'Chyba',
+};
+
+// watchUpload shows the progress of the upload uploadId, as the server
+// reports it, in the upload card until it is done or failed.
+function watchUpload(uploadId, count, name) {
+  const circle = document.getElementById('progress-circle');
+  const text = document.getElementById('progress-text');
+  document.getElementById('upload-fname').textContent = name;
+  return new Promise(resolve => {
+    let misses = 0;
+    const timer = setInterval(async () => {
+      const resp = await fetch(`${API}/uploads/${uploadId}/progress`, {
+        headers: localStorage.getItem('apiKey') ? { 'X-API-Key': localStorage.getItem('apiKey') } : {},
+      });
+      if (!resp.ok) {
+        // not started yet, or gone
+        if (++misses > 20) { clearInterval(timer); resolve(); }
+        return;
+      }
+      const p = await resp.json();
+      const share = p.phase === 'receiving' && p.total > 0 ? p.received / p.total : 1;
+      circle.setAttribute('stroke-dashoffset', String(251.2 * (1 - share)));
+      text.textContent = p.phase === 'receiving' ? `${Math.round(share * 100)}%` : uploadPhases[p.phase];
+      document.getElementById('upload-status').textContent =
+        `${count} • ${formatBytes(p.received)}${p.total > 0 ? ' / ' + formatBytes(p.total) : ''} • ${uploadPhases[p.phase]}`;
+      if (p.phase === 'done' || p.phase === 'failed') {
+        clearInterval(timer);
+        resolve();
+      }
+    }, 500);
   });
 }
 
 document.addEventListener('DOMContentLoaded', ()=> {
   loadImages();
+  watchEvents();
+
+  document.addEventListener('keydown', e => {
+    if (current < 0) return;
+    if (e.key === 'Escape') closeModal();
+    // arrows move the cursor in the comment form
+    else if (e.target.closest('form')) return;
+    else if (e.key === 'ArrowLeft') prevImage();
+    else if (e.key === 'ArrowRight') nextImage();
+  });
+
+  document.getElementById('comment-form').addEventListener('submit', postComment);
+
+  // Load further pages as the user scrolls towards the end of the grid
+  const sentinel = document.createElement('div');
+  document.querySelector('main').appendChild(sentinel);
+  new IntersectionObserver(entries => {
+    if (entries.some(e => e.isIntersecting)) loadMore();
+  }, { rootMargin: '400px' }).observe(sentinel);
+
   const input = document.getElementById('upload');
   if (input) {
     input.addEventListener('change', async (e) => {
       const files = Array.from(e.target.files);
-      for (const f of files) {
+      for (const [i, f] of files.entries()) {
         const fd = new FormData();
         fd.append('file', f);
-        const resp = await fetch(API, { method: 'POST', body: fd });
+        const uploadId = Math.random().toString(36).slice(2) + Date.now().toString(36);
+        const progress = watchUpload(uploadId, `${i + 1} / ${files.length}`, f.name);
+        const resp = await apiFetch(`${API}/images`, { method: 'POST', body: fd, headers: { 'X-Upload-ID': uploadId } });
+        const j = await resp.json();
+        console.log('upload', j);
+        await progress;
+      }
+      await loadImages();
+    });
+
+    // Images pasted from the clipboard, such as screenshots, are uploaded
+    // as JSON, see rawupload.go
+    document.addEventListener('paste', async (e) => {
+      if (e.target.closest('input, textarea')) return;
+      const files = Array.from(e.clipboardData.files).filter(f => f.type.startsWith('image/'));
+      if (!files.length) return;
+      e.preventDefault();
+      for (const f of files) {
+        const data = await new Promise((resolve, reject) => {
+          const reader = new FileReader();
+          reader.onload = () => resolve(reader.result);
+          reader.onerror = () => reject(reader.error);
+          reader.readAsDataURL(f);
+        });
+        const resp = await apiFetch(`${API}/images`, {
+          method: 'POST',
+          headers: { 'Content-Type': 'application/json' },
+          body: JSON.stringify({ name: f.name || 'pasted', data }),
+        });
         const j = await resp.json();
         console.log('upload', j);
       }
@@ -0,0 +1,87 @@
+// static/map.js
+// The map of geotagged images, backed by /api/v1/geo
+// the gallery may be served under a sub-path, see proxy.go
+const BASE = document.querySelector('meta[name="base-path"]')?.content || '';
+const API = `${BASE}/api/v1`;
+
+// apiFetch adds the stored API key (if any) and asks for one when the server
+// rejects the request, like the gallery does.
+async function apiFetch(url, opts = {}) {
+  const send = () => {
+    const headers = new Headers(opts.headers || {});
+    const key = localStorage.getItem('apiKey');
+    if (key) headers.set('X-API-Key', key);
+    return fetch(url, { ...opts, headers });
+  };
+  let res = await send();
+  if (res.status === 401) {
+    const key = prompt('API klíč:');
+    if (key) {
+      localStorage.setItem('apiKey', key);
+      res = await send();
+    }
+  }
+  return res;
+}
+
+function showError(err) {
+  const el = document.getElementById('map-error');
+  el.textContent = err ? err.message : '';
+  el.hidden = !err;
+}
+
+function escapeHTML(s) {
+  const d = document.createElement('div');
+  d.textContent = s;
+  return d.innerHTML;
+}
+
+const map = L.map('map', { worldCopyJump: true }).setView([30, 10], 2);
+L.tileLayer('https://tile.openstreetmap.org/{z}/{x}/{y}.png', {
+  maxZoom: 19,
+  attribution: '&copy; <a href="https://www.openstreetmap.org/copyright">OpenStreetMap</a>',
+}).addTo(map);
+const markers = L.layerGroup().addTo(map);
+
+// clusterIcon is the cluster's image with the number of images on it.
+function clusterIcon(c) {
+  const count = c.count > 1 ? `<span class="map-count">${c.count}</span>` : '';
+  return L.divIcon({
+    className: 'map-cluster',
+    html: `<img src="${escapeHTML(c.image.thumb)}" alt="">${count}`,
+    iconSize: [48, 48],
+  });
+}
+
+let loading = 0;
+async function load() {
+  const seq = ++loading;
+  const center = map.getCenter().lng;
+  const params = new URLSearchParams({ bbox: map.getBounds().toBBoxString(), zoom: map.getZoom() });
+  try {
+    const res = await apiFetch(`${API}/geo?${params}`);
+    const body = await res.json().catch(() => ({}));
+    if (!res.ok) throw new Error(body.error || `Chyba ${res.status}`);
+    if (seq !== loading) return;
+    showError(null);
+    markers.clearLayers();
+    for (const c of body.clusters) {
+      // the server wraps longitudes; put markers on the copy of the world in view
+      const lon = c.lon + 360 * Math.round((center - c.lon) / 360);
+      const marker = L.marker([c.lat, lon], { icon: clusterIcon(c), title: c.image.name });
+      marker.on('click', () => {
+        if (c.count > 1) {
+          map.setView([c.lat, lon], Math.min(map.getZoom() + 2, map.getMaxZoom()));
+        } else {
+          window.open(c.image.url, '_blank', 'noopener');
+        }
+      });
+      markers.addLayer(marker);
+    }
+  } catch (err) {
+    if (seq === loading) showError(err);
+  }
+}
+
+map.on('moveend', load);
+load();
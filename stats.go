@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// GET /api/v1/stats sums up the images the caller can see, for dashboards
+// and capacity planning: how many there are and how large, by format, the
+// uploads of each of the last ?days= days (UTC), the cameras used most,
+// the average size in pixels, and how often they were viewed and
+// downloaded with the most popular of them, see views.go. The listing's
+// filters apply. The admin dashboard has its own, gallery wide figures,
+// see admin.go.
+
+const (
+	defaultStatsDays = 30
+	maxStatsDays     = 366
+	topCameras       = 10
+	topPopular       = 10
+)
+
+type galleryStats struct {
+	Images     usage         `json:"images"`
+	Formats    []formatStats `json:"formats"`
+	Uploads    []dayStats    `json:"uploads"` // oldest first, days without uploads left out
+	Cameras    []cameraStats `json:"cameras"` // most used first
+	Views      int64         `json:"views"`
+	Downloads  int64         `json:"downloads"`
+	Popular    []ImageMeta   `json:"popular"` // most viewed and downloaded first
+	Dimensions struct {
+		Width      float64 `json:"width"`
+		Height     float64 `json:"height"`
+		Megapixels float64 `json:"megapixels"`
+	} `json:"dimensions"` // averages over the images with a known size
+}
+
+type formatStats struct {
+	Mime  string `json:"mime"`
+	Count int64  `json:"count"`
+	Bytes int64  `json:"bytes"`
+}
+
+type dayStats struct {
+	Day   string `json:"day"`
+	Count int64  `json:"count"`
+	Bytes int64  `json:"bytes"`
+}
+
+type cameraStats struct {
+	Camera string `json:"camera"`
+	Count  int64  `json:"count"`
+}
+
+func handleStats(w http.ResponseWriter, r *http.Request) {
+	if apiPreamble(w, r) {
+		return
+	}
+	if r.Method != "GET" {
+		writeJSONError(w, "Unsupported method", http.StatusMethodNotAllowed)
+		return
+	}
+	v := r.URL.Query()
+	days, err := queryInt(v.Get("days"), defaultStatsDays, maxStatsDays)
+	if err != nil {
+		writeJSONError(w, "Invalid days", http.StatusBadRequest)
+		return
+	}
+	var q listQuery
+	if err := parseListFilters(v, &q); err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	p, authenticated := resolvePrincipal(r)
+	q.Owner = p.ownerFilter()
+	q.HideProtected = !authenticated
+	q.Rater = p.UserID
+
+	s, err := imageStats(q, days)
+	if err != nil {
+		writeJSONError(w, "Could not gather stats", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(s)
+}
+
+func imageStats(q listQuery, days int) (galleryStats, error) {
+	s := galleryStats{Formats: []formatStats{}, Uploads: []dayStats{}, Cameras: []cameraStats{}, Popular: []ImageMeta{}}
+	conds, args := q.filters()
+	where := whereClause(conds)
+
+	err := db.QueryRow(`SELECT COUNT(*), COALESCE(SUM(size), 0) FROM images`+where, args...).Scan(&s.Images.Count, &s.Images.Bytes)
+	if err != nil {
+		return s, err
+	}
+	err = db.QueryRow(`SELECT COALESCE(AVG(width), 0), COALESCE(AVG(height), 0), COALESCE(AVG(width * height), 0) / 1e6
+		FROM images`+where+` AND width > 0 AND height > 0`, args...).
+		Scan(&s.Dimensions.Width, &s.Dimensions.Height, &s.Dimensions.Megapixels)
+	if err != nil {
+		return s, err
+	}
+
+	err = db.QueryRow(`SELECT COALESCE(SUM(views), 0), COALESCE(SUM(downloads), 0) FROM image_views
+		WHERE image_id IN (SELECT id FROM images`+where+`)`, args...).Scan(&s.Views, &s.Downloads)
+	if err != nil {
+		return s, err
+	}
+	top := q
+	top.Limit, top.Sort, top.Desc = topPopular, "popular", true
+	popular, err := listImages(top)
+	if err != nil {
+		return s, err
+	}
+	for _, meta := range popular.Images {
+		if meta.Views+meta.Downloads > 0 {
+			s.Popular = append(s.Popular, meta)
+		}
+	}
+
+	rows, err := db.Query(`SELECT mime, COUNT(*), COALESCE(SUM(size), 0) FROM images`+where+`
+		GROUP BY mime ORDER BY COUNT(*) DESC, mime`, args...)
+	if err != nil {
+		return s, err
+	}
+	for rows.Next() {
+		var f formatStats
+		if err := rows.Scan(&f.Mime, &f.Count, &f.Bytes); err != nil {
+			rows.Close()
+			return s, err
+		}
+		s.Formats = append(s.Formats, f)
+	}
+	rows.Close()
+
+	since := time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, 1-days)
+	rows, err = db.Query(`SELECT strftime('%Y-%m-%d', uploaded_at / 1000000000, 'unixepoch') AS day, COUNT(*), COALESCE(SUM(size), 0)
+		FROM images`+where+` AND uploaded_at >= ? GROUP BY day ORDER BY day`, append(args, since.UnixNano())...)
+	if err != nil {
+		return s, err
+	}
+	for rows.Next() {
+		var d dayStats
+		if err := rows.Scan(&d.Day, &d.Count, &d.Bytes); err != nil {
+			rows.Close()
+			return s, err
+		}
+		s.Uploads = append(s.Uploads, d)
+	}
+	rows.Close()
+
+	rows, err = db.Query(`SELECT camera, COUNT(*) FROM images`+where+` AND camera != ''
+		GROUP BY camera COLLATE NOCASE ORDER BY COUNT(*) DESC, camera LIMIT ?`, append(args, topCameras)...)
+	if err != nil {
+		return s, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c cameraStats
+		if err := rows.Scan(&c.Camera, &c.Count); err != nil {
+			return s, err
+		}
+		s.Cameras = append(s.Cameras, c)
+	}
+	return s, rows.Err()
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// Storage is where original images live. Names are the flat file names
+// produced by uniqueFileName; missing objects are reported as fs.ErrNotExist.
+type Storage interface {
+	Put(ctx context.Context, name string, r io.Reader, size int64, contentType string) error
+	Open(ctx context.Context, name string) (io.ReadSeekCloser, ObjectInfo, error)
+	Stat(ctx context.Context, name string) (ObjectInfo, error)
+	Delete(ctx context.Context, name string) error
+	List(ctx context.Context) ([]ObjectInfo, error)
+}
+
+type ObjectInfo struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// fileMover is implemented by backends that can adopt a local file without
+// copying it, e.g. by renaming it into place.
+type fileMover interface {
+	MoveIn(localPath, name string) error
+}
+
+// spaceReporter is implemented by backends with a bounded local capacity.
+type spaceReporter interface {
+	FreeSpace() (uint64, error)
+}
+
+var storage Storage
+
+func newStorage(c Config) (Storage, error) {
+	switch c.Storage {
+	case "", "local":
+		return newLocalStorage(c.UploadDir)
+	case "s3":
+		return newS3Storage(c)
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", c.Storage)
+	}
+}
+
+// isMediaName reports whether name is an image or video of the gallery, as
+// opposed to the index, scratch files and the like.
+func isMediaName(name string) bool {
+	_, ok := formatOf(name)
+	return ok && !strings.HasPrefix(name, ".")
+}
+
+// storeLocalFile hands a finished local file over to storage, removing the
+// local copy afterwards.
+func storeLocalFile(ctx context.Context, localPath, name, contentType string) error {
+	if m, ok := baseStorage().(fileMover); ok {
+		return m.MoveIn(localPath, name)
+	}
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(localPath)
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return storage.Put(ctx, name, f, info.Size(), contentType)
+}
+
+// localStorage keeps originals as plain files, spread over two levels of
+// subdirectories by the SHA-256 of their name: uploads/ab/cd/<name>. A flat
+// directory with 100k files makes listing and backups crawl. The layout is
+// not content-addressed: names are the image ids of URLs and the index,
+// and identical uploads are linked by deduplication already (see ingest).
+type localStorage struct {
+	dir string
+}
+
+var shardRegex = regexp.MustCompile(`^[0-9a-f]{2}$`)
+
+// newLocalStorage opens the upload directory, moving files left there by
+// the old flat layout into their shards.
+func newLocalStorage(dir string) (Storage, error) {
+	l := localStorage{dir: dir}
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	moved := 0
+	for _, e := range entries {
+		// the index, sessions and other scratch files stay where they are
+		if !e.Type().IsRegular() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		if err := l.MoveIn(filepath.Join(dir, e.Name()), e.Name()); err != nil {
+			return nil, fmt.Errorf("move %s into its shard: %w", e.Name(), err)
+		}
+		moved++
+	}
+	if moved > 0 {
+		slog.Info("Moved files to the sharded layout", "files", moved)
+	}
+	return l, nil
+}
+
+func shardDir(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	h := hex.EncodeToString(sum[:2])
+	return filepath.Join(h[:2], h[2:])
+}
+
+func (l localStorage) path(name string) string {
+	name = filepath.Base(name)
+	if p, ok := sourcePath(name); ok {
+		return p
+	}
+	return filepath.Join(l.dir, shardDir(name), name)
+}
+
+// Put writes to a temp file next to the final one and renames it into
+// place once complete, so a failed copy never shows up as a truncated
+// image, nor destroys the file it was to replace.
+func (l localStorage) Put(ctx context.Context, name string, r io.Reader, size int64, contentType string) error {
+	if isSourceFile(name) {
+		return errSourceFile
+	}
+	p := l.path(name)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(p), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, r)
+	if err == nil && size >= 0 && n != size {
+		err = fmt.Errorf("wrote %d of %d bytes", n, size)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), p)
+}
+
+func (l localStorage) Open(ctx context.Context, name string) (io.ReadSeekCloser, ObjectInfo, error) {
+	f, err := os.Open(l.path(name))
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, ObjectInfo{}, err
+	}
+	return f, ObjectInfo{Name: name, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (l localStorage) Stat(ctx context.Context, name string) (ObjectInfo, error) {
+	info, err := os.Stat(l.path(name))
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{Name: name, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (l localStorage) Delete(ctx context.Context, name string) error {
+	if isSourceFile(name) {
+		return errSourceFile
+	}
+	return os.Remove(l.path(name))
+}
+
+func (l localStorage) List(ctx context.Context) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	for _, a := range shards(l.dir) {
+		for _, b := range shards(filepath.Join(l.dir, a)) {
+			entries, err := os.ReadDir(filepath.Join(l.dir, a, b))
+			if err != nil {
+				return nil, err
+			}
+			for _, e := range entries {
+				// dot files are writes still in progress
+				if e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+					continue
+				}
+				info, err := e.Info()
+				if err != nil {
+					continue
+				}
+				objects = append(objects, ObjectInfo{Name: e.Name(), Size: info.Size(), ModTime: info.ModTime()})
+			}
+		}
+	}
+	if len(cfg.SourceDirs) > 0 {
+		objects = append(objects, scanSources()...)
+	}
+	return objects, nil
+}
+
+// shards lists the shard directories in dir.
+func shards(dir string) []string {
+	entries, _ := os.ReadDir(dir)
+	var names []string
+	for _, e := range entries {
+		if e.IsDir() && shardRegex.MatchString(e.Name()) {
+			names = append(names, e.Name())
+		}
+	}
+	return names
+}
+
+// removeStaleTemps deletes temp files of writes that were cut short, e.g.
+// by a crash, and are older than age.
+func (l localStorage) removeStaleTemps(age time.Duration) int {
+	removed := 0
+	for _, a := range shards(l.dir) {
+		for _, b := range shards(filepath.Join(l.dir, a)) {
+			dir := filepath.Join(l.dir, a, b)
+			entries, _ := os.ReadDir(dir)
+			for _, e := range entries {
+				info, err := e.Info()
+				if err != nil || !strings.HasPrefix(e.Name(), ".tmp-") || time.Since(info.ModTime()) < age {
+					continue
+				}
+				if os.Remove(filepath.Join(dir, e.Name())) == nil {
+					removed++
+				}
+			}
+		}
+	}
+	return removed
+}
+
+func (l localStorage) MoveIn(localPath, name string) error {
+	if isSourceFile(name) {
+		return errSourceFile
+	}
+	p := l.path(name)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	return os.Rename(localPath, p)
+}
+
+func (l localStorage) FreeSpace() (uint64, error) {
+	return freeSpace(l.dir)
+}
+
+// s3Storage keeps originals in an S3 compatible bucket (AWS, MinIO, ...),
+// flat under the prefix: buckets list by page and do not slow down with
+// many keys, so they are not sharded.
+type s3Storage struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+func newS3Storage(c Config) (Storage, error) {
+	if c.S3Endpoint == "" || c.S3Bucket == "" {
+		return nil, errors.New("s3 storage needs s3-endpoint and s3-bucket")
+	}
+	client, err := newS3Client(c)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	ok, err := client.BucketExists(ctx, c.S3Bucket)
+	if err != nil {
+		return nil, fmt.Errorf("s3: %w", err)
+	}
+	if !ok {
+		return nil, fmt.Errorf("s3: bucket %q does not exist", c.S3Bucket)
+	}
+
+	prefix := strings.Trim(c.S3Prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return s3Storage{client: client, bucket: c.S3Bucket, prefix: prefix}, nil
+}
+
+// newS3Client connects to the S3 endpoint of c; backups use it too.
+func newS3Client(c Config) (*minio.Client, error) {
+	return minio.New(c.S3Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(c.S3AccessKey, c.S3SecretKey, ""),
+		Secure: c.S3UseSSL,
+		Region: c.S3Region,
+	})
+}
+
+// s3Err maps "no such key" responses onto fs.ErrNotExist.
+func s3Err(err error) error {
+	if err != nil && minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return fmt.Errorf("%w: %v", fs.ErrNotExist, err)
+	}
+	return err
+}
+
+func (s s3Storage) Put(ctx context.Context, name string, r io.Reader, size int64, contentType string) error {
+	_, err := s.client.PutObject(ctx, s.bucket, s.prefix+name, r, size, minio.PutObjectOptions{ContentType: contentType})
+	return err
+}
+
+func (s s3Storage) Open(ctx context.Context, name string) (io.ReadSeekCloser, ObjectInfo, error) {
+	obj, err := s.client.GetObject(ctx, s.bucket, s.prefix+name, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, ObjectInfo{}, s3Err(err)
+	}
+	st, err := obj.Stat()
+	if err != nil {
+		obj.Close()
+		return nil, ObjectInfo{}, s3Err(err)
+	}
+	return obj, ObjectInfo{Name: name, Size: st.Size, ModTime: st.LastModified}, nil
+}
+
+func (s s3Storage) Stat(ctx context.Context, name string) (ObjectInfo, error) {
+	st, err := s.client.StatObject(ctx, s.bucket, s.prefix+name, minio.StatObjectOptions{})
+	if err != nil {
+		return ObjectInfo{}, s3Err(err)
+	}
+	return ObjectInfo{Name: name, Size: st.Size, ModTime: st.LastModified}, nil
+}
+
+func (s s3Storage) Delete(ctx context.Context, name string) error {
+	return s.client.RemoveObject(ctx, s.bucket, s.prefix+name, minio.RemoveObjectOptions{})
+}
+
+func (s s3Storage) List(ctx context.Context) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	for obj := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: s.prefix}) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		name := strings.TrimPrefix(obj.Key, s.prefix)
+		if name == "" || strings.Contains(name, "/") {
+			continue
+		}
+		objects = append(objects, ObjectInfo{Name: name, Size: obj.Size, ModTime: obj.LastModified})
+	}
+	return objects, nil
+}
@@ -0,0 +1,781 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// db is the metadata index. By default it lives next to the uploads (hidden
+// from the file server) so it survives on the same volume as the images.
+var db *sql.DB
+
+// migrations are applied in order; the index of the last applied entry is
+// kept in PRAGMA user_version. Only ever append to this list.
+var migrations = []string{
+	`CREATE TABLE images (
+		id          TEXT PRIMARY KEY,
+		name        TEXT NOT NULL,
+		size        INTEGER NOT NULL,
+		mime        TEXT NOT NULL,
+		width       INTEGER NOT NULL DEFAULT 0,
+		height      INTEGER NOT NULL DEFAULT 0,
+		exif        TEXT NOT NULL DEFAULT '',
+		mod_time    INTEGER NOT NULL,
+		uploaded_at INTEGER NOT NULL
+	)`,
+	`CREATE TABLE albums (
+		id         TEXT PRIMARY KEY,
+		name       TEXT NOT NULL,
+		created_at INTEGER NOT NULL
+	);
+	CREATE TABLE album_images (
+		album_id TEXT NOT NULL REFERENCES albums(id) ON DELETE CASCADE,
+		image_id TEXT NOT NULL REFERENCES images(id) ON DELETE CASCADE,
+		added_at INTEGER NOT NULL,
+		PRIMARY KEY (album_id, image_id)
+	);
+	CREATE INDEX album_images_image ON album_images(image_id)`,
+	`CREATE TABLE image_tags (
+		image_id TEXT NOT NULL REFERENCES images(id) ON DELETE CASCADE,
+		tag      TEXT NOT NULL,
+		PRIMARY KEY (image_id, tag)
+	);
+	CREATE INDEX image_tags_tag ON image_tags(tag)`,
+	`CREATE TABLE users (
+		id            TEXT PRIMARY KEY,
+		username      TEXT NOT NULL UNIQUE,
+		password_hash TEXT NOT NULL,
+		role          TEXT NOT NULL,
+		created_at    INTEGER NOT NULL
+	);
+	CREATE TABLE user_sessions (
+		token_hash TEXT PRIMARY KEY,
+		user_id    TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		expires_at INTEGER NOT NULL
+	);
+	ALTER TABLE images ADD COLUMN owner_id TEXT NOT NULL DEFAULT '';
+	ALTER TABLE albums ADD COLUMN owner_id TEXT NOT NULL DEFAULT '';
+	CREATE INDEX images_owner ON images(owner_id)`,
+	`ALTER TABLE images ADD COLUMN sha256 TEXT NOT NULL DEFAULT '';
+	CREATE INDEX images_sha256 ON images(sha256)`,
+	// reindex everything once to pick up capture times
+	`ALTER TABLE images ADD COLUMN taken_at INTEGER NOT NULL DEFAULT 0;
+	UPDATE images SET mod_time = 0`,
+	`ALTER TABLE images ADD COLUMN deleted_at INTEGER NOT NULL DEFAULT 0;
+	CREATE INDEX images_deleted ON images(deleted_at)`,
+	`CREATE TABLE shares (
+		token_hash    TEXT PRIMARY KEY,
+		image_id      TEXT NOT NULL REFERENCES images(id) ON DELETE CASCADE,
+		expires_at    INTEGER NOT NULL DEFAULT 0,
+		max_downloads INTEGER NOT NULL DEFAULT 0,
+		downloads     INTEGER NOT NULL DEFAULT 0,
+		created_at    INTEGER NOT NULL
+	)`,
+	`ALTER TABLE albums ADD COLUMN password_hash TEXT NOT NULL DEFAULT '';
+	CREATE TABLE album_access (
+		token_hash TEXT PRIMARY KEY,
+		album_id   TEXT NOT NULL REFERENCES albums(id) ON DELETE CASCADE,
+		expires_at INTEGER NOT NULL
+	)`,
+	// reindex to report rotated photos with their displayed size
+	`UPDATE images SET mod_time = 0`,
+	// reindex to compute placeholders
+	`ALTER TABLE images ADD COLUMN blurhash TEXT NOT NULL DEFAULT '';
+	UPDATE images SET mod_time = 0`,
+	// and colors, comma separated
+	`ALTER TABLE images ADD COLUMN palette TEXT NOT NULL DEFAULT '';
+	UPDATE images SET mod_time = 0`,
+	`CREATE TABLE jobs (
+		id         TEXT PRIMARY KEY,
+		kind       TEXT NOT NULL,
+		image_id   TEXT NOT NULL DEFAULT '',
+		owner_id   TEXT NOT NULL DEFAULT '',
+		payload    TEXT NOT NULL DEFAULT '',
+		status     TEXT NOT NULL,
+		attempts   INTEGER NOT NULL DEFAULT 0,
+		error      TEXT NOT NULL DEFAULT '',
+		run_at     INTEGER NOT NULL,
+		created_at INTEGER NOT NULL,
+		updated_at INTEGER NOT NULL
+	);
+	CREATE INDEX jobs_due ON jobs(status, run_at);
+	CREATE INDEX jobs_image ON jobs(image_id);
+	ALTER TABLE images ADD COLUMN processing INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE users ADD COLUMN banned_at INTEGER NOT NULL DEFAULT 0`,
+	`CREATE TABLE retention_log (
+		id        INTEGER PRIMARY KEY AUTOINCREMENT,
+		at        INTEGER NOT NULL,
+		rule      TEXT NOT NULL,
+		image_id  TEXT NOT NULL,
+		name      TEXT NOT NULL,
+		owner_id  TEXT NOT NULL DEFAULT '',
+		size      INTEGER NOT NULL,
+		dry_run   INTEGER NOT NULL,
+		permanent INTEGER NOT NULL
+	)`,
+	// index_state counts the changes to what the listing shows, for its
+	// ETag; changed_at is in seconds, like Last-Modified
+	`CREATE TABLE index_state (
+		id         INTEGER PRIMARY KEY CHECK (id = 1),
+		version    INTEGER NOT NULL,
+		changed_at INTEGER NOT NULL
+	);
+	INSERT INTO index_state VALUES (1, 1, CAST(strftime('%s', 'now') AS INTEGER));
+	CREATE TRIGGER images_insert_version AFTER INSERT ON images BEGIN ` + bumpIndexVersion + ` END;
+	CREATE TRIGGER images_update_version AFTER UPDATE ON images BEGIN ` + bumpIndexVersion + ` END;
+	CREATE TRIGGER images_delete_version AFTER DELETE ON images BEGIN ` + bumpIndexVersion + ` END;
+	CREATE TRIGGER image_tags_insert_version AFTER INSERT ON image_tags BEGIN ` + bumpIndexVersion + ` END;
+	CREATE TRIGGER image_tags_delete_version AFTER DELETE ON image_tags BEGIN ` + bumpIndexVersion + ` END;
+	CREATE TRIGGER album_images_insert_version AFTER INSERT ON album_images BEGIN ` + bumpIndexVersion + ` END;
+	CREATE TRIGGER album_images_delete_version AFTER DELETE ON album_images BEGIN ` + bumpIndexVersion + ` END;
+	CREATE TRIGGER albums_password_version AFTER UPDATE OF password_hash ON albums BEGIN ` + bumpIndexVersion + ` END`,
+	`CREATE TABLE upload_links (
+		id          TEXT PRIMARY KEY,
+		token_hash  TEXT NOT NULL UNIQUE,
+		album_id    TEXT NOT NULL REFERENCES albums(id) ON DELETE CASCADE,
+		expires_at  INTEGER NOT NULL DEFAULT 0,
+		max_uploads INTEGER NOT NULL DEFAULT 0,
+		max_bytes   INTEGER NOT NULL DEFAULT 0,
+		uploads     INTEGER NOT NULL DEFAULT 0,
+		created_at  INTEGER NOT NULL
+	)`,
+	`ALTER TABLE images ADD COLUMN pending INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE images ADD COLUMN scan TEXT NOT NULL DEFAULT '';
+	ALTER TABLE images ADD COLUMN flagged INTEGER NOT NULL DEFAULT 0`,
+	// reindex to find focus points, "x,y"
+	`ALTER TABLE images ADD COLUMN focus TEXT NOT NULL DEFAULT '';
+	UPDATE images SET mod_time = 0`,
+	`ALTER TABLE albums ADD COLUMN watermark INTEGER NOT NULL DEFAULT 0;
+	CREATE TRIGGER albums_watermark_version AFTER UPDATE OF watermark ON albums BEGIN ` + bumpIndexVersion + ` END`,
+	// reindex to fill the EXIF columns the listing filters on
+	`ALTER TABLE images ADD COLUMN camera TEXT NOT NULL DEFAULT '';
+	ALTER TABLE images ADD COLUMN lens TEXT NOT NULL DEFAULT '';
+	ALTER TABLE images ADD COLUMN iso INTEGER NOT NULL DEFAULT 0;
+	CREATE INDEX images_camera ON images(camera COLLATE NOCASE);
+	CREATE INDEX images_lens ON images(lens COLLATE NOCASE);
+	CREATE INDEX images_iso ON images(iso);
+	CREATE INDEX images_taken ON images(taken_at);
+	UPDATE images SET mod_time = 0`,
+	// reindex for positions on the map, see geo.go; NULL without GPS
+	`ALTER TABLE images ADD COLUMN lat REAL;
+	ALTER TABLE images ADD COLUMN lon REAL;
+	CREATE INDEX images_position ON images(lat, lon);
+	UPDATE images SET mod_time = 0`,
+	// places of the positions, see geocode.go
+	`ALTER TABLE images ADD COLUMN country TEXT NOT NULL DEFAULT '';
+	ALTER TABLE images ADD COLUMN country_code TEXT NOT NULL DEFAULT '';
+	ALTER TABLE images ADD COLUMN city TEXT NOT NULL DEFAULT '';
+	ALTER TABLE images ADD COLUMN geocoded INTEGER NOT NULL DEFAULT 0;
+	CREATE INDEX images_country ON images(country COLLATE NOCASE);
+	CREATE INDEX images_country_code ON images(country_code);
+	CREATE INDEX images_city ON images(city COLLATE NOCASE)`,
+	// reindex for perceptual hashes, see phash.go
+	`ALTER TABLE images ADD COLUMN phash TEXT NOT NULL DEFAULT '';
+	UPDATE images SET mod_time = 0`,
+	// full-text search, see search.go
+	`CREATE TABLE image_search (
+		doc      INTEGER PRIMARY KEY,
+		image_id TEXT NOT NULL UNIQUE
+	);
+	INSERT INTO image_search (image_id) SELECT id FROM images;
+	` + searchIndex(searchColumnsV1, searchDocsV1, searchWatchedV1),
+	// titles, descriptions and alt text, see captions.go; the search index
+	// is rebuilt to take them in
+	`ALTER TABLE images ADD COLUMN title TEXT NOT NULL DEFAULT '';
+	ALTER TABLE images ADD COLUMN description TEXT NOT NULL DEFAULT '';
+	ALTER TABLE images ADD COLUMN alt TEXT NOT NULL DEFAULT '';
+	DROP TRIGGER images_search_insert;
+	DROP TRIGGER images_search_update;
+	DROP TRIGGER images_search_delete;
+	DROP TRIGGER image_tags_search_insert;
+	DROP TRIGGER image_tags_search_delete;
+	DROP TABLE images_fts;
+	` + searchIndex(searchColumnsV2, searchDocsV2, searchWatched),
+	// custom fields, see fields.go; the search index is rebuilt to take them in
+	`CREATE TABLE image_fields (
+		image_id TEXT NOT NULL REFERENCES images(id) ON DELETE CASCADE,
+		key      TEXT NOT NULL,
+		value    TEXT NOT NULL,
+		PRIMARY KEY (image_id, key)
+	);
+	CREATE INDEX image_fields_key ON image_fields(key, value COLLATE NOCASE);
+	CREATE TRIGGER image_fields_insert_version AFTER INSERT ON image_fields BEGIN ` + bumpIndexVersion + ` END;
+	CREATE TRIGGER image_fields_update_version AFTER UPDATE ON image_fields BEGIN ` + bumpIndexVersion + ` END;
+	CREATE TRIGGER image_fields_delete_version AFTER DELETE ON image_fields BEGIN ` + bumpIndexVersion + ` END;
+	DROP TRIGGER images_search_insert;
+	DROP TRIGGER images_search_update;
+	DROP TRIGGER images_search_delete;
+	DROP TRIGGER image_tags_search_insert;
+	DROP TRIGGER image_tags_search_delete;
+	DROP TABLE images_fts;
+	` + searchIndex(searchColumns, searchDocs, searchWatched) + `;
+	CREATE TRIGGER image_fields_search_insert AFTER INSERT ON image_fields BEGIN
+		` + searchRefresh(searchColumns, searchDocs, "new.image_id") + `
+	END;
+	CREATE TRIGGER image_fields_search_update AFTER UPDATE ON image_fields BEGIN
+		` + searchRefresh(searchColumns, searchDocs, "new.image_id") + `
+	END;
+	CREATE TRIGGER image_fields_search_delete AFTER DELETE ON image_fields BEGIN
+		` + searchRefresh(searchColumns, searchDocs, "old.image_id") + `
+	END`,
+	// favorites and ratings of each user, see ratings.go
+	`CREATE TABLE image_ratings (
+		user_id  TEXT NOT NULL,
+		image_id TEXT NOT NULL REFERENCES images(id) ON DELETE CASCADE,
+		favorite INTEGER NOT NULL DEFAULT 0,
+		rating   INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (user_id, image_id)
+	);
+	CREATE INDEX image_ratings_image ON image_ratings(image_id);
+	CREATE TRIGGER image_ratings_insert_version AFTER INSERT ON image_ratings BEGIN ` + bumpIndexVersion + ` END;
+	CREATE TRIGGER image_ratings_update_version AFTER UPDATE ON image_ratings BEGIN ` + bumpIndexVersion + ` END;
+	CREATE TRIGGER image_ratings_delete_version AFTER DELETE ON image_ratings BEGIN ` + bumpIndexVersion + ` END`,
+	// view and download counts, see views.go; no version bump
+	`CREATE TABLE image_views (
+		image_id  TEXT PRIMARY KEY REFERENCES images(id) ON DELETE CASCADE,
+		views     INTEGER NOT NULL DEFAULT 0,
+		downloads INTEGER NOT NULL DEFAULT 0
+	)`,
+	// comments, see comments.go
+	`CREATE TABLE comments (
+		id         TEXT PRIMARY KEY,
+		image_id   TEXT NOT NULL REFERENCES images(id) ON DELETE CASCADE,
+		user_id    TEXT NOT NULL DEFAULT '',
+		author     TEXT NOT NULL,
+		body       TEXT NOT NULL,
+		pending    INTEGER NOT NULL DEFAULT 0,
+		created_at INTEGER NOT NULL
+	);
+	CREATE INDEX comments_image ON comments(image_id, created_at)`,
+	// deletion links of screenshot uploads, see sharex.go
+	`CREATE TABLE deletion_tokens (
+		token_hash TEXT PRIMARY KEY,
+		image_id   TEXT NOT NULL REFERENCES images(id) ON DELETE CASCADE,
+		created_at INTEGER NOT NULL
+	);
+	CREATE INDEX deletion_tokens_image ON deletion_tokens(image_id)`,
+	// responses kept for Idempotency-Key retries, see idempotency.go
+	`CREATE TABLE idempotency_keys (
+		owner        TEXT NOT NULL,
+		key          TEXT NOT NULL,
+		request      TEXT NOT NULL,
+		status       INTEGER NOT NULL DEFAULT 0,
+		content_type TEXT NOT NULL DEFAULT '',
+		body         BLOB,
+		created_at   INTEGER NOT NULL,
+		PRIMARY KEY (owner, key)
+	);
+	CREATE INDEX idempotency_keys_created ON idempotency_keys(created_at)`,
+	// albums mirroring a folder of a source directory, see sources.go
+	`ALTER TABLE albums ADD COLUMN source TEXT NOT NULL DEFAULT ''`,
+}
+
+const bumpIndexVersion = `UPDATE index_state SET version = version + 1, changed_at = CAST(strftime('%s', 'now') AS INTEGER);`
+
+func openStore(path string) error {
+	var err error
+	db, err = sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=foreign_keys(1)")
+	if err != nil {
+		return err
+	}
+
+	var version int
+	if err := db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		return err
+	}
+	for i := version; i < len(migrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(migrations[i]); err != nil {
+			tx.Rollback()
+			return err
+		}
+		// PRAGMA does not accept bound parameters
+		if _, err := tx.Exec(`PRAGMA user_version = ` + strconv.Itoa(i+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncStore brings the index in line with storage: new or changed files
+// are (re)indexed and rows for vanished files are dropped.
+func syncStore() error {
+	known := map[string]int64{}
+	// uploads still being processed are left to their jobs
+	processing := map[string]bool{}
+	// Rows without a content hash predate deduplication; treat them as
+	// changed so they get one
+	rows, err := db.Query(`SELECT id, CASE WHEN sha256 = '' THEN 0 ELSE mod_time END, processing FROM images`)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var id string
+		var mod int64
+		var busy bool
+		if err := rows.Scan(&id, &mod, &busy); err != nil {
+			rows.Close()
+			return err
+		}
+		if busy {
+			processing[id] = true
+		} else {
+			known[id] = mod
+		}
+	}
+	rows.Close()
+
+	objects, err := storage.List(context.Background())
+	if err != nil {
+		return err
+	}
+
+	added := 0
+	for _, obj := range objects {
+		img := obj.Name
+		if !isMediaName(img) || processing[img] {
+			continue
+		}
+		mod, ok := known[img]
+		delete(known, img)
+		if ok && mod == obj.ModTime.UnixNano() {
+			continue
+		}
+		if _, err := indexImage(context.Background(), img, obj.ModTime, ""); err != nil {
+			slog.Warn("Could not index image", "image", img, "err", err)
+			continue
+		}
+		added++
+	}
+
+	for id := range known {
+		deleteImage(id)
+	}
+	if len(cfg.SourceDirs) > 0 {
+		if err := syncSourceAlbums(); err != nil {
+			return err
+		}
+	}
+	slog.Info("Index synced", "updated", added, "removed", len(known))
+	return nil
+}
+
+// indexImage reads the metadata of a stored file and records it. uploaded is
+// only used when the image is not indexed yet. sum is the SHA-256 of the
+// content; when empty it is computed from storage.
+func indexImage(ctx context.Context, img string, uploaded time.Time, sum string) (ImageMeta, error) {
+	meta, info, err := readImageMeta(ctx, img)
+	if err != nil {
+		return meta, err
+	}
+	if sum == "" {
+		if sum, err = hashStored(img); err != nil {
+			return meta, err
+		}
+	}
+
+	exifJSON := ""
+	if len(meta.Exif) > 0 {
+		b, _ := json.Marshal(meta.Exif)
+		exifJSON = string(b)
+	}
+	var taken int64
+	if meta.Taken != nil {
+		taken = meta.Taken.UnixNano()
+	}
+	indexColors(&meta)
+	focus := ""
+	if len(meta.Focus) == 2 {
+		focus = formatFocus(meta.Focus[0], meta.Focus[1])
+	}
+	iso, _ := strconv.Atoi(meta.Exif["ISO"])
+	lat, lon := exifPosition(meta)
+	_, err = db.Exec(`INSERT INTO images (id, name, size, mime, width, height, exif, camera, lens, iso, lat, lon, sha256, taken_at, blurhash, palette, focus, phash, mod_time, uploaded_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(id) DO UPDATE SET name = excluded.name, size = excluded.size, mime = excluded.mime,
+			width = excluded.width, height = excluded.height, exif = excluded.exif,
+			camera = excluded.camera, lens = excluded.lens, iso = excluded.iso, lat = excluded.lat, lon = excluded.lon, sha256 = excluded.sha256,
+			geocoded = CASE WHEN lat IS excluded.lat AND lon IS excluded.lon THEN geocoded ELSE 0 END,
+			country = CASE WHEN lat IS excluded.lat AND lon IS excluded.lon THEN country ELSE '' END,
+			country_code = CASE WHEN lat IS excluded.lat AND lon IS excluded.lon THEN country_code ELSE '' END,
+			city = CASE WHEN lat IS excluded.lat AND lon IS excluded.lon THEN city ELSE '' END,
+			taken_at = excluded.taken_at, blurhash = excluded.blurhash, palette = excluded.palette, focus = excluded.focus, phash = excluded.phash,
+			mod_time = excluded.mod_time`,
+		meta.ID, meta.Name, meta.Size, meta.Mime, meta.Width, meta.Height, exifJSON,
+		exifText(meta.Exif["CameraModel"]), exifText(meta.Exif["LensModel"]), iso, lat, lon, sum, taken, meta.Blurhash,
+		strings.Join(meta.Palette, ","), focus, meta.PHash, info.ModTime.UnixNano(), uploaded.UnixNano())
+	if err != nil {
+		return meta, err
+	}
+	return getImage(img)
+}
+
+// exifText is an EXIF string without the padding cameras leave in it.
+func exifText(s string) string {
+	return strings.TrimSpace(strings.TrimRight(s, "\x00"))
+}
+
+const imageColumns = `id, name, size, mime, width, height, exif, taken_at, uploaded_at, deleted_at, owner_id, sha256, blurhash, palette, focus, phash, title, description, alt, country, country_code, city, processing, pending, scan, flagged,
+	(SELECT json_group_array(tag) FROM (SELECT tag FROM image_tags t WHERE t.image_id = images.id ORDER BY tag)),
+	(SELECT json_group_object(key, value) FROM image_fields f WHERE f.image_id = images.id),
+	COALESCE((SELECT views FROM image_views v WHERE v.image_id = images.id), 0),
+	COALESCE((SELECT downloads FROM image_views v WHERE v.image_id = images.id), 0),
+	EXISTS (SELECT 1 FROM album_images ai JOIN albums a ON a.id = ai.album_id WHERE ai.image_id = images.id AND a.watermark = 1)`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanImageRow(row rowScanner) (ImageMeta, error) {
+	var meta ImageMeta
+	var exifJSON, paletteList, focus, scanJSON, tagsJSON, fieldsJSON string
+	var place Place
+	var taken, uploaded, deleted int64
+	err := row.Scan(&meta.ID, &meta.Name, &meta.Size, &meta.Mime, &meta.Width, &meta.Height, &exifJSON, &taken, &uploaded, &deleted, &meta.Owner, &meta.SHA256, &meta.Blurhash, &paletteList, &focus, &meta.PHash,
+		&meta.Title, &meta.Description, &meta.Alt, &place.Country, &place.CountryCode, &place.City, &meta.Processing, &meta.Pending, &scanJSON, &meta.Flagged, &tagsJSON, &fieldsJSON,
+		&meta.Views, &meta.Downloads, &meta.Watermarked)
+	if err != nil {
+		return meta, err
+	}
+	if paletteList != "" {
+		meta.Palette = strings.Split(paletteList, ",")
+		meta.Color = meta.Palette[0]
+	}
+	meta.Focus = parseFocus(focus)
+	meta.Place = placeOf(place)
+	if exifJSON != "" {
+		json.Unmarshal([]byte(exifJSON), &meta.Exif)
+	}
+	if scanJSON != "" {
+		json.Unmarshal([]byte(scanJSON), &meta.Scan)
+	}
+	json.Unmarshal([]byte(tagsJSON), &meta.Tags)
+	if fieldsJSON != "{}" {
+		json.Unmarshal([]byte(fieldsJSON), &meta.Fields)
+	}
+	meta.Uploaded = time.Unix(0, uploaded).UTC()
+	if taken != 0 {
+		t := time.Unix(0, taken).UTC()
+		meta.Taken = &t
+	}
+	if deleted != 0 {
+		t := time.Unix(0, deleted).UTC()
+		meta.Deleted = &t
+	}
+	// only a configured watermark is drawn
+	meta.Watermarked = meta.Watermarked && watermark != nil
+	meta.URL, meta.Thumb = imageURLs(meta)
+	meta.Srcset = srcset(meta)
+	return meta, nil
+}
+
+func getImage(id string) (ImageMeta, error) {
+	return cachedImage(id)
+}
+
+func queryImage(id string) (ImageMeta, error) {
+	return scanImageRow(db.QueryRow(`SELECT `+imageColumns+` FROM images WHERE id = ?`, id))
+}
+
+// findDuplicate returns an image of owner with the given content hash.
+func findDuplicate(sum, owner string) (ImageMeta, error) {
+	return scanImageRow(db.QueryRow(`SELECT `+imageColumns+` FROM images WHERE sha256 = ? AND owner_id = ? AND deleted_at = 0
+		ORDER BY uploaded_at LIMIT 1`, sum, owner))
+}
+
+// hashStored computes the SHA-256 of an original in storage.
+func hashStored(img string) (string, error) {
+	f, _, err := storage.Open(context.Background(), img)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return hashReader(f)
+}
+
+// listQuery selects a page of the image listing. Either Offset or Cursor
+// is used to position the page; Cursor wins when both are set.
+type listQuery struct {
+	Limit  int // 0 means no limit
+	Offset int
+	Cursor string
+	Sort   string // key of sortColumns, "" for name
+	Desc   bool
+
+	Album string   // only images in this album
+	Tags  []string // only images carrying all of these tags
+	Owner string   // only images owned by this user
+
+	// EXIF filters: camera model and lens match whole, ignoring case;
+	// images without a capture time are left out by the time bounds
+	Camera      string
+	Lens        string
+	ISOMin      int
+	ISOMax      int
+	TakenAfter  time.Time // inclusive
+	TakenBefore time.Time // exclusive
+
+	// place filters, see geocode.go: the country by name or code and the
+	// city, ignoring case
+	Country string
+	City    string
+
+	Fields [][2]string // custom fields, key and value, see fields.go
+
+	// the favorites and ratings of Rater, see ratings.go
+	Rater     string
+	Favorites bool
+	MinRating int
+
+	Trashed       bool // list the trash instead of the gallery
+	Pending       bool // list the images awaiting review instead, see moderation.go
+	Flagged       bool // only images a content scan flagged, see scan.go
+	HideProtected bool // leave out images of password protected albums
+}
+
+// sortColumns maps the ?sort= keys of the listing to the value sorted on.
+// Images without a capture time sort by their upload time under "taken";
+// "popular" is views and downloads together, see views.go.
+var sortColumns = map[string]string{
+	"name":     `name`,
+	"uploaded": `uploaded_at`,
+	"size":     `size`,
+	"taken":    `(CASE WHEN taken_at > 0 THEN taken_at ELSE uploaded_at END)`,
+	"popular":  `COALESCE((SELECT views + downloads FROM image_views v WHERE v.image_id = images.id), 0)`,
+}
+
+// sortKey is the value of the sort column for m, as stored in cursors.
+func (q listQuery) sortKey(m ImageMeta) string {
+	switch q.Sort {
+	case "uploaded":
+		return strconv.FormatInt(m.Uploaded.UnixNano(), 10)
+	case "size":
+		return strconv.FormatInt(m.Size, 10)
+	case "taken":
+		if m.Taken != nil {
+			return strconv.FormatInt(m.Taken.UnixNano(), 10)
+		}
+		return strconv.FormatInt(m.Uploaded.UnixNano(), 10)
+	case "popular":
+		return strconv.FormatInt(m.Views+m.Downloads, 10)
+	}
+	return m.Name
+}
+
+// filters returns the WHERE conditions shared by the count and page queries.
+func (q listQuery) filters() ([]string, []any) {
+	conds := []string{`deleted_at = 0`}
+	if q.Trashed {
+		conds[0] = `deleted_at > 0`
+	}
+	if q.Pending {
+		conds = append(conds, `pending = 1`)
+	} else {
+		conds = append(conds, `pending = 0`)
+	}
+	if q.Flagged {
+		conds = append(conds, `flagged = 1`)
+	}
+	var args []any
+	if q.Owner != "" {
+		conds = append(conds, `owner_id = ?`)
+		args = append(args, q.Owner)
+	}
+	if q.HideProtected {
+		conds = append(conds, `id NOT IN (SELECT ai.image_id FROM album_images ai JOIN albums a ON a.id = ai.album_id
+			WHERE a.password_hash != '')`)
+	}
+	if q.Album != "" {
+		conds = append(conds, `id IN (SELECT image_id FROM album_images WHERE album_id = ?)`)
+		args = append(args, q.Album)
+	}
+	for _, tag := range q.Tags {
+		conds = append(conds, `id IN (SELECT image_id FROM image_tags WHERE tag = ?)`)
+		args = append(args, tag)
+	}
+	if q.Camera != "" {
+		conds = append(conds, `camera = ? COLLATE NOCASE`)
+		args = append(args, q.Camera)
+	}
+	if q.Lens != "" {
+		conds = append(conds, `lens = ? COLLATE NOCASE`)
+		args = append(args, q.Lens)
+	}
+	if q.ISOMin > 0 {
+		conds = append(conds, `iso >= ?`)
+		args = append(args, q.ISOMin)
+	}
+	if q.ISOMax > 0 {
+		conds = append(conds, `iso > 0 AND iso <= ?`)
+		args = append(args, q.ISOMax)
+	}
+	if !q.TakenAfter.IsZero() {
+		conds = append(conds, `taken_at >= ?`)
+		args = append(args, q.TakenAfter.UnixNano())
+	}
+	if !q.TakenBefore.IsZero() {
+		conds = append(conds, `taken_at > 0 AND taken_at < ?`)
+		args = append(args, q.TakenBefore.UnixNano())
+	}
+	if q.Country != "" {
+		conds = append(conds, `(country = ? COLLATE NOCASE OR country_code = lower(?))`)
+		args = append(args, q.Country, q.Country)
+	}
+	if q.City != "" {
+		conds = append(conds, `city = ? COLLATE NOCASE`)
+		args = append(args, q.City)
+	}
+	if q.Favorites {
+		conds = append(conds, `id IN (SELECT image_id FROM image_ratings WHERE user_id = ? AND favorite = 1)`)
+		args = append(args, q.Rater)
+	}
+	if q.MinRating > 0 {
+		conds = append(conds, `id IN (SELECT image_id FROM image_ratings WHERE user_id = ? AND rating >= ?)`)
+		args = append(args, q.Rater, q.MinRating)
+	}
+	for _, f := range q.Fields {
+		conds = append(conds, `id IN (SELECT image_id FROM image_fields WHERE key = ? AND value = ? COLLATE NOCASE)`)
+		args = append(args, f[0], f[1])
+	}
+	return conds, args
+}
+
+func whereClause(conds []string) string {
+	if len(conds) == 0 {
+		return ""
+	}
+	return ` WHERE ` + strings.Join(conds, ` AND `)
+}
+
+// ImageList is one page of the listing together with the total number of
+// images, so clients can render pagers or load lazily.
+type ImageList struct {
+	Images     []ImageMeta `json:"images"`
+	Total      int         `json:"total"`
+	Page       int         `json:"page,omitempty"`
+	Limit      int         `json:"limit,omitempty"`
+	NextCursor string      `json:"nextCursor,omitempty"`
+}
+
+var errBadCursor = errors.New("invalid cursor")
+
+func listImages(q listQuery) (ImageList, error) {
+	return cachedList(q)
+}
+
+func queryImages(q listQuery) (ImageList, error) {
+	list := ImageList{Images: []ImageMeta{}, Limit: q.Limit}
+	conds, args := q.filters()
+	if err := db.QueryRow(`SELECT COUNT(*) FROM images`+whereClause(conds), args...).Scan(&list.Total); err != nil {
+		return list, err
+	}
+
+	if q.Sort == "" {
+		q.Sort = "name"
+	}
+	column, dir, cmp := sortColumns[q.Sort], ` ASC`, `>`
+	if q.Desc {
+		dir, cmp = ` DESC`, `<`
+	}
+	if q.Cursor != "" {
+		key, id, err := q.decodeCursor(q.Cursor)
+		if err != nil {
+			return list, err
+		}
+		conds = append(conds, `(`+column+`, id) `+cmp+` (?, ?)`)
+		args = append(args, key, id)
+	}
+	query := `SELECT ` + imageColumns + ` FROM images` + whereClause(conds) + ` ORDER BY ` + column + dir + `, id` + dir
+	if q.Limit > 0 {
+		// fetch one extra row to learn whether there is a next page
+		query += ` LIMIT ?`
+		args = append(args, q.Limit+1)
+		if q.Cursor == "" && q.Offset > 0 {
+			query += ` OFFSET ?`
+			args = append(args, q.Offset)
+		}
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return list, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		meta, err := scanImageRow(rows)
+		if err != nil {
+			return list, err
+		}
+		list.Images = append(list.Images, meta)
+	}
+	if q.Limit > 0 && len(list.Images) > q.Limit {
+		list.Images = list.Images[:q.Limit]
+		last := list.Images[q.Limit-1]
+		list.NextCursor = q.encodeCursor(last)
+	}
+	return list, rows.Err()
+}
+
+// A cursor records the sort and the position of the last image returned,
+// so it cannot be replayed against a different ordering.
+func (q listQuery) encodeCursor(last ImageMeta) string {
+	sort := q.Sort
+	if q.Desc {
+		sort += " desc"
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(sort + "\x00" + q.sortKey(last) + "\x00" + last.ID))
+}
+
+func (q listQuery) decodeCursor(c string) (key any, id string, err error) {
+	b, err := base64.RawURLEncoding.DecodeString(c)
+	if err != nil {
+		return nil, "", errBadCursor
+	}
+	parts := strings.SplitN(string(b), "\x00", 3)
+	sort := q.Sort
+	if q.Desc {
+		sort += " desc"
+	}
+	if len(parts) != 3 || parts[0] != sort {
+		return nil, "", errBadCursor
+	}
+	if q.Sort == "name" {
+		return parts[1], parts[2], nil
+	}
+	n, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return nil, "", errBadCursor
+	}
+	return n, parts[2], nil
+}
+
+// indexVersion returns the version of the index and when it last changed.
+// Any change to images, their tags or albums, or album passwords and
+// watermarks bumps it.
+func indexVersion() (int64, time.Time, error) {
+	var version, changed int64
+	err := db.QueryRow(`SELECT version, changed_at FROM index_state`).Scan(&version, &changed)
+	return version, time.Unix(changed, 0).UTC(), err
+}
+
+func deleteImage(id string) error {
+	_, err := db.Exec(`DELETE FROM images WHERE id = ?`, id)
+	return err
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// With "svg" among cfg.Formats vector images can be uploaded. An SVG is a
+// document that can carry scripts, so uploads are rewritten through an
+// allowlist of drawing elements first: scripts, foreignObject, event
+// handler attributes, links to anything but the document itself and CSS
+// that fetches from elsewhere are dropped, and so are comments, processing
+// instructions and DTDs. As a second line, SVGs are always served with a
+// CSP that forbids scripts and sandboxes the document, which also covers
+// SVGs that reached the upload directory some other way. SVGs are not
+// rasterized: their thumbnails and /img/ renditions are the sanitized file
+// itself.
+
+const (
+	svgType = "image/svg+xml"
+	svgCSP  = "default-src 'none'; style-src 'unsafe-inline'; img-src data:; sandbox"
+)
+
+// svgElements are the elements kept by sanitizeSVG. Anything else is
+// dropped together with its content.
+var svgElements = map[string]bool{}
+
+func init() {
+	for _, name := range strings.Fields(`svg g defs symbol use switch view title desc style
+		path rect circle ellipse line polyline polygon text tspan textPath image
+		linearGradient radialGradient stop pattern clipPath mask marker
+		animateTransform animateMotion mpath filter
+		feBlend feColorMatrix feComponentTransfer feComposite feConvolveMatrix
+		feDiffuseLighting feDisplacementMap feDistantLight feDropShadow feFlood
+		feFuncA feFuncB feFuncG feFuncR feGaussianBlur feImage feMerge feMergeNode
+		feMorphology feOffset fePointLight feSpecularLighting feSpotLight feTile
+		feTurbulence`) {
+		svgElements[name] = true
+	}
+}
+
+var (
+	cssURL       = regexp.MustCompile(`(?i)url\(\s*['"]?\s*([^'")\s]*)`)
+	svgDataImage = regexp.MustCompile(`^data:image/(png|jpeg|gif|webp);base64,`)
+)
+
+func isSVGName(name string) bool { return strings.EqualFold(filepath.Ext(name), ".svg") }
+
+// isSVG reports whether head, the start of a file, is an SVG document:
+// an <svg> root after an optional XML declaration, comments and doctype.
+func isSVG(head []byte) bool {
+	s := bytes.TrimPrefix(head, []byte("\xef\xbb\xbf"))
+	for {
+		s = bytes.TrimLeft(s, " \t\r\n")
+		var end string
+		switch {
+		case bytes.HasPrefix(s, []byte("<?")):
+			end = "?>"
+		case bytes.HasPrefix(s, []byte("<!--")):
+			end = "-->"
+		case bytes.HasPrefix(s, []byte("<!")):
+			end = ">"
+		default:
+			return bytes.HasPrefix(s, []byte("<svg")) && len(s) > 4 && strings.IndexByte(" \t\r\n/>", s[4]) >= 0
+		}
+		i := bytes.Index(s, []byte(end))
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(end):]
+	}
+}
+
+// setSVGHeaders marks a response as an SVG that must not run anything.
+func setSVGHeaders(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", svgType)
+	w.Header().Set("Content-Security-Policy", svgCSP)
+}
+
+// sanitizeSVGFile rewrites the local SVG at path through sanitizeSVG.
+func sanitizeSVGFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	tmp, err := os.CreateTemp(cfg.sessionDir(), ".svg-*")
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(tmp)
+	err = sanitizeSVG(bw, src)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// sanitizeSVG copies the SVG document in r to w, keeping only what
+// svgElements and keepSVGAttr allow. Links are unwrapped, their content
+// stays. A document that does not parse or whose root is not <svg> is
+// errMalformedImage.
+func sanitizeSVG(w io.Writer, r io.Reader) error {
+	d := xml.NewDecoder(r)
+	bw := bufio.NewWriter(w)
+	var open []string // written elements, "" for unwrapped ones
+	skip := 0         // depth inside a dropped element
+	root := false
+	for {
+		tok, err := d.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %v", errMalformedImage, err)
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if skip > 0 {
+				skip++
+				continue
+			}
+			name := t.Name.Local
+			if t.Name.Space != "" && t.Name.Space != "svg" {
+				name = ""
+			}
+			if len(open) == 0 {
+				if root || name != "svg" {
+					return errMalformedImage
+				}
+				root = true
+			}
+			switch {
+			case name == "a":
+				open = append(open, "")
+				continue
+			case !svgElements[name]:
+				skip = 1
+				continue
+			}
+			bw.WriteString("<" + name)
+			if len(open) == 0 {
+				// the prefixes of dropped namespaces go with them
+				bw.WriteString(` xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink"`)
+			}
+			for _, a := range t.Attr {
+				if !keepSVGAttr(name, a) {
+					continue
+				}
+				qname := a.Name.Local
+				if a.Name.Space != "" {
+					qname = a.Name.Space + ":" + qname
+				}
+				bw.WriteString(" " + qname + `="`)
+				xml.EscapeText(bw, []byte(a.Value))
+				bw.WriteString(`"`)
+			}
+			bw.WriteString(">")
+			open = append(open, name)
+		case xml.EndElement:
+			if skip > 0 {
+				skip--
+				continue
+			}
+			if len(open) == 0 {
+				return errMalformedImage
+			}
+			name := open[len(open)-1]
+			open = open[:len(open)-1]
+			if name != "" {
+				bw.WriteString("</" + name + ">")
+			}
+		case xml.CharData:
+			if skip > 0 || len(open) == 0 {
+				continue
+			}
+			if open[len(open)-1] == "style" && !safeSVGValue(string(t)) {
+				continue
+			}
+			xml.EscapeText(bw, t)
+		}
+		// comments, processing instructions and directives are dropped
+	}
+	if !root || len(open) > 0 {
+		return errMalformedImage
+	}
+	return bw.Flush()
+}
+
+// keepSVGAttr reports whether the attribute a of element stays.
+func keepSVGAttr(element string, a xml.Attr) bool {
+	switch a.Name.Space {
+	case "", "xlink", "xml":
+	default:
+		// namespace declarations and editor data
+		return false
+	}
+	local := strings.ToLower(a.Name.Local)
+	if local == "xmlns" || strings.HasPrefix(local, "on") {
+		return false
+	}
+	if local == "href" {
+		v := strings.TrimSpace(a.Value)
+		return strings.HasPrefix(v, "#") ||
+			((element == "image" || element == "feImage") && svgDataImage.MatchString(v))
+	}
+	return safeSVGValue(a.Value)
+}
+
+// safeSVGValue reports whether an attribute value or style sheet stays
+// inside the document: no script URLs, no imports and url() only to
+// fragments.
+func safeSVGValue(v string) bool {
+	compact := strings.ToLower(strings.Map(func(r rune) rune {
+		if r <= ' ' {
+			return -1
+		}
+		return r
+	}, v))
+	if strings.Contains(compact, "javascript:") || strings.Contains(compact, "vbscript:") || strings.Contains(compact, "@import") {
+		return false
+	}
+	for _, m := range cssURL.FindAllStringSubmatch(v, -1) {
+		if !strings.HasPrefix(m[1], "#") {
+			return false
+		}
+	}
+	return true
+}
+
+// svgSize reads the size of an SVG from its root's width and height,
+// falling back to the viewBox. Units other than pixels count as pixels;
+// percentages are unknown.
+func svgSize(r io.Reader) (int, int) {
+	d := xml.NewDecoder(r)
+	for {
+		tok, err := d.RawToken()
+		if err != nil {
+			return 0, 0
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		var width, height float64
+		var box []string
+		for _, a := range start.Attr {
+			switch a.Name.Local {
+			case "width":
+				width = svgLength(a.Value)
+			case "height":
+				height = svgLength(a.Value)
+			case "viewBox":
+				box = strings.FieldsFunc(a.Value, func(r rune) bool { return r == ',' || r <= ' ' })
+			}
+		}
+		if (width == 0 || height == 0) && len(box) == 4 {
+			bw, _ := strconv.ParseFloat(box[2], 64)
+			bh, _ := strconv.ParseFloat(box[3], 64)
+			if bw > 0 && bh > 0 {
+				switch {
+				case width > 0:
+					height = width * bh / bw
+				case height > 0:
+					width = height * bw / bh
+				default:
+					width, height = bw, bh
+				}
+			}
+		}
+		return int(math.Round(width)), int(math.Round(height))
+	}
+}
+
+func svgLength(v string) float64 {
+	v = strings.TrimSpace(v)
+	if strings.HasSuffix(v, "%") {
+		return 0
+	}
+	v = strings.TrimRight(v, "abcdefghijklmnopqrstuvwxyz")
+	n, err := strconv.ParseFloat(v, 64)
+	if err != nil || n < 0 || math.IsInf(n, 0) {
+		return 0
+	}
+	return n
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+const maxTagLength = 64
+
+// normalizeTag lower-cases and trims a tag; it returns "" for tags that
+// cannot be stored.
+func normalizeTag(tag string) string {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	if utf8.RuneCountInString(tag) > maxTagLength {
+		return ""
+	}
+	return tag
+}
+
+// handleAddTags serves POST /api/v1/images/{id}/tags with {"tags": [...]}.
+func handleAddTags(w http.ResponseWriter, r *http.Request, id string) {
+	var req struct {
+		Tags []string `json:"tags"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64*1024)).Decode(&req); err != nil || len(req.Tags) == 0 {
+		writeJSONError(w, "Expected JSON body with tags", http.StatusBadRequest)
+		return
+	}
+	if _, err := getImage(id); errors.Is(err, sql.ErrNoRows) {
+		writeJSONError(w, "Image not found", http.StatusNotFound)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeJSONError(w, "Could not tag image", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	for _, t := range req.Tags {
+		tag := normalizeTag(t)
+		if tag == "" {
+			writeJSONError(w, "Invalid tag: "+t, http.StatusBadRequest)
+			return
+		}
+		if _, err := tx.Exec(`INSERT OR IGNORE INTO image_tags (image_id, tag) VALUES (?, ?)`, id, tag); err != nil {
+			writeJSONError(w, "Could not tag image", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		writeJSONError(w, "Could not tag image", http.StatusInternalServerError)
+		return
+	}
+
+	notifyImage("image.tagged", id)
+	writeImageTags(w, id)
+}
+
+// handleRemoveTag serves DELETE /api/v1/images/{id}/tags/{tag}.
+func handleRemoveTag(w http.ResponseWriter, id, tag string) {
+	if _, err := getImage(id); errors.Is(err, sql.ErrNoRows) {
+		writeJSONError(w, "Image not found", http.StatusNotFound)
+		return
+	}
+	if _, err := db.Exec(`DELETE FROM image_tags WHERE image_id = ? AND tag = ?`, id, normalizeTag(tag)); err != nil {
+		writeJSONError(w, "Could not untag image", http.StatusInternalServerError)
+		return
+	}
+	notifyImage("image.tagged", id)
+	writeImageTags(w, id)
+}
+
+func writeImageTags(w http.ResponseWriter, id string) {
+	meta, err := getImage(id)
+	if err != nil {
+		writeJSONError(w, "Could not load image", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]any{"id": id, "tags": meta.Tags})
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultThumbWidth = 400
+	maxThumbSide      = 2048
+)
+
+// handleThumb serves /thumbs/{id}?w=...&h=..., scaling the original down to
+// fit the requested box. It is the gallery's fixed preset of /img/.
+func handleThumb(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/thumbs/")
+	width, err1 := thumbSide(r.URL.Query().Get("w"))
+	height, err2 := thumbSide(r.URL.Query().Get("h"))
+	if err1 != nil || err2 != nil {
+		http.Error(w, "Invalid thumbnail size", http.StatusBadRequest)
+		return
+	}
+	if width == 0 && height == 0 {
+		width = defaultThumbWidth
+	}
+	t := thumbTransform(id, width, height)
+	t.Format = negotiateFormat(w, r, t.Format)
+	serveTransformed(w, r, id, t)
+}
+
+// thumbTransform is the rendition behind a thumbnail of the given box.
+func thumbTransform(id string, width, height int) transform {
+	return transform{
+		Width:   width,
+		Height:  height,
+		Fit:     fitContain,
+		Format:  defaultFormat(id),
+		Quality: defaultQuality,
+	}
+}
+
+// srcset lists the cfg.SrcsetWidths thumbnails of meta for an img srcset.
+// Widths from the image's own on give one thumbnail at its full size, as
+// thumbnails are never scaled up. Videos and formats served as they are
+// have none.
+func srcset(meta ImageMeta) string {
+	if meta.Width == 0 || isVideoName(meta.ID) || rendersAsIs(meta.ID) {
+		return ""
+	}
+	var list []string
+	for _, w := range cfg.SrcsetWidths {
+		if w < meta.Width {
+			list = append(list, thumbURL(meta, w)+" "+strconv.Itoa(w)+"w")
+		} else {
+			list = append(list, thumbURL(meta, w)+" "+strconv.Itoa(meta.Width)+"w")
+			break
+		}
+	}
+	return strings.Join(list, ", ")
+}
+
+// renderSrcset renders the srcset thumbnails of meta ahead of the first
+// request.
+func renderSrcset(ctx context.Context, meta ImageMeta, srcMod time.Time) {
+	if meta.Srcset == "" {
+		return
+	}
+	for _, w := range cfg.SrcsetWidths {
+		t := thumbTransform(meta.ID, w, 0)
+		t.Watermark = watermarkVersion(meta)
+		if _, err := renderCached(meta.ID, t, srcMod); err != nil {
+			slog.WarnContext(ctx, "Could not render srcset thumbnail", "image", meta.ID, "width", w, "err", err)
+			return
+		}
+		if w >= meta.Width {
+			return
+		}
+	}
+}
+
+// thumbSide parses a w/h query value; empty means "unconstrained".
+func thumbSide(v string) (int, error) {
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		return 0, strconv.ErrSyntax
+	}
+	if n > maxThumbSide {
+		n = maxThumbSide
+	}
+	return n, nil
+}
+
+// fitSize scales (w, h) down to fit inside (maxW, maxH), preserving the
+// aspect ratio. A zero bound is ignored. Images are never scaled up.
+func fitSize(w, h, maxW, maxH int) (int, int) {
+	scale := 1.0
+	if maxW > 0 && w > maxW {
+		scale = float64(maxW) / float64(w)
+	}
+	if maxH > 0 && h > maxH {
+		if s := float64(maxH) / float64(h); s < scale {
+			scale = s
+		}
+	}
+	tw, th := int(float64(w)*scale+0.5), int(float64(h)*scale+0.5)
+	if tw < 1 {
+		tw = 1
+	}
+	if th < 1 {
+		th = 1
+	}
+	return tw, th
+}
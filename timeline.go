@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+// The timeline groups the images by the day, month or year they were
+// taken, or uploaded, newest first:
+//
+//	GET /api/v1/timeline?by=day|month|year&time=taken|uploaded
+//
+// Each group has its period ("2024-05-01", "2024-05" or "2024"), how many
+// images it holds and the first few of them to show. Images without a
+// capture time count as taken when they were uploaded. Periods are in UTC.
+// The listing's filters apply; pages of groups follow nextCursor.
+
+const (
+	defaultTimelineGroups  = 50
+	maxTimelineGroups      = 500
+	defaultTimelineSamples = 4
+	maxTimelineSamples     = 20
+)
+
+// timelineFormats are the strftime formats of the periods.
+var timelineFormats = map[string]string{"day": "%Y-%m-%d", "month": "%Y-%m", "year": "%Y"}
+
+// TimelineGroup is the images of one period.
+type TimelineGroup struct {
+	Period string      `json:"period"`
+	Count  int         `json:"count"`
+	Images []ImageMeta `json:"images"` // the latest few
+}
+
+type timeline struct {
+	Groups     []TimelineGroup `json:"groups"`
+	NextCursor string          `json:"nextCursor,omitempty"`
+}
+
+func handleTimeline(w http.ResponseWriter, r *http.Request) {
+	if apiPreamble(w, r) {
+		return
+	}
+	if r.Method != "GET" {
+		writeJSONError(w, "Unsupported method", http.StatusMethodNotAllowed)
+		return
+	}
+	v := r.URL.Query()
+	by := v.Get("by")
+	if by == "" {
+		by = "day"
+	}
+	format, ok := timelineFormats[by]
+	if !ok {
+		writeJSONError(w, "Invalid by, expected day, month or year", http.StatusBadRequest)
+		return
+	}
+	column := sortColumns["taken"]
+	switch v.Get("time") {
+	case "", "taken":
+	case "uploaded":
+		column = sortColumns["uploaded"]
+	default:
+		writeJSONError(w, "Invalid time, expected taken or uploaded", http.StatusBadRequest)
+		return
+	}
+	limit, err := queryInt(v.Get("limit"), defaultTimelineGroups, maxTimelineGroups)
+	if err != nil {
+		writeJSONError(w, "Invalid limit", http.StatusBadRequest)
+		return
+	}
+	samples, err := queryInt(v.Get("samples"), defaultTimelineSamples, maxTimelineSamples)
+	if err != nil {
+		writeJSONError(w, "Invalid samples", http.StatusBadRequest)
+		return
+	}
+	var q listQuery
+	if err := parseListFilters(v, &q); err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	p, authenticated := resolvePrincipal(r)
+	q.Owner = p.ownerFilter()
+	q.HideProtected = !authenticated
+	q.Rater = p.UserID
+
+	t, err := timelineGroups(q, format, column, v.Get("cursor"), limit, samples)
+	if err != nil {
+		writeJSONError(w, "Could not list images", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(t)
+}
+
+// queryInt reads a positive number parameter, def when missing and at most
+// max.
+func queryInt(s string, def, max int) (int, error) {
+	if s == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 {
+		return 0, errors.New("not a positive number")
+	}
+	return min(n, max), nil
+}
+
+// timelineGroups returns up to limit periods before cursor, each with its
+// latest samples images.
+func timelineGroups(q listQuery, format, column, cursor string, limit, samples int) (timeline, error) {
+	t := timeline{Groups: []TimelineGroup{}}
+	conds, args := q.filters()
+	// column is in nanoseconds
+	periods := `SELECT id, strftime('` + format + `', ` + column + ` / 1000000000, 'unixepoch') AS period, ` + column + ` AS at
+		FROM images` + whereClause(conds)
+
+	pageArgs := append([]any{}, args...)
+	where := ""
+	if cursor != "" {
+		where = ` WHERE period < ?`
+		pageArgs = append(pageArgs, cursor)
+	}
+	rows, err := db.Query(`SELECT period, COUNT(*) FROM (`+periods+`)`+where+`
+		GROUP BY period ORDER BY period DESC LIMIT ?`, append(pageArgs, limit+1)...)
+	if err != nil {
+		return t, err
+	}
+	index := map[string]int{}
+	for rows.Next() {
+		var g TimelineGroup
+		if err := rows.Scan(&g.Period, &g.Count); err != nil {
+			rows.Close()
+			return t, err
+		}
+		g.Images = []ImageMeta{}
+		index[g.Period] = len(t.Groups)
+		t.Groups = append(t.Groups, g)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return t, err
+	}
+	if len(t.Groups) > limit {
+		t.Groups = t.Groups[:limit]
+		t.NextCursor = t.Groups[limit-1].Period
+	}
+	if len(t.Groups) == 0 {
+		return t, nil
+	}
+
+	last := t.Groups[len(t.Groups)-1].Period
+	where = ` WHERE period >= ?`
+	sampleArgs := append(append([]any{}, args...), last)
+	if cursor != "" {
+		where += ` AND period < ?`
+		sampleArgs = append(sampleArgs, cursor)
+	}
+	sampleArgs = append(sampleArgs, samples)
+	rows, err = db.Query(`SELECT period, id FROM (
+			SELECT period, id, ROW_NUMBER() OVER (PARTITION BY period ORDER BY at DESC, id) AS n FROM (`+periods+`)`+where+`
+		) WHERE n <= ? ORDER BY period DESC, n`, sampleArgs...)
+	if err != nil {
+		return t, err
+	}
+	var ids, idPeriods []string
+	for rows.Next() {
+		var period, id string
+		if err := rows.Scan(&period, &id); err != nil {
+			rows.Close()
+			return t, err
+		}
+		ids = append(ids, id)
+		idPeriods = append(idPeriods, period)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return t, err
+	}
+	images, err := imagesByID(ids)
+	if err != nil {
+		return t, err
+	}
+	for i, id := range ids {
+		if meta, ok := images[id]; ok {
+			g := &t.Groups[index[idPeriods[i]]]
+			g.Images = append(g.Images, meta)
+		}
+	}
+	return t, nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// serve runs srv as configured: plain HTTP, HTTPS with cfg.TLSCert, or
+// HTTPS with certificates that autocert fetches from Let's Encrypt and
+// renews as needed. In autocert mode a second listener on cfg.HTTPAddr
+// answers the HTTP-01 challenges and redirects everything else to HTTPS.
+func serve(srv *http.Server) error {
+	switch {
+	case len(cfg.AutocertDomains) > 0:
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(cfg.AutocertDomains...),
+			Cache:      autocert.DirCache(cfg.AutocertCacheDir),
+			Email:      cfg.AutocertEmail,
+		}
+		srv.TLSConfig = m.TLSConfig()
+		srv.TLSConfig.MinVersion = tls.VersionTLS12
+
+		challenge := &http.Server{
+			Addr:              cfg.HTTPAddr,
+			Handler:           m.HTTPHandler(nil),
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		srv.RegisterOnShutdown(func() { challenge.Shutdown(context.Background()) })
+		go func() {
+			slog.Info("ACME challenge listener starting", "addr", cfg.HTTPAddr)
+			if err := challenge.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				fatal("ACME challenge listener", "err", err)
+			}
+		}()
+		slog.Info("Server starting", "addr", srv.Addr, "tls", "autocert", "domains", cfg.AutocertDomains)
+		return srv.ListenAndServeTLS("", "")
+	case cfg.TLSCert != "":
+		srv.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+		slog.Info("Server starting", "addr", srv.Addr, "tls", "certificate")
+		return srv.ListenAndServeTLS(cfg.TLSCert, cfg.TLSKey)
+	default:
+		slog.Info("Server starting", "addr", srv.Addr)
+		return srv.ListenAndServe()
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// With cfg.Tracing the gallery records spans of requests, uploads, metadata
+// reads and storage calls. They follow W3C Trace Context: a request's span
+// continues the trace of an incoming traceparent header and is named in the
+// traceparent of the response, and each span is logged when it ends as a
+// "span" record with trace_id, span_id, parent_id and duration.
+// That lines them up with the traces of a proxy or client, and a collector
+// reading the logs (the OpenTelemetry filelog receiver, say) can turn them
+// into its own spans without the gallery linking an exporter.
+
+type span struct {
+	name     string
+	traceID  string
+	spanID   string
+	parentID string
+	start    time.Time
+	attrs    []slog.Attr
+}
+
+// startSpan begins a span below the one in ctx, or a new trace. Without
+// tracing it returns ctx and a nil span, whose end does nothing.
+func startSpan(ctx context.Context, name string, attrs ...slog.Attr) (context.Context, *span) {
+	if !cfg.Tracing {
+		return ctx, nil
+	}
+	s := &span{name: name, spanID: randomHex(8), start: time.Now(), attrs: attrs}
+	if parent, ok := ctx.Value(ctxSpan).(*span); ok {
+		s.traceID, s.parentID = parent.traceID, parent.spanID
+	} else {
+		s.traceID = randomHex(16)
+	}
+	return context.WithValue(ctx, ctxSpan, s), s
+}
+
+// end logs the span, with err if it failed. ctx is the one startSpan
+// returned, which gives the record its trace_id.
+func (s *span) end(ctx context.Context, err error) {
+	if s == nil {
+		return
+	}
+	attrs := append([]slog.Attr{
+		slog.String("name", s.name),
+		slog.String("span_id", s.spanID),
+		slog.String("parent_id", s.parentID),
+		slog.Duration("duration", time.Since(s.start)),
+	}, s.attrs...)
+	if err != nil {
+		attrs = append(attrs, slog.String("err", err.Error()))
+	}
+	slog.LogAttrs(ctx, slog.LevelInfo, "span", attrs...)
+}
+
+// traceparent is the header value naming s as the parent.
+func (s *span) traceparent() string {
+	return "00-" + s.traceID + "-" + s.spanID + "-01"
+}
+
+// remoteSpan is the caller's span from a traceparent header, if it is
+// valid, for requests to continue.
+func remoteSpan(header string) (*span, bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) != 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return nil, false
+	}
+	for _, p := range parts {
+		if _, err := hex.DecodeString(p); err != nil || p != strings.ToLower(p) {
+			return nil, false
+		}
+	}
+	if parts[1] == strings.Repeat("0", 32) || parts[2] == strings.Repeat("0", 16) {
+		return nil, false
+	}
+	return &span{traceID: parts[1], spanID: parts[2]}, true
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// tracedStorage wraps the storage backend in spans. Code that looks for
+// optional backend interfaces goes through baseStorage.
+type tracedStorage struct {
+	Storage
+}
+
+// baseStorage is the backend itself, without tracing.
+func baseStorage() Storage {
+	if t, ok := storage.(tracedStorage); ok {
+		return t.Storage
+	}
+	return storage
+}
+
+func (t tracedStorage) Put(ctx context.Context, name string, r io.Reader, size int64, contentType string) error {
+	ctx, s := startSpan(ctx, "storage.put", slog.String("object", name), slog.Int64("size", size))
+	err := t.Storage.Put(ctx, name, r, size, contentType)
+	s.end(ctx, err)
+	return err
+}
+
+func (t tracedStorage) Open(ctx context.Context, name string) (io.ReadSeekCloser, ObjectInfo, error) {
+	ctx, s := startSpan(ctx, "storage.open", slog.String("object", name))
+	f, info, err := t.Storage.Open(ctx, name)
+	s.end(ctx, err)
+	return f, info, err
+}
+
+func (t tracedStorage) Stat(ctx context.Context, name string) (ObjectInfo, error) {
+	ctx, s := startSpan(ctx, "storage.stat", slog.String("object", name))
+	info, err := t.Storage.Stat(ctx, name)
+	s.end(ctx, err)
+	return info, err
+}
+
+func (t tracedStorage) Delete(ctx context.Context, name string) error {
+	ctx, s := startSpan(ctx, "storage.delete", slog.String("object", name))
+	err := t.Storage.Delete(ctx, name)
+	s.end(ctx, err)
+	return err
+}
+
+func (t tracedStorage) List(ctx context.Context) ([]ObjectInfo, error) {
+	ctx, s := startSpan(ctx, "storage.list")
+	list, err := t.Storage.List(ctx)
+	s.end(ctx, err)
+	return list, err
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/image/draw"
+)
+
+const (
+	fitContain = "contain" // fit inside the box, keep aspect ratio
+	fitCover   = "cover"   // fill the box, cropping the overflow
+	fitFill    = "fill"    // stretch to exactly the box
+
+	defaultQuality = 82
+)
+
+// imageEncoder writes one output format of the transformation endpoint.
+// Quality is only meaningful for lossy formats.
+type imageEncoder struct {
+	ext    string
+	mime   string
+	opaque bool // no alpha channel; transparent areas become white
+	lossy  bool // takes a quality
+	encode func(w io.Writer, img image.Image, quality int) error
+}
+
+// encoders lists the formats /img/ can produce. WebP is decoded but not
+// encoded: the Go encoders for it need a newer toolchain than we build with.
+// AVIF and JPEG XL join when their commands are configured, see avif.go.
+var encoders = map[string]imageEncoder{
+	"jpeg": {ext: ".jpg", mime: "image/jpeg", opaque: true, lossy: true, encode: func(w io.Writer, img image.Image, q int) error {
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: q})
+	}},
+	"png": {ext: ".png", mime: "image/png", encode: func(w io.Writer, img image.Image, q int) error {
+		return png.Encode(w, img)
+	}},
+	"gif": {ext: ".gif", mime: "image/gif", encode: func(w io.Writer, img image.Image, q int) error {
+		return gif.Encode(w, img, nil)
+	}},
+}
+
+// transform describes a resized rendition of an original.
+type transform struct {
+	Width, Height int
+	Fit           string
+	Format        string
+	Quality       int
+	Watermark     string // version of the watermark to draw, see watermark.go
+}
+
+// renditionVersion changes whenever rendering does, so that renditions
+// cached before are not served any more. 2 turns images upright, 3 crops
+// around the focus point.
+const renditionVersion = "3"
+
+// cacheName is the file name of the rendition inside the image's cache dir.
+func (t transform) cacheName() string {
+	name := "v" + renditionVersion + "-" + strconv.Itoa(t.Width) + "x" + strconv.Itoa(t.Height)
+	if t.Fit != fitContain {
+		name += "-" + t.Fit
+	}
+	if encoders[t.Format].lossy && t.Quality != defaultQuality {
+		name += "-q" + strconv.Itoa(t.Quality)
+	}
+	if t.Watermark != "" {
+		name += "-wm" + t.Watermark
+	}
+	return name + encoders[t.Format].ext
+}
+
+// transformLocks serializes generation of the same rendition so concurrent
+// requests for a fresh one don't all decode the original.
+var transformLocks sync.Map
+
+// handleTransform serves /img/{id}?w=&h=&fit=&format=&q=, resizing, cropping
+// and re-encoding the original on demand. Results are cached next to the
+// thumbnails, so one original can serve many display sizes. Callers without
+// an API key or account only get the cfg.ImagePresets, so nobody can fill
+// the cache with every size there is.
+func handleTransform(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/img/")
+	t, err := parseTransform(id, r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, ok := resolvePrincipal(r); !ok && !isPreset(id, t) {
+		http.Error(w, "Not one of the image presets", http.StatusForbidden)
+		return
+	}
+	if r.URL.Query().Get("format") == "" {
+		t.Format = negotiateFormat(w, r, t.Format)
+	}
+	serveTransformed(w, r, id, t)
+}
+
+func parseTransform(id string, v url.Values) (transform, error) {
+	t := transform{Fit: fitContain, Format: defaultFormat(id), Quality: defaultQuality}
+
+	var err1, err2 error
+	t.Width, err1 = thumbSide(v.Get("w"))
+	t.Height, err2 = thumbSide(v.Get("h"))
+	if err1 != nil || err2 != nil {
+		return t, errors.New("Invalid size")
+	}
+	if f := v.Get("fit"); f != "" {
+		if f != fitContain && f != fitCover && f != fitFill {
+			return t, errors.New("Invalid fit, expected contain, cover or fill")
+		}
+		t.Fit = f
+	}
+	if f := strings.ToLower(v.Get("format")); f != "" {
+		if f == "jpg" {
+			f = "jpeg"
+		}
+		if _, ok := encoders[f]; !ok {
+			return t, fmt.Errorf("Unsupported format %q", f)
+		}
+		t.Format = f
+	}
+	if q := v.Get("q"); q != "" {
+		n, err := strconv.Atoi(q)
+		if err != nil || n < 1 || n > 100 {
+			return t, errors.New("Invalid quality, expected 1-100")
+		}
+		t.Quality = n
+	}
+	return t, nil
+}
+
+// isPreset reports whether t of the original id is one of cfg.ImagePresets.
+func isPreset(id string, t transform) bool {
+	for _, preset := range cfg.ImagePresets {
+		v, err := url.ParseQuery(preset)
+		if err != nil {
+			continue
+		}
+		if p, err := parseTransform(id, v); err == nil && p == t {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultFormat keeps PNG and GIF originals lossless (and transparent);
+// everything else becomes JPEG.
+func defaultFormat(id string) string {
+	switch strings.ToLower(filepath.Ext(id)) {
+	case ".png", ".gif":
+		return "png"
+	}
+	return "jpeg"
+}
+
+// serveTransformed renders t of the original id, unless a fresh copy is
+// already cached, and serves it.
+func serveTransformed(w http.ResponseWriter, r *http.Request, id string, t transform) {
+	if id == "" || id != filepath.Base(id) || strings.HasPrefix(id, ".") {
+		http.NotFound(w, r)
+		return
+	}
+	meta, ok := servableImage(r, id)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	srcInfo, err := storage.Stat(r.Context(), id)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if rendersAsIs(id) {
+		serveOriginalRendition(w, r, meta)
+		return
+	}
+
+	t.Watermark = watermarkVersion(meta)
+	cached, err := renderCached(id, t, srcInfo.ModTime)
+	if err != nil {
+		http.Error(w, "Could not transform image", http.StatusUnprocessableEntity)
+		return
+	}
+
+	w.Header().Set("Content-Type", encoders[t.Format].mime)
+	setRenditionCache(w, r, meta)
+	http.ServeFile(w, r, cached)
+}
+
+// serveOriginalRendition serves an original the gallery cannot decode in
+// place of any rendition: browsers scale SVGs and AVIFs themselves.
+func serveOriginalRendition(w http.ResponseWriter, r *http.Request, meta ImageMeta) {
+	f, info, err := storage.Open(r.Context(), meta.ID)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", mediaType(meta.ID))
+	if isSVGName(meta.ID) {
+		setSVGHeaders(w)
+	}
+	setRenditionCache(w, r, meta)
+	http.ServeContent(w, r, meta.ID, info.ModTime, f)
+}
+
+// renderCached renders t of the original id unless the cached copy is
+// newer than srcMod, and returns the path of the cached copy.
+func renderCached(id string, t transform, srcMod time.Time) (string, error) {
+	cached := filepath.Join(cfg.ThumbDir, id, t.cacheName())
+	mu, _ := transformLocks.LoadOrStore(cached, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	defer mu.(*sync.Mutex).Unlock()
+
+	var added int64
+	if info, err := os.Stat(cached); err != nil || info.ModTime().Before(srcMod) {
+		if err := renderTransform(id, cached, t); err != nil {
+			return "", err
+		}
+		if info, err := os.Stat(cached); err == nil {
+			added = info.Size()
+		}
+	}
+	renditionUsed(cached, added)
+	return cached, nil
+}
+
+func renderTransform(id, dst string, t transform) error {
+	img, err := decodeStored(id)
+	if err != nil {
+		return err
+	}
+
+	src := img.Bounds()
+	var tw, th int
+	switch t.Fit {
+	case fitCover:
+		fx, fy := focusPoint(img)
+		src = coverCrop(src, t.Width, t.Height, fx, fy)
+		tw, th = fitSize(src.Dx(), src.Dy(), t.Width, t.Height)
+	case fitFill:
+		tw, th = t.Width, t.Height
+		if tw == 0 {
+			tw = src.Dx()
+		}
+		if th == 0 {
+			th = src.Dy()
+		}
+	default:
+		tw, th = fitSize(src.Dx(), src.Dy(), t.Width, t.Height)
+	}
+
+	enc := encoders[t.Format]
+	out := image.NewRGBA(image.Rect(0, 0, tw, th))
+	if enc.opaque {
+		draw.Draw(out, out.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	}
+	draw.CatmullRom.Scale(out, out.Bounds(), img, src, draw.Over, nil)
+	if t.Watermark != "" && watermark != nil {
+		applyWatermark(out)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	// Write to a temp file first so readers never see a half-written file
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	err = enc.encode(tmp, out, t.Quality)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
+
+// decodeStored decodes the stored file id upright, or the poster frame of
+// a video.
+func decodeStored(id string) (image.Image, error) {
+	if isVideoName(id) {
+		return videoPoster(context.Background(), id)
+	}
+	f, _, err := storage.Open(context.Background(), id)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	orientation := readOrientation(f)
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	img, err := decodeLimited(f)
+	if err != nil {
+		return nil, err
+	}
+	return applyOrientation(img, orientation), nil
+}
+
+// coverCrop returns the largest part of r with the aspect ratio of (w, h),
+// centered on the focus point (fx, fy) as far as r allows. With either
+// side unconstrained there is nothing to crop.
+func coverCrop(r image.Rectangle, w, h int, fx, fy float64) image.Rectangle {
+	if w == 0 || h == 0 {
+		return r
+	}
+	cw, ch := r.Dx(), r.Dy()
+	if cw*h > ch*w {
+		cw = max(1, (ch*w+h/2)/h)
+	} else {
+		ch = max(1, (cw*h+w/2)/w)
+	}
+	x := r.Min.X + min(max(int(fx*float64(r.Dx()))-cw/2, 0), r.Dx()-cw)
+	y := r.Min.Y + min(max(int(fy*float64(r.Dy()))-ch/2, 0), r.Dy()-ch)
+	return image.Rect(x, y, x+cw, y+ch)
+}
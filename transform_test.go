@@ -0,0 +1,26 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestTransformPresets(t *testing.T) {
+	testGallery(t)
+	cfg.ImagePresets = stringList{"w=800&h=600&fit=cover", "w=1600"}
+	_, session := testUser(t, "alice", false)
+
+	for target, want := range map[string]int{
+		"/img/a.jpg?fit=cover&h=600&w=800": http.StatusNotFound,
+		"/img/a.jpg?w=1600":                http.StatusNotFound,
+		"/img/a.jpg?w=1601":                http.StatusForbidden,
+		"/img/a.jpg?w=1600&q=90":           http.StatusForbidden,
+	} {
+		if w := serveTest(http.HandlerFunc(handleTransform), "GET", target, ""); w.Code != want {
+			t.Errorf("anonymous GET %s: got %d, want %d", target, w.Code, want)
+		}
+	}
+	if w := serveTest(http.HandlerFunc(handleTransform), "GET", "/img/a.jpg?w=1601", "", session); w.Code != http.StatusNotFound {
+		t.Errorf("signed in GET of another size: got %d, want 404", w.Code)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Deleted images first go to the trash, where they stay restorable for
+// cfg.TrashRetention before gcTrash purges them for good:
+//
+//	DELETE /api/v1/images/{id}               move to trash (?permanent=1 purges)
+//	POST   /api/v1/images/{id}/restore       take back out of the trash
+//	GET    /api/v1/trash                     list trashed images
+//
+// Trashed images are left out of listings, albums and the file servers.
+
+// handleTrash serves GET /api/v1/trash, a listing like GET /api/v1/images.
+func handleTrash(w http.ResponseWriter, r *http.Request) {
+	if apiPreamble(w, r) {
+		return
+	}
+	if r.Method != "GET" {
+		writeJSONError(w, "Unsupported method", http.StatusMethodNotAllowed)
+		return
+	}
+	q, page, err := parseListQuery(r)
+	if err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	q.Owner = requestViewer(r).ownerFilter()
+	q.Trashed = true
+	result, err := listImages(q)
+	if errors.Is(err, errBadCursor) {
+		writeProblem(w, http.StatusBadRequest, "invalid_cursor", "Invalid cursor", nil)
+		return
+	}
+	if err != nil {
+		writeJSONError(w, "Could not list images", http.StatusInternalServerError)
+		return
+	}
+	result.Page = page
+	json.NewEncoder(w).Encode(result)
+}
+
+func handleDeleteImage(w http.ResponseWriter, r *http.Request, meta ImageMeta) {
+	permanent, err := removeImage(r.Context(), meta, r.URL.Query().Get("permanent") == "1")
+	if errors.Is(err, errSourceFile) {
+		writeJSONError(w, "Image is in a read-only source directory", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		writeJSONError(w, "Could not delete image", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]any{"success": true, "id": meta.ID, "permanent": permanent})
+}
+
+// removeImage moves meta to the trash, or deletes it for good when asked
+// to, when it is in the trash already or when there is no trash, and
+// reports which it did.
+func removeImage(ctx context.Context, meta ImageMeta, permanent bool) (bool, error) {
+	if isSourceFile(meta.ID) {
+		return false, errSourceFile
+	}
+	var err error
+	if permanent || meta.Deleted != nil || cfg.TrashRetention <= 0 {
+		// deleting from the trash empties it for this image
+		permanent = true
+		err = purgeImage(ctx, meta.ID)
+	} else {
+		_, err = db.Exec(`UPDATE images SET deleted_at = ? WHERE id = ?`, time.Now().UnixNano(), meta.ID)
+	}
+	if err != nil {
+		return permanent, err
+	}
+	notify(webhookEvent{Event: "image.deleted", Image: meta, Permanent: permanent})
+	return permanent, nil
+}
+
+func handleRestoreImage(w http.ResponseWriter, meta ImageMeta) {
+	if meta.Deleted == nil {
+		writeJSONError(w, "Image is not in the trash", http.StatusConflict)
+		return
+	}
+	if _, err := db.Exec(`UPDATE images SET deleted_at = 0 WHERE id = ?`, meta.ID); err != nil {
+		writeJSONError(w, "Could not restore image", http.StatusInternalServerError)
+		return
+	}
+	meta, err := getImage(meta.ID)
+	if err != nil {
+		writeJSONError(w, "Could not restore image", http.StatusInternalServerError)
+		return
+	}
+	notify(webhookEvent{Event: "image.restored", Image: meta})
+	json.NewEncoder(w).Encode(meta)
+}
+
+// purgeImage removes an image with its cached renditions for good.
+func purgeImage(ctx context.Context, id string) error {
+	if err := storage.Delete(ctx, id); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	storage.Delete(ctx, heicOriginalName(id))
+	os.RemoveAll(filepath.Join(cfg.ThumbDir, id))
+	return deleteImage(id)
+}
+
+// gcTrash empties the trash of expired images once an hour.
+func gcTrash() {
+	for {
+		purgeExpiredTrash()
+		time.Sleep(time.Hour)
+	}
+}
+
+// purgeExpiredTrash purges images that have been in the trash longer than
+// the retention window and returns how many.
+func purgeExpiredTrash() int {
+	cutoff := time.Now().Add(-cfg.TrashRetention).UnixNano()
+	rows, err := db.Query(`SELECT id FROM images WHERE deleted_at > 0 AND deleted_at < ?`, cutoff)
+	var ids []string
+	if err == nil {
+		for rows.Next() {
+			var id string
+			if rows.Scan(&id) == nil {
+				ids = append(ids, id)
+			}
+		}
+		rows.Close()
+	}
+	purged := 0
+	for _, id := range ids {
+		meta, _ := getImage(id)
+		if err := purgeImage(context.Background(), id); err != nil {
+			slog.Warn("Could not purge trashed image", "image", id, "err", err)
+			continue
+		}
+		slog.Info("Purged trashed image", "image", id)
+		notify(webhookEvent{Event: "image.deleted", Image: meta, Permanent: true})
+		purged++
+	}
+	return purged
+}
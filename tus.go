@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// The tus endpoint speaks tus 1.0.0 (https://tus.io/protocols/resumable-upload)
+// with the creation, termination and expiration extensions, so stock clients
+// such as tus-js-client or Uppy can resume interrupted uploads. It shares the
+// upload sessions of /api/v1/uploads; the image is added to the gallery as soon
+// as the last byte arrives and its id is returned in X-Image-Id.
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,termination,expiration"
+)
+
+func handleTus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Cache-Control", "no-store")
+	method := r.Method
+	if method == "OPTIONS" {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", tusExtensions)
+		w.Header().Set("Tus-Max-Size", strconv.FormatInt(cfg.maxUploadBytes(), 10))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "Unsupported tus version", http.StatusPreconditionFailed)
+		return
+	}
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/tus"), "/")
+	if id == "" {
+		if method != "POST" {
+			http.Error(w, "Unsupported method", http.StatusMethodNotAllowed)
+			return
+		}
+		createTusUpload(w, r)
+		return
+	}
+
+	s := lookupSession(id)
+	if s == nil || !requestViewer(r).sees(s.owner) {
+		http.Error(w, "Unknown upload", http.StatusNotFound)
+		return
+	}
+	switch method {
+	case "HEAD":
+		s.mu.Lock()
+		writeTusState(w, s)
+		s.mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	case "PATCH":
+		patchTusUpload(w, r, s)
+	case "DELETE":
+		dropSession(s)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Unsupported method", http.StatusMethodNotAllowed)
+	}
+}
+
+func createTusUpload(w http.ResponseWriter, r *http.Request) {
+	size, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || size < 0 {
+		http.Error(w, "Missing or invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+	if size > cfg.maxUploadBytes() {
+		http.Error(w, "Upload exceeds Tus-Max-Size", http.StatusRequestEntityTooLarge)
+		return
+	}
+	meta, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	name := meta["filename"]
+	if name == "" {
+		name = meta["name"]
+	}
+	if name == "" {
+		name = "upload"
+	}
+
+	s, status, err := newUploadSession(r, name, size)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.Header().Set("Location", sitePath(apiV1+"/tus/"+s.ID))
+	w.Header().Set("Upload-Expires", s.Expires.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+func patchTusUpload(w http.ResponseWriter, r *http.Request, s *uploadSession) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "Expected Content-Type application/offset+octet-stream", http.StatusUnsupportedMediaType)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "Missing or invalid Upload-Offset", http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if offset != s.Offset {
+		writeTusState(w, s)
+		http.Error(w, "Upload-Offset does not match", http.StatusConflict)
+		return
+	}
+
+	err = s.write(r.Body, s.Total-s.Offset)
+	if errors.Is(err, errDiskFull) {
+		http.Error(w, "Not enough free disk space", http.StatusInsufficientStorage)
+		return
+	}
+	if err != nil && !errors.Is(err, errChunkInterrupted) {
+		http.Error(w, "Could not open upload session", http.StatusInternalServerError)
+		return
+	}
+	// An interrupted chunk is not an error in tus: the client asks for the
+	// offset with HEAD and carries on from there.
+	if s.Offset == s.Total {
+		meta, _, err := s.complete()
+		if err != nil {
+			msg, status, _ := ingestErrorStatus(err)
+			http.Error(w, msg, status)
+			return
+		}
+		w.Header().Set("X-Image-Id", meta.ID)
+	}
+	writeTusState(w, s)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeTusState(w http.ResponseWriter, s *uploadSession) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(s.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(s.Total, 10))
+	w.Header().Set("Upload-Expires", s.Expires.UTC().Format(http.TimeFormat))
+}
+
+// parseTusMetadata decodes an Upload-Metadata header: comma separated
+// "key base64value" pairs, where the value may be omitted.
+func parseTusMetadata(h string) (map[string]string, error) {
+	meta := map[string]string{}
+	for _, pair := range strings.Split(h, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		key, value, _ := strings.Cut(pair, " ")
+		v, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+		if err != nil {
+			return nil, errors.New("Malformed Upload-Metadata")
+		}
+		meta[key] = string(v)
+	}
+	return meta, nil
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTusNeedsCredentials(t *testing.T) {
+	testGallery(t)
+	cfg.Accounts = false
+	cfg.APIKeys = apiKeys{"phone": "secret"}
+	api := newAPIRouter()
+
+	for _, override := range []string{"POST", "PATCH"} {
+		r := httptest.NewRequest("GET", "/api/v1/tus/", nil)
+		r.Header.Set("Tus-Resumable", tusVersion)
+		r.Header.Set("X-HTTP-Method-Override", override)
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, r)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("GET overridden to %s: got %d, want 401", override, w.Code)
+		}
+	}
+	var n int
+	db.QueryRow(`SELECT COUNT(*) FROM images`).Scan(&n)
+	if n != 0 {
+		t.Errorf("%d images were added", n)
+	}
+}
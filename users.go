@@ -0,0 +1,362 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// With accounts enabled every user only sees and manages their own images
+// and albums; admins see everything. API keys act as admins.
+const (
+	roleAdmin = "admin"
+	roleUser  = "user"
+
+	sessionCookie     = "gallery_session"
+	loginSessionTTL   = 30 * 24 * time.Hour
+	minPasswordLength = 8
+)
+
+type User struct {
+	ID       string     `json:"id"`
+	Username string     `json:"username"`
+	Role     string     `json:"role"`
+	Created  time.Time  `json:"created"`
+	Banned   *time.Time `json:"banned,omitempty"` // may no longer log in, see admin.go
+}
+
+// principal is whoever is behind a request: a logged in user or an API key.
+type principal struct {
+	UserID string
+	Name   string
+	Admin  bool
+}
+
+func requestPrincipal(r *http.Request) (principal, bool) {
+	p, ok := r.Context().Value(ctxPrincipal).(principal)
+	return p, ok
+}
+
+// resolvePrincipal identifies the caller from an API key or session cookie.
+func resolvePrincipal(r *http.Request) (principal, bool) {
+	if p, ok := requestPrincipal(r); ok {
+		return p, true
+	}
+	if name, ok := matchAPIKey(requestAPIKey(r)); ok {
+		return principal{Name: name, Admin: true}, true
+	}
+	if !cfg.Accounts {
+		return principal{}, false
+	}
+	c, err := r.Cookie(sessionCookie)
+	if err != nil || c.Value == "" {
+		return principal{}, false
+	}
+	var u User
+	err = db.QueryRow(`SELECT u.id, u.username, u.role FROM user_sessions s JOIN users u ON u.id = s.user_id
+		WHERE s.token_hash = ? AND s.expires_at > ? AND u.banned_at = 0`, hashToken(c.Value), time.Now().UnixNano()).
+		Scan(&u.ID, &u.Username, &u.Role)
+	if err != nil {
+		return principal{}, false
+	}
+	return principal{UserID: u.ID, Name: u.Username, Admin: u.Role == roleAdmin}, true
+}
+
+// sees reports whether p may access something owned by owner.
+func (p principal) sees(owner string) bool {
+	return !cfg.Accounts || p.Admin || (p.UserID != "" && p.UserID == owner)
+}
+
+// ownerFilter is the owner to restrict listings to, or "" for everything.
+func (p principal) ownerFilter() string {
+	if !cfg.Accounts || p.Admin {
+		return ""
+	}
+	if p.UserID == "" {
+		// anonymous callers own nothing; match no real user
+		return "-"
+	}
+	return p.UserID
+}
+
+// requestViewer returns the caller for handlers that are not wrapped by
+// requireAuth, such as the file and thumbnail servers.
+func requestViewer(r *http.Request) principal {
+	p, _ := resolvePrincipal(r)
+	return p
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+var usernameRegex = regexp.MustCompile(`^[a-zA-Z0-9._-]{3,32}$`)
+
+// handleAuth serves the account endpoints:
+//
+//	POST /api/v1/auth/register  {"username": "...", "password": "..."}
+//	POST /api/v1/auth/login     {"username": "...", "password": "..."}
+//	POST /api/v1/auth/logout
+//	GET  /api/v1/auth/me
+//	GET  /api/v1/auth/csrf      the CSRF token for cookie clients, see csrf.go
+func handleAuth(w http.ResponseWriter, r *http.Request) {
+	if apiPreamble(w, r) {
+		return
+	}
+	if r.URL.Path == "/api/v1/auth/csrf" && r.Method == "GET" {
+		json.NewEncoder(w).Encode(map[string]string{"token": csrfToken(w, r)})
+		return
+	}
+	if !cfg.Accounts {
+		writeJSONError(w, "Accounts are disabled", http.StatusNotFound)
+		return
+	}
+
+	switch action := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/auth"), "/"); {
+	case action == "register" && r.Method == "POST":
+		handleRegister(w, r)
+	case action == "login" && r.Method == "POST":
+		handleLogin(w, r)
+	case action == "logout" && r.Method == "POST":
+		if c, err := r.Cookie(sessionCookie); err == nil {
+			db.Exec(`DELETE FROM user_sessions WHERE token_hash = ?`, hashToken(c.Value))
+		}
+		http.SetCookie(w, &http.Cookie{Name: sessionCookie, Path: sitePath("/"), MaxAge: -1, HttpOnly: true, Secure: secureRequest(r), SameSite: http.SameSiteLaxMode})
+		json.NewEncoder(w).Encode(map[string]bool{"success": true})
+	case action == "me" && r.Method == "GET":
+		p, ok := resolvePrincipal(r)
+		if !ok || p.UserID == "" {
+			writeJSONError(w, "Not logged in", http.StatusUnauthorized)
+			return
+		}
+		u, err := getUser(p.UserID)
+		if err != nil {
+			writeJSONError(w, "Not logged in", http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(u)
+	default:
+		writeJSONError(w, "Unsupported method", http.StatusMethodNotAllowed)
+	}
+}
+
+type loginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+func readCredentials(w http.ResponseWriter, r *http.Request) (loginRequest, bool) {
+	var c loginRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&c); err != nil || c.Username == "" || c.Password == "" {
+		writeJSONError(w, "Expected JSON body with username and password", http.StatusBadRequest)
+		return c, false
+	}
+	return c, true
+}
+
+func handleRegister(w http.ResponseWriter, r *http.Request) {
+	var count int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM users`).Scan(&count); err != nil {
+		writeJSONError(w, "Could not register", http.StatusInternalServerError)
+		return
+	}
+	// The very first account bootstraps the instance and becomes admin
+	if count > 0 && !cfg.AllowRegistration {
+		writeJSONError(w, "Registration is closed", http.StatusForbidden)
+		return
+	}
+
+	c, ok := readCredentials(w, r)
+	if !ok {
+		return
+	}
+	if !usernameRegex.MatchString(c.Username) {
+		writeJSONError(w, "Username must be 3-32 letters, digits, dots, dashes or underscores", http.StatusBadRequest)
+		return
+	}
+	if len(c.Password) < minPasswordLength || len(c.Password) > 72 {
+		writeJSONError(w, "Password must be 8-72 characters long", http.StatusBadRequest)
+		return
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(c.Password), bcrypt.DefaultCost)
+	if err != nil {
+		writeJSONError(w, "Could not register", http.StatusInternalServerError)
+		return
+	}
+	u := User{ID: randomString(16), Username: c.Username, Role: roleAdmin, Created: time.Now().UTC()}
+	// the count above is only a shortcut: of concurrent first sign-ups a
+	// single one finds the table empty here
+	var added int64
+	res, err := db.Exec(`INSERT INTO users (id, username, password_hash, role, created_at)
+		SELECT ?, ?, ?, ?, ? WHERE NOT EXISTS (SELECT 1 FROM users)`,
+		u.ID, u.Username, string(hash), u.Role, u.Created.UnixNano())
+	if err == nil {
+		added, _ = res.RowsAffected()
+	}
+	if err == nil && added == 0 {
+		if !cfg.AllowRegistration {
+			writeJSONError(w, "Registration is closed", http.StatusForbidden)
+			return
+		}
+		u.Role = roleUser
+		_, err = db.Exec(`INSERT INTO users (id, username, password_hash, role, created_at) VALUES (?, ?, ?, ?, ?)`,
+			u.ID, u.Username, string(hash), u.Role, u.Created.UnixNano())
+	}
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE") {
+			writeJSONError(w, "Username is taken", http.StatusConflict)
+		} else {
+			writeJSONError(w, "Could not register", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if !startLoginSession(w, r, u.ID) {
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(u)
+}
+
+func handleLogin(w http.ResponseWriter, r *http.Request) {
+	c, ok := readCredentials(w, r)
+	if !ok {
+		return
+	}
+	var id, hash string
+	var banned int64
+	err := db.QueryRow(`SELECT id, password_hash, banned_at FROM users WHERE username = ?`, c.Username).Scan(&id, &hash, &banned)
+	if err == nil {
+		err = bcrypt.CompareHashAndPassword([]byte(hash), []byte(c.Password))
+	}
+	if err != nil {
+		writeJSONError(w, "Invalid username or password", http.StatusUnauthorized)
+		return
+	}
+	if banned > 0 {
+		writeJSONError(w, "Account is banned", http.StatusForbidden)
+		return
+	}
+
+	if !startLoginSession(w, r, id) {
+		return
+	}
+	u, _ := getUser(id)
+	json.NewEncoder(w).Encode(u)
+}
+
+func startLoginSession(w http.ResponseWriter, r *http.Request, userID string) bool {
+	token := randomString(48)
+	expires := time.Now().Add(loginSessionTTL)
+	if _, err := db.Exec(`INSERT INTO user_sessions (token_hash, user_id, expires_at) VALUES (?, ?, ?)`,
+		hashToken(token), userID, expires.UnixNano()); err != nil {
+		writeJSONError(w, "Could not start session", http.StatusInternalServerError)
+		return false
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     sitePath("/"),
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   secureRequest(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+	return true
+}
+
+const userColumns = `id, username, role, created_at, banned_at`
+
+func scanUserRow(row rowScanner) (User, error) {
+	var u User
+	var created, banned int64
+	err := row.Scan(&u.ID, &u.Username, &u.Role, &created, &banned)
+	u.Created = time.Unix(0, created).UTC()
+	if banned > 0 {
+		t := time.Unix(0, banned).UTC()
+		u.Banned = &t
+	}
+	return u, err
+}
+
+func getUser(id string) (User, error) {
+	return scanUserRow(db.QueryRow(`SELECT `+userColumns+` FROM users WHERE id = ?`, id))
+}
+
+// handleUsers serves GET /api/v1/users for admins.
+func handleUsers(w http.ResponseWriter, r *http.Request) {
+	if apiPreamble(w, r) {
+		return
+	}
+	if p, _ := requestPrincipal(r); !p.Admin {
+		writeJSONError(w, "Admins only", http.StatusForbidden)
+		return
+	}
+	if r.Method != "GET" {
+		writeJSONError(w, "Unsupported method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rows, err := db.Query(`SELECT ` + userColumns + ` FROM users ORDER BY username`)
+	if err != nil {
+		writeJSONError(w, "Could not list users", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	users := []User{}
+	for rows.Next() {
+		u, err := scanUserRow(rows)
+		if err != nil {
+			writeJSONError(w, "Could not list users", http.StatusInternalServerError)
+			return
+		}
+		users = append(users, u)
+	}
+	json.NewEncoder(w).Encode(users)
+}
+
+// visibleImage loads an image and hides it (as not found) from callers that
+// may not see it.
+func visibleImage(r *http.Request, id string) (ImageMeta, error) {
+	meta, err := getImage(id)
+	if err != nil {
+		return meta, err
+	}
+	if !canOpenImage(r, meta) {
+		return ImageMeta{}, sql.ErrNoRows
+	}
+	return meta, nil
+}
+
+// servableImage reports whether the file servers may hand out id to the
+// caller: it must be indexed, not in the trash and visible to them.
+func servableImage(r *http.Request, id string) (ImageMeta, bool) {
+	meta, err := visibleImage(r, id)
+	return meta, err == nil && meta.Deleted == nil
+}
+
+// gcLoginSessions drops expired login sessions once a day.
+func gcLoginSessions() {
+	for {
+		expireLoginSessions()
+		time.Sleep(24 * time.Hour)
+	}
+}
+
+func expireLoginSessions() (int64, error) {
+	res, err := db.Exec(`DELETE FROM user_sessions WHERE expires_at <= ?`, time.Now().UnixNano())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+func TestOnlyFirstSignUpIsAdmin(t *testing.T) {
+	testGallery(t)
+	api := newAPIRouter()
+	const n = 8
+	codes := make([]int, n)
+	var wg sync.WaitGroup
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			body := fmt.Sprintf(`{"username":"user%d","password":"correct horse"}`, i)
+			codes[i] = serveTest(api, "POST", "/api/v1/auth/register", body).Code
+		}(i)
+	}
+	wg.Wait()
+
+	created := 0
+	for _, code := range codes {
+		switch code {
+		case http.StatusCreated:
+			created++
+		case http.StatusForbidden:
+		default:
+			t.Errorf("sign-up answered %d", code)
+		}
+	}
+	var admins int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM users WHERE role = ?`, roleAdmin).Scan(&admins); err != nil {
+		t.Fatal(err)
+	}
+	if created != 1 || admins != 1 {
+		t.Errorf("%d sign-ups went through and %d became admin, want 1 and 1", created, admins)
+	}
+}
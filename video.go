@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Videos (MP4, WebM, MOV) live in the gallery next to the images. Their
+// thumbnails and /img renditions are made from a poster frame, and their
+// size comes from probing the file. Both jobs go through videoTool, which
+// ffmpeg implements; without it videos are refused at upload.
+
+// videoTypes maps video file extensions to their content type.
+var videoTypes = map[string]string{
+	".mp4":  "video/mp4",
+	".m4v":  "video/mp4",
+	".webm": "video/webm",
+	".mov":  "video/quicktime",
+}
+
+func isVideoName(name string) bool { return videoType(name) != "" }
+
+// videoType returns the content type of a video file name, "" for others.
+// Minimal systems have no mime.types, so it is not left to the mime package.
+func videoType(name string) string {
+	return videoTypes[strings.ToLower(filepath.Ext(name))]
+}
+
+// sniffVideo recognizes the video formats http.DetectContentType misses,
+// QuickTime in particular. It returns "" for anything else.
+func sniffVideo(head []byte) string {
+	if len(head) < 12 {
+		return ""
+	}
+	box := string(head[4:8])
+	switch {
+	case box == "ftyp" && string(head[8:12]) == "qt  ":
+		return "video/quicktime"
+	case box == "ftyp":
+		return "video/mp4"
+	case box == "moov" || box == "mdat" || box == "wide":
+		// old QuickTime files start without ftyp
+		return "video/quicktime"
+	}
+	return ""
+}
+
+// videoTool probes videos and grabs poster frames from them.
+type videoTool interface {
+	Probe(ctx context.Context, path string) (width, height int, err error)
+	Poster(ctx context.Context, path string) (image.Image, error)
+}
+
+// videos is nil when video support is off.
+var videos videoTool
+
+// setupVideos enables video support if the configured ffmpeg is there.
+func setupVideos(c Config) error {
+	if c.FFmpeg == "" {
+		return nil
+	}
+	ffmpeg, err := exec.LookPath(c.FFmpeg)
+	if err != nil {
+		return fmt.Errorf("ffmpeg: %w", err)
+	}
+	ffprobe, err := exec.LookPath(c.FFprobe)
+	if err != nil {
+		return fmt.Errorf("ffprobe: %w", err)
+	}
+	videos = ffmpegTool{ffmpeg: ffmpeg, ffprobe: ffprobe}
+	return nil
+}
+
+type ffmpegTool struct {
+	ffmpeg, ffprobe string
+}
+
+func (t ffmpegTool) Probe(ctx context.Context, path string) (int, int, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, t.ffprobe, "-v", "error", "-select_streams", "v:0",
+		"-show_entries", "stream=width,height:stream_side_data=rotation", "-of", "json", path).Output()
+	if err != nil {
+		return 0, 0, err
+	}
+	var probe struct {
+		Streams []struct {
+			Width    int `json:"width"`
+			Height   int `json:"height"`
+			SideData []struct {
+				Rotation int `json:"rotation"`
+			} `json:"side_data_list"`
+		} `json:"streams"`
+	}
+	if err := json.Unmarshal(out, &probe); err != nil {
+		return 0, 0, err
+	}
+	if len(probe.Streams) == 0 {
+		return 0, 0, errors.New("no video stream")
+	}
+	s := probe.Streams[0]
+	for _, d := range s.SideData {
+		// phone videos shot upright are stored sideways, like photos
+		if d.Rotation == 90 || d.Rotation == -90 || d.Rotation == 270 || d.Rotation == -270 {
+			return s.Height, s.Width, nil
+		}
+	}
+	return s.Width, s.Height, nil
+}
+
+// Poster takes a frame a second in, or the first one for shorter clips.
+// ffmpeg applies the rotation of the video itself.
+func (t ffmpegTool) Poster(ctx context.Context, path string) (image.Image, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	for _, at := range []string{"1", "0"} {
+		out, err := exec.CommandContext(ctx, t.ffmpeg, "-v", "error", "-ss", at, "-i", path,
+			"-frames:v", "1", "-f", "image2pipe", "-vcodec", "png", "-").Output()
+		if err != nil || len(out) == 0 {
+			continue
+		}
+		img, err := decodeLimited(bytes.NewReader(out))
+		if err == nil {
+			return img, nil
+		}
+	}
+	return nil, errors.New("no poster frame")
+}
+
+// localMediaFile returns a local path to the stored file id, downloading it
+// to a scratch file for remote storage. Callers must call done afterwards.
+func localMediaFile(ctx context.Context, id string) (path string, done func(), err error) {
+	if l, ok := baseStorage().(localStorage); ok {
+		return l.path(id), func() {}, nil
+	}
+	src, _, err := storage.Open(ctx, id)
+	if err != nil {
+		return "", nil, err
+	}
+	defer src.Close()
+	tmp, err := os.CreateTemp(cfg.sessionDir(), ".media-*"+filepath.Ext(id))
+	if err != nil {
+		return "", nil, err
+	}
+	_, err = io.Copy(tmp, src)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", nil, err
+	}
+	return tmp.Name(), func() { os.Remove(tmp.Name()) }, nil
+}
+
+// videoPoster grabs the poster frame of the stored video id.
+func videoPoster(ctx context.Context, id string) (image.Image, error) {
+	if videos == nil {
+		return nil, errors.New("video support is off")
+	}
+	path, done, err := localMediaFile(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	return videos.Poster(ctx, path)
+}
+
+// probeVideo reads the displayed size of the stored video id.
+func probeVideo(ctx context.Context, id string) (int, int, error) {
+	if videos == nil {
+		return 0, 0, errors.New("video support is off")
+	}
+	path, done, err := localMediaFile(ctx, id)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer done()
+	return videos.Probe(ctx, path)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The gallery counts how often each original is viewed and downloaded,
+// only as numbers: nothing about who looked is kept. A view is a full GET
+// of /uploads/{id}; revalidations, HEAD and resumed range requests are not
+// counted. A download is /uploads/{id}?download=1, which the viewer's
+// download button uses, or the image in a ZIP archive. Counts are
+// gathered in memory and written every viewFlushInterval, and at
+// shutdown. They sort the listing with ?sort=popular, views and downloads
+// together, and are summed up in the stats. Since they change all the
+// time they do not bump the index version, so a cached listing may show
+// older counts until something else changes.
+
+const viewFlushInterval = 10 * time.Second
+
+var (
+	viewsMu      sync.Mutex
+	pendingViews = map[string]*[2]int64{} // views, downloads
+)
+
+// countView counts a view, or a download, of the image id.
+func countView(id string, download bool) {
+	viewsMu.Lock()
+	defer viewsMu.Unlock()
+	c := pendingViews[id]
+	if c == nil {
+		c = &[2]int64{}
+		pendingViews[id] = c
+	}
+	if download {
+		c[1]++
+	} else {
+		c[0]++
+	}
+}
+
+// countedRequest reports whether a request for an original counts: a
+// full, unconditional GET.
+func countedRequest(r *http.Request) bool {
+	if r.Method != "GET" || r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Modified-Since") != "" {
+		return false
+	}
+	rng := r.Header.Get("Range")
+	return rng == "" || strings.HasPrefix(rng, "bytes=0-")
+}
+
+// writeViews writes the counts every viewFlushInterval.
+func writeViews() {
+	for {
+		time.Sleep(viewFlushInterval)
+		flushViews()
+	}
+}
+
+// flushViews adds the counts gathered since the last call to the index.
+// Counts of images deleted meanwhile are dropped.
+func flushViews() {
+	viewsMu.Lock()
+	counts := pendingViews
+	pendingViews = map[string]*[2]int64{}
+	viewsMu.Unlock()
+	if len(counts) == 0 {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		slog.Warn("Could not write view counts", "err", err)
+		return
+	}
+	defer tx.Rollback()
+	for id, c := range counts {
+		_, err := tx.Exec(`INSERT INTO image_views (image_id, views, downloads)
+			SELECT ?, ?, ? WHERE EXISTS (SELECT 1 FROM images WHERE id = ?)
+			ON CONFLICT(image_id) DO UPDATE SET views = views + excluded.views, downloads = downloads + excluded.downloads`,
+			id, c[0], c[1], id)
+		if err != nil {
+			slog.Warn("Could not write view counts", "err", err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		slog.Warn("Could not write view counts", "err", err)
+	}
+}
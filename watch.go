@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// The index learns of uploads and deletions as they go through the
+// gallery. Files copied into or out of a local upload directory behind
+// its back, by a restore or rsync say, are noticed by watching it, see
+// watchTree, and indexed as syncStore would at startup; the index
+// version moves on and the cached listings, see cache.go, with it.
+// Source directories are watched the same way. Changes are gathered for
+// watchDelay before they are looked at, as copies arrive in pieces.
+
+const watchDelay = 2 * time.Second
+
+// arriving are the uploads stored but not yet recorded in the index, left
+// alone by the watcher.
+var arriving sync.Map
+
+// watchStorage keeps the index in line with a local upload directory.
+func watchStorage() {
+	l, ok := baseStorage().(localStorage)
+	if !ok {
+		return
+	}
+	changes := make(chan string, 256)
+	if err := watchTree(l.dir, changes); err != nil {
+		slog.Warn("Not watching the upload directory", "dir", l.dir, "err", err)
+		return
+	}
+	// source directories are rescanned whole, see sources.go
+	if len(cfg.SourceDirs) > 0 {
+		sourceChanges := make(chan string, 256)
+		for _, dir := range cfg.SourceDirs {
+			if err := watchTree(dir, sourceChanges); err != nil {
+				slog.Warn("Not watching source directory", "dir", dir, "err", err)
+			}
+		}
+		go gatherChanges(sourceChanges, watchDelay, func(map[string]bool) {
+			if err := syncStore(); err != nil {
+				slog.Warn("Could not sync the index", "err", err)
+			}
+		})
+	}
+	go gatherChanges(changes, watchDelay, func(paths map[string]bool) {
+		if paths[""] {
+			if err := syncStore(); err != nil {
+				slog.Warn("Could not sync the index", "err", err)
+			}
+			return
+		}
+		for p := range paths {
+			syncStoredFile(l, p)
+		}
+	})
+}
+
+// gatherChanges collects the paths sent to changes for delay after the
+// first and hands them to f together.
+func gatherChanges(changes <-chan string, delay time.Duration, f func(map[string]bool)) {
+	pending := map[string]bool{}
+	timer := time.NewTimer(delay)
+	timer.Stop()
+	for {
+		select {
+		case p := <-changes:
+			if len(pending) == 0 {
+				timer.Reset(delay)
+			}
+			pending[p] = true
+		case <-timer.C:
+			f(pending)
+			pending = map[string]bool{}
+		}
+	}
+}
+
+// syncStoredFile brings the index in line with the file at path: it is
+// (re)indexed if new or changed and its row dropped if it is gone.
+func syncStoredFile(l localStorage, path string) {
+	name := filepath.Base(path)
+	if !isMediaName(name) || l.path(name) != path {
+		return
+	}
+	if _, ok := arriving.Load(name); ok {
+		return
+	}
+	var mod int64
+	var busy bool
+	err := db.QueryRow(`SELECT mod_time, processing FROM images WHERE id = ?`, name).Scan(&mod, &busy)
+	known := err == nil
+	if (err != nil && !errors.Is(err, sql.ErrNoRows)) || busy {
+		return
+	}
+	info, err := os.Stat(path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		if known {
+			slog.Info("Stored file removed", "image", name)
+			deleteImage(name)
+		}
+	case err != nil, known && mod == info.ModTime().UnixNano():
+	default:
+		if _, err := indexImage(context.Background(), name, info.ModTime(), ""); err != nil {
+			slog.Warn("Could not index image", "image", name, "err", err)
+			return
+		}
+		slog.Info("Stored file indexed", "image", name)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const watchMask = syscall.IN_CREATE | syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO | syscall.IN_MOVED_FROM | syscall.IN_DELETE
+
+// watchTree reports the paths of files changed under root, and in
+// directories made there later, with inotify. Dot directories, scratch
+// space mostly, are left out. An empty path means changes were lost and
+// anything under root may have changed.
+func watchTree(root string, changes chan<- string) error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return fmt.Errorf("inotify: %w", err)
+	}
+	dirs := map[int32]string{}
+	wd, err := syscall.InotifyAddWatch(fd, root, watchMask)
+	if err != nil {
+		syscall.Close(fd)
+		return fmt.Errorf("watch %s: %w", root, err)
+	}
+	dirs[int32(wd)] = root
+	// add watches the directories under dir, reporting the files found
+	// there if they may have arrived before the watch
+	add := func(dir string, report bool) {
+		filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+			switch {
+			case err != nil:
+			case d.IsDir() && p != root && strings.HasPrefix(d.Name(), "."):
+				return filepath.SkipDir
+			case d.IsDir() && p != root:
+				if wd, err := syscall.InotifyAddWatch(fd, p, watchMask); err == nil {
+					dirs[int32(wd)] = p
+				}
+			case !d.IsDir() && report:
+				changes <- p
+			}
+			return nil
+		})
+	}
+	add(root, false)
+
+	go func() {
+		buf := make([]byte, 64<<10)
+		for {
+			n, err := syscall.Read(fd, buf)
+			if err == syscall.EINTR {
+				continue
+			}
+			if err != nil {
+				slog.Error("Watching files stopped", "dir", root, "err", err)
+				return
+			}
+			for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+				ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+				start := off + syscall.SizeofInotifyEvent
+				off = start + int(ev.Len)
+				name := string(bytes.TrimRight(buf[start:off], "\x00"))
+				dir, ok := dirs[ev.Wd]
+				switch {
+				case ev.Mask&syscall.IN_Q_OVERFLOW != 0:
+					changes <- ""
+				case ev.Mask&syscall.IN_IGNORED != 0:
+					delete(dirs, ev.Wd)
+				case !ok || name == "":
+				case ev.Mask&syscall.IN_ISDIR == 0:
+					changes <- filepath.Join(dir, name)
+				case ev.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0:
+					add(filepath.Join(dir, name), true)
+				case ev.Mask&syscall.IN_MOVED_FROM != 0:
+					// the files in it left without events of their own
+					changes <- ""
+				}
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,26 @@
+//go:build !linux
+
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// watchPoll is how often trees are rescanned where changes are not
+// reported.
+const watchPoll = time.Minute
+
+// watchTree has no file notifications on this platform; it asks for a
+// rescan of root every watchPoll instead.
+func watchTree(root string, changes chan<- string) error {
+	if _, err := os.Stat(root); err != nil {
+		return err
+	}
+	go func() {
+		for range time.Tick(watchPoll) {
+			changes <- ""
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/color"
+	"net/http"
+	"os"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// Albums can have their images watermarked, see handleAlbums. The mark is
+// cfg.Watermark, an image file (a PNG with transparency works best), or
+// else cfg.WatermarkText, drawn cfg.WatermarkOpacity strong in a corner or
+// the center (cfg.WatermarkPosition) at a quarter of the width. It goes on
+// thumbnails and /img/ renditions of images in at least one such album, and
+// on their originals as served to anyone but the owner; the stored files
+// are never touched. Renditions and their ?v= carry the watermark's
+// settings, so changing them renders everything anew.
+
+const watermarkScale = 0.25
+
+var watermarkPositions = []string{"top-left", "top-right", "bottom-left", "bottom-right", "center"}
+
+// watermark is nil without one configured.
+var watermark *watermarkMark
+
+type watermarkMark struct {
+	img      image.Image
+	position string
+	opacity  float64
+	version  string // changes with the settings
+}
+
+func setupWatermark(c Config) error {
+	watermark = nil
+	if c.Watermark == "" && c.WatermarkText == "" {
+		return nil
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00%g\x00", c.Watermark, c.WatermarkText, c.WatermarkPosition, c.WatermarkOpacity)
+	var img image.Image
+	if c.Watermark != "" {
+		data, err := os.ReadFile(c.Watermark)
+		if err != nil {
+			return err
+		}
+		h.Write(data)
+		if img, err = decodeLimited(bytes.NewReader(data)); err != nil {
+			return fmt.Errorf("%s: %w", c.Watermark, err)
+		}
+	} else {
+		img = textMark(c.WatermarkText)
+	}
+	watermark = &watermarkMark{
+		img:      img,
+		position: c.WatermarkPosition,
+		opacity:  c.WatermarkOpacity,
+		version:  hex.EncodeToString(h.Sum(nil))[:8],
+	}
+	return nil
+}
+
+// textMark draws text in white with a dark shadow, to be scaled up.
+func textMark(text string) image.Image {
+	face := basicfont.Face7x13
+	width := font.MeasureString(face, text).Ceil()
+	img := image.NewRGBA(image.Rect(0, 0, width+1, face.Height+1))
+	d := font.Drawer{Dst: img, Face: face}
+	for _, c := range []struct {
+		col    color.Color
+		offset int
+	}{{color.RGBA{0, 0, 0, 160}, 1}, {color.White, 0}} {
+		d.Src = image.NewUniform(c.col)
+		d.Dot = fixed.P(c.offset, face.Ascent+c.offset)
+		d.DrawString(text)
+	}
+	return img
+}
+
+// watermarkVersion is the version of the watermark meta gets, "" for none.
+func watermarkVersion(meta ImageMeta) string {
+	if watermark == nil || !meta.Watermarked {
+		return ""
+	}
+	return watermark.version
+}
+
+// seesUnmarked reports whether the caller gets the original of meta as it
+// is stored: its owner or an admin, signed in.
+func seesUnmarked(r *http.Request, meta ImageMeta) bool {
+	p, ok := resolvePrincipal(r)
+	return watermarkVersion(meta) == "" || (ok && p.sees(meta.Owner))
+}
+
+// serveWatermarkedOriginal serves the original of meta at full size with
+// the watermark drawn on, rendered once like any other rendition.
+func serveWatermarkedOriginal(w http.ResponseWriter, r *http.Request, meta ImageMeta) {
+	info, err := storage.Stat(r.Context(), meta.ID)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	t := transform{Fit: fitContain, Format: defaultFormat(meta.ID), Quality: defaultQuality, Watermark: watermarkVersion(meta)}
+	cached, err := renderCached(meta.ID, t, info.ModTime)
+	if err != nil {
+		http.Error(w, "Could not read file", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", encoders[t.Format].mime)
+	http.ServeFile(w, r, cached)
+}
+
+// applyWatermark draws the watermark onto dst.
+func applyWatermark(dst *image.RGBA) {
+	m := watermark
+	b := dst.Bounds()
+	mb := m.img.Bounds()
+	w := max(1, int(float64(b.Dx())*watermarkScale))
+	h := max(1, w*mb.Dy()/mb.Dx())
+	margin := b.Dx() / 50
+	var x, y int
+	switch m.position {
+	case "top-left":
+		x, y = margin, margin
+	case "top-right":
+		x, y = b.Dx()-w-margin, margin
+	case "bottom-left":
+		x, y = margin, b.Dy()-h-margin
+	case "center":
+		x, y = (b.Dx()-w)/2, (b.Dy()-h)/2
+	default:
+		x, y = b.Dx()-w-margin, b.Dy()-h-margin
+	}
+	scaled := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(scaled, scaled.Bounds(), m.img, mb, draw.Src, nil)
+	r := image.Rect(x, y, x+w, y+h).Add(b.Min)
+	mask := image.NewUniform(color.Alpha{uint8(m.opacity * 255)})
+	draw.DrawMask(dst, r, scaled, image.Point{}, mask, image.Point{}, draw.Over)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// Webhooks tell other systems about changes in the gallery. Every
+// configured URL gets a POST with a JSON webhookEvent for:
+//
+//	image.uploaded  a new image was stored (not for linked duplicates)
+//	image.deleted   an image went to the trash, or for good with permanent
+//	image.tagged    tags were added or removed; image holds the new set
+//	image.updated   the title, description, alt text or fields were edited
+//	image.restored  an image came back out of the trash
+//	image.approved  an upload awaiting review was approved, see moderation.go
+//
+// With cfg.WebhookSecret the body is signed in X-Gallery-Signature as
+// "sha256=" followed by the hex HMAC-SHA256 of the body. Deliveries happen
+// in the background and are retried a few times on failure.
+
+type webhookEvent struct {
+	ID        string    `json:"id"`
+	Event     string    `json:"event"`
+	Time      time.Time `json:"time"`
+	Image     ImageMeta `json:"image"`
+	Permanent bool      `json:"permanent,omitempty"`
+}
+
+type webhookDelivery struct {
+	URL  string
+	ID   string
+	Type string
+	Body []byte
+}
+
+var (
+	webhookQueue  = make(chan webhookDelivery, 256)
+	webhookClient = &http.Client{Timeout: 10 * time.Second}
+)
+
+// webhookRetries are the pauses before each further attempt.
+var webhookRetries = []time.Duration{5 * time.Second, 30 * time.Second, 2 * time.Minute}
+
+// notifyImage sends an event about the image id to event streams and
+// webhooks.
+func notifyImage(event, id string) {
+	meta, err := getImage(id)
+	if err != nil {
+		slog.Warn("Could not load image for webhook", "image", id, "err", err)
+		return
+	}
+	notify(webhookEvent{Event: event, Image: meta})
+}
+
+func notify(ev webhookEvent) {
+	ev.ID = randomString(16)
+	ev.Time = time.Now().UTC()
+	publish(ev)
+	if len(cfg.Webhooks) == 0 {
+		return
+	}
+	body, err := json.Marshal(ev)
+	if err != nil {
+		slog.Warn("Could not encode webhook", "event", ev.Event, "err", err)
+		return
+	}
+	for _, url := range cfg.Webhooks {
+		select {
+		case webhookQueue <- webhookDelivery{URL: url, ID: ev.ID, Type: ev.Event, Body: body}:
+		default:
+			slog.Warn("Webhook queue full, dropping event", "event", ev.Event, "url", url)
+		}
+	}
+}
+
+// deliverWebhooks works through the queue, retrying failed deliveries in
+// the background so one slow endpoint does not hold up the rest.
+func deliverWebhooks() {
+	for d := range webhookQueue {
+		if err := postWebhook(d); err != nil {
+			go retryWebhook(d, err)
+		}
+	}
+}
+
+func retryWebhook(d webhookDelivery, err error) {
+	for _, wait := range webhookRetries {
+		slog.Warn("Webhook delivery failed", "event", d.Type, "url", d.URL, "delivery", d.ID, "err", err, "retry_in", wait)
+		time.Sleep(wait)
+		if err = postWebhook(d); err == nil {
+			return
+		}
+	}
+	slog.Error("Giving up on webhook", "event", d.Type, "url", d.URL, "delivery", d.ID, "err", err)
+}
+
+func postWebhook(d webhookDelivery) error {
+	req, err := http.NewRequest("POST", d.URL, bytes.NewReader(d.Body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "ai-morph-gallery")
+	req.Header.Set("X-Gallery-Event", d.Type)
+	req.Header.Set("X-Gallery-Delivery", d.ID)
+	if cfg.WebhookSecret != "" {
+		mac := hmac.New(sha256.New, []byte(cfg.WebhookSecret))
+		mac.Write(d.Body)
+		req.Header.Set("X-Gallery-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("endpoint answered %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// An album anyone may open can be embedded in other sites, such as a blog,
+// with the snippet
+//
+//	<script src="https://gallery.example/static/embed.js" data-album="{id}" async></script>
+//
+// which puts an iframe of /embed/{id} in its place and keeps it as tall as
+// its content. The page is a plain grid of thumbnails, each opening the
+// image's page, see embed.go, in a new tab; ?limit= bounds it. Only the
+// sites in cfg.EmbedOrigins may frame it, told to browsers with the
+// frame-ancestors directive; without any the widget is off. Albums with a
+// password are never embedded, nor are galleries that need credentials to
+// read.
+
+const defaultEmbedLimit = 60
+
+var widgetTemplate = template.Must(template.New("widget").Parse(`<!doctype html>
+<html lang="cs">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Album.Name}}</title>
+<style>
+body { margin:0; font-family:system-ui, sans-serif; background:transparent; }
+#grid { display:grid; grid-template-columns:repeat(auto-fill, minmax(160px, 1fr)); gap:6px; }
+#grid a { display:block; aspect-ratio:1; overflow:hidden; border-radius:6px; }
+#grid img { width:100%; height:100%; object-fit:cover; }
+footer { margin-top:6px; font-size:12px; text-align:right; }
+footer a { color:inherit; }
+</style>
+</head>
+<body>
+<div id="grid">
+{{range .Images}}<a href="{{$.Base}}/i/{{.ID}}" target="_blank" rel="noopener"{{if .Color}} style="background:{{.Color}}"{{end}}><img src="{{.Thumb}}" alt="{{.Alt}}" loading="lazy"></a>
+{{end}}</div>
+<footer><a href="{{.Base}}/a/{{.Album.ID}}" target="_blank" rel="noopener">{{.Album.Name}}</a></footer>
+<script src="{{.Base}}/static/embed.js"></script>
+</body>
+</html>
+`))
+
+// validateEmbedOrigins checks cfg.EmbedOrigins, which take the form of
+// CORS origins.
+func validateEmbedOrigins(origins []string) error {
+	for _, o := range origins {
+		if o == "*" {
+			continue
+		}
+		u, err := url.Parse(o)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || strings.TrimSuffix(u.Path, "/") != "" {
+			return fmt.Errorf("embed origin %q must be like https://example.com", o)
+		}
+	}
+	return nil
+}
+
+// frameAncestors is the CSP of pages only the cfg.EmbedOrigins may frame.
+func frameAncestors() string {
+	sources := make([]string, len(cfg.EmbedOrigins))
+	for i, o := range cfg.EmbedOrigins {
+		sources[i] = strings.TrimSuffix(o, "/")
+	}
+	directive := "frame-ancestors 'self' " + strings.Join(sources, " ")
+	if cfg.ContentSecurityPolicy == "" {
+		return directive
+	}
+	return strings.TrimSuffix(strings.TrimSpace(cfg.ContentSecurityPolicy), ";") + "; " + directive
+}
+
+// handleWidget serves /embed/{album}.
+func handleWidget(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/embed/"), "/")
+	if len(cfg.EmbedOrigins) == 0 || !publicReads() || id == "" {
+		http.NotFound(w, r)
+		return
+	}
+	album, err := getAlbum(id)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && (album.Protected || !canOpenAlbum(r, album))) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Could not load album", http.StatusInternalServerError)
+		return
+	}
+	limit, err := queryInt(r.URL.Query().Get("limit"), defaultEmbedLimit, maxPageSize)
+	if err != nil {
+		http.Error(w, "Invalid limit", http.StatusBadRequest)
+		return
+	}
+	list, err := listImages(listQuery{Album: album.ID, Limit: limit, HideProtected: true})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Widget", "err", err)
+		http.Error(w, "Could not load album", http.StatusInternalServerError)
+		return
+	}
+	for i := range list.Images {
+		list.Images[i].Alt = altOf(list.Images[i])
+	}
+
+	h := w.Header()
+	h.Del("X-Frame-Options")
+	h.Set("Content-Security-Policy", frameAncestors())
+	h.Set("Content-Type", "text/html; charset=utf-8")
+	h.Set("Cache-Control", "public, max-age=300")
+	widgetTemplate.Execute(w, struct {
+		Album  Album
+		Images []ImageMeta
+		Base   string
+	}{album, list.Images, cfg.BasePath})
+}